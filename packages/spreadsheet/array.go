@@ -0,0 +1,225 @@
+package main
+
+import (
+	"iter"
+)
+
+// ArrayValue is an in-memory two-dimensional array of values, produced by
+// array-aware operators and functions. it implements Range, so functions
+// taking ranges accept arrays too. a formula whose final result is an array
+// spills it into the cells below and to the right of the formula cell.
+// arrays are not modified once evaluated, so they can be shared.
+type ArrayValue struct {
+	rows   int
+	cols   int
+	values []Primitive // row-major
+}
+
+// NewArrayValue creates an array of empty values
+func NewArrayValue(rows, cols int) *ArrayValue {
+	return &ArrayValue{rows: rows, cols: cols, values: make([]Primitive, rows*cols)}
+}
+
+// Rows returns the number of rows of the array
+func (a *ArrayValue) Rows() int {
+	return a.rows
+}
+
+// Cols returns the number of columns of the array
+func (a *ArrayValue) Cols() int {
+	return a.cols
+}
+
+// At returns the value at a 0-based row and column
+func (a *ArrayValue) At(row, col int) Primitive {
+	return a.values[row*a.cols+col]
+}
+
+// Set stores the value at a 0-based row and column
+func (a *ArrayValue) Set(row, col int, value Primitive) {
+	a.values[row*a.cols+col] = value
+}
+
+// GetBounds returns the extent of the array. arrays live on no worksheet,
+// so the worksheet ID is 0 and the top-left corner is A1.
+func (a *ArrayValue) GetBounds() RangeAddress {
+	return RangeAddress{EndRow: uint32(a.rows - 1), EndColumn: uint32(a.cols - 1)}
+}
+
+// Size returns the number of values in the array
+func (a *ArrayValue) Size() int {
+	return len(a.values)
+}
+
+// Iterate returns an iterator over all values of the array as cells
+func (a *ArrayValue) Iterate() iter.Seq[*Cell] {
+	return func(yield func(*Cell) bool) {
+		for i, value := range a.values {
+			cell := &Cell{
+				Type:  primitiveType(value),
+				Row:   uint32(i / a.cols),
+				Col:   uint32(i % a.cols),
+				Value: value,
+			}
+			if !yield(cell) {
+				return
+			}
+		}
+	}
+}
+
+// IterateValues returns an iterator over all values of the array in
+// row-major order, with nil for empty values
+func (a *ArrayValue) IterateValues() iter.Seq[Primitive] {
+	return func(yield func(Primitive) bool) {
+		for _, value := range a.values {
+			if !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// IterateOccupied returns an iterator over the non-empty values of the array
+// and their position within it
+func (a *ArrayValue) IterateOccupied() iter.Seq2[CellAddress, Primitive] {
+	return func(yield func(CellAddress, Primitive) bool) {
+		for i, value := range a.values {
+			if value == nil {
+				continue
+			}
+			if !yield(CellAddress{Row: uint32(i / a.cols), Column: uint32(i % a.cols)}, value) {
+				return
+			}
+		}
+	}
+}
+
+// IterateOccupiedValues returns an iterator over the non-empty values of the
+// array in row-major order
+func (a *ArrayValue) IterateOccupiedValues() iter.Seq[Primitive] {
+	return func(yield func(Primitive) bool) {
+		for _, value := range a.values {
+			if value != nil && !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// primitiveType returns the cell type of a value
+func primitiveType(value Primitive) CellType {
+	switch value.(type) {
+	case float64, int, int64:
+		return CellValueTypeNumber
+	case string:
+		return CellValueTypeString
+	case bool:
+		return CellValueTypeBoolean
+	case *SpreadsheetError:
+		return CellValueTypeError
+	}
+	return CellValueTypeEmpty
+}
+
+// isArrayOperand reports whether an operand is a range or an array, which
+// operators apply to element by element
+func isArrayOperand(value Primitive) bool {
+	_, ok := value.(Range)
+	return ok
+}
+
+// toArray converts a range or array operand to an array. ranges spanning
+// several worksheets have no shape and can't be converted.
+func toArray(value Primitive) (*ArrayValue, bool) {
+	switch v := value.(type) {
+	case *ArrayValue:
+		return v, true
+	case *CellRange:
+		bounds := v.GetBounds()
+		array := NewArrayValue(int(bounds.EndRow-bounds.StartRow+1), int(bounds.EndColumn-bounds.StartColumn+1))
+		i := 0
+		for value := range v.IterateValues() {
+			array.values[i] = value
+			i++
+		}
+		return array, true
+	}
+	return nil, false
+}
+
+// broadcastBinaryOp applies a binary operator element by element. a scalar
+// operand, a single row or a single column is repeated to the size of the
+// other operand, as in Excel, and positions outside a smaller operand are
+// #N/A.
+func broadcastBinaryOp(ctx *EvalContext, op BinaryOp, leftVal, rightVal Primitive) (Primitive, error) {
+	left, leftIsArray := toArray(leftVal)
+	right, rightIsArray := toArray(rightVal)
+	if (isArrayOperand(leftVal) && !leftIsArray) || (isArrayOperand(rightVal) && !rightIsArray) {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "Operators can't be applied to 3D references")
+	}
+	if !leftIsArray {
+		left = &ArrayValue{rows: 1, cols: 1, values: []Primitive{leftVal}}
+	}
+	if !rightIsArray {
+		right = &ArrayValue{rows: 1, cols: 1, values: []Primitive{rightVal}}
+	}
+
+	rows, cols := max(left.rows, right.rows), max(left.cols, right.cols)
+	if err := ctx.spreadsheet.limits.checkRangeCells(uint64(rows) * uint64(cols)); err != nil {
+		return nil, err
+	}
+
+	result := NewArrayValue(rows, cols)
+	for row := range rows {
+		for col := range cols {
+			leftElem, leftOk := left.broadcastAt(row, col)
+			rightElem, rightOk := right.broadcastAt(row, col)
+			if !leftOk || !rightOk {
+				result.Set(row, col, NewSpreadsheetError(ErrorCodeNA, ""))
+				continue
+			}
+			value, err := evalBinaryOp(ctx, op, leftElem, rightElem)
+			if err != nil {
+				value = toErrorValue(err)
+			}
+			result.Set(row, col, value)
+		}
+	}
+	return result, nil
+}
+
+// broadcastUnaryOp applies a unary operator to every value of a range or
+// array operand
+func broadcastUnaryOp(op UnaryOp, val Primitive) (Primitive, error) {
+	operand, ok := toArray(val)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "Operators can't be applied to 3D references")
+	}
+
+	result := NewArrayValue(operand.rows, operand.cols)
+	for i, elem := range operand.values {
+		value, err := evalUnaryOp(op, elem)
+		if err != nil {
+			value = toErrorValue(err)
+		}
+		result.values[i] = value
+	}
+	return result, nil
+}
+
+// broadcastAt returns the value an array contributes at a position of a
+// broadcast result. single rows and columns repeat, other positions outside
+// the array have no value.
+func (a *ArrayValue) broadcastAt(row, col int) (Primitive, bool) {
+	if a.rows == 1 {
+		row = 0
+	}
+	if a.cols == 1 {
+		col = 0
+	}
+	if row >= a.rows || col >= a.cols {
+		return nil, false
+	}
+	return a.At(row, col), true
+}
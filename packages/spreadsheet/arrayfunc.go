@@ -0,0 +1,526 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// array functions take ranges or arrays and return arrays, which spill from
+// the formula cell. a single value argument acts as a 1x1 array.
+
+// arrayArg converts an argument of an array function to an array
+func arrayArg(name string, arg any) (*ArrayValue, error) {
+	if err := checkForError(arg); err != nil {
+		return nil, err
+	}
+	if _, ok := arg.(Range); !ok {
+		return &ArrayValue{rows: 1, cols: 1, values: []Primitive{arg}}, nil
+	}
+	array, ok := toArray(arg)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, name+" doesn't accept 3D references")
+	}
+	return array, nil
+}
+
+// rangeShape returns the number of rows and columns of a range or array.
+// ranges spanning several worksheets have no shape.
+func rangeShape(r Range) (rows, cols int, ok bool) {
+	if _, isMulti := r.(*MultiRange); isMulti {
+		return 0, 0, false
+	}
+	bounds := r.GetBounds()
+	return int(bounds.EndRow-bounds.StartRow) + 1, int(bounds.EndColumn-bounds.StartColumn) + 1, true
+}
+
+// numberArg converts a single value argument of a function to a number
+func numberArg(name string, arg any, which string) (float64, error) {
+	if err := checkForError(arg); err != nil {
+		return 0, err
+	}
+	num, ok := toNumber(arg)
+	if !ok {
+		return 0, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("%s requires a numeric %s argument", name, which))
+	}
+	return num, nil
+}
+
+// boolArg converts an optional flag argument of a function to a boolean
+func boolArg(args []any, i int) (bool, error) {
+	if i >= len(args) {
+		return false, nil
+	}
+	if err := checkForError(args[i]); err != nil {
+		return false, err
+	}
+	return isTruthy(args[i]), nil
+}
+
+// lines splits an array into its rows, or into its columns when byCol is set
+func (a *ArrayValue) lines(byCol bool) [][]Primitive {
+	if !byCol {
+		lines := make([][]Primitive, a.rows)
+		for row := range a.rows {
+			lines[row] = a.values[row*a.cols : (row+1)*a.cols]
+		}
+		return lines
+	}
+
+	lines := make([][]Primitive, a.cols)
+	for col := range a.cols {
+		line := make([]Primitive, a.rows)
+		for row := range a.rows {
+			line[row] = a.At(row, col)
+		}
+		lines[col] = line
+	}
+	return lines
+}
+
+// arrayFromLines joins lines of equal length into an array, as its rows or
+// as its columns when byCol is set
+func arrayFromLines(lines [][]Primitive, byCol bool) *ArrayValue {
+	length := len(lines[0])
+	if !byCol {
+		array := NewArrayValue(len(lines), length)
+		for row, line := range lines {
+			copy(array.values[row*length:], line)
+		}
+		return array
+	}
+
+	array := NewArrayValue(length, len(lines))
+	for col, line := range lines {
+		for row, value := range line {
+			array.Set(row, col, value)
+		}
+	}
+	return array
+}
+
+// sortOrderArg converts a sort order argument, 1 for ascending or -1 for
+// descending
+func sortOrderArg(name string, value Primitive) (int, error) {
+	if err := checkForError(value); err != nil {
+		return 0, err
+	}
+	order, ok := toNumber(value)
+	if !ok || (order != 1 && order != -1) {
+		return 0, NewSpreadsheetError(ErrorCodeValue, name+" sort order must be 1 or -1")
+	}
+	return int(order), nil
+}
+
+// sortRank orders values of different types when sorting: numbers, then
+// text, then booleans, then errors
+func sortRank(value Primitive) int {
+	switch value.(type) {
+	case string:
+		return 1
+	case bool:
+		return 2
+	case *SpreadsheetError:
+		return 3
+	}
+	return 0
+}
+
+// compareSortValues compares two non-empty values for sorting. text compares
+// ignoring case.
+func compareSortValues(a, b Primitive) int {
+	if rankA, rankB := sortRank(a), sortRank(b); rankA != rankB {
+		return rankA - rankB
+	}
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(strings.ToLower(av), strings.ToLower(b.(string)))
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0
+		} else if !av {
+			return -1
+		}
+		return 1
+	case *SpreadsheetError:
+		return int(av.ErrorCode) - int(b.(*SpreadsheetError).ErrorCode)
+	}
+	an, _ := toNumber(a)
+	bn, _ := toNumber(b)
+	if an < bn {
+		return -1
+	} else if an > bn {
+		return 1
+	}
+	return 0
+}
+
+// sortLines sorts lines by their keys, each ascending (1) or descending (-1)
+// by its order. the sort is stable, lines with equal keys keep their order,
+// and blank keys sort last in either order.
+func sortLines(lines [][]Primitive, key func(line, k int) Primitive, orders []int) [][]Primitive {
+	perm := make([]int, len(lines))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.SliceStable(perm, func(i, j int) bool {
+		for k, order := range orders {
+			a, b := key(perm[i], k), key(perm[j], k)
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				continue
+			}
+			if c := compareSortValues(a, b) * order; c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	sorted := make([][]Primitive, len(lines))
+	for i, p := range perm {
+		sorted[i] = lines[p]
+	}
+	return sorted
+}
+
+// uniqueKey returns a key identifying the values of a line, equal for lines
+// that differ only in the case of their text
+func uniqueKey(line []Primitive) string {
+	var key strings.Builder
+	for _, value := range line {
+		switch v := value.(type) {
+		case string:
+			key.WriteString("s" + strings.ToLower(v))
+		case bool:
+			key.WriteString("b" + strconv.FormatBool(v))
+		case *SpreadsheetError:
+			key.WriteString("e" + strconv.Itoa(int(v.ErrorCode)))
+		case nil:
+			key.WriteString("z")
+		default:
+			num, _ := toNumber(v)
+			key.WriteString("n" + strconv.FormatFloat(num, 'g', -1, 64))
+		}
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// newArray creates an array of a size given by function arguments, which
+// must be at least 1 and fit a worksheet and the range limit
+func (bf *BuiltInFunctions) newArray(name string, rows, cols float64) (*ArrayValue, error) {
+	rows, cols = math.Trunc(rows), math.Trunc(cols)
+	if rows < 1 || cols < 1 {
+		return nil, NewSpreadsheetError(ErrorCodeValue, name+" requires at least 1 row and 1 column")
+	}
+	if rows > float64(MaxRows) || cols > float64(MaxColumns) {
+		return nil, NewSpreadsheetError(ErrorCodeValue,
+			fmt.Sprintf("%s of %gx%g doesn't fit a worksheet", name, rows, cols))
+	}
+	if bf.limits != nil {
+		if err := bf.limits.checkRangeCells(uint64(rows) * uint64(cols)); err != nil {
+			return nil, err
+		}
+	}
+	return NewArrayValue(int(rows), int(cols)), nil
+}
+
+// FILTER(array, include, [if_empty]) returns the rows of array whose value
+// in include, a column, is true, or the columns whose value in include, a
+// row, is true. ranges are read value by value without being copied first.
+func (bf *BuiltInFunctions) FILTER(args ...any) (Primitive, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "FILTER requires 2 or 3 arguments")
+	}
+	if err := checkForError(args[0]); err != nil {
+		return nil, err
+	}
+
+	source, isRange := args[0].(Range)
+	if !isRange {
+		source = &ArrayValue{rows: 1, cols: 1, values: []Primitive{args[0]}}
+	}
+	rows, cols, ok := rangeShape(source)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "FILTER doesn't accept 3D references")
+	}
+
+	include, err := arrayArg("FILTER", args[1])
+	if err != nil {
+		return nil, err
+	}
+	var byCol bool
+	switch {
+	case include.cols == 1 && include.rows == rows:
+		byCol = false
+	case include.rows == 1 && include.cols == cols:
+		byCol = true
+	default:
+		return nil, NewSpreadsheetError(ErrorCodeValue,
+			fmt.Sprintf("FILTER include of %dx%d doesn't match the rows or columns of a %dx%d array", include.rows, include.cols, rows, cols))
+	}
+	keep := make([]bool, len(include.values))
+	kept := 0
+	for i, value := range include.values {
+		if err := checkForError(value); err != nil {
+			return nil, err
+		}
+		if keep[i] = isTruthy(value); keep[i] {
+			kept++
+		}
+	}
+
+	if kept == 0 {
+		if len(args) == 3 {
+			return args[2], nil
+		}
+		return nil, NewSpreadsheetError(ErrorCodeCalc, "FILTER returned an empty array")
+	}
+
+	var result *ArrayValue
+	if byCol {
+		result = NewArrayValue(rows, kept)
+	} else {
+		result = NewArrayValue(kept, cols)
+	}
+	i, n := 0, 0
+	for value := range source.IterateValues() {
+		row, col := i/cols, i%cols
+		i++
+		if (byCol && keep[col]) || (!byCol && keep[row]) {
+			result.values[n] = value
+			n++
+		}
+	}
+	return result, nil
+}
+
+// SORT(array, [sort_index], [sort_order], [by_col]) sorts the rows of array
+// by the values in the sort_index column, or its columns by the values in
+// the sort_index row when by_col is true. sort_index and sort_order may be
+// arrays to sort by several keys.
+func (bf *BuiltInFunctions) SORT(args ...any) (Primitive, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "SORT requires 1 to 4 arguments")
+	}
+	array, err := arrayArg("SORT", args[0])
+	if err != nil {
+		return nil, err
+	}
+	byCol, err := boolArg(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	lines := array.lines(byCol)
+	length := len(lines[0])
+
+	indexes := []int{0}
+	if len(args) > 1 {
+		indexArray, err := arrayArg("SORT", args[1])
+		if err != nil {
+			return nil, err
+		}
+		indexes = indexes[:0]
+		for _, value := range indexArray.values {
+			index, err := numberArg("SORT", value, "sort index")
+			if err != nil {
+				return nil, err
+			}
+			if index < 1 || index > float64(length) {
+				return nil, NewSpreadsheetError(ErrorCodeValue,
+					fmt.Sprintf("SORT index %g is outside the array, which has %d", index, length))
+			}
+			indexes = append(indexes, int(index)-1)
+		}
+	}
+
+	orders := []int{1}
+	if len(args) > 2 {
+		orderArray, err := arrayArg("SORT", args[2])
+		if err != nil {
+			return nil, err
+		}
+		orders = orders[:0]
+		for _, value := range orderArray.values {
+			order, err := sortOrderArg("SORT", value)
+			if err != nil {
+				return nil, err
+			}
+			orders = append(orders, order)
+		}
+	}
+	if len(orders) == 1 && len(indexes) > 1 {
+		for len(orders) < len(indexes) {
+			orders = append(orders, orders[0])
+		}
+	}
+	if len(orders) != len(indexes) {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "SORT requires a sort order for every sort index")
+	}
+
+	sorted := sortLines(lines, func(line, k int) Primitive {
+		return lines[line][indexes[k]]
+	}, orders)
+	return arrayFromLines(sorted, byCol), nil
+}
+
+// SORTBY(array, by_array1, [sort_order1], [by_array2, sort_order2], ...)
+// sorts the rows of array by the values of the by arrays, single columns
+// as tall as array, or its columns when the by arrays are single rows as
+// wide as array
+func (bf *BuiltInFunctions) SORTBY(args ...any) (Primitive, error) {
+	if len(args) < 2 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "SORTBY requires at least 2 arguments")
+	}
+	array, err := arrayArg("SORTBY", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*ArrayValue
+	var orders []int
+	byCol := false
+	for i := 1; i < len(args); i += 2 {
+		by, err := arrayArg("SORTBY", args[i])
+		if err != nil {
+			return nil, err
+		}
+		var keyByCol bool
+		switch {
+		case by.cols == 1 && by.rows == array.rows:
+			keyByCol = false
+		case by.rows == 1 && by.cols == array.cols:
+			keyByCol = true
+		default:
+			return nil, NewSpreadsheetError(ErrorCodeValue,
+				fmt.Sprintf("SORTBY array of %dx%d doesn't match the rows or columns of a %dx%d array", by.rows, by.cols, array.rows, array.cols))
+		}
+		if len(keys) == 0 {
+			byCol = keyByCol
+		} else if keyByCol != byCol && array.rows*array.cols > 1 {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "SORTBY arrays must all be rows or all be columns")
+		}
+		keys = append(keys, by)
+
+		order := 1
+		if i+1 < len(args) {
+			if order, err = sortOrderArg("SORTBY", args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		orders = append(orders, order)
+	}
+
+	lines := array.lines(byCol)
+	sorted := sortLines(lines, func(line, k int) Primitive {
+		return keys[k].values[line]
+	}, orders)
+	return arrayFromLines(sorted, byCol), nil
+}
+
+// UNIQUE(array, [by_col], [exactly_once]) returns the distinct rows of array,
+// or its distinct columns when by_col is true, in order of first appearance.
+// with exactly_once, only rows or columns that appear once are returned.
+// text compares ignoring case.
+func (bf *BuiltInFunctions) UNIQUE(args ...any) (Primitive, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "UNIQUE requires 1 to 3 arguments")
+	}
+	array, err := arrayArg("UNIQUE", args[0])
+	if err != nil {
+		return nil, err
+	}
+	byCol, err := boolArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	exactlyOnce, err := boolArg(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := array.lines(byCol)
+	counts := make(map[string]int, len(lines))
+	var distinct [][]Primitive
+	var distinctKeys []string
+	for _, line := range lines {
+		key := uniqueKey(line)
+		if counts[key] == 0 {
+			distinct = append(distinct, line)
+			distinctKeys = append(distinctKeys, key)
+		}
+		counts[key]++
+	}
+
+	if exactlyOnce {
+		once := distinct[:0]
+		for i, line := range distinct {
+			if counts[distinctKeys[i]] == 1 {
+				once = append(once, line)
+			}
+		}
+		distinct = once
+	}
+	if len(distinct) == 0 {
+		return nil, NewSpreadsheetError(ErrorCodeCalc, "UNIQUE returned an empty array")
+	}
+	return arrayFromLines(distinct, byCol), nil
+}
+
+// SEQUENCE(rows, [columns], [start], [step]) returns an array of numbers
+// counting from start by step, filling each row before the next
+func (bf *BuiltInFunctions) SEQUENCE(args ...any) (Primitive, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "SEQUENCE requires 1 to 4 arguments")
+	}
+	params := []float64{0, 1, 1, 1}
+	for i, which := range []string{"rows", "columns", "start", "step"}[:len(args)] {
+		num, err := numberArg("SEQUENCE", args[i], which)
+		if err != nil {
+			return nil, err
+		}
+		params[i] = num
+	}
+
+	rows, cols, start, step := math.Trunc(params[0]), math.Trunc(params[1]), params[2], params[3]
+	if rows < 0 || cols < 0 {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "SEQUENCE requires non-negative rows and columns")
+	}
+	if rows == 0 || cols == 0 {
+		return nil, NewSpreadsheetError(ErrorCodeCalc, "SEQUENCE returned an empty array")
+	}
+	array, err := bf.newArray("SEQUENCE", rows, cols)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range array.values {
+		array.values[i] = start + float64(i)*step
+	}
+	return array, nil
+}
+
+// TRANSPOSE(array) swaps the rows and columns of array
+func (bf *BuiltInFunctions) TRANSPOSE(args ...any) (Primitive, error) {
+	if len(args) != 1 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "TRANSPOSE requires exactly 1 argument")
+	}
+	array, err := arrayArg("TRANSPOSE", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewArrayValue(array.cols, array.rows)
+	for row := range array.rows {
+		for col := range array.cols {
+			result.Set(col, row, array.At(row, col))
+		}
+	}
+	return result, nil
+}
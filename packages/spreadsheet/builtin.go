@@ -35,8 +35,9 @@ func (d *DefaultRandomGenerator) Float64() float64 {
 
 // BuiltInFunctions contains all spreadsheet built-in functions
 type BuiltInFunctions struct {
-	clock Clock
-	rng   RandomGenerator
+	clock  Clock
+	rng    RandomGenerator
+	limits *Limits // bounds the arrays functions build, nil for unlimited
 }
 
 // checkForError returns the error if value is a *SpreadsheetError, nil otherwise
@@ -56,70 +57,79 @@ func NewDefaultBuiltInFunctions() *BuiltInFunctions {
 	}
 }
 
+// builtinFunction is a built-in function, called with the function set
+// providing its clock and random number generator
+type builtinFunction func(bf *BuiltInFunctions, args ...any) (Primitive, error)
+
+// builtinFunctions maps upper case function names to their implementation
+var builtinFunctions = map[string]builtinFunction{
+	"SUM":         (*BuiltInFunctions).SUM,
+	"AVERAGE":     (*BuiltInFunctions).AVERAGE,
+	"AVERAGEA":    (*BuiltInFunctions).AVERAGEA,
+	"COUNT":       (*BuiltInFunctions).COUNT,
+	"COUNTA":      (*BuiltInFunctions).COUNTA,
+	"COUNTBLANK":  (*BuiltInFunctions).COUNTBLANK,
+	"MAX":         (*BuiltInFunctions).MAX,
+	"MIN":         (*BuiltInFunctions).MIN,
+	"MEDIAN":      (*BuiltInFunctions).MEDIAN,
+	"MODE":        (*BuiltInFunctions).MODE,
+	"AND":         (*BuiltInFunctions).AND,
+	"OR":          (*BuiltInFunctions).OR,
+	"NOT":         (*BuiltInFunctions).NOT,
+	"CONCATENATE": (*BuiltInFunctions).CONCATENATE,
+	"LEN":         (*BuiltInFunctions).LEN,
+	"UPPER":       (*BuiltInFunctions).UPPER,
+	"LOWER":       (*BuiltInFunctions).LOWER,
+	"TRIM":        (*BuiltInFunctions).TRIM,
+	"ABS":         (*BuiltInFunctions).ABS,
+	"ROUND":       (*BuiltInFunctions).ROUND,
+	"FLOOR":       (*BuiltInFunctions).FLOOR,
+	"CEILING":     (*BuiltInFunctions).CEILING,
+	"SQRT":        (*BuiltInFunctions).SQRT,
+	"POWER":       (*BuiltInFunctions).POWER,
+	"MOD":         (*BuiltInFunctions).MOD,
+	"PI":          (*BuiltInFunctions).PI,
+	"NOW":         (*BuiltInFunctions).NOW,
+	"TODAY":       (*BuiltInFunctions).TODAY,
+	"RAND":        (*BuiltInFunctions).RAND,
+	"FILTER":      (*BuiltInFunctions).FILTER,
+	"SORT":        (*BuiltInFunctions).SORT,
+	"SORTBY":      (*BuiltInFunctions).SORTBY,
+	"UNIQUE":      (*BuiltInFunctions).UNIQUE,
+	"SEQUENCE":    (*BuiltInFunctions).SEQUENCE,
+	"TRANSPOSE":   (*BuiltInFunctions).TRANSPOSE,
+	"MAP":         (*BuiltInFunctions).MAP,
+	"REDUCE":      (*BuiltInFunctions).REDUCE,
+	"SCAN":        (*BuiltInFunctions).SCAN,
+	"BYROW":       (*BuiltInFunctions).BYROW,
+	"BYCOL":       (*BuiltInFunctions).BYCOL,
+	"MAKEARRAY":   (*BuiltInFunctions).MAKEARRAY,
+	"ISBLANK":     (*BuiltInFunctions).ISBLANK,
+	"ISERR":       (*BuiltInFunctions).ISERR,
+	"ISERROR":     (*BuiltInFunctions).ISERROR,
+	"ISNA":        (*BuiltInFunctions).ISNA,
+	"ISNUMBER":    (*BuiltInFunctions).ISNUMBER,
+	"ISTEXT":      (*BuiltInFunctions).ISTEXT,
+	"ISLOGICAL":   (*BuiltInFunctions).ISLOGICAL,
+	"ERROR.TYPE":  (*BuiltInFunctions).ERROR_TYPE,
+	"TYPE":        (*BuiltInFunctions).TYPE,
+	"N":           (*BuiltInFunctions).N,
+	"NA":          (*BuiltInFunctions).NA,
+}
+
+// lookupFunction resolves a built-in function by name, ignoring case
+func lookupFunction(name string) (builtinFunction, bool) {
+	fn, exists := builtinFunctions[strings.ToUpper(name)]
+	return fn, exists
+}
+
 // Call invokes a built-in function by name with the given arguments
 func (bf *BuiltInFunctions) Call(name string, args ...any) (Primitive, error) {
-	switch strings.ToUpper(name) {
-	case "SUM":
-		return bf.SUM(args...)
-	case "AVERAGE":
-		return bf.AVERAGE(args...)
-	case "AVERAGEA":
-		return bf.AVERAGEA(args...)
-	case "COUNT":
-		return bf.COUNT(args...)
-	case "COUNTA":
-		return bf.COUNTA(args...)
-	case "MAX":
-		return bf.MAX(args...)
-	case "MIN":
-		return bf.MIN(args...)
-	case "MEDIAN":
-		return bf.MEDIAN(args...)
-	case "MODE":
-		return bf.MODE(args...)
-	case "IF":
-		return bf.IF(args...)
-	case "AND":
-		return bf.AND(args...)
-	case "OR":
-		return bf.OR(args...)
-	case "NOT":
-		return bf.NOT(args...)
-	case "CONCATENATE":
-		return bf.CONCATENATE(args...)
-	case "LEN":
-		return bf.LEN(args...)
-	case "UPPER":
-		return bf.UPPER(args...)
-	case "LOWER":
-		return bf.LOWER(args...)
-	case "TRIM":
-		return bf.TRIM(args...)
-	case "ABS":
-		return bf.ABS(args...)
-	case "ROUND":
-		return bf.ROUND(args...)
-	case "FLOOR":
-		return bf.FLOOR(args...)
-	case "CEILING":
-		return bf.CEILING(args...)
-	case "SQRT":
-		return bf.SQRT(args...)
-	case "POWER":
-		return bf.POWER(args...)
-	case "MOD":
-		return bf.MOD(args...)
-	case "PI":
-		return bf.PI(args...)
-	case "NOW":
-		return bf.NOW(args...)
-	case "TODAY":
-		return bf.TODAY(args...)
-	case "RAND":
-		return bf.RAND(args...)
-	default:
+	fn, exists := lookupFunction(name)
+	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Unknown function: %s", name))
 	}
+	return fn(bf, args...)
 }
 
 func (bf *BuiltInFunctions) SUM(args ...any) (Primitive, error) {
@@ -130,7 +140,7 @@ func (bf *BuiltInFunctions) SUM(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			for value := range r.IterateOccupiedValues() {
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -156,7 +166,7 @@ func (bf *BuiltInFunctions) AVERAGE(args ...any) (Primitive, error) {
 			return nil, err
 		}
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			for value := range r.IterateOccupiedValues() {
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -221,7 +231,7 @@ func (bf *BuiltInFunctions) AVERAGEA(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			for value := range r.IterateOccupiedValues() {
 				if err := processValue(value); err != nil {
 					return nil, err
 				}
@@ -275,7 +285,7 @@ func (bf *BuiltInFunctions) COUNT(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			for value := range r.IterateOccupiedValues() {
 				// COUNT doesn't propagate errors from Range values, just skips them
 				if _, isErr := value.(*SpreadsheetError); !isErr && shouldCount(value) {
 					count++
@@ -303,7 +313,7 @@ func (bf *BuiltInFunctions) COUNTA(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			for value := range r.IterateOccupiedValues() {
 				// COUNTA counts errors as non-empty cells, doesn't propagate them
 				// count everything except nil (empty cells)
 				if value != nil {
@@ -319,6 +329,39 @@ func (bf *BuiltInFunctions) COUNTA(args ...any) (Primitive, error) {
 	return float64(count), nil
 }
 
+func (bf *BuiltInFunctions) COUNTBLANK(args ...any) (Primitive, error) {
+	if len(args) != 1 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "COUNTBLANK requires exactly 1 argument")
+	}
+
+	isBlank := func(value Primitive) bool {
+		// empty text, e.g. from a formula, counts as blank too
+		return value == nil || value == ""
+	}
+
+	r, ok := args[0].(Range)
+	if !ok {
+		// a single cell reference arrives as its value
+		if err := checkForError(args[0]); err != nil {
+			return nil, err
+		}
+		if isBlank(args[0]) {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	}
+
+	// empty cells are never visited, so start from the size of the range and
+	// subtract the occupied cells that are not blank. errors are not blank.
+	blank := r.Size()
+	for value := range r.IterateOccupiedValues() {
+		if !isBlank(value) {
+			blank--
+		}
+	}
+	return float64(blank), nil
+}
+
 func (bf *BuiltInFunctions) MAX(args ...any) (Primitive, error) {
 	max := math.Inf(-1)
 	hasValues := false
@@ -329,7 +372,9 @@ func (bf *BuiltInFunctions) MAX(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			occupied := 0
+			for value := range r.IterateOccupiedValues() {
+				occupied++
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -340,6 +385,13 @@ func (bf *BuiltInFunctions) MAX(args ...any) (Primitive, error) {
 					hasValues = true
 				}
 			}
+			// empty cells count as zero
+			if occupied < r.Size() {
+				if 0 > max {
+					max = 0
+				}
+				hasValues = true
+			}
 		} else {
 			if num, ok := toNumber(arg); ok && !math.IsNaN(num) {
 				if num > max {
@@ -366,7 +418,9 @@ func (bf *BuiltInFunctions) MIN(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			occupied := 0
+			for value := range r.IterateOccupiedValues() {
+				occupied++
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -377,6 +431,13 @@ func (bf *BuiltInFunctions) MIN(args ...any) (Primitive, error) {
 					hasValues = true
 				}
 			}
+			// empty cells count as zero
+			if occupied < r.Size() {
+				if 0 < min {
+					min = 0
+				}
+				hasValues = true
+			}
 		} else {
 			if num, ok := toNumber(arg); ok && !math.IsNaN(num) {
 				if num < min {
@@ -395,13 +456,16 @@ func (bf *BuiltInFunctions) MIN(args ...any) (Primitive, error) {
 
 func (bf *BuiltInFunctions) MEDIAN(args ...any) (Primitive, error) {
 	values := []float64{}
+	zeros := 0 // empty cells, which count as zero
 	for _, arg := range args {
 		if err := checkForError(arg); err != nil {
 			return nil, err
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			occupied := 0
+			for value := range r.IterateOccupiedValues() {
+				occupied++
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -409,6 +473,7 @@ func (bf *BuiltInFunctions) MEDIAN(args ...any) (Primitive, error) {
 					values = append(values, num)
 				}
 			}
+			zeros += r.Size() - occupied
 		} else {
 			if num, ok := toNumber(arg); ok && !math.IsNaN(num) {
 				values = append(values, num)
@@ -416,7 +481,7 @@ func (bf *BuiltInFunctions) MEDIAN(args ...any) (Primitive, error) {
 		}
 	}
 
-	if len(values) == 0 {
+	if len(values)+zeros == 0 {
 		return nil, NewSpreadsheetError(ErrorCodeNum, "MEDIAN has no numeric values")
 	}
 
@@ -429,13 +494,29 @@ func (bf *BuiltInFunctions) MEDIAN(args ...any) (Primitive, error) {
 		}
 	}
 
-	mid := len(values) / 2
-	if len(values)%2 == 0 {
+	// the zeros sit between the negative and the non-negative values
+	negatives := 0
+	for negatives < len(values) && values[negatives] < 0 {
+		negatives++
+	}
+	at := func(i int) float64 {
+		switch {
+		case i < negatives:
+			return values[i]
+		case i < negatives+zeros:
+			return 0
+		}
+		return values[i-zeros]
+	}
+
+	count := len(values) + zeros
+	mid := count / 2
+	if count%2 == 0 {
 		// even count: average of two middle values
-		return (values[mid-1] + values[mid]) / 2, nil
+		return (at(mid-1) + at(mid)) / 2, nil
 	}
 	// odd count: middle value
-	return values[mid], nil
+	return at(mid), nil
 }
 
 func (bf *BuiltInFunctions) MODE(args ...any) (Primitive, error) {
@@ -447,7 +528,9 @@ func (bf *BuiltInFunctions) MODE(args ...any) (Primitive, error) {
 		}
 
 		if r, ok := arg.(Range); ok {
-			for value := range r.IterateValues() {
+			occupied := 0
+			for value := range r.IterateOccupiedValues() {
+				occupied++
 				if err := checkForError(value); err != nil {
 					return nil, err
 				}
@@ -455,6 +538,10 @@ func (bf *BuiltInFunctions) MODE(args ...any) (Primitive, error) {
 					frequencyMap[num]++
 				}
 			}
+			// empty cells count as zero
+			if empty := r.Size() - occupied; empty > 0 {
+				frequencyMap[0] += empty
+			}
 		} else {
 			if num, ok := toNumber(arg); ok && !math.IsNaN(num) {
 				frequencyMap[num]++
@@ -500,28 +587,6 @@ func (bf *BuiltInFunctions) MODE(args ...any) (Primitive, error) {
 	return modes[0], nil
 }
 
-func (bf *BuiltInFunctions) IF(args ...any) (Primitive, error) {
-	if len(args) < 2 || len(args) > 3 {
-		return nil, NewSpreadsheetError(ErrorCodeNA, "IF requires 2 or 3 arguments")
-	}
-
-	// Check for errors in condition before evaluating
-	if err := checkForError(args[0]); err != nil {
-		return nil, err
-	}
-
-	condition := isTruthy(args[0])
-	if condition {
-		return args[1], nil
-	}
-
-	if len(args) == 3 {
-		return args[2], nil
-	}
-
-	return false, nil
-}
-
 func (bf *BuiltInFunctions) AND(args ...any) (Primitive, error) {
 	for _, arg := range args {
 		// Check for errors before evaluating
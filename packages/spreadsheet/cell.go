@@ -7,6 +7,7 @@ package main
 //   - bool: boolean values (TRUE/FALSE)
 //   - nil: empty/null cells
 //   - SpreadsheetError: error values (#DIV/0!, #VALUE!, etc.)
+//   - ArrayValue: arrays produced during evaluation, never stored in a cell
 type Primitive any
 
 // ErrorCode represents standard spreadsheet error codes following
@@ -14,26 +15,32 @@ type Primitive any
 type ErrorCode uint8
 
 const (
-	ErrorCodeNull  ErrorCode = 1 // #NULL! - no cells in common between ranges
-	ErrorCodeDiv0  ErrorCode = 2 // #DIV/0! - division by zero
-	ErrorCodeValue ErrorCode = 3 // #VALUE! - wrong type of argument or operand
-	ErrorCodeRef   ErrorCode = 4 // #REF! - invalid cell reference
-	ErrorCodeName  ErrorCode = 5 // #NAME? - unrecognized function name
-	ErrorCodeNum   ErrorCode = 6 // #NUM! - number too large or small to be represented
-	ErrorCodeNA    ErrorCode = 7 // #N/A - not enough arguments for function
-	ErrorCodeOther ErrorCode = 8 // #ERROR! - all other errors
+	ErrorCodeNull     ErrorCode = 1  // #NULL! - no cells in common between ranges
+	ErrorCodeDiv0     ErrorCode = 2  // #DIV/0! - division by zero
+	ErrorCodeValue    ErrorCode = 3  // #VALUE! - wrong type of argument or operand
+	ErrorCodeRef      ErrorCode = 4  // #REF! - invalid cell reference
+	ErrorCodeName     ErrorCode = 5  // #NAME? - unrecognized function name
+	ErrorCodeNum      ErrorCode = 6  // #NUM! - number too large or small to be represented
+	ErrorCodeNA       ErrorCode = 7  // #N/A - not enough arguments for function
+	ErrorCodeOther    ErrorCode = 8  // #ERROR! - all other errors
+	ErrorCodeCircular ErrorCode = 9  // #CIRCULAR! - formula depends on its own result
+	ErrorCodeSpill    ErrorCode = 10 // #SPILL! - array result blocked by occupied cells
+	ErrorCodeCalc     ErrorCode = 11 // #CALC! - array function with an empty result
 )
 
 // ErrorMapper maps error code numbers to their string representations
 var ErrorMapper = map[ErrorCode]string{
-	ErrorCodeNull:  "#NULL!",
-	ErrorCodeDiv0:  "#DIV/0!",
-	ErrorCodeValue: "#VALUE!",
-	ErrorCodeRef:   "#REF!",
-	ErrorCodeName:  "#NAME?",
-	ErrorCodeNum:   "#NUM!",
-	ErrorCodeNA:    "#N/A",
-	ErrorCodeOther: "#ERROR!",
+	ErrorCodeNull:     "#NULL!",
+	ErrorCodeDiv0:     "#DIV/0!",
+	ErrorCodeValue:    "#VALUE!",
+	ErrorCodeRef:      "#REF!",
+	ErrorCodeName:     "#NAME?",
+	ErrorCodeNum:      "#NUM!",
+	ErrorCodeNA:       "#N/A",
+	ErrorCodeOther:    "#ERROR!",
+	ErrorCodeCircular: "#CIRCULAR!",
+	ErrorCodeSpill:    "#SPILL!",
+	ErrorCodeCalc:     "#CALC!",
 }
 
 // SpreadsheetError preserves error code for display in cells
@@ -0,0 +1,129 @@
+package main
+
+// maxCircularReferences caps the number of cycles FindCircularReferences
+// reports. densely connected cells can form exponentially many cycles.
+const maxCircularReferences = 1000
+
+// FindCircularReferences returns every cycle between formula cells, both
+// through direct references and through ranges. each cycle is an ordered
+// list of A1 addresses starting at its first cell, where every cell depends
+// on the next one and the last cell depends on the first. at most
+// maxCircularReferences cycles are returned.
+func (s *Spreadsheet) FindCircularReferences() [][]string {
+	formulaCells := make(map[CellAddress]struct{}, len(s.storage.formulas.formulaAtCell))
+	cells := make([]CellAddress, 0, len(s.storage.formulas.formulaAtCell))
+	for addr := range s.storage.formulas.formulaAtCell {
+		formulaCells[addr] = struct{}{}
+		cells = append(cells, addr)
+	}
+	sortCellAddresses(cells)
+
+	// only formula cells can be part of a cycle
+	precedents := s.pendingPrecedents(formulaCells)
+	components := stronglyConnectedComponents(cells, precedents)
+
+	var result [][]string
+	for _, cycle := range elementaryCycles(components, precedents, maxCircularReferences) {
+		formatted := make([]string, len(cycle))
+		for i, addr := range cycle {
+			formatted[i] = s.formatCellAddress(addr)
+		}
+		result = append(result, formatted)
+	}
+	return result
+}
+
+// elementaryCycles finds the elementary cycles within strongly connected
+// components using Johnson's algorithm with an explicit stack. cycles start
+// at their smallest cell and follow the edges to precedents. the search
+// stops once limit cycles are found.
+func elementaryCycles(components [][]CellAddress, precedents map[CellAddress][]CellAddress, limit int) [][]CellAddress {
+	var cycles [][]CellAddress
+
+	type frame struct {
+		addr  CellAddress
+		next  int  // index of the next precedent to visit
+		found bool // whether a cycle was found through this cell
+	}
+
+	for _, component := range components {
+		if len(component) == 1 && !isSelfReferencing(component[0], precedents) {
+			continue
+		}
+		sortCellAddresses(component)
+		order := make(map[CellAddress]int, len(component))
+		for i, addr := range component {
+			order[addr] = i
+		}
+
+		for i, start := range component {
+			// cycles through smaller cells were found in earlier rounds
+			allowed := func(addr CellAddress) bool {
+				j, ok := order[addr]
+				return ok && j >= i
+			}
+			blocked := map[CellAddress]bool{start: true}
+			blockedBy := make(map[CellAddress][]CellAddress)
+			unblock := func(addr CellAddress) {
+				queue := []CellAddress{addr}
+				for len(queue) > 0 {
+					current := queue[len(queue)-1]
+					queue = queue[:len(queue)-1]
+					if !blocked[current] {
+						continue
+					}
+					blocked[current] = false
+					queue = append(queue, blockedBy[current]...)
+					delete(blockedBy, current)
+				}
+			}
+
+			path := []frame{{addr: start}}
+			for len(path) > 0 {
+				top := &path[len(path)-1]
+				edges := precedents[top.addr]
+
+				if top.next < len(edges) {
+					next := edges[top.next]
+					top.next++
+					if !allowed(next) {
+						continue
+					}
+					if next == start {
+						cycle := make([]CellAddress, len(path))
+						for k, f := range path {
+							cycle[k] = f.addr
+						}
+						cycles = append(cycles, cycle)
+						if len(cycles) >= limit {
+							return cycles
+						}
+						top.found = true
+					} else if !blocked[next] {
+						blocked[next] = true
+						path = append(path, frame{addr: next})
+					}
+					continue
+				}
+
+				// all precedents visited
+				done := path[len(path)-1]
+				path = path[:len(path)-1]
+				if done.found {
+					unblock(done.addr)
+					if len(path) > 0 {
+						path[len(path)-1].found = true
+					}
+				} else {
+					for _, next := range edges {
+						if allowed(next) {
+							blockedBy[next] = append(blockedBy[next], done.addr)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return cycles
+}
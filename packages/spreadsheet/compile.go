@@ -0,0 +1,161 @@
+package main
+
+import "sync"
+
+// compiledFormula evaluates a formula compiled from its AST. it behaves
+// exactly like evaluating the AST, without dispatching on node types,
+// re-boxing literals or resolving functions by name on every evaluation.
+type compiledFormula func(ctx *EvalContext) (Primitive, error)
+
+// compile turns an AST into a tree of closures. literals are boxed once,
+// functions are resolved once and operators are bound to their operands.
+// FormulaTable compiles each distinct formula when it is interned.
+func compile(node ASTNode) compiledFormula {
+	switch n := node.(type) {
+	case *NumberNode:
+		value := Primitive(n.Value)
+		return func(*EvalContext) (Primitive, error) { return value, nil }
+
+	case *StringNode:
+		value := Primitive(n.Value)
+		return func(*EvalContext) (Primitive, error) { return value, nil }
+
+	case *BooleanNode:
+		value := Primitive(n.Value)
+		return func(*EvalContext) (Primitive, error) { return value, nil }
+
+	case *ArrayNode:
+		// array constants hold literals only, so they are built once. arrays
+		// are never modified once evaluated, so every evaluation shares it
+		value, err := n.Eval(nil)
+		return func(*EvalContext) (Primitive, error) { return value, err }
+
+	case *BinaryOpNode:
+		return compileBinaryOp(n)
+
+	case *UnaryOpNode:
+		operand := compile(n.Operand)
+		op := n.Op
+		return func(ctx *EvalContext) (Primitive, error) {
+			val, err := operand(ctx)
+			if err != nil {
+				val = toErrorValue(err)
+			}
+			return evalUnaryOp(op, val)
+		}
+
+	case *FunctionCallNode:
+		return compileFunctionCall(n)
+	}
+
+	// references read the workbook and are already direct
+	return node.Eval
+}
+
+// compileBinaryOp compiles a binary operation. arithmetic on two numbers,
+// by far the most common case, skips the generic operator path.
+func compileBinaryOp(n *BinaryOpNode) compiledFormula {
+	left := compile(n.Left)
+	right := compile(n.Right)
+	op := n.Op
+
+	var arithmetic func(a, b float64) (Primitive, bool)
+	switch op {
+	case BinOpAdd:
+		arithmetic = func(a, b float64) (Primitive, bool) { return a + b, true }
+	case BinOpSubtract:
+		arithmetic = func(a, b float64) (Primitive, bool) { return a - b, true }
+	case BinOpMultiply:
+		arithmetic = func(a, b float64) (Primitive, bool) { return a * b, true }
+	case BinOpDivide:
+		// division by zero takes the generic path for its error
+		arithmetic = func(a, b float64) (Primitive, bool) { return a / b, b != 0 }
+	}
+
+	return func(ctx *EvalContext) (Primitive, error) {
+		leftVal, err := left(ctx)
+		if err != nil {
+			leftVal = toErrorValue(err)
+		}
+		rightVal, err := right(ctx)
+		if err != nil {
+			rightVal = toErrorValue(err)
+		}
+
+		if arithmetic != nil {
+			if a, ok := leftVal.(float64); ok {
+				if b, ok := rightVal.(float64); ok {
+					if result, ok := arithmetic(a, b); ok {
+						return result, nil
+					}
+				}
+			}
+		}
+		return evalBinaryOp(ctx, op, leftVal, rightVal)
+	}
+}
+
+// compileFunctionCall compiles a function call with the function resolved
+// up front. special forms get their arguments unevaluated, and functions
+// that aren't built in are looked up among the names when called, failing
+// with #NAME? when there is no such LAMBDA.
+func compileFunctionCall(n *FunctionCallNode) compiledFormula {
+	args := make([]compiledFormula, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = compile(arg)
+	}
+
+	if n.isSpecialForm() {
+		return specialForm(n, args)
+	}
+
+	fn, builtin := lookupFunction(n.Name)
+
+	return func(ctx *EvalContext) (Primitive, error) {
+		if ctx.args == nil {
+			ctx.args = new(argStack)
+		}
+		stack := ctx.args
+		base := len(stack.values)
+		for _, arg := range args {
+			value, err := arg(ctx)
+			if err != nil {
+				// functions decide how to handle error values
+				value = toErrorValue(err)
+			}
+			stack.values = append(stack.values, value)
+		}
+		// the capacity is cut so a function appending to its arguments can't
+		// overwrite those of the calls it makes
+		values := stack.values[base:len(stack.values):len(stack.values)]
+
+		var result Primitive
+		var err error
+		if builtin {
+			result, err = fn(ctx.spreadsheet.functions, values...)
+			if err != nil {
+				result, err = nil, toErrorValue(err)
+			}
+		} else {
+			result, err = callNamedFunction(ctx, n.Name, values)
+		}
+
+		clear(stack.values[base:])
+		stack.values = stack.values[:base]
+		return result, err
+	}
+}
+
+// argStack holds the arguments of the function calls being evaluated. a call
+// pushes its arguments above those of the calls around it and pops them once
+// the function returns, so calls don't allocate their arguments. functions
+// must not keep their arguments past the call.
+type argStack struct {
+	values []any
+}
+
+// argStacks reuses argument stacks across evaluations, which may run
+// concurrently
+var argStacks = sync.Pool{
+	New: func() any { return new(argStack) },
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EventType identifies the kind of change an Event reports
+type EventType int
+
+const (
+	EventCellValueChanged   EventType = iota + 1 // the value of a cell changed
+	EventCellFormulaChanged                      // a formula was set, replaced or removed
+	EventWorksheetAdded
+	EventWorksheetRemoved
+	EventWorksheetRenamed
+	EventNamedRangeAdded
+	EventNamedRangeRemoved
+	EventNamedRangeRenamed
+	EventWorksheetMoved
+	EventTableAdded
+	EventTableRemoved
+)
+
+// Event describes a change to the workbook
+type Event struct {
+	Type       EventType
+	Address    string    // cell in A1 notation for cell events, e.g. "Sheet1!B2"
+	OldValue   Primitive // previous value for value changes
+	NewValue   Primitive // new value for value changes
+	OldFormula string    // previous formula for formula changes, empty if there was none
+	NewFormula string    // new formula for formula changes, empty if it was removed
+	Name       string    // worksheet, named range or table name for lifecycle events
+	OldName    string    // previous name for rename events
+
+	cell CellAddress // cell of cell events, used to match watched ranges
+}
+
+// isCellEvent reports whether the event is about a single cell
+func (e Event) isCellEvent() bool {
+	return e.Type == EventCellValueChanged || e.Type == EventCellFormulaChanged
+}
+
+// subscriber receives events, optionally only cell events within a range
+type subscriber struct {
+	handler func(Event)
+	watch   *RangeAddress
+}
+
+// Subscribe registers a handler for every event of the workbook. handlers run
+// synchronously on the goroutine making the change. value changes caused by
+// a calculation are reported once per cell when it completes. the returned
+// function removes the subscription.
+func (s *Spreadsheet) Subscribe(handler func(Event)) func() {
+	return s.addSubscriber(&subscriber{handler: handler})
+}
+
+// Watch registers a handler for value and formula changes of a cell, like
+// "Sheet1!A1", or of the cells of a range, like "Sheet1!A1:B10". the returned
+// function removes the subscription.
+func (s *Spreadsheet) Watch(rangeOrAddress string, handler func(Event)) (func(), error) {
+	watch, err := s.resolveRange(rangeOrAddress)
+	if err != nil {
+		return nil, err
+	}
+	return s.addSubscriber(&subscriber{handler: handler, watch: &watch}), nil
+}
+
+// addSubscriber registers a subscriber and returns the function removing it
+func (s *Spreadsheet) addSubscriber(sub *subscriber) func() {
+	if s.subscribers == nil {
+		s.subscribers = make(map[int]*subscriber)
+	}
+	s.nextSubscriberID++
+	id := s.nextSubscriberID
+	s.subscribers[id] = sub
+	return func() {
+		delete(s.subscribers, id)
+	}
+}
+
+// resolveRange parses a cell address or a range like "Sheet1!A1:B10" into a
+// range address on a defined worksheet
+func (s *Spreadsheet) resolveRange(ref string) (RangeAddress, error) {
+	start, end := ref, ref
+	if colon := strings.LastIndex(ref, ":"); colon > 0 {
+		start = ref[:colon]
+		end = ref[colon+1:]
+		if exclamation := strings.LastIndex(start, "!"); exclamation > 0 && !strings.Contains(end, "!") {
+			end = start[:exclamation+1] + end
+		}
+	}
+
+	startWorksheetID, startRow, startCol, err := s.resolveAddress(start)
+	if err != nil {
+		return RangeAddress{}, err
+	}
+	endWorksheetID, endRow, endCol, err := s.resolveAddress(end)
+	if err != nil {
+		return RangeAddress{}, err
+	}
+	if startWorksheetID == 0 || !s.storage.worksheets.IsWorksheetDefined(startWorksheetID) {
+		return RangeAddress{}, NewApplicationError(NotFound, fmt.Sprintf("Worksheet not found for %s", ref))
+	}
+	if startWorksheetID != endWorksheetID {
+		return RangeAddress{}, NewApplicationError(InvalidArgument, "Ranges cannot span worksheets")
+	}
+
+	return RangeAddress{
+		WorksheetID: startWorksheetID,
+		StartRow:    min(startRow, endRow),
+		StartColumn: min(startCol, endCol),
+		EndRow:      max(startRow, endRow),
+		EndColumn:   max(startCol, endCol),
+	}, nil
+}
+
+// hasSubscribers reports whether anyone listens for events, so changes don't
+// need to be tracked otherwise
+func (s *Spreadsheet) hasSubscribers() bool {
+	return len(s.subscribers) > 0
+}
+
+// emit delivers an event to the matching subscribers in subscription order
+func (s *Spreadsheet) emit(event Event) {
+	if !s.hasSubscribers() {
+		return
+	}
+
+	ids := make([]int, 0, len(s.subscribers))
+	for id := range s.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		sub, exists := s.subscribers[id]
+		if !exists {
+			continue // removed by an earlier handler
+		}
+		if sub.watch != nil && (!event.isCellEvent() || !s.storage.dependencyGraph.IsInRange(event.cell, *sub.watch)) {
+			continue
+		}
+		sub.handler(event)
+	}
+}
+
+// cellState returns the value and formula of a cell, as seen by Get
+func (s *Spreadsheet) cellState(addr CellAddress) (Primitive, string) {
+	var formula string
+	if _, isFormula := s.storage.formulas.GetFormulaAtCell(addr); isFormula {
+		formula, _ = s.storage.dependencyGraph.GetFormula(addr)
+	}
+	worksheet, exists := s.storage.worksheets.GetWorksheet(addr.WorksheetID)
+	if !exists {
+		return nil, formula
+	}
+	cell := worksheet.GetCell(addr.Row, addr.Column)
+	if cell == nil {
+		return nil, formula
+	}
+	return cell.Value, formula
+}
+
+// emitCellChanges emits the formula and value changes of a cell edited by
+// Set or Remove. value changes of formula cells are reported by Calculate.
+func (s *Spreadsheet) emitCellChanges(addr CellAddress, oldValue Primitive, oldFormula string) {
+	newValue, newFormula := s.cellState(addr)
+	address := s.formatCellAddress(addr)
+
+	if oldFormula != newFormula {
+		s.emit(Event{
+			Type:       EventCellFormulaChanged,
+			Address:    address,
+			OldFormula: oldFormula,
+			NewFormula: newFormula,
+			cell:       addr,
+		})
+	}
+	if newFormula == "" && !valuesEqual(oldValue, newValue) {
+		s.emit(Event{
+			Type:     EventCellValueChanged,
+			Address:  address,
+			OldValue: oldValue,
+			NewValue: newValue,
+			cell:     addr,
+		})
+	}
+}
+
+// setFormulaResult stores a formula result and, while a calculation is
+// tracking changes, remembers the value the cell had before its first change
+func (s *Spreadsheet) setFormulaResult(worksheet *Worksheet, addr CellAddress, result Primitive) {
+	previous, changed := worksheet.SetFormulaResult(addr.Row, addr.Column, result)
+	if changed {
+		s.recordChange(addr, previous)
+	}
+}
+
+// recordChange remembers the value a cell had before its first change by
+// the running calculation, if changes are being tracked
+func (s *Spreadsheet) recordChange(addr CellAddress, previous Primitive) {
+	if s.changes == nil {
+		return
+	}
+
+	s.changesMu.Lock()
+	if _, seen := s.changes[addr]; !seen {
+		s.changes[addr] = previous
+	}
+	s.changesMu.Unlock()
+}
+
+// emitCalculationChanges emits one value change per cell whose value differs
+// from before the calculation and stops tracking changes
+func (s *Spreadsheet) emitCalculationChanges() {
+	changes := s.changes
+	s.changes = nil
+
+	cells := make([]CellAddress, 0, len(changes))
+	for addr := range changes {
+		cells = append(cells, addr)
+	}
+	sortCellAddresses(cells)
+
+	for _, addr := range cells {
+		newValue, _ := s.cellState(addr)
+		if valuesEqual(changes[addr], newValue) {
+			continue // changed back during the calculation
+		}
+		s.emit(Event{
+			Type:     EventCellValueChanged,
+			Address:  s.formatCellAddress(addr),
+			OldValue: changes[addr],
+			NewValue: newValue,
+			cell:     addr,
+		})
+	}
+}
+
+// valuesEqual reports whether two values are the same for change
+// notifications. errors are equal when their codes are.
+func valuesEqual(a, b Primitive) bool {
+	return valueChange(a, b) == 0
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormulaStep is one evaluated sub-expression of a formula
+type FormulaStep struct {
+	Expression string    // sub-expression in A1 notation, e.g. "SUM(A1:A3)"
+	Value      Primitive // value of the sub-expression, a *CellRange for ranges
+	Depth      int       // nesting depth, 0 for the whole formula
+	Reference  string    // cell or range the sub-expression reads in A1 notation, empty otherwise
+}
+
+// FormulaExplanation describes how a formula cell gets its value, like the
+// Evaluate Formula dialog of Excel
+type FormulaExplanation struct {
+	Address   string        // cell in A1 notation, e.g. "Sheet1!B2"
+	Formula   string        // formula in A1 notation, with the leading '='
+	Value     Primitive     // value of the formula
+	Steps     []FormulaStep // sub-expressions in evaluation order, the last one is the whole formula
+	ErrorStep int           // index of the first step that produced an error, -1 if there's none
+	ErrorCell string        // precedent cell the error originated in, empty if it originated in this formula
+}
+
+// ExplainFormula evaluates the formula at address step by step, recording
+// the value of each sub-expression. precedents are read as they are, so
+// call Calculate first for up to date values. when the formula results in
+// an error, the explanation points at the first step producing it and the
+// precedent cell it came from.
+func (s *Spreadsheet) ExplainFormula(address string) (*FormulaExplanation, error) {
+	worksheetID, row, col, err := s.resolveAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if worksheetID == 0 || !s.storage.worksheets.IsWorksheetDefined(worksheetID) {
+		return nil, NewApplicationError(NotFound, fmt.Sprintf("Worksheet not found for %s", address))
+	}
+
+	addr := CellAddress{WorksheetID: worksheetID, Row: row, Column: col}
+	explanation, records, ok := s.explain(addr)
+	if !ok {
+		return nil, NewApplicationError(InvalidArgument, fmt.Sprintf("Cell %s does not contain a formula", address))
+	}
+
+	if explanation.ErrorStep >= 0 {
+		explanation.ErrorCell = s.errorOrigin(addr, records[explanation.ErrorStep], records)
+	}
+	return explanation, nil
+}
+
+// explainRecord is the internal record of a step, keeping what's needed to
+// follow an error to the cell it came from
+type explainRecord struct {
+	children []int         // indexes of the steps of the operands or arguments
+	cell     *CellAddress  // cell a reference reads
+	rng      *RangeAddress // range a range or named range reads
+}
+
+// recordingNode wraps an AST node to record its value when it's evaluated.
+// operands are wrapped as well, so every sub-expression is recorded exactly
+// once, in the order the formula evaluates it.
+type recordingNode struct {
+	ASTNode
+	step    FormulaStep
+	record  explainRecord
+	steps   *[]FormulaStep   // steps of the formula, shared by all its nodes
+	records *[]explainRecord // records of the steps, by index
+}
+
+func (n *recordingNode) Eval(ctx *EvalContext) (Primitive, error) {
+	start := len(*n.steps)
+	value, err := n.ASTNode.Eval(ctx)
+
+	step := n.step
+	step.Value = value
+	if err != nil {
+		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
+			step.Value = spreadsheetErr
+		} else {
+			step.Value = NewSpreadsheetError(ErrorCodeValue, err.Error())
+		}
+	}
+
+	// the steps of the operands were recorded since this node started
+	record := n.record
+	for i := start; i < len(*n.steps); i++ {
+		if (*n.steps)[i].Depth == step.Depth+1 {
+			record.children = append(record.children, i)
+		}
+	}
+
+	*n.steps = append(*n.steps, step)
+	*n.records = append(*n.records, record)
+	return value, err
+}
+
+// explain evaluates the formula of a cell with every node recorded. the
+// boolean is false when the cell has no formula.
+func (s *Spreadsheet) explain(addr CellAddress) (*FormulaExplanation, []explainRecord, bool) {
+	formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(addr)
+	if !isFormula {
+		return nil, nil, false
+	}
+	ast, exists := s.storage.formulas.GetAST(formulaID)
+	if !exists {
+		return nil, nil, false
+	}
+
+	var steps []FormulaStep
+	var records []explainRecord
+	root := s.wrapForExplain(ast, addr, 0, &steps, &records)
+
+	explanation := &FormulaExplanation{
+		Address:   s.formatCellAddress(addr),
+		Formula:   "=" + s.formulaText(ast, addr),
+		Value:     s.evaluateFormula(root.Eval, addr),
+		ErrorStep: -1,
+	}
+	explanation.Steps = steps
+
+	for i, step := range steps {
+		if _, isErr := step.Value.(*SpreadsheetError); isErr {
+			explanation.ErrorStep = i
+			break
+		}
+	}
+	return explanation, records, true
+}
+
+// wrapForExplain wraps a node and its operands in recording nodes
+func (s *Spreadsheet) wrapForExplain(node ASTNode, origin CellAddress, depth int, steps *[]FormulaStep, records *[]explainRecord) ASTNode {
+	wrap := func(child ASTNode) ASTNode {
+		return s.wrapForExplain(child, origin, depth+1, steps, records)
+	}
+
+	wrapped := node
+	var record explainRecord
+	var reference string
+
+	switch n := node.(type) {
+	case *BinaryOpNode:
+		wrapped = &BinaryOpNode{Op: n.Op, Left: wrap(n.Left), Right: wrap(n.Right), Position: n.Position}
+
+	case *UnaryOpNode:
+		wrapped = &UnaryOpNode{Op: n.Op, Operand: wrap(n.Operand), Position: n.Position}
+
+	case *FunctionCallNode:
+		args := make([]ASTNode, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = wrap(arg)
+		}
+		wrapped = &FunctionCallNode{Name: n.Name, Args: args, Local: n.Local, Position: n.Position}
+
+	case *CellRefNode:
+		if cell, ok := cellRefAddress(n, origin); ok {
+			record.cell = &cell
+			reference = s.formatCellAddress(cell)
+		}
+
+	case *RangeNode:
+		if rangeAddr, ok := n.bounds(origin); ok {
+			record.rng = &rangeAddr
+			reference = s.formatRangeAddress(rangeAddr)
+		}
+
+	case *Range3DNode:
+		if area, ok := n.Area.bounds(origin); ok {
+			reference = s.formatWorksheetSpan(n.FirstWorksheetID, n.LastWorksheetID, area)
+		}
+
+	case *StructuredRefNode:
+		if rangeAddr, ok := s.structuredRefBounds(n, origin); ok {
+			record.rng = &rangeAddr
+			reference = s.formatRangeAddress(rangeAddr)
+		}
+
+	case *NamedRangeNode:
+		if nameID, exists := n.nameID(s.storage.namedRanges, origin.WorksheetID); exists {
+			if rangeAddr, defined := s.storage.namedRanges.GetRangeAddress(nameID); defined {
+				record.rng = &rangeAddr
+				reference = s.formatRangeAddress(rangeAddr)
+			}
+		}
+	}
+
+	return &recordingNode{
+		ASTNode: wrapped,
+		step: FormulaStep{
+			Expression: s.formulaText(node, origin),
+			Depth:      depth,
+			Reference:  reference,
+		},
+		record:  record,
+		steps:   steps,
+		records: records,
+	}
+}
+
+// errorOrigin follows an error from the step producing it to the precedent
+// cell it came from. errors read through a reference continue into the
+// referenced cell's formula, errors of a function continue into the first
+// cell of a range argument holding an error.
+func (s *Spreadsheet) errorOrigin(addr CellAddress, record explainRecord, records []explainRecord) string {
+	visited := map[CellAddress]bool{addr: true}
+	origin := ""
+
+	for {
+		next, ok := s.errorPrecedent(record, records)
+		if !ok || visited[next] {
+			return origin
+		}
+		visited[next] = true
+		origin = s.formatCellAddress(next)
+
+		explanation, nextRecords, isFormula := s.explain(next)
+		if !isFormula || explanation.ErrorStep < 0 {
+			return origin
+		}
+		record, records = nextRecords[explanation.ErrorStep], nextRecords
+	}
+}
+
+// errorPrecedent returns the precedent cell the error of a step was read
+// from, if any
+func (s *Spreadsheet) errorPrecedent(record explainRecord, records []explainRecord) (CellAddress, bool) {
+	if record.cell != nil {
+		return *record.cell, true
+	}
+
+	for _, child := range record.children {
+		if rangeAddr := records[child].rng; rangeAddr != nil {
+			if cell, found := s.firstErrorCell(*rangeAddr); found {
+				return cell, true
+			}
+		}
+	}
+	return CellAddress{}, false
+}
+
+// firstErrorCell returns the first cell of a range, row by row, holding an
+// error value
+func (s *Spreadsheet) firstErrorCell(rangeAddr RangeAddress) (CellAddress, bool) {
+	worksheet, exists := s.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
+	if !exists {
+		return CellAddress{}, false
+	}
+
+	var found CellAddress
+	var ok bool
+	worksheet.occupiedCells(rangeAddr.StartRow, rangeAddr.StartColumn, rangeAddr.EndRow, rangeAddr.EndColumn,
+		func(row, col uint32) bool {
+			if _, isErr := worksheet.GetValue(row, col).(*SpreadsheetError); isErr {
+				found = CellAddress{WorksheetID: rangeAddr.WorksheetID, Row: row, Column: col}
+				ok = true
+			}
+			return !ok
+		})
+	return found, ok
+}
+
+// cellRefAddress resolves a cell reference relative to the cell of its formula
+func cellRefAddress(n *CellRefNode, origin CellAddress) (CellAddress, bool) {
+	row := int32(origin.Row) + n.RowOffset
+	col := int32(origin.Column) + n.ColOffset
+	if row < 0 || col < 0 {
+		return CellAddress{}, false
+	}
+
+	worksheetID := n.WorksheetID
+	if worksheetID == 0 {
+		worksheetID = origin.WorksheetID
+	}
+	return CellAddress{WorksheetID: worksheetID, Row: uint32(row), Column: uint32(col)}, true
+}
+
+// operator precedence levels, from the loosest to the tightest binding
+const (
+	precedenceComparison = iota + 1
+	precedenceConcat
+	precedenceAdditive
+	precedenceMultiplicative
+	precedencePower
+	precedenceUnary
+	precedencePercent
+	precedencePrimary
+)
+
+// precedence returns how tightly a node binds its operands
+func precedence(node ASTNode) int {
+	switch n := node.(type) {
+	case *BinaryOpNode:
+		switch n.Op {
+		case BinOpConcat:
+			return precedenceConcat
+		case BinOpAdd, BinOpSubtract:
+			return precedenceAdditive
+		case BinOpMultiply, BinOpDivide, BinOpModulo:
+			return precedenceMultiplicative
+		case BinOpPower:
+			return precedencePower
+		}
+		return precedenceComparison
+	case *UnaryOpNode:
+		if n.Op == UnaryOpPercent {
+			return precedencePercent
+		}
+		return precedenceUnary
+	}
+	return precedencePrimary
+}
+
+// formulaText renders an AST in A1 notation, without the leading '=', as
+// written in the cell at origin. references to the worksheet of origin are
+// left unqualified and parentheses are only added where precedence needs
+// them.
+func (s *Spreadsheet) formulaText(node ASTNode, origin CellAddress) string {
+	// operand renders a child, wrapped in parentheses when it binds looser
+	// than its parent allows
+	operand := func(child ASTNode, minimum int) string {
+		text := s.formulaText(child, origin)
+		if precedence(child) < minimum {
+			return "(" + text + ")"
+		}
+		return text
+	}
+
+	switch n := node.(type) {
+	case *BinaryOpNode:
+		level := precedence(n)
+		// operators are left-associative except for power
+		leftMinimum, rightMinimum := level, level+1
+		if n.Op == BinOpPower {
+			leftMinimum, rightMinimum = level+1, level
+		}
+		return operand(n.Left, leftMinimum) + binaryOperatorText(n.Op) + operand(n.Right, rightMinimum)
+
+	case *UnaryOpNode:
+		switch n.Op {
+		case UnaryOpPercent:
+			return operand(n.Operand, precedencePrimary) + "%"
+		case UnaryOpMinus:
+			return "-" + operand(n.Operand, precedenceUnary)
+		}
+		return "+" + operand(n.Operand, precedenceUnary)
+
+	case *FunctionCallNode:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = s.formulaText(arg, origin)
+		}
+		return n.Name + "(" + strings.Join(args, ",") + ")"
+
+	case *CellRefNode:
+		cell, ok := cellRefAddress(n, origin)
+		if !ok {
+			return "#REF!"
+		}
+		return s.referenceText(s.formatCellAddress(cell), cell.WorksheetID, origin)
+
+	case *RangeNode:
+		rangeAddr, ok := n.bounds(origin)
+		if !ok {
+			return "#REF!"
+		}
+		return s.referenceText(s.formatRangeAddress(rangeAddr), rangeAddr.WorksheetID, origin)
+
+	case *Range3DNode:
+		area, ok := n.Area.bounds(origin)
+		if !ok {
+			return "#REF!"
+		}
+		return s.formatWorksheetSpan(n.FirstWorksheetID, n.LastWorksheetID, area)
+
+	case *StructuredRefNode:
+		return s.structuredRefText(n, origin)
+
+	case *NamedRangeNode:
+		if n.WorksheetID != 0 {
+			worksheetName, _ := s.storage.worksheets.GetWorksheetName(n.WorksheetID)
+			return worksheetName + "!" + n.Name
+		}
+	}
+
+	return node.ToString()
+}
+
+// referenceText drops the worksheet prefix of a formatted reference to the
+// worksheet of origin
+func (s *Spreadsheet) referenceText(formatted string, worksheetID uint32, origin CellAddress) string {
+	if worksheetID != origin.WorksheetID {
+		return formatted
+	}
+	return formatted[strings.Index(formatted, "!")+1:]
+}
+
+// binaryOperatorText returns the symbol of a binary operator
+func binaryOperatorText(op BinaryOp) string {
+	switch op {
+	case BinOpAdd:
+		return "+"
+	case BinOpSubtract:
+		return "-"
+	case BinOpMultiply:
+		return "*"
+	case BinOpDivide:
+		return "/"
+	case BinOpModulo:
+		return "%"
+	case BinOpPower:
+		return "^"
+	case BinOpConcat:
+		return "&"
+	case BinOpEqual:
+		return "="
+	case BinOpNotEqual:
+		return "<>"
+	case BinOpLess:
+		return "<"
+	case BinOpLessEqual:
+		return "<="
+	case BinOpGreater:
+		return ">"
+	case BinOpGreaterEqual:
+		return ">="
+	}
+	return "?"
+}
@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 // ASTKey represents a normalized AST used as a key for formula deduplication,
 // two formulas with the same structure (ignoring whitespace) will have the
 // same ASTKey. ASTKey represents a normalized AST for formula deduplication
@@ -11,9 +13,10 @@ type ASTKey string
 type FormulaTable struct {
 	// core formula storage
 
-	astIndex  map[ASTKey]uint32  // normalized AST -> formula ID
-	astCache  map[uint32]ASTNode // formula ID -> cached parsed AST
-	refCounts map[uint32]int     // formula ID -> reference count
+	astIndex  map[ASTKey]uint32          // normalized AST -> formula ID
+	astCache  map[uint32]ASTNode         // formula ID -> cached parsed AST
+	compiled  map[uint32]compiledFormula // formula ID -> AST compiled for evaluation
+	refCounts map[uint32]int             // formula ID -> reference count
 
 	// cell tracking
 
@@ -30,6 +33,20 @@ type FormulaTable struct {
 	namedRangesUsed         map[uint32]map[uint32]struct{} // formula ID -> named range IDs it uses
 	formulasUsingNamedRange map[uint32]map[uint32]struct{} // named range ID -> formula IDs using it
 
+	// function call tracking, for names called as functions before they are
+	// defined
+
+	functionsCalled         map[uint32]map[string]struct{} // formula ID -> upper case function names it calls
+	formulasCallingFunction map[string]map[uint32]struct{} // upper case function name -> formula IDs calling it
+
+	// 3D reference tracking
+
+	worksheetSpans map[uint32]struct{} // formula IDs referencing a span of worksheets
+
+	// table tracking
+
+	structuredRefs map[uint32]struct{} // formula IDs holding a structured reference
+
 	nextID uint32
 }
 
@@ -38,6 +55,7 @@ func NewFormulaTable() *FormulaTable {
 	return &FormulaTable{
 		astIndex:                make(map[ASTKey]uint32),
 		astCache:                make(map[uint32]ASTNode),
+		compiled:                make(map[uint32]compiledFormula),
 		refCounts:               make(map[uint32]int),
 		cellsUsingFormula:       make(map[uint32]map[CellAddress]struct{}),
 		formulaAtCell:           make(map[CellAddress]uint32),
@@ -45,6 +63,10 @@ func NewFormulaTable() *FormulaTable {
 		referencedWorksheets:    make(map[uint32]map[uint32]struct{}),
 		namedRangesUsed:         make(map[uint32]map[uint32]struct{}),
 		formulasUsingNamedRange: make(map[uint32]map[uint32]struct{}),
+		functionsCalled:         make(map[uint32]map[string]struct{}),
+		formulasCallingFunction: make(map[string]map[uint32]struct{}),
+		worksheetSpans:          make(map[uint32]struct{}),
+		structuredRefs:          make(map[uint32]struct{}),
 		nextID:                  1, // Start at 1, reserve 0 for no formula
 	}
 }
@@ -73,8 +95,15 @@ func (ft *FormulaTable) InternFormula(ast ASTNode, cell CellAddress) uint32 {
 	id := ft.nextID
 	ft.astIndex[key] = id
 	ft.astCache[id] = ast
+	ft.compiled[id] = compile(ast)
 	ft.refCounts[id] = 1
 	ft.trackCellUsage(id, cell)
+	if containsNode(ast, isRange3D) {
+		ft.worksheetSpans[id] = struct{}{}
+	}
+	if containsNode(ast, isStructuredRef) {
+		ft.structuredRefs[id] = struct{}{}
+	}
 	ft.nextID++
 
 	return id
@@ -109,6 +138,12 @@ func (ft *FormulaTable) GetAST(id uint32) (ASTNode, bool) {
 	return ast, exists
 }
 
+// GetCompiled retrieves the compiled form of a formula ID
+func (ft *FormulaTable) GetCompiled(id uint32) (compiledFormula, bool) {
+	compiled, exists := ft.compiled[id]
+	return compiled, exists
+}
+
 // GetFormulaID returns the ID for a normalized AST
 func (ft *FormulaTable) GetFormulaID(ast ASTNode) (uint32, bool) {
 	key := ft.normalizeAST(ast)
@@ -163,10 +198,13 @@ func (ft *FormulaTable) removeFormula(formulaID uint32) {
 
 	// remove from all maps
 	delete(ft.astCache, formulaID)
+	delete(ft.compiled, formulaID)
 	delete(ft.refCounts, formulaID)
 	delete(ft.cellsUsingFormula, formulaID)
 	delete(ft.owningWorksheets, formulaID)
 	delete(ft.referencedWorksheets, formulaID)
+	delete(ft.worksheetSpans, formulaID)
+	delete(ft.structuredRefs, formulaID)
 
 	// clean up named range tracking
 	if namedRanges, exists := ft.namedRangesUsed[formulaID]; exists {
@@ -180,6 +218,17 @@ func (ft *FormulaTable) removeFormula(formulaID uint32) {
 		}
 		delete(ft.namedRangesUsed, formulaID)
 	}
+
+	// clean up function call tracking
+	for name := range ft.functionsCalled[formulaID] {
+		if formulas, ok := ft.formulasCallingFunction[name]; ok {
+			delete(formulas, formulaID)
+			if len(formulas) == 0 {
+				delete(ft.formulasCallingFunction, name)
+			}
+		}
+	}
+	delete(ft.functionsCalled, formulaID)
 }
 
 // updateWorksheetOwnership updates worksheet ownership after removing a cell
@@ -292,6 +341,87 @@ func (ft *FormulaTable) GetFormulasUsingNamedRange(namedRangeID uint32) []uint32
 	return result
 }
 
+// TrackFunctionCall tracks that a formula calls a function that isn't
+// built in, whether or not a name defines it
+func (ft *FormulaTable) TrackFunctionCall(formulaID uint32, name string) {
+	name = strings.ToUpper(name)
+
+	// track formula -> function names
+	if ft.functionsCalled[formulaID] == nil {
+		ft.functionsCalled[formulaID] = make(map[string]struct{})
+	}
+	ft.functionsCalled[formulaID][name] = struct{}{}
+
+	// track function name -> formulas (reverse index)
+	if ft.formulasCallingFunction[name] == nil {
+		ft.formulasCallingFunction[name] = make(map[uint32]struct{})
+	}
+	ft.formulasCallingFunction[name][formulaID] = struct{}{}
+}
+
+// GetFormulasCallingFunction returns formula IDs that call a function,
+// matching its name ignoring case
+func (ft *FormulaTable) GetFormulasCallingFunction(name string) []uint32 {
+	formulas := ft.formulasCallingFunction[strings.ToUpper(name)]
+	result := make([]uint32, 0, len(formulas))
+	for id := range formulas {
+		result = append(result, id)
+	}
+	return result
+}
+
+// GetFormulasWithWorksheetSpans returns the IDs of formulas holding a 3D
+// reference
+func (ft *FormulaTable) GetFormulasWithWorksheetSpans() []uint32 {
+	result := make([]uint32, 0, len(ft.worksheetSpans))
+	for formulaID := range ft.worksheetSpans {
+		result = append(result, formulaID)
+	}
+	return result
+}
+
+// GetFormulasWithStructuredRefs returns the IDs of formulas holding a
+// structured reference to a table
+func (ft *FormulaTable) GetFormulasWithStructuredRefs() []uint32 {
+	result := make([]uint32, 0, len(ft.structuredRefs))
+	for formulaID := range ft.structuredRefs {
+		result = append(result, formulaID)
+	}
+	return result
+}
+
+// containsNode reports whether the AST holds a node matching match
+func containsNode(node ASTNode, match func(ASTNode) bool) bool {
+	if match(node) {
+		return true
+	}
+	switch n := node.(type) {
+	case *BinaryOpNode:
+		return containsNode(n.Left, match) || containsNode(n.Right, match)
+	case *UnaryOpNode:
+		return containsNode(n.Operand, match)
+	case *FunctionCallNode:
+		for _, arg := range n.Args {
+			if containsNode(arg, match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRange3D reports whether a node is a 3D reference
+func isRange3D(node ASTNode) bool {
+	_, is := node.(*Range3DNode)
+	return is
+}
+
+// isStructuredRef reports whether a node is a structured reference
+func isStructuredRef(node ASTNode) bool {
+	_, is := node.(*StructuredRefNode)
+	return is
+}
+
 // GetCellsUsingFormula returns all cells using a specific formula
 func (ft *FormulaTable) GetCellsUsingFormula(formulaID uint32) []CellAddress {
 	cells := ft.cellsUsingFormula[formulaID]
@@ -326,6 +456,7 @@ func (ft *FormulaTable) TotalReferences() int {
 func (ft *FormulaTable) Clear() {
 	ft.astIndex = make(map[ASTKey]uint32)
 	ft.astCache = make(map[uint32]ASTNode)
+	ft.compiled = make(map[uint32]compiledFormula)
 	ft.refCounts = make(map[uint32]int)
 	ft.cellsUsingFormula = make(map[uint32]map[CellAddress]struct{})
 	ft.formulaAtCell = make(map[CellAddress]uint32)
@@ -333,5 +464,9 @@ func (ft *FormulaTable) Clear() {
 	ft.referencedWorksheets = make(map[uint32]map[uint32]struct{})
 	ft.namedRangesUsed = make(map[uint32]map[uint32]struct{})
 	ft.formulasUsingNamedRange = make(map[uint32]map[uint32]struct{})
+	ft.functionsCalled = make(map[uint32]map[string]struct{})
+	ft.formulasCallingFunction = make(map[string]map[uint32]struct{})
+	ft.worksheetSpans = make(map[uint32]struct{})
+	ft.structuredRefs = make(map[uint32]struct{})
 	ft.nextID = 1
 }
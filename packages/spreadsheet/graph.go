@@ -1,5 +1,7 @@
 package main
 
+import "sort"
+
 // DependencyNode represents a cell in the dependency graph
 type DependencyNode struct {
 	// address of *THIS* node
@@ -27,6 +29,7 @@ type DependencyNode struct {
 type DependencyGraph struct {
 	nodes          map[CellAddress]*DependencyNode           // all nodes in the graph
 	rangeObservers map[RangeAddress]map[CellAddress]struct{} // range -> cells that depend on it
+	rangeIndex     *RangeIndex                               // spatial index over observed ranges
 	dirtySet       map[CellAddress]struct{}                  // cells needing recalculation
 	volatileCells  map[CellAddress]struct{}                  // cells with volatile functions (always recalculate)
 }
@@ -36,6 +39,7 @@ func NewDependencyGraph() *DependencyGraph {
 	return &DependencyGraph{
 		nodes:          make(map[CellAddress]*DependencyNode),
 		rangeObservers: make(map[RangeAddress]map[CellAddress]struct{}),
+		rangeIndex:     NewRangeIndex(),
 		dirtySet:       make(map[CellAddress]struct{}),
 		volatileCells:  make(map[CellAddress]struct{}),
 	}
@@ -92,6 +96,7 @@ func (dg *DependencyGraph) RemoveNode(addr CellAddress) bool {
 			delete(observers, addr)
 			if len(observers) == 0 {
 				delete(dg.rangeObservers, rangeAddr)
+				dg.rangeIndex.Delete(rangeAddr)
 			}
 		}
 	}
@@ -168,6 +173,7 @@ func (dg *DependencyGraph) AddRangeDependency(from CellAddress, rangeAddr RangeA
 	// add node to range observers
 	if dg.rangeObservers[rangeAddr] == nil {
 		dg.rangeObservers[rangeAddr] = make(map[CellAddress]struct{})
+		dg.rangeIndex.Insert(rangeAddr)
 	}
 	dg.rangeObservers[rangeAddr][from] = struct{}{}
 }
@@ -187,6 +193,7 @@ func (dg *DependencyGraph) RemoveRangeDependency(from CellAddress, rangeAddr Ran
 		delete(observers, from)
 		if len(observers) == 0 {
 			delete(dg.rangeObservers, rangeAddr)
+			dg.rangeIndex.Delete(rangeAddr)
 		}
 	}
 
@@ -235,15 +242,94 @@ func (dg *DependencyGraph) MarkRangeDirty(rangeAddr RangeAddress) {
 
 // MarkCellIfInRangeDirty marks cells dirty if the given cell is within any observed range
 func (dg *DependencyGraph) MarkCellIfInRangeDirty(addr CellAddress) {
-	// check all observed ranges to see if this cell is within them
-	for rangeAddr, observers := range dg.rangeObservers {
-		if dg.IsInRange(addr, rangeAddr) {
-			// mark all observers of this range as dirty
-			for observerAddr := range observers {
-				dg.MarkDirty(observerAddr)
+	// mark all observers of ranges containing this cell as dirty
+	for _, observerAddr := range dg.GetRangeDependents(addr) {
+		dg.MarkDirty(observerAddr)
+	}
+}
+
+// GetRangeDependents returns cells that depend on a range containing the
+// given cell
+func (dg *DependencyGraph) GetRangeDependents(addr CellAddress) []CellAddress {
+	var result []CellAddress
+	dg.rangeIndex.Containing(addr, func(rangeAddr RangeAddress) {
+		for observerAddr := range dg.rangeObservers[rangeAddr] {
+			result = append(result, observerAddr)
+		}
+	})
+	return result
+}
+
+// GetObservedRangesContaining returns the observed ranges that contain the
+// given cell
+func (dg *DependencyGraph) GetObservedRangesContaining(addr CellAddress) []RangeAddress {
+	var result []RangeAddress
+	dg.rangeIndex.Containing(addr, func(rangeAddr RangeAddress) {
+		result = append(result, rangeAddr)
+	})
+	return result
+}
+
+// GetRangeDependentsInRange returns cells that depend on a range overlapping
+// the given rectangle. bulk edits use it to find everything reading the
+// edited block with a single query instead of one query per cell.
+func (dg *DependencyGraph) GetRangeDependentsInRange(r RangeAddress) []CellAddress {
+	seen := make(map[CellAddress]struct{})
+	var result []CellAddress
+	dg.rangeIndex.Intersecting(r, func(rangeAddr RangeAddress) {
+		for observerAddr := range dg.rangeObservers[rangeAddr] {
+			if _, exists := seen[observerAddr]; !exists {
+				seen[observerAddr] = struct{}{}
+				result = append(result, observerAddr)
+			}
+		}
+	})
+	return result
+}
+
+// GetCellDependentsInRange returns cells that reference a cell of the
+// rectangle directly. it walks whichever is smaller, the rectangle or the
+// graph's nodes.
+func (dg *DependencyGraph) GetCellDependentsInRange(r RangeAddress) []CellAddress {
+	seen := make(map[CellAddress]struct{})
+	var result []CellAddress
+	collect := func(node *DependencyNode) {
+		for dependentAddr := range node.CellDependents {
+			if _, exists := seen[dependentAddr]; !exists {
+				seen[dependentAddr] = struct{}{}
+				result = append(result, dependentAddr)
 			}
 		}
 	}
+
+	cells := (uint64(r.EndRow) - uint64(r.StartRow) + 1) * (uint64(r.EndColumn) - uint64(r.StartColumn) + 1)
+	if cells > uint64(len(dg.nodes)) {
+		for addr, node := range dg.nodes {
+			if r.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+				collect(node)
+			}
+		}
+		return result
+	}
+
+	for row := r.StartRow; row <= r.EndRow; row++ {
+		for col := r.StartColumn; col <= r.EndColumn; col++ {
+			if node, exists := dg.nodes[CellAddress{WorksheetID: r.WorksheetID, Row: row, Column: col}]; exists {
+				collect(node)
+			}
+		}
+	}
+	return result
+}
+
+// MarkRangeIntersectionsDirty marks cells dirty if they observe any range
+// overlapping the given rectangle
+func (dg *DependencyGraph) MarkRangeIntersectionsDirty(r RangeAddress) {
+	dg.rangeIndex.Intersecting(r, func(rangeAddr RangeAddress) {
+		for observerAddr := range dg.rangeObservers[rangeAddr] {
+			dg.MarkDirty(observerAddr)
+		}
+	})
 }
 
 // IsInRange checks if a cell is within a range
@@ -253,6 +339,56 @@ func (dg *DependencyGraph) IsInRange(cell CellAddress, r RangeAddress) bool {
 		cell.Column >= r.StartColumn && cell.Column <= r.EndColumn
 }
 
+// IsDirty checks if a cell needs recalculation
+func (dg *DependencyGraph) IsDirty(addr CellAddress) bool {
+	_, isDirty := dg.dirtySet[addr]
+	return isDirty
+}
+
+// GetDirtyCellsInRange returns the dirty cells within a range, sorted by
+// row then column. it walks whichever is smaller, the range or the dirty
+// set, so huge ranges are never materialized.
+func (dg *DependencyGraph) GetDirtyCellsInRange(r RangeAddress) []CellAddress {
+	var cells []CellAddress
+	area := (uint64(r.EndRow) - uint64(r.StartRow) + 1) * (uint64(r.EndColumn) - uint64(r.StartColumn) + 1)
+	if area <= uint64(len(dg.dirtySet)) {
+		for row := r.StartRow; row <= r.EndRow; row++ {
+			for col := r.StartColumn; col <= r.EndColumn; col++ {
+				addr := CellAddress{WorksheetID: r.WorksheetID, Row: row, Column: col}
+				if _, isDirty := dg.dirtySet[addr]; isDirty {
+					cells = append(cells, addr)
+				}
+			}
+		}
+		return cells
+	}
+
+	for addr := range dg.dirtySet {
+		if dg.IsInRange(addr, r) {
+			cells = append(cells, addr)
+		}
+	}
+	sortCellAddresses(cells)
+	return cells
+}
+
+// cellsInRange returns the cells of a sorted slice that lie within a range.
+// cells are sorted by worksheet then row, so the cells of the range are
+// between its first and last row.
+func cellsInRange(sorted []CellAddress, r RangeAddress) []CellAddress {
+	var cells []CellAddress
+	first := sort.Search(len(sorted), func(i int) bool {
+		c := sorted[i]
+		return c.WorksheetID > r.WorksheetID || (c.WorksheetID == r.WorksheetID && c.Row >= r.StartRow)
+	})
+	for i := first; i < len(sorted) && sorted[i].WorksheetID == r.WorksheetID && sorted[i].Row <= r.EndRow; i++ {
+		if sorted[i].Column >= r.StartColumn && sorted[i].Column <= r.EndColumn {
+			cells = append(cells, sorted[i])
+		}
+	}
+	return cells
+}
+
 // ClearDirty clears the dirty flag for a cell
 func (dg *DependencyGraph) ClearDirty(addr CellAddress) {
 	delete(dg.dirtySet, addr)
@@ -262,13 +398,15 @@ func (dg *DependencyGraph) ClearDirty(addr CellAddress) {
 	}
 }
 
-// ClearAllDirty clears all dirty flags
+// ClearAllDirty clears all dirty flags. only nodes in the dirty set are
+// flagged, so the other nodes are left alone.
 func (dg *DependencyGraph) ClearAllDirty() {
-	dg.dirtySet = make(map[CellAddress]struct{})
-
-	for _, node := range dg.nodes {
-		node.IsDirty = false
+	for addr := range dg.dirtySet {
+		if node, exists := dg.nodes[addr]; exists {
+			node.IsDirty = false
+		}
 	}
+	dg.dirtySet = make(map[CellAddress]struct{})
 }
 
 // GetDirectDependents returns cells directly depending on this cell
@@ -285,33 +423,36 @@ func (dg *DependencyGraph) GetDirectDependents(addr CellAddress) []CellAddress {
 	return result
 }
 
-// GetAllDependents returns all cells affected by this cell (transitive closure)
+// GetAllDependents returns all cells affected by this cell (transitive
+// closure), including cells depending on a range that contains an affected
+// cell
 func (dg *DependencyGraph) GetAllDependents(addr CellAddress) []CellAddress {
-	visited := make(map[CellAddress]struct{})
+	visited := map[CellAddress]struct{}{addr: {}}
 	var result []CellAddress
 
-	dg.collectDependents(addr, visited, &result)
-	return result
-}
-
-// collectDependents recursively collects all dependents
-func (dg *DependencyGraph) collectDependents(addr CellAddress, visited map[CellAddress]struct{}, result *[]CellAddress) {
-	if _, alreadyVisited := visited[addr]; alreadyVisited {
-		return
-	}
-	visited[addr] = struct{}{}
-
-	node, exists := dg.nodes[addr]
-	if !exists {
-		return
-	}
-
-	for dependentAddr := range node.CellDependents {
-		if _, alreadyVisited := visited[dependentAddr]; !alreadyVisited {
-			*result = append(*result, dependentAddr)
-			dg.collectDependents(dependentAddr, visited, result)
+	// walk with an explicit stack so long chains don't exhaust the goroutine
+	// stack
+	stack := []CellAddress{addr}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, dependentAddr := range dg.GetDirectDependents(current) {
+			if _, alreadyVisited := visited[dependentAddr]; !alreadyVisited {
+				visited[dependentAddr] = struct{}{}
+				result = append(result, dependentAddr)
+				stack = append(stack, dependentAddr)
+			}
+		}
+		for _, observerAddr := range dg.GetRangeDependents(current) {
+			if _, alreadyVisited := visited[observerAddr]; !alreadyVisited {
+				visited[observerAddr] = struct{}{}
+				result = append(result, observerAddr)
+				stack = append(stack, observerAddr)
+			}
 		}
 	}
+	return result
 }
 
 // GetDirectPrecedents returns cells this cell directly depends on
@@ -342,55 +483,80 @@ func (dg *DependencyGraph) GetRangePrecedents(addr CellAddress) []RangeAddress {
 	return result
 }
 
+// GetCalculationOrder returns the cells of the graph ordered so that every
+// cell comes after its precedents, including the cells inside the ranges it
+// depends on. the boolean reports whether a cycle was found, in which case
+// the order is only a best effort. the graph is walked with an explicit
+// stack, so very deep chains are fine.
 func (dg *DependencyGraph) GetCalculationOrder() ([]CellAddress, bool) {
+	// sorted node addresses, used to find the nodes inside a range
+	nodes := make([]CellAddress, 0, len(dg.nodes))
+	for addr := range dg.nodes {
+		nodes = append(nodes, addr)
+	}
+	sortCellAddresses(nodes)
+
 	// three states: unvisited (not in map), visiting (false), visited (true)
 	state := make(map[CellAddress]bool)
-	var order []CellAddress
+	order := make([]CellAddress, 0, len(nodes))
 	hasCycle := false
 
-	var visit func(addr CellAddress) bool
-	visit = func(addr CellAddress) bool {
-		if completed, exists := state[addr]; exists {
-			if !completed {
-				// currently visiting - cycle detected
-				return true
-			}
-			// already visited
-			return false
+	type frame struct {
+		addr       CellAddress
+		precedents []CellAddress
+		next       int
+	}
+
+	for _, root := range nodes {
+		if _, visited := state[root]; visited {
+			continue
 		}
 
-		// mark as visiting
-		state[addr] = false
+		state[root] = false
+		stack := []frame{{addr: root, precedents: dg.calculationPrecedents(root, nodes)}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.next == len(top.precedents) {
+				// all precedents visited
+				state[top.addr] = true
+				order = append(order, top.addr)
+				stack = stack[:len(stack)-1]
+				continue
+			}
 
-		node, exists := dg.nodes[addr]
-		if exists {
-			// visit all precedents first
-			for precedentAddr := range node.CellPrecedents {
-				if visit(precedentAddr) {
+			precedent := top.precedents[top.next]
+			top.next++
+			if completed, exists := state[precedent]; exists {
+				if !completed {
+					// currently visiting - cycle detected
 					hasCycle = true
 				}
+				continue
 			}
-		}
-
-		// mark as visited
-		state[addr] = true
-		order = append(order, addr)
 
-		return false
-	}
-
-	// visit all nodes
-	for addr := range dg.nodes {
-		if _, visited := state[addr]; !visited {
-			if visit(addr) {
-				hasCycle = true
-			}
+			state[precedent] = false
+			stack = append(stack, frame{addr: precedent, precedents: dg.calculationPrecedents(precedent, nodes)})
 		}
 	}
 
 	return order, hasCycle
 }
 
+// calculationPrecedents returns the direct precedents of a cell followed by
+// the nodes inside its range precedents, in deterministic order. nodes must
+// be the sorted addresses of all nodes in the graph.
+func (dg *DependencyGraph) calculationPrecedents(addr CellAddress, nodes []CellAddress) []CellAddress {
+	precedents := dg.GetDirectPrecedents(addr)
+	sortCellAddresses(precedents)
+
+	ranges := dg.GetRangePrecedents(addr)
+	sortRangeAddresses(ranges)
+	for _, r := range ranges {
+		precedents = append(precedents, cellsInRange(nodes, r)...)
+	}
+	return precedents
+}
+
 // HasCycle checks if there are circular dependencies
 func (dg *DependencyGraph) HasCycle() bool {
 	_, hasCycle := dg.GetCalculationOrder()
@@ -401,33 +567,7 @@ func (dg *DependencyGraph) HasCycle() bool {
 // cell changes. this includes direct and transitive dependents, plus cells
 // observing ranges
 func (dg *DependencyGraph) GetAffectedCells(addr CellAddress) []CellAddress {
-	affected := make(map[CellAddress]struct{})
-
-	// get all transitive dependents
-	dependents := dg.GetAllDependents(addr)
-	for _, dep := range dependents {
-		affected[dep] = struct{}{}
-	}
-
-	// check if this cell is in any observed ranges
-	for rangeAddr, observers := range dg.rangeObservers {
-		if dg.IsInRange(addr, rangeAddr) {
-			for observerAddr := range observers {
-				affected[observerAddr] = struct{}{}
-				// also get transitive dependents of the observer
-				observerDeps := dg.GetAllDependents(observerAddr)
-				for _, dep := range observerDeps {
-					affected[dep] = struct{}{}
-				}
-			}
-		}
-	}
-
-	result := make([]CellAddress, 0, len(affected))
-	for affectedAddr := range affected {
-		result = append(result, affectedAddr)
-	}
-	return result
+	return dg.GetAllDependents(addr)
 }
 
 // SetFormula sets the formula for a node (creates node if needed)
@@ -473,6 +613,7 @@ func (dg *DependencyGraph) RangeObserverCount() int {
 func (dg *DependencyGraph) Clear() {
 	dg.nodes = make(map[CellAddress]*DependencyNode)
 	dg.rangeObservers = make(map[RangeAddress]map[CellAddress]struct{})
+	dg.rangeIndex.Clear()
 	dg.dirtySet = make(map[CellAddress]struct{})
 	dg.volatileCells = make(map[CellAddress]struct{})
 }
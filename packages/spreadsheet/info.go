@@ -0,0 +1,433 @@
+package main
+
+// information functions test the type of a value, and error-handling
+// functions trap errors. tests of a single value apply to ranges and arrays
+// element by element, returning arrays.
+
+// errorTypeNumbers maps error codes to the numbers ERROR.TYPE returns for
+// them, as in Excel. #ERROR! and #CIRCULAR! aren't Excel errors, they get
+// the numbers after Excel's last, 14 for #CALC!, since Excel uses 8 and 10
+// to 13 for its #GETTING_DATA, #CONNECT!, #BLOCKED!, #UNKNOWN! and #FIELD!.
+var errorTypeNumbers = map[ErrorCode]float64{
+	ErrorCodeNull:     1,
+	ErrorCodeDiv0:     2,
+	ErrorCodeValue:    3,
+	ErrorCodeRef:      4,
+	ErrorCodeName:     5,
+	ErrorCodeNum:      6,
+	ErrorCodeNA:       7,
+	ErrorCodeSpill:    9,
+	ErrorCodeCalc:     14,
+	ErrorCodeOther:    15,
+	ErrorCodeCircular: 16,
+}
+
+// mapValues applies a test of a single value to the argument of an
+// information function, element by element when it is a range or an array
+func mapValues(name string, args []any, test func(value Primitive) Primitive) (Primitive, error) {
+	if len(args) != 1 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, name+" requires exactly 1 argument")
+	}
+	if !isArrayOperand(args[0]) {
+		return test(args[0]), nil
+	}
+	array, ok := toArray(args[0])
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, name+" doesn't accept 3D references")
+	}
+	result := NewArrayValue(array.rows, array.cols)
+	for row := range array.rows {
+		for col := range array.cols {
+			result.Set(row, col, test(array.At(row, col)))
+		}
+	}
+	return result, nil
+}
+
+// ISBLANK(value) checks whether value is an empty cell
+func (bf *BuiltInFunctions) ISBLANK(args ...any) (Primitive, error) {
+	return mapValues("ISBLANK", args, func(value Primitive) Primitive {
+		return value == nil
+	})
+}
+
+// ISERR(value) checks whether value is an error other than #N/A
+func (bf *BuiltInFunctions) ISERR(args ...any) (Primitive, error) {
+	return mapValues("ISERR", args, func(value Primitive) Primitive {
+		err := checkForError(value)
+		return err != nil && err.ErrorCode != ErrorCodeNA
+	})
+}
+
+// ISERROR(value) checks whether value is any error
+func (bf *BuiltInFunctions) ISERROR(args ...any) (Primitive, error) {
+	return mapValues("ISERROR", args, func(value Primitive) Primitive {
+		return checkForError(value) != nil
+	})
+}
+
+// ISNA(value) checks whether value is the #N/A error
+func (bf *BuiltInFunctions) ISNA(args ...any) (Primitive, error) {
+	return mapValues("ISNA", args, func(value Primitive) Primitive {
+		err := checkForError(value)
+		return err != nil && err.ErrorCode == ErrorCodeNA
+	})
+}
+
+// ISNUMBER(value) checks whether value is a number. text that looks like a
+// number is not a number.
+func (bf *BuiltInFunctions) ISNUMBER(args ...any) (Primitive, error) {
+	return mapValues("ISNUMBER", args, func(value Primitive) Primitive {
+		return primitiveType(value) == CellValueTypeNumber
+	})
+}
+
+// ISTEXT(value) checks whether value is text
+func (bf *BuiltInFunctions) ISTEXT(args ...any) (Primitive, error) {
+	return mapValues("ISTEXT", args, func(value Primitive) Primitive {
+		return primitiveType(value) == CellValueTypeString
+	})
+}
+
+// ISLOGICAL(value) checks whether value is TRUE or FALSE
+func (bf *BuiltInFunctions) ISLOGICAL(args ...any) (Primitive, error) {
+	return mapValues("ISLOGICAL", args, func(value Primitive) Primitive {
+		return primitiveType(value) == CellValueTypeBoolean
+	})
+}
+
+// ERROR_TYPE implements ERROR.TYPE(value), the number of the error value
+// is, or #N/A when it isn't an error
+func (bf *BuiltInFunctions) ERROR_TYPE(args ...any) (Primitive, error) {
+	return mapValues("ERROR.TYPE", args, func(value Primitive) Primitive {
+		if err := checkForError(value); err != nil {
+			if number, exists := errorTypeNumbers[err.ErrorCode]; exists {
+				return number
+			}
+		}
+		return NewSpreadsheetError(ErrorCodeNA, "ERROR.TYPE requires an error")
+	})
+}
+
+// TYPE(value) returns the type of value: 1 for numbers and empty cells, 2
+// for text, 4 for logical values, 16 for errors, 64 for ranges and arrays
+// and 128 for LAMBDAs
+func (bf *BuiltInFunctions) TYPE(args ...any) (Primitive, error) {
+	if len(args) != 1 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "TYPE requires exactly 1 argument")
+	}
+	if _, isLambda := args[0].(*LambdaValue); isLambda {
+		return 128.0, nil
+	}
+	if isArrayOperand(args[0]) {
+		return 64.0, nil
+	}
+	switch primitiveType(args[0]) {
+	case CellValueTypeString:
+		return 2.0, nil
+	case CellValueTypeBoolean:
+		return 4.0, nil
+	case CellValueTypeError:
+		return 16.0, nil
+	}
+	return 1.0, nil
+}
+
+// N(value) converts value to a number: numbers are kept, TRUE is 1, errors
+// are passed on and anything else is 0. a range gives its first value.
+func (bf *BuiltInFunctions) N(args ...any) (Primitive, error) {
+	if len(args) != 1 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "N requires exactly 1 argument")
+	}
+	value := args[0]
+	if isArrayOperand(value) {
+		array, ok := toArray(value)
+		if !ok {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "N doesn't accept 3D references")
+		}
+		value = array.At(0, 0)
+	}
+	if err := checkForError(value); err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case float64, int, int64, bool:
+		number, _ := toNumber(value)
+		return number, nil
+	}
+	return 0.0, nil
+}
+
+// NA() returns the #N/A error, marking a value as not available
+func (bf *BuiltInFunctions) NA(args ...any) (Primitive, error) {
+	if len(args) != 0 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "NA takes no arguments")
+	}
+	return nil, NewSpreadsheetError(ErrorCodeNA, "")
+}
+
+// lazyFunction builds the evaluation of a function given its unevaluated
+// arguments, so it evaluates only the arguments it needs
+type lazyFunction func(n *FunctionCallNode, args []compiledFormula) compiledFormula
+
+// lazyFunctions are the built-in functions evaluated as special forms.
+// IF, IFERROR and IFNA skip the branch they don't return, ISREF and
+// ISFORMULA look at their argument as a reference rather than at its value.
+var lazyFunctions = map[string]lazyFunction{
+	"IF":        lazyIF,
+	"IFERROR":   lazyIfError(func(*SpreadsheetError) bool { return true }),
+	"IFNA":      lazyIfError(func(err *SpreadsheetError) bool { return err.ErrorCode == ErrorCodeNA }),
+	"ISREF":     lazyISREF,
+	"ISFORMULA": lazyISFORMULA,
+}
+
+// failing returns the evaluation of a call with the wrong arguments
+func failing(code ErrorCode, message string) compiledFormula {
+	return func(*EvalContext) (Primitive, error) {
+		return nil, NewSpreadsheetError(code, message)
+	}
+}
+
+// evalArgument evaluates an argument of a lazy function, passing on its
+// errors
+func evalArgument(ctx *EvalContext, arg compiledFormula) (Primitive, error) {
+	value, err := arg(ctx)
+	if err != nil {
+		return nil, toErrorValue(err)
+	}
+	return value, nil
+}
+
+// lazyIF builds IF(condition, then, [else]), evaluating only the branch the
+// condition selects. a range or array condition selects element by element,
+// see arrayIF.
+func lazyIF(n *FunctionCallNode, args []compiledFormula) compiledFormula {
+	if len(args) < 2 || len(args) > 3 {
+		return failing(ErrorCodeNA, "IF requires 2 or 3 arguments")
+	}
+	return func(ctx *EvalContext) (Primitive, error) {
+		condition, err := evalArgument(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkForError(condition); err != nil {
+			return nil, err
+		}
+		if isArrayOperand(condition) {
+			return arrayIF(ctx, condition, args[1:])
+		}
+		if isTruthy(condition) {
+			return evalArgument(ctx, args[1])
+		}
+		if len(args) == 3 {
+			return evalArgument(ctx, args[2])
+		}
+		return false, nil
+	}
+}
+
+// arrayIF evaluates IF with a range or array condition into an array with
+// the value of the selected branch for each element of the condition, as in
+// Excel. each branch is evaluated once, when an element selects it, and a
+// branch giving an array is broadcast against the condition like the
+// operands of an operator. errors in the condition stay in their elements.
+func arrayIF(ctx *EvalContext, conditionVal Primitive, branches []compiledFormula) (Primitive, error) {
+	condition, ok := toArray(conditionVal)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "IF can't test a 3D reference")
+	}
+
+	// the then branch, the else branch and the FALSE of a missing else
+	values := []Primitive{nil, nil, false}
+	evaluated := []bool{false, false, true}
+	selected := func(elem Primitive) int {
+		switch {
+		case isTruthy(elem):
+			return 0
+		case len(branches) == 2:
+			return 1
+		}
+		return 2
+	}
+	rows, cols := condition.rows, condition.cols
+	for _, elem := range condition.values {
+		if checkForError(elem) != nil {
+			continue
+		}
+		branch := selected(elem)
+		if evaluated[branch] {
+			continue
+		}
+		value, err := branches[branch](ctx)
+		if err != nil {
+			value = toErrorValue(err)
+		}
+		if isArrayOperand(value) {
+			array, ok := toArray(value)
+			if !ok {
+				return nil, NewSpreadsheetError(ErrorCodeValue, "IF can't return a 3D reference")
+			}
+			rows, cols = max(rows, array.rows), max(cols, array.cols)
+			value = array
+		}
+		values[branch], evaluated[branch] = value, true
+	}
+	if err := ctx.spreadsheet.limits.checkRangeCells(uint64(rows) * uint64(cols)); err != nil {
+		return nil, err
+	}
+
+	result := NewArrayValue(rows, cols)
+	for row := range rows {
+		for col := range cols {
+			elem, ok := condition.broadcastAt(row, col)
+			if !ok {
+				result.Set(row, col, NewSpreadsheetError(ErrorCodeNA, ""))
+				continue
+			}
+			if checkForError(elem) != nil {
+				result.Set(row, col, elem)
+				continue
+			}
+			value := values[selected(elem)]
+			if array, isArray := value.(*ArrayValue); isArray {
+				if value, ok = array.broadcastAt(row, col); !ok {
+					value = NewSpreadsheetError(ErrorCodeNA, "")
+				}
+			}
+			result.Set(row, col, value)
+		}
+	}
+	return result, nil
+}
+
+// lazyIfError builds IFERROR(value, fallback), or IFNA when trapped only
+// accepts #N/A. the fallback is evaluated only when value is a trapped
+// error, and replaces the trapped errors of ranges and arrays element by
+// element.
+func lazyIfError(trapped func(*SpreadsheetError) bool) lazyFunction {
+	return func(n *FunctionCallNode, args []compiledFormula) compiledFormula {
+		if len(args) != 2 {
+			return failing(ErrorCodeNA, n.Name+" requires exactly 2 arguments")
+		}
+		return func(ctx *EvalContext) (Primitive, error) {
+			value, err := args[0](ctx)
+			if err != nil {
+				value = toErrorValue(err)
+			}
+			if valueErr := checkForError(value); valueErr != nil {
+				if !trapped(valueErr) {
+					return nil, valueErr
+				}
+				return evalArgument(ctx, args[1])
+			}
+			array, ok := toArray(value)
+			if !ok {
+				return value, nil
+			}
+
+			var result *ArrayValue
+			var fallback Primitive
+			for row := range array.rows {
+				for col := range array.cols {
+					elementErr := checkForError(array.At(row, col))
+					if elementErr == nil || !trapped(elementErr) {
+						continue
+					}
+					if result == nil {
+						if fallback, err = evalArgument(ctx, args[1]); err != nil {
+							return nil, err
+						}
+						result = &ArrayValue{rows: array.rows, cols: array.cols, values: append([]Primitive(nil), array.values...)}
+					}
+					replacement := fallback
+					if fallbackArray, isArray := toArray(fallback); isArray {
+						if replacement, ok = fallbackArray.broadcastAt(row, col); !ok {
+							replacement = NewSpreadsheetError(ErrorCodeNA, "")
+						}
+					}
+					result.Set(row, col, replacement)
+				}
+			}
+			if result == nil {
+				return value, nil
+			}
+			return result, nil
+		}
+	}
+}
+
+// referenceArgument returns the node of an argument, unwrapped from the
+// recording of ExplainFormula
+func referenceArgument(node ASTNode) ASTNode {
+	if recording, ok := node.(*recordingNode); ok {
+		return recording.ASTNode
+	}
+	return node
+}
+
+// isReferenceNode reports whether a node is a reference to cells
+func isReferenceNode(node ASTNode) bool {
+	switch node.(type) {
+	case *CellRefNode, *RangeNode, *Range3DNode, *StructuredRefNode:
+		return true
+	}
+	return false
+}
+
+// lazyISREF builds ISREF(value), which checks whether value is a reference:
+// a cell or range reference, or a name or function giving a range
+func lazyISREF(n *FunctionCallNode, args []compiledFormula) compiledFormula {
+	if len(args) != 1 {
+		return failing(ErrorCodeNA, "ISREF requires exactly 1 argument")
+	}
+	if isReferenceNode(referenceArgument(n.Args[0])) {
+		return func(*EvalContext) (Primitive, error) { return true, nil }
+	}
+	return func(ctx *EvalContext) (Primitive, error) {
+		value, err := args[0](ctx)
+		if err != nil {
+			return false, nil
+		}
+		_, isArray := value.(*ArrayValue)
+		return isArrayOperand(value) && !isArray, nil
+	}
+}
+
+// lazyISFORMULA builds ISFORMULA(reference), which checks whether the cell
+// referenced, or the first cell of the range referenced, holds a formula
+func lazyISFORMULA(n *FunctionCallNode, args []compiledFormula) compiledFormula {
+	if len(args) != 1 {
+		return failing(ErrorCodeNA, "ISFORMULA requires exactly 1 argument")
+	}
+	reference := referenceArgument(n.Args[0])
+	return func(ctx *EvalContext) (Primitive, error) {
+		var cell CellAddress
+		switch ref := reference.(type) {
+		case *CellRefNode:
+			addr, ok := cellRefAddress(ref, ctx.GetCurrentAddress())
+			if !ok {
+				return nil, NewSpreadsheetError(ErrorCodeRef, "Invalid cell reference")
+			}
+			cell = addr
+		case *StructuredRefNode:
+			rangeAddr, ok := ctx.spreadsheet.structuredRefBounds(ref, ctx.GetCurrentAddress())
+			if !ok {
+				return nil, NewSpreadsheetError(ErrorCodeRef, "Invalid structured reference")
+			}
+			cell = CellAddress{WorksheetID: rangeAddr.WorksheetID, Row: rangeAddr.StartRow, Column: rangeAddr.StartColumn}
+		default:
+			value, err := evalArgument(ctx, args[0])
+			if err != nil {
+				return nil, err
+			}
+			cellRange, isRange := value.(*CellRange)
+			if !isRange {
+				return nil, NewSpreadsheetError(ErrorCodeValue, "ISFORMULA requires a reference")
+			}
+			bounds := cellRange.GetBounds()
+			cell = CellAddress{WorksheetID: bounds.WorksheetID, Row: bounds.StartRow, Column: bounds.StartColumn}
+		}
+		_, isFormula := ctx.spreadsheet.storage.formulas.GetFormulaAtCell(cell)
+		return isFormula, nil
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"math"
+)
+
+// IterationSettings configures iterative calculation. when enabled, circular
+// references are not reported as errors. instead the cells of each cycle
+// are evaluated repeatedly until their values settle.
+type IterationSettings struct {
+	Enabled       bool
+	MaxIterations int     // maximum number of passes over a cycle
+	MaxChange     float64 // a cycle converges once no value changes by more than this
+}
+
+// DefaultIterationSettings returns iterative calculation disabled, with the
+// same iteration defaults as Excel
+func DefaultIterationSettings() IterationSettings {
+	return IterationSettings{
+		Enabled:       false,
+		MaxIterations: 100,
+		MaxChange:     0.001,
+	}
+}
+
+// CycleStatus reports how a cycle of formula cells was resolved by iterative
+// calculation
+type CycleStatus struct {
+	Cells      []string // cells of the cycle in A1 notation, e.g. "Sheet1!B2"
+	Iterations int      // passes performed over the cycle
+	MaxChange  float64  // largest change of a value during the last pass
+	Converged  bool     // whether the last pass changed no value by more than the maximum
+}
+
+// SetIterativeCalculation sets how circular references are calculated.
+// values below 1 for MaxIterations are treated as 1. toggling the mode marks
+// every formula dirty, so the next calculation applies it.
+func (s *Spreadsheet) SetIterativeCalculation(settings IterationSettings) {
+	settings.MaxIterations = max(settings.MaxIterations, 1)
+	if settings.Enabled != s.iteration.Enabled {
+		for addr := range s.storage.formulas.formulaAtCell {
+			s.storage.dependencyGraph.MarkDirty(addr)
+		}
+	}
+	s.iteration = settings
+}
+
+// GetIterativeCalculation returns how circular references are calculated
+func (s *Spreadsheet) GetIterativeCalculation() IterationSettings {
+	return s.iteration
+}
+
+// GetCycleStatus returns the status of every cycle evaluated by the last
+// calculation, in evaluation order
+func (s *Spreadsheet) GetCycleStatus() []CycleStatus {
+	return s.cycleStatus
+}
+
+// calculateIterative evaluates the formula cells affected by the dirty set
+// one strongly connected component at a time, precedents first. components
+// without a cycle are evaluated once, cycles are evaluated until they
+// converge or run out of iterations.
+func (s *Spreadsheet) calculateIterative(ctx context.Context) error {
+	s.cycleStatus = nil
+
+	pending := s.pendingFormulaCells()
+	precedents := s.pendingPrecedents(pending)
+
+	cells := make([]CellAddress, 0, len(pending))
+	for addr := range pending {
+		cells = append(cells, addr)
+	}
+	sortCellAddresses(cells)
+
+	for _, component := range stronglyConnectedComponents(cells, precedents) {
+		if err := ctx.Err(); err != nil {
+			return newInterruptedError(err)
+		}
+
+		if len(component) > 1 || isSelfReferencing(component[0], precedents) {
+			status, err := s.iterateComponent(ctx, component)
+			if err != nil {
+				return err
+			}
+			s.cycleStatus = append(s.cycleStatus, status)
+		} else if result, deferred := s.evaluateLevelCell(component[0]); deferred {
+			s.storeDeferredResult(component[0], result)
+		}
+
+		for _, addr := range component {
+			s.storage.dependencyGraph.ClearDirty(addr)
+			s.calculationStack.markCompleted(addr)
+			s.reportProgress()
+		}
+	}
+	return nil
+}
+
+// iterateComponent evaluates the cells of a cycle in address order, each
+// pass using the values of the previous one (Gauss-Seidel), until no value
+// changes by more than the maximum change
+func (s *Spreadsheet) iterateComponent(ctx context.Context, component []CellAddress) (CycleStatus, error) {
+	sortCellAddresses(component)
+
+	status := CycleStatus{Cells: make([]string, len(component))}
+	for i, addr := range component {
+		status.Cells[i] = s.formatCellAddress(addr)
+
+		// errors stored by a previous calculation, circular reference errors
+		// in particular, would keep the cycle from ever converging
+		if _, isErr := s.formulaResult(addr).(*SpreadsheetError); isErr {
+			if worksheet, exists := s.storage.worksheets.GetWorksheet(addr.WorksheetID); exists {
+				s.setFormulaResult(worksheet, addr, 0.0)
+			}
+		}
+	}
+
+	for status.Iterations < s.iteration.MaxIterations {
+		if err := ctx.Err(); err != nil {
+			return status, newInterruptedError(err)
+		}
+
+		status.Iterations++
+		status.MaxChange = 0
+		for _, addr := range component {
+			previous := s.formulaResult(addr)
+			if result, deferred := s.evaluateLevelCell(addr); deferred {
+				s.storeDeferredResult(addr, result)
+			}
+			status.MaxChange = max(status.MaxChange, valueChange(previous, s.formulaResult(addr)))
+		}
+
+		if status.MaxChange <= s.iteration.MaxChange {
+			status.Converged = true
+			break
+		}
+	}
+	return status, nil
+}
+
+// formulaResult returns the value currently stored for a formula cell
+func (s *Spreadsheet) formulaResult(addr CellAddress) Primitive {
+	worksheet, exists := s.storage.worksheets.GetWorksheet(addr.WorksheetID)
+	if !exists {
+		return nil
+	}
+	cell := worksheet.GetCell(addr.Row, addr.Column)
+	if cell == nil {
+		return nil
+	}
+	return cell.Value
+}
+
+// valueChange measures how much a value changed between two passes. numbers
+// compare by their difference, other values either didn't change or changed
+// by an infinite amount.
+func valueChange(previous, current Primitive) float64 {
+	previousNum, previousIsNum := previous.(float64)
+	currentNum, currentIsNum := current.(float64)
+	if previousIsNum && currentIsNum {
+		if math.IsNaN(previousNum) || math.IsNaN(currentNum) {
+			return math.Inf(1)
+		}
+		return math.Abs(currentNum - previousNum)
+	}
+
+	previousErr, previousIsErr := previous.(*SpreadsheetError)
+	currentErr, currentIsErr := current.(*SpreadsheetError)
+	if previousIsErr || currentIsErr {
+		if previousIsErr && currentIsErr && previousErr.ErrorCode == currentErr.ErrorCode {
+			return 0
+		}
+		return math.Inf(1)
+	}
+
+	if previous == current {
+		return 0
+	}
+	return math.Inf(1)
+}
+
+// isSelfReferencing reports whether a cell is one of its own precedents
+func isSelfReferencing(addr CellAddress, precedents map[CellAddress][]CellAddress) bool {
+	for _, precedent := range precedents[addr] {
+		if precedent == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// stronglyConnectedComponents groups cells into strongly connected components
+// using Tarjan's algorithm with an explicit stack. edges point from a cell to
+// its precedents, so every component comes after the components it depends
+// on.
+func stronglyConnectedComponents(cells []CellAddress, precedents map[CellAddress][]CellAddress) [][]CellAddress {
+	index := make(map[CellAddress]int, len(cells))
+	lowLink := make(map[CellAddress]int, len(cells))
+	onStack := make(map[CellAddress]bool, len(cells))
+	var stack []CellAddress
+	var components [][]CellAddress
+
+	type frame struct {
+		addr CellAddress
+		next int // index of the next precedent to visit
+	}
+
+	for _, root := range cells {
+		if _, visited := index[root]; visited {
+			continue
+		}
+
+		work := []frame{{addr: root}}
+		index[root] = len(index)
+		lowLink[root] = index[root]
+		stack = append(stack, root)
+		onStack[root] = true
+
+		for len(work) > 0 {
+			top := &work[len(work)-1]
+			edges := precedents[top.addr]
+
+			if top.next < len(edges) {
+				precedent := edges[top.next]
+				top.next++
+				if _, visited := index[precedent]; !visited {
+					index[precedent] = len(index)
+					lowLink[precedent] = index[precedent]
+					stack = append(stack, precedent)
+					onStack[precedent] = true
+					work = append(work, frame{addr: precedent})
+				} else if onStack[precedent] {
+					lowLink[top.addr] = min(lowLink[top.addr], index[precedent])
+				}
+				continue
+			}
+
+			// all precedents visited, pop the component if this cell is its root
+			addr := top.addr
+			work = work[:len(work)-1]
+			if len(work) > 0 {
+				parent := work[len(work)-1].addr
+				lowLink[parent] = min(lowLink[parent], lowLink[addr])
+			}
+
+			if lowLink[addr] == index[addr] {
+				var component []CellAddress
+				for {
+					member := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[member] = false
+					component = append(component, member)
+					if member == addr {
+						break
+					}
+				}
+				components = append(components, component)
+			}
+		}
+	}
+
+	return components
+}
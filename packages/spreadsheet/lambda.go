@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scope binds a name of LET or LAMBDA to a value. scopes are never modified,
+// a binding links to the enclosing scope, so closures and nested evaluations
+// share them.
+type scope struct {
+	name   string
+	value  Primitive
+	parent *scope
+}
+
+// lookup returns the value bound to a name, ignoring case
+func (sc *scope) lookup(name string) (Primitive, bool) {
+	for s := sc; s != nil; s = s.parent {
+		if strings.EqualFold(s.name, name) {
+			return s.value, true
+		}
+	}
+	return nil, false
+}
+
+// bind returns a context evaluating like ctx, with name bound to value
+func (ctx *EvalContext) bind(name string, value Primitive) *EvalContext {
+	bound := *ctx
+	bound.scope = &scope{name: name, value: value, parent: ctx.scope}
+	return &bound
+}
+
+// VariableNode represents a name bound by an enclosing LET or LAMBDA
+type VariableNode struct {
+	Name     string
+	Position NodePosition
+}
+
+func (n *VariableNode) Eval(ctx *EvalContext) (Primitive, error) {
+	value, exists := ctx.scope.lookup(n.Name)
+	if !exists {
+		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Name '%s' is not bound", n.Name))
+	}
+	return value, nil
+}
+
+func (n *VariableNode) GetPosition() NodePosition {
+	return n.Position
+}
+
+func (n *VariableNode) ToString() string {
+	return n.Name
+}
+
+// LambdaValue is a function created by LAMBDA. it keeps the context it was
+// created in, so its calculation sees the names bound around it and reads
+// references relative to the cell of its formula.
+type LambdaValue struct {
+	params []string
+	body   compiledFormula
+	ctx    *EvalContext
+}
+
+// call evaluates the calculation of the LAMBDA with its parameters bound to
+// args
+func (l *LambdaValue) call(args ...any) (Primitive, error) {
+	if len(args) != len(l.params) {
+		return nil, NewSpreadsheetError(ErrorCodeValue,
+			fmt.Sprintf("LAMBDA requires %d arguments, got %d", len(l.params), len(args)))
+	}
+	ctx := *l.ctx
+	ctx.depth++
+	if limit := ctx.spreadsheet.limits.MaxCallDepth; limit > 0 && ctx.depth > limit {
+		return nil, NewSpreadsheetError(ErrorCodeNum, fmt.Sprintf("LAMBDA calls exceed depth limit of %d", limit))
+	}
+
+	bound := &ctx
+	for i, param := range l.params {
+		bound = bound.bind(param, args[i])
+	}
+	return l.body(bound)
+}
+
+// isSpecialForm reports whether a function call evaluates its arguments
+// itself: LET, LAMBDA, calls of LAMBDAs bound to names and lazyFunctions
+func (n *FunctionCallNode) isSpecialForm() bool {
+	_, lazy := lazyFunctions[n.Name]
+	return n.Local || n.Name == "LET" || n.Name == "LAMBDA" || lazy
+}
+
+// specialForm returns the evaluation of a special form given its unevaluated
+// arguments. the parser only builds LET and LAMBDA calls with names in their
+// binding positions.
+func specialForm(n *FunctionCallNode, args []compiledFormula) compiledFormula {
+	if n.Local {
+		name := n.Name
+		return func(ctx *EvalContext) (Primitive, error) {
+			value, _ := ctx.scope.lookup(name)
+			lambda, ok := value.(*LambdaValue)
+			if !ok {
+				return nil, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("%s isn't a LAMBDA", name))
+			}
+			values := make([]any, len(args))
+			for i, arg := range args {
+				value, err := arg(ctx)
+				if err != nil {
+					value = toErrorValue(err)
+				}
+				values[i] = value
+			}
+			result, err := lambda.call(values...)
+			if err != nil {
+				return nil, toErrorValue(err)
+			}
+			return result, nil
+		}
+	}
+	if lazy, exists := lazyFunctions[n.Name]; exists {
+		return lazy(n, args)
+	}
+
+	if len(args) == 0 {
+		return func(*EvalContext) (Primitive, error) {
+			return nil, NewSpreadsheetError(ErrorCodeNA, n.Name+" requires a calculation")
+		}
+	}
+	// binding names are variables, or recording nodes wrapping them when the
+	// formula is explained, both render as the name
+	names := make([]string, 0, len(n.Args)/2)
+	calculation := args[len(args)-1]
+
+	if n.Name == "LAMBDA" {
+		for _, param := range n.Args[:len(n.Args)-1] {
+			names = append(names, param.ToString())
+		}
+		return func(ctx *EvalContext) (Primitive, error) {
+			return &LambdaValue{params: names, body: calculation, ctx: ctx}, nil
+		}
+	}
+
+	values := make([]compiledFormula, 0, len(n.Args)/2)
+	for i := 0; i+1 < len(n.Args); i += 2 {
+		names = append(names, n.Args[i].ToString())
+		values = append(values, args[i+1])
+	}
+	return func(ctx *EvalContext) (Primitive, error) {
+		for i, name := range names {
+			value, err := values[i](ctx)
+			if err != nil {
+				value = toErrorValue(err)
+			}
+			ctx = ctx.bind(name, value)
+		}
+		return calculation(ctx)
+	}
+}
+
+// callNamedFunction calls a LAMBDA defined as a name, like TAXCALC for
+// =TAXCALC(A1). only defined names are functions, others are unknown.
+func callNamedFunction(ctx *EvalContext, name string, args []any) (Primitive, error) {
+	namedRanges := ctx.spreadsheet.storage.namedRanges
+	id, exists := namedRanges.ResolveNamedRangeID(ctx.address.WorksheetID, name)
+	if !exists || !namedRanges.IsRangeDefined(id) {
+		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Unknown function: %s", name))
+	}
+	formula, exists := namedRanges.GetFormula(id)
+	if !exists {
+		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Named range '%s' isn't a function", name))
+	}
+
+	value, err := ctx.evalNamedFormula(formula)
+	if err != nil {
+		return nil, toErrorValue(err)
+	}
+	lambda, ok := value.(*LambdaValue)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("%s isn't a LAMBDA", name))
+	}
+
+	result, err := lambda.call(args...)
+	if err != nil {
+		return nil, toErrorValue(err)
+	}
+	return result, nil
+}
+
+// evalNamedFormula evaluates the formula of a name used by the formula of
+// ctx. it sees none of the names bound in ctx, and counts as a call, so names
+// defined in terms of each other fail instead of recursing forever.
+func (ctx *EvalContext) evalNamedFormula(formula namedFormula) (Primitive, error) {
+	named := &EvalContext{
+		spreadsheet: ctx.spreadsheet,
+		address:     formula.originFor(ctx.address),
+		depth:       ctx.depth + 1,
+		args:        ctx.args,
+	}
+	if limit := ctx.spreadsheet.limits.MaxCallDepth; limit > 0 && named.depth > limit {
+		return nil, NewSpreadsheetError(ErrorCodeNum, fmt.Sprintf("Names nest deeper than the limit of %d", limit))
+	}
+	return formula.compiled(named)
+}
+
+// lambdaArg converts an argument of a LAMBDA helper function to a LAMBDA
+func lambdaArg(name string, arg any, params int) (*LambdaValue, error) {
+	if err := checkForError(arg); err != nil {
+		return nil, err
+	}
+	lambda, ok := arg.(*LambdaValue)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeValue, name+" requires a LAMBDA as its last argument")
+	}
+	if len(lambda.params) != params {
+		return nil, NewSpreadsheetError(ErrorCodeValue,
+			fmt.Sprintf("%s requires a LAMBDA with %d parameters, got %d", name, params, len(lambda.params)))
+	}
+	return lambda, nil
+}
+
+// callForElement calls a LAMBDA for one element of an array result. errors
+// become the element, and arrays, which can't nest, become #CALC!.
+func callForElement(lambda *LambdaValue, args ...any) Primitive {
+	result, err := lambda.call(args...)
+	if err != nil {
+		return toErrorValue(err)
+	}
+	switch v := result.(type) {
+	case Range:
+		if array, ok := toArray(v); ok && array.Size() == 1 {
+			return array.At(0, 0)
+		}
+		return NewSpreadsheetError(ErrorCodeCalc, "Nested arrays aren't supported")
+	case *LambdaValue:
+		return NewSpreadsheetError(ErrorCodeCalc, "A LAMBDA can't be an array element")
+	}
+	return result
+}
+
+// MAP(array1, [array2, ...], lambda) calls lambda with the values at each
+// position of the arrays, which must have the same size, and returns the
+// results as an array of that size
+func (bf *BuiltInFunctions) MAP(args ...any) (Primitive, error) {
+	if len(args) < 2 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "MAP requires at least 2 arguments")
+	}
+	lambda, err := lambdaArg("MAP", args[len(args)-1], len(args)-1)
+	if err != nil {
+		return nil, err
+	}
+	arrays := make([]*ArrayValue, len(args)-1)
+	for i, arg := range args[:len(args)-1] {
+		if arrays[i], err = arrayArg("MAP", arg); err != nil {
+			return nil, err
+		}
+		if arrays[i].rows != arrays[0].rows || arrays[i].cols != arrays[0].cols {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "MAP requires arrays of the same size")
+		}
+	}
+
+	result := NewArrayValue(arrays[0].rows, arrays[0].cols)
+	values := make([]any, len(arrays))
+	for i := range result.values {
+		for j, array := range arrays {
+			values[j] = array.values[i]
+		}
+		result.values[i] = callForElement(lambda, values...)
+	}
+	return result, nil
+}
+
+// REDUCE(initial_value, array, lambda) calls lambda with an accumulator,
+// starting at initial_value, and each value of array, row by row, and
+// returns the last result
+func (bf *BuiltInFunctions) REDUCE(args ...any) (Primitive, error) {
+	if len(args) != 3 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "REDUCE requires exactly 3 arguments")
+	}
+	array, err := arrayArg("REDUCE", args[1])
+	if err != nil {
+		return nil, err
+	}
+	lambda, err := lambdaArg("REDUCE", args[2], 2)
+	if err != nil {
+		return nil, err
+	}
+
+	accumulator := args[0]
+	for _, value := range array.values {
+		if accumulator, err = lambda.call(accumulator, value); err != nil {
+			return nil, err
+		}
+	}
+	return accumulator, nil
+}
+
+// SCAN(initial_value, array, lambda) works like REDUCE and returns every
+// intermediate result, as an array of the size of array
+func (bf *BuiltInFunctions) SCAN(args ...any) (Primitive, error) {
+	if len(args) != 3 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "SCAN requires exactly 3 arguments")
+	}
+	array, err := arrayArg("SCAN", args[1])
+	if err != nil {
+		return nil, err
+	}
+	lambda, err := lambdaArg("SCAN", args[2], 2)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewArrayValue(array.rows, array.cols)
+	accumulator := args[0]
+	for i, value := range array.values {
+		accumulator = callForElement(lambda, accumulator, value)
+		result.values[i] = accumulator
+	}
+	return result, nil
+}
+
+// BYROW(array, lambda) calls lambda with each row of array and returns the
+// results as a column
+func (bf *BuiltInFunctions) BYROW(args ...any) (Primitive, error) {
+	return byLine("BYROW", false, args)
+}
+
+// BYCOL(array, lambda) calls lambda with each column of array and returns
+// the results as a row
+func (bf *BuiltInFunctions) BYCOL(args ...any) (Primitive, error) {
+	return byLine("BYCOL", true, args)
+}
+
+// byLine implements BYROW and BYCOL
+func byLine(name string, byCol bool, args []any) (Primitive, error) {
+	if len(args) != 2 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, name+" requires exactly 2 arguments")
+	}
+	array, err := arrayArg(name, args[0])
+	if err != nil {
+		return nil, err
+	}
+	lambda, err := lambdaArg(name, args[1], 1)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := array.lines(byCol)
+	results := make([]Primitive, len(lines))
+	for i, line := range lines {
+		var lineArray *ArrayValue
+		if byCol {
+			lineArray = &ArrayValue{rows: len(line), cols: 1, values: line}
+		} else {
+			lineArray = &ArrayValue{rows: 1, cols: len(line), values: line}
+		}
+		results[i] = callForElement(lambda, lineArray)
+	}
+	return arrayFromLines([][]Primitive{results}, !byCol), nil
+}
+
+// MAKEARRAY(rows, columns, lambda) returns an array of the given size, with
+// each value the result of lambda called with its 1-based row and column
+func (bf *BuiltInFunctions) MAKEARRAY(args ...any) (Primitive, error) {
+	if len(args) != 3 {
+		return nil, NewSpreadsheetError(ErrorCodeNA, "MAKEARRAY requires exactly 3 arguments")
+	}
+	rows, err := numberArg("MAKEARRAY", args[0], "rows")
+	if err != nil {
+		return nil, err
+	}
+	cols, err := numberArg("MAKEARRAY", args[1], "columns")
+	if err != nil {
+		return nil, err
+	}
+	lambda, err := lambdaArg("MAKEARRAY", args[2], 2)
+	if err != nil {
+		return nil, err
+	}
+	array, err := bf.newArray("MAKEARRAY", rows, cols)
+	if err != nil {
+		return nil, err
+	}
+
+	for row := range array.rows {
+		for col := range array.cols {
+			array.Set(row, col, callForElement(lambda, float64(row+1), float64(col+1)))
+		}
+	}
+	return array, nil
+}
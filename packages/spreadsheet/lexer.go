@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 // TokenType represents different types of tokens in formulas
 type TokenType int
 
@@ -22,6 +24,10 @@ const (
 	TokenIdentifier
 	TokenWhitespace
 	TokenError
+	TokenLeftBrace  // { opening an array constant
+	TokenRightBrace // } closing an array constant
+	TokenSemicolon  // ; separating the rows of an array constant
+	TokenStructured // a reference into a table, like Sales[Amount] or [@Qty]
 )
 
 // BinaryOp represents binary operators in AST nodes
@@ -78,11 +84,17 @@ const (
 	charCaret      = '^'
 	charUnderscore = '_'
 	charExclaim    = '!'
+	charLBrace     = '{'
+	charRBrace     = '}'
+	charSemicolon  = ';'
+	charLBracket   = '['
+	charRBracket   = ']'
 )
 
 // tokenTransitions maps the current state to valid next token types
 var tokenTransitions = map[TokenState]map[TokenType]bool{
 	StateStart: {
+		TokenLeftBrace:     true, // array constant
 		TokenEquals:        true, // formula prefix
 		TokenUnaryPrefixOp: true, // unary +/-
 		TokenNumber:        true,
@@ -90,6 +102,7 @@ var tokenTransitions = map[TokenState]map[TokenType]bool{
 		TokenBoolean:       true,
 		TokenCell:          true,
 		TokenRange:         true, // allow ranges at start for standalone parsing
+		TokenStructured:    true,
 		TokenFunction:      true,
 		TokenIdentifier:    true,
 		TokenLeftParen:     true,
@@ -103,21 +116,26 @@ var tokenTransitions = map[TokenState]map[TokenType]bool{
 		// whitespace is significant - no consecutive values
 	},
 	StateAfterOperator: {
+		TokenLeftBrace:     true, // array constant
 		TokenNumber:        true,
 		TokenString:        true,
 		TokenBoolean:       true,
 		TokenCell:          true,
+		TokenRange:         true, // operators apply to ranges element-wise
+		TokenStructured:    true,
 		TokenFunction:      true,
 		TokenIdentifier:    true,
 		TokenLeftParen:     true,
 		TokenUnaryPrefixOp: true, // only unary after binary
 	},
 	StateAfterLeftParen: {
+		TokenLeftBrace:     true, // array constant
 		TokenNumber:        true,
 		TokenString:        true,
 		TokenBoolean:       true,
 		TokenCell:          true,
 		TokenRange:         true, // allow ranges in functions
+		TokenStructured:    true,
 		TokenFunction:      true,
 		TokenIdentifier:    true,
 		TokenLeftParen:     true, // nested
@@ -132,11 +150,13 @@ var tokenTransitions = map[TokenState]map[TokenType]bool{
 		TokenEOF:            true,
 	},
 	StateAfterComma: { // only valid in function context
+		TokenLeftBrace:     true, // array constant
 		TokenNumber:        true,
 		TokenString:        true,
 		TokenBoolean:       true,
 		TokenCell:          true,
 		TokenRange:         true, // allow ranges in function arguments
+		TokenStructured:    true,
 		TokenFunction:      true,
 		TokenIdentifier:    true,
 		TokenLeftParen:     true,
@@ -154,12 +174,28 @@ var tokenTransitions = map[TokenState]map[TokenType]bool{
 		TokenComma:          true, // if in function args
 		TokenEOF:            true,
 	},
+	StateAfterLeftBrace: { // also after a separator within an array constant
+		TokenNumber:        true,
+		TokenString:        true,
+		TokenBoolean:       true,
+		TokenUnaryPrefixOp: true, // sign of a number
+	},
+	StateAfterArraySign: {
+		TokenNumber: true,
+	},
+	StateAfterArrayValue: {
+		TokenComma:      true, // next value of the row
+		TokenSemicolon:  true, // next row
+		TokenRightBrace: true,
+	},
 	StateAfterEquals: {
+		TokenLeftBrace:     true, // array constant
 		TokenNumber:        true,
 		TokenString:        true,
 		TokenBoolean:       true,
 		TokenCell:          true,
 		TokenRange:         true,
+		TokenStructured:    true,
 		TokenFunction:      true,
 		TokenIdentifier:    true,
 		TokenLeftParen:     true,
@@ -187,6 +223,9 @@ const (
 	StateAfterComma
 	StateAfterColon
 	StateAfterIdentifier
+	StateAfterLeftBrace
+	StateAfterArraySign
+	StateAfterArrayValue
 )
 
 // Lexer tokenizes spreadsheet formula expressions
@@ -196,6 +235,7 @@ type Lexer struct {
 	pos        int
 	state      TokenState
 	parenDepth int
+	braceDepth int
 	inString   bool
 	tokens     []Token
 	error      string
@@ -322,6 +362,12 @@ func (l *Lexer) Tokenize() ([]Token, []string) {
 		return nil, []string{l.error}
 	}
 
+	// check for unclosed array constants (only if no error already)
+	if l.error == "" && l.braceDepth > 0 {
+		l.error = "unbalanced braces: missing closing brace"
+		return nil, []string{l.error}
+	}
+
 	// check for unclosed string (only if no error already)
 	if l.error == "" && l.inString {
 		l.error = "unclosed string literal"
@@ -363,11 +409,23 @@ func (l *Lexer) updateState(tokenType TokenType) {
 	switch tokenType {
 	case TokenEquals:
 		l.state = StateAfterEquals
-	case TokenNumber, TokenString, TokenBoolean, TokenCell:
+	case TokenNumber, TokenString, TokenBoolean:
+		if l.braceDepth > 0 {
+			l.state = StateAfterArrayValue
+		} else {
+			l.state = StateAfterValue
+		}
+	case TokenCell:
 		l.state = StateAfterValue
-	case TokenRange:
+	case TokenRange, TokenStructured:
 		l.state = StateAfterValue
-	case TokenUnaryPrefixOp, TokenBinaryOp:
+	case TokenUnaryPrefixOp:
+		if l.braceDepth > 0 {
+			l.state = StateAfterArraySign
+		} else {
+			l.state = StateAfterOperator
+		}
+	case TokenBinaryOp:
 		l.state = StateAfterOperator
 	case TokenUnaryPostfixOp:
 		// Postfix operators don't change state - they stay in current state
@@ -376,7 +434,15 @@ func (l *Lexer) updateState(tokenType TokenType) {
 	case TokenRightParen:
 		l.state = StateAfterRightParen
 	case TokenComma:
-		l.state = StateAfterComma
+		if l.braceDepth > 0 {
+			l.state = StateAfterLeftBrace
+		} else {
+			l.state = StateAfterComma
+		}
+	case TokenSemicolon, TokenLeftBrace:
+		l.state = StateAfterLeftBrace
+	case TokenRightBrace:
+		l.state = StateAfterValue
 	case TokenColon:
 		l.state = StateAfterColon
 	case TokenIdentifier:
@@ -409,6 +475,13 @@ func (l *Lexer) nextToken() Token {
 		}
 	}
 
+	// check for whole-row ranges (3:5) before numbers
+	if l.isDigit(ch) {
+		if tok, ok := l.scanRowRange(); ok {
+			return tok
+		}
+	}
+
 	// check for numbers
 	if l.isDigit(ch) || (ch == charPeriod && l.pos+1 < len(l.input) && l.isDigit(rune(l.runes[l.pos+1]))) {
 		return l.scanNumber()
@@ -430,6 +503,23 @@ func (l *Lexer) nextToken() Token {
 	case charComma:
 		l.pos++
 		return Token{Type: TokenComma, Value: ",", Pos: startPos}
+	case charLBrace:
+		l.pos++
+		l.braceDepth++
+		return Token{Type: TokenLeftBrace, Value: "{", Pos: startPos}
+	case charRBrace:
+		l.pos++
+		l.braceDepth--
+		if l.braceDepth < 0 {
+			return Token{Type: TokenError, Value: "unexpected closing brace", Pos: startPos}
+		}
+		return Token{Type: TokenRightBrace, Value: "}", Pos: startPos}
+	case charSemicolon:
+		l.pos++
+		return Token{Type: TokenSemicolon, Value: ";", Pos: startPos}
+	case charLBracket:
+		// a structured reference within the table of the formula, [@Qty]
+		return l.scanStructuredRef(startPos)
 	case charColon:
 		l.pos++
 		return Token{Type: TokenColon, Value: ":", Pos: startPos}
@@ -598,8 +688,10 @@ func (l *Lexer) scanString() Token {
 func (l *Lexer) scanIdentifierOrCell() Token {
 	startPos := l.pos
 
-	// first, collect the identifier part
-	for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current()) || l.current() == charUnderscore) {
+	// first, collect the identifier part. names may hold periods after
+	// their first character, like ERROR.TYPE
+	for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current()) || l.current() == charUnderscore ||
+		(l.current() == charPeriod && l.pos > startPos)) {
 		l.pos++
 	}
 
@@ -611,12 +703,24 @@ func (l *Lexer) scanIdentifierOrCell() Token {
 		return Token{Type: TokenBoolean, Value: upperValue, Pos: startPos}
 	}
 
+	// check for a structured reference to a table (Sales[Amount])
+	if l.current() == charLBracket {
+		return l.scanStructuredRef(startPos)
+	}
+
 	// check if it's a worksheet reference (identifier followed by !)
 	if l.current() == charExclaim {
 		// this is a worksheet name, scan the rest as worksheet reference
 		return l.scanWorksheetRefWithName(startPos)
 	}
 
+	// check for a 3D reference across a span of worksheets (Jan:Dec!B7)
+	if l.current() == charColon {
+		if tok, ok := l.scanWorksheetSpan(startPos); ok {
+			return tok
+		}
+	}
+
 	// check if it's a cell reference
 	if l.isCell(value) {
 		// check for range (A1:B2)
@@ -644,6 +748,21 @@ func (l *Lexer) scanIdentifierOrCell() Token {
 		return Token{Type: TokenCell, Value: value, Pos: startPos}
 	}
 
+	// check for a whole-column range (A:C)
+	if l.isColumn(value) && l.current() == charColon {
+		savedPos := l.pos
+		l.pos++ // consume ':'
+
+		columnStart := l.pos
+		for l.pos < len(l.runes) && l.isAlpha(l.current()) {
+			l.pos++
+		}
+		if l.isColumn(l.substring(columnStart, l.pos)) && !l.isAlphaNumeric(l.current()) {
+			return Token{Type: TokenRange, Value: l.substring(startPos, l.pos), Pos: startPos}
+		}
+		l.pos = savedPos
+	}
+
 	// check if it's a function (followed by open paren)
 	if l.current() == charLParen {
 		return Token{Type: TokenFunction, Value: upperValue, Pos: startPos}
@@ -684,6 +803,59 @@ func (l *Lexer) isCell(s string) bool {
 	return true
 }
 
+// isColumn checks if a string is a column reference (e.g., A, XFD)
+func (l *Lexer) isColumn(s string) bool {
+	if len(s) == 0 || len(s) > 3 {
+		return false
+	}
+	for _, ch := range s {
+		if !l.isAlpha(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRow checks if a string is a row reference (e.g., 3, 1048576)
+func (l *Lexer) isRow(s string) bool {
+	if len(s) == 0 || len(s) > 7 || s[0] == '0' {
+		return false
+	}
+	for _, ch := range s {
+		if !l.isDigit(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanRowRange scans a whole-row range like 3:5. it reports false and
+// leaves the position untouched when the input is not one, e.g. a number
+func (l *Lexer) scanRowRange() (Token, bool) {
+	startPos := l.pos
+
+	end := l.pos
+	for end < len(l.runes) && l.isDigit(l.runes[end]) {
+		end++
+	}
+	if end >= len(l.runes) || l.runes[end] != charColon || !l.isRow(l.substring(startPos, end)) {
+		return Token{}, false
+	}
+
+	secondStart := end + 1
+	secondEnd := secondStart
+	for secondEnd < len(l.runes) && l.isDigit(l.runes[secondEnd]) {
+		secondEnd++
+	}
+	if !l.isRow(l.substring(secondStart, secondEnd)) ||
+		(secondEnd < len(l.runes) && (l.isAlpha(l.runes[secondEnd]) || l.runes[secondEnd] == charPeriod)) {
+		return Token{}, false
+	}
+
+	l.pos = secondEnd
+	return Token{Type: TokenRange, Value: l.substring(startPos, l.pos), Pos: startPos}, true
+}
+
 // toUpper converts a string to uppercase
 func (l *Lexer) toUpper(s string) string {
 	result := make([]rune, len(s))
@@ -697,6 +869,28 @@ func (l *Lexer) toUpper(s string) string {
 	return string(result)
 }
 
+// scanStructuredRef scans the brackets of a structured reference, which may
+// nest like Sales[[#Headers],[Amount]]. within them an apostrophe escapes
+// the next character, so column names may hold brackets.
+func (l *Lexer) scanStructuredRef(startPos int) Token {
+	depth := 0
+	for l.pos < len(l.runes) {
+		switch l.current() {
+		case charApostrophe:
+			l.pos++
+		case charLBracket:
+			depth++
+		case charRBracket:
+			depth--
+		}
+		l.pos++
+		if depth == 0 {
+			return Token{Type: TokenStructured, Value: l.substring(startPos, l.pos), Pos: startPos}
+		}
+	}
+	return Token{Type: TokenError, Value: "unclosed structured reference", Pos: startPos}
+}
+
 // scanWorksheetRef scans a worksheet reference starting with single quote
 func (l *Lexer) scanWorksheetRef() Token {
 	startPos := l.pos
@@ -727,38 +921,42 @@ func (l *Lexer) scanWorksheetRef() Token {
 
 	l.pos++ // consume !
 
-	// now scan the cell or range reference
-	cellStart := l.pos
-	for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current())) {
-		l.pos++
+	tok := l.scanQualifiedReference(startPos)
+	if strings.Contains(l.substring(startPos, l.pos), ":") {
+		switch tok.Type {
+		case TokenCell:
+			// a quoted span of worksheets ('Jan:Dec'!B7) is a 3D reference
+			tok.Type = TokenRange
+		case TokenIdentifier:
+			return Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
+		}
 	}
+	return tok
+}
 
-	cellRef := l.substring(cellStart, l.pos)
-	if !l.isCell(cellRef) {
-		return Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
+// scanWorksheetSpan scans a 3D reference like Jan:Dec!B7 once the first
+// worksheet name has been scanned. 3D references are always ranges, even
+// over a single cell. it reports false and leaves the position untouched
+// when the colon doesn't start a span of worksheets.
+func (l *Lexer) scanWorksheetSpan(startPos int) (Token, bool) {
+	end := l.pos + 1
+	for end < len(l.runes) && (l.isAlphaNumeric(l.runes[end]) || l.runes[end] == charUnderscore) {
+		end++
 	}
-
-	// check for range
-	if l.current() == charColon {
-		l.pos++ // consume ':'
-		rangeStart := l.pos
-		for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current())) {
-			l.pos++
-		}
-
-		secondCell := l.substring(rangeStart, l.pos)
-		if l.isCell(secondCell) {
-			// worksheet _range_ reference
-			fullRef := l.substring(startPos, l.pos)
-			return Token{Type: TokenRange, Value: fullRef, Pos: startPos}
-		} else {
-			return Token{Type: TokenError, Value: "invalid range reference", Pos: startPos}
-		}
+	if end == l.pos+1 || end >= len(l.runes) || l.runes[end] != charExclaim {
+		return Token{}, false
 	}
 
-	// worksheet _cell_ reference
-	fullRef := l.substring(startPos, l.pos)
-	return Token{Type: TokenCell, Value: fullRef, Pos: startPos}
+	l.pos = end + 1 // consume the second name and !
+	tok := l.scanQualifiedReference(startPos)
+	switch tok.Type {
+	case TokenCell:
+		tok.Type = TokenRange
+	case TokenIdentifier:
+		// names are local to a single worksheet
+		tok = Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
+	}
+	return tok, true
 }
 
 // scanWorksheetRefWithName scans worksheet reference when we already have
@@ -770,38 +968,53 @@ func (l *Lexer) scanWorksheetRefWithName(startPos int) Token {
 
 	l.pos++ // consume !
 
-	// scan the cell or range reference
-	cellStart := l.pos
+	return l.scanQualifiedReference(startPos)
+}
+
+// scanQualifiedReference scans the reference following a worksheet name and
+// its '!': a cell, a cell range, a whole-column range or a whole-row range
+func (l *Lexer) scanQualifiedReference(startPos int) Token {
+	firstStart := l.pos
 	for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current())) {
 		l.pos++
 	}
-
-	cellRef := l.substring(cellStart, l.pos)
-	if !l.isCell(cellRef) {
-		return Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
-	}
+	first := l.substring(firstStart, l.pos)
 
 	// check for range
 	if l.current() == charColon {
+		if !l.isCell(first) && !l.isColumn(first) && !l.isRow(first) {
+			return Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
+		}
+
 		l.pos++ // consume ':'
-		rangeStart := l.pos
+		secondStart := l.pos
 		for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current())) {
 			l.pos++
 		}
 
-		secondCell := l.substring(rangeStart, l.pos)
-		if l.isCell(secondCell) {
+		second := l.substring(secondStart, l.pos)
+		if (l.isCell(first) && l.isCell(second)) || (l.isColumn(first) && l.isColumn(second)) ||
+			(l.isRow(first) && l.isRow(second)) {
 			// worksheet range reference
-			fullRef := l.substring(startPos, l.pos)
-			return Token{Type: TokenRange, Value: fullRef, Pos: startPos}
-		} else {
-			return Token{Type: TokenError, Value: "invalid range reference", Pos: startPos}
+			return Token{Type: TokenRange, Value: l.substring(startPos, l.pos), Pos: startPos}
+		}
+		return Token{Type: TokenError, Value: "invalid range reference", Pos: startPos}
+	}
+
+	if !l.isCell(first) {
+		// a name local to the worksheet, like Sheet1!Total
+		for l.pos < len(l.runes) && (l.isAlphaNumeric(l.current()) || l.current() == charUnderscore) {
+			l.pos++
+		}
+		name := l.substring(firstStart, l.pos)
+		if name == "" || l.isDigit([]rune(name)[0]) || l.current() == charLParen {
+			return Token{Type: TokenError, Value: "invalid cell reference after worksheet", Pos: startPos}
 		}
+		return Token{Type: TokenIdentifier, Value: l.substring(startPos, l.pos), Pos: startPos}
 	}
 
 	// worksheet cell reference
-	fullRef := l.substring(startPos, l.pos)
-	return Token{Type: TokenCell, Value: fullRef, Pos: startPos}
+	return Token{Type: TokenCell, Value: l.substring(startPos, l.pos), Pos: startPos}
 }
 
 // scanUnaryPrefixOrBinaryOp scans + and - which can be either unary
@@ -891,8 +1104,9 @@ func (l *Lexer) isUnaryContext() bool {
 	// - after another operator
 	// - after left paren
 	// - after comma
+	// - before a value of an array constant
 	switch l.state {
-	case StateStart, StateAfterEquals, StateAfterOperator, StateAfterLeftParen, StateAfterComma:
+	case StateStart, StateAfterEquals, StateAfterOperator, StateAfterLeftParen, StateAfterComma, StateAfterLeftBrace:
 		return true
 	default:
 		return false
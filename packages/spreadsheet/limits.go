@@ -0,0 +1,134 @@
+package main
+
+import "fmt"
+
+// Limits bounds the resources a workbook can consume, so untrusted input
+// can't exhaust memory or the goroutine stack. a zero field means unlimited.
+// limits checked when a cell is set surface as an AppError with code
+// ResourceExhausted, limits checked during evaluation surface as #NUM!.
+type Limits struct {
+	MaxFormulaLength  int // bytes in a formula, including the leading '='
+	MaxASTDepth       int // nesting depth of a parsed formula
+	MaxRangeCells     int // cells a single range may cover when evaluated
+	MaxTotalCells     int // non-empty cells across all worksheets
+	MaxRecursionDepth int // depth of the calculation work stack
+	MaxStringLength   int // bytes in a string value or formula result
+	MaxCallDepth      int // nesting of LAMBDA calls
+}
+
+// DefaultLimits returns the limits used by NewSpreadsheet. they are generous
+// enough for hand-written workbooks while keeping evaluation bounded.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxFormulaLength:  8192,
+		MaxASTDepth:       256,
+		MaxRangeCells:     1 << 24,
+		MaxTotalCells:     0,
+		MaxRecursionDepth: 1000000,
+		MaxStringLength:   32767,
+		MaxCallDepth:      1024,
+	}
+}
+
+// SetLimits replaces the resource limits of the spreadsheet. cells that are
+// already stored are not re-checked.
+func (s *Spreadsheet) SetLimits(limits Limits) {
+	s.limits = limits
+}
+
+// GetLimits returns the resource limits of the spreadsheet
+func (s *Spreadsheet) GetLimits() Limits {
+	return s.limits
+}
+
+// checkFormulaLength returns a ResourceExhausted error when formula is longer
+// than the limit
+func (l Limits) checkFormulaLength(formula string) error {
+	if l.MaxFormulaLength > 0 && len(formula) > l.MaxFormulaLength {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Formula length %d exceeds limit of %d", len(formula), l.MaxFormulaLength))
+	}
+	return nil
+}
+
+// checkASTDepth returns a ResourceExhausted error when the AST is nested
+// deeper than the limit
+func (l Limits) checkASTDepth(node ASTNode) error {
+	if l.MaxASTDepth > 0 && astDepthExceeds(node, l.MaxASTDepth) {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Formula nesting exceeds depth limit of %d", l.MaxASTDepth))
+	}
+	return nil
+}
+
+// checkStringValue returns a ResourceExhausted error when a string value is
+// longer than the limit
+func (l Limits) checkStringValue(value string) error {
+	if l.MaxStringLength > 0 && len(value) > l.MaxStringLength {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("String length %d exceeds limit of %d", len(value), l.MaxStringLength))
+	}
+	return nil
+}
+
+// checkRangeSize returns a #NUM! error when the range covers more cells than
+// the limit
+func (l Limits) checkRangeSize(startRow, startCol, endRow, endCol uint32) error {
+	return l.checkRangeCells((uint64(endRow) - uint64(startRow) + 1) * (uint64(endCol) - uint64(startCol) + 1))
+}
+
+// checkRangeCells returns a #NUM! error when a number of range cells is over
+// the limit
+func (l Limits) checkRangeCells(cells uint64) error {
+	if l.MaxRangeCells <= 0 {
+		return nil
+	}
+	if cells > uint64(l.MaxRangeCells) {
+		return NewSpreadsheetError(ErrorCodeNum,
+			fmt.Sprintf("Range of %d cells exceeds limit of %d", cells, l.MaxRangeCells))
+	}
+	return nil
+}
+
+// checkStringResult returns a #NUM! error when a string result is longer
+// than the limit, otherwise the result unchanged
+func (l Limits) checkStringResult(result Primitive) Primitive {
+	if str, ok := result.(string); ok && l.MaxStringLength > 0 && len(str) > l.MaxStringLength {
+		return NewSpreadsheetError(ErrorCodeNum,
+			fmt.Sprintf("String length %d exceeds limit of %d", len(str), l.MaxStringLength))
+	}
+	return result
+}
+
+// astDepthExceeds reports whether the AST is deeper than limit. it stops
+// descending once the limit is reached, so the recursion itself is bounded.
+func astDepthExceeds(node ASTNode, limit int) bool {
+	if node == nil {
+		return false
+	}
+	if limit <= 0 {
+		return true
+	}
+	switch n := node.(type) {
+	case *BinaryOpNode:
+		return astDepthExceeds(n.Left, limit-1) || astDepthExceeds(n.Right, limit-1)
+	case *UnaryOpNode:
+		return astDepthExceeds(n.Operand, limit-1)
+	case *FunctionCallNode:
+		for _, arg := range n.Args {
+			if astDepthExceeds(arg, limit-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cellCount returns the number of non-empty cells across all worksheets
+func (s *Spreadsheet) cellCount() int {
+	total := 0
+	for _, worksheet := range s.storage.worksheets.GetAllDefinedWorksheets() {
+		total += worksheet.GetTotalCells()
+	}
+	return total
+}
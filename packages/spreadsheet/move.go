@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// rangeMove describes a block of cells cut from the source rectangle and
+// pasted over the destination rectangle of the same size
+type rangeMove struct {
+	source      RangeAddress
+	destination RangeAddress
+}
+
+// cell maps a cell through the move. moved cells follow the move and cells
+// overwritten by it are lost, other cells stay where they are.
+func (m rangeMove) cell(addr CellAddress) (CellAddress, bool) {
+	if m.source.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+		return CellAddress{
+			WorksheetID: m.destination.WorksheetID,
+			Row:         addr.Row - m.source.StartRow + m.destination.StartRow,
+			Column:      addr.Column - m.source.StartColumn + m.destination.StartColumn,
+		}, true
+	}
+	if m.destination.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+		return CellAddress{}, false
+	}
+	return addr, true
+}
+
+// rng maps a range through the move. a range follows the move when it lies
+// within the moved block and is lost when it lies within the overwritten
+// cells, other ranges stay where they are.
+func (m rangeMove) rng(r RangeAddress) (RangeAddress, bool) {
+	within := func(outer RangeAddress) bool {
+		return r.WorksheetID == outer.WorksheetID &&
+			r.StartRow >= outer.StartRow && r.EndRow <= outer.EndRow &&
+			r.StartColumn >= outer.StartColumn && r.EndColumn <= outer.EndColumn
+	}
+
+	if within(m.source) {
+		return RangeAddress{
+			WorksheetID: m.destination.WorksheetID,
+			StartRow:    r.StartRow - m.source.StartRow + m.destination.StartRow,
+			StartColumn: r.StartColumn - m.source.StartColumn + m.destination.StartColumn,
+			EndRow:      r.EndRow - m.source.StartRow + m.destination.StartRow,
+			EndColumn:   r.EndColumn - m.source.StartColumn + m.destination.StartColumn,
+		}, true
+	}
+	if within(m.destination) {
+		return RangeAddress{}, false
+	}
+	return r, true
+}
+
+// MoveRange cuts a cell, like "Sheet1!A1", or a range, like "Sheet1!A1:B10",
+// and pastes it with its top-left corner at dst, as in Excel. references to
+// the moved cells, in the moved formulas and everywhere else, follow them to
+// the new location. ranges follow when they lie within the moved block.
+// references to the cells overwritten by the move become #REF!. named ranges
+// and tables within the moved block are moved as well, and a moved table
+// can't land on another table.
+func (s *Spreadsheet) MoveRange(src string, dst string) error {
+	source, err := s.resolveRange(src)
+	if err != nil {
+		return err
+	}
+	target, err := s.resolveRange(dst)
+	if err != nil {
+		return err
+	}
+
+	height := source.EndRow - source.StartRow
+	width := source.EndColumn - source.StartColumn
+	if uint64(target.StartRow)+uint64(height) >= uint64(MaxRows) ||
+		uint64(target.StartColumn)+uint64(width) >= uint64(MaxColumns) {
+		return NewApplicationError(OutOfRange, "Move destination extends past the worksheet")
+	}
+
+	move := rangeMove{
+		source: source,
+		destination: RangeAddress{
+			WorksheetID: target.WorksheetID,
+			StartRow:    target.StartRow,
+			StartColumn: target.StartColumn,
+			EndRow:      target.StartRow + height,
+			EndColumn:   target.StartColumn + width,
+		},
+	}
+	if move.source == move.destination {
+		return nil
+	}
+
+	sourceWorksheet, _ := s.storage.worksheets.GetWorksheet(source.WorksheetID)
+	worksheet, _ := s.storage.worksheets.GetWorksheet(target.WorksheetID)
+
+	// tables within the moved block follow it
+	var movedTables []*Table
+	for _, table := range sourceWorksheet.tables {
+		if source.Contains(source.WorksheetID, table.Range.StartRow, table.Range.StartColumn) &&
+			source.Contains(source.WorksheetID, table.Range.EndRow, table.Range.EndColumn) {
+			movedTables = append(movedTables, table)
+		}
+	}
+	for _, table := range movedTables {
+		relocated, _ := move.rng(table.Range)
+		for _, other := range worksheet.tables {
+			if !slices.Contains(movedTables, other) && rangesOverlap(other.Range, relocated) {
+				return NewApplicationError(InvalidArgument, fmt.Sprintf("Table %s would overlap table %s", table.Name, other.Name))
+			}
+		}
+	}
+
+	// take the moved cells with their formulas rewritten for their new place
+	type movedCell struct {
+		addr  CellAddress
+		value Primitive
+		ast   ASTNode
+	}
+	var moved []movedCell
+	sourceWorksheet.occupiedCells(source.StartRow, source.StartColumn, source.EndRow, source.EndColumn, func(row, col uint32) bool {
+		from := CellAddress{WorksheetID: source.WorksheetID, Row: row, Column: col}
+		if s.spilledWithin(from, source) {
+			return true
+		}
+		to, _ := move.cell(from)
+		cell := movedCell{addr: to, value: sourceWorksheet.GetValue(row, col)}
+		if formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(from); isFormula {
+			ast, _ := s.storage.formulas.GetAST(formulaID)
+			cell.ast = relocateReferences(ast, from, to, move)
+		}
+		moved = append(moved, cell)
+		return true
+	})
+
+	// formulas elsewhere reading the moved or the overwritten cells
+	rewritten := make(map[CellAddress]ASTNode)
+	dg := s.storage.dependencyGraph
+	for _, area := range []RangeAddress{move.source, move.destination} {
+		for _, dependents := range [][]CellAddress{dg.GetCellDependentsInRange(area), dg.GetRangeDependentsInRange(area)} {
+			for _, addr := range dependents {
+				if _, done := rewritten[addr]; done ||
+					move.source.Contains(addr.WorksheetID, addr.Row, addr.Column) ||
+					move.destination.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+					continue
+				}
+				formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(addr)
+				if !isFormula {
+					continue
+				}
+				ast, _ := s.storage.formulas.GetAST(formulaID)
+				if relocated := relocateReferences(ast, addr, addr, move); relocated.ToString() != ast.ToString() {
+					rewritten[addr] = relocated
+				}
+			}
+		}
+	}
+
+	// cut the source and clear the destination
+	for _, area := range []RangeAddress{move.source, move.destination} {
+		areaWorksheet := sourceWorksheet
+		if area.WorksheetID != source.WorksheetID {
+			areaWorksheet = worksheet
+		}
+		var cleared []CellAddress
+		areaWorksheet.occupiedCells(area.StartRow, area.StartColumn, area.EndRow, area.EndColumn, func(row, col uint32) bool {
+			cleared = append(cleared, CellAddress{WorksheetID: area.WorksheetID, Row: row, Column: col})
+			return true
+		})
+		for _, addr := range cleared {
+			s.removeCell(areaWorksheet, addr)
+		}
+	}
+
+	for _, cell := range moved {
+		var err error
+		switch {
+		case cell.ast != nil:
+			err = s.setFormulaAST(worksheet, cell.addr, cell.ast)
+		case cell.value != nil:
+			err = s.setCell(worksheet, cell.addr, cell.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for addr, ast := range rewritten {
+		dependentWorksheet, _ := s.storage.worksheets.GetWorksheet(addr.WorksheetID)
+		if err := s.setFormulaAST(dependentWorksheet, addr, ast); err != nil {
+			return err
+		}
+	}
+
+	for nameID, rangeAddr := range s.storage.namedRanges.DefinedRanges() {
+		if relocated, ok := move.rng(rangeAddr); ok && relocated != rangeAddr {
+			key := s.storage.namedRanges.idToName[nameID]
+			s.markNamedRangeUsersDirty(s.storage.namedRanges.DefineNamedRange(key.worksheetID, key.name, relocated))
+		}
+	}
+
+	if len(movedTables) > 0 {
+		for _, table := range movedTables {
+			table.Range, _ = move.rng(table.Range)
+		}
+		if worksheet != sourceWorksheet {
+			sourceWorksheet.tables = slices.DeleteFunc(sourceWorksheet.tables, func(table *Table) bool {
+				return slices.Contains(movedTables, table)
+			})
+			worksheet.tables = append(worksheet.tables, movedTables...)
+		}
+		s.refreshTableReferences()
+	}
+
+	return nil
+}
+
+// relocateReferences returns the AST of a formula moving from one cell to
+// another, with references mapped through a move. references keep pointing
+// at the same cells unless those cells moved.
+func relocateReferences(node ASTNode, from, to CellAddress, move rangeMove) ASTNode {
+	switch n := node.(type) {
+	case *CellRefNode:
+		target, ok := cellRefAddress(n, from)
+		if !ok {
+			return node
+		}
+		target, ok = move.cell(target)
+		if !ok {
+			return &ErrorNode{Code: ErrorCodeRef, Position: n.Position}
+		}
+		return &CellRefNode{
+			WorksheetID: target.WorksheetID,
+			RowOffset:   int32(target.Row) - int32(to.Row),
+			ColOffset:   int32(target.Column) - int32(to.Column),
+			Position:    n.Position,
+		}
+
+	case *RangeNode:
+		rangeAddr, ok := n.bounds(from)
+		if !ok {
+			return node
+		}
+		rangeAddr, ok = move.rng(rangeAddr)
+		if !ok {
+			return &ErrorNode{Code: ErrorCodeRef, Position: n.Position}
+		}
+		return rangeNodeAt(rangeAddr, to, n)
+
+	case *Range3DNode:
+		// 3D references don't follow moves, they only stay on the same cells
+		area, ok := n.Area.bounds(from)
+		if !ok {
+			return node
+		}
+		relocated := *n
+		relocated.Area = rangeNodeAt(area, to, n.Area)
+		relocated.Area.WorksheetID = 0
+		return &relocated
+
+	case *BinaryOpNode:
+		return &BinaryOpNode{Op: n.Op, Left: relocateReferences(n.Left, from, to, move),
+			Right: relocateReferences(n.Right, from, to, move), Position: n.Position}
+
+	case *UnaryOpNode:
+		return &UnaryOpNode{Op: n.Op, Operand: relocateReferences(n.Operand, from, to, move), Position: n.Position}
+
+	case *FunctionCallNode:
+		args := make([]ASTNode, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = relocateReferences(arg, from, to, move)
+		}
+		return &FunctionCallNode{Name: n.Name, Args: args, Local: n.Local, Position: n.Position}
+	}
+	return node
+}
+
+// rangeNodeAt returns a range node covering a range as seen from a cell,
+// keeping the whole-column and whole-row form of the original node
+func rangeNodeAt(rangeAddr RangeAddress, origin CellAddress, original *RangeNode) *RangeNode {
+	node := &RangeNode{
+		WorksheetID:  rangeAddr.WorksheetID,
+		WholeColumns: original.WholeColumns,
+		WholeRows:    original.WholeRows,
+		Position:     original.Position,
+	}
+	if !original.WholeColumns {
+		node.StartRowOffset = int32(rangeAddr.StartRow) - int32(origin.Row)
+		node.EndRowOffset = int32(rangeAddr.EndRow) - int32(origin.Row)
+	}
+	if !original.WholeRows {
+		node.StartColOffset = int32(rangeAddr.StartColumn) - int32(origin.Column)
+		node.EndColOffset = int32(rangeAddr.EndColumn) - int32(origin.Column)
+	}
+	return node
+}
@@ -16,17 +16,43 @@ type NodePosition struct {
 // volatile function detection through tree traversal rather than
 // regex/string manipulation.
 type ASTNode interface {
-	Eval(s *Spreadsheet) (Primitive, error)
+	Eval(ctx *EvalContext) (Primitive, error)
 	GetPosition() NodePosition
 	ToString() string
 }
 
+// EvalContext carries the state needed to evaluate a formula: the owning
+// spreadsheet and the cell being calculated. a context is created for each
+// evaluation so independent cells can be evaluated concurrently.
+type EvalContext struct {
+	spreadsheet *Spreadsheet
+	address     CellAddress
+	scope       *scope    // names bound by LET and LAMBDA, nil outside of them
+	depth       int       // nesting of LAMBDA calls
+	args        *argStack // arguments of the function calls being evaluated
+}
+
+// NewEvalContext creates an evaluation context for a formula at address
+func NewEvalContext(s *Spreadsheet, address CellAddress) *EvalContext {
+	return &EvalContext{
+		spreadsheet: s,
+		address:     address,
+	}
+}
+
+// GetCurrentAddress returns the address of the cell being calculated
+func (ctx *EvalContext) GetCurrentAddress() CellAddress {
+	return ctx.address
+}
+
 // ParserContext provides context for parsing relative references
 type ParserContext struct {
 	CurrentWorksheetID uint32
 	CurrentRow         int32
 	CurrentColumn      int32
 	ResolveWorksheet   func(name string) uint32
+	ResolveTable       func(name string) *Table // a table by name, or the table of the current cell for an empty name
+	MaxDepth           int                      // maximum nesting of parentheses, arguments and unary operators, 0 for no limit
 }
 
 // Parser parses tokens into an AST
@@ -35,6 +61,8 @@ type Parser struct {
 	pos     int
 	context *ParserContext
 	lexer   *Lexer
+	depth   int      // current nesting depth
+	scope   []string // names bound by the enclosing LET and LAMBDA functions
 }
 
 // StringNode represents a string literal
@@ -43,7 +71,7 @@ type StringNode struct {
 	Position NodePosition
 }
 
-func (n *StringNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *StringNode) Eval(ctx *EvalContext) (Primitive, error) {
 	return n.Value, nil
 }
 
@@ -63,7 +91,7 @@ type NumberNode struct {
 	Position NodePosition
 }
 
-func (n *NumberNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *NumberNode) Eval(ctx *EvalContext) (Primitive, error) {
 	return n.Value, nil
 }
 
@@ -85,7 +113,7 @@ type BooleanNode struct {
 	Position NodePosition
 }
 
-func (n *BooleanNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *BooleanNode) Eval(ctx *EvalContext) (Primitive, error) {
 	return n.Value, nil
 }
 
@@ -100,6 +128,63 @@ func (n *BooleanNode) ToString() string {
 	return "FALSE"
 }
 
+// ArrayNode represents an array constant, like {1,2,3;4,5,6}. values of a
+// row are separated by commas and rows by semicolons. every value is a
+// number, string or boolean literal.
+type ArrayNode struct {
+	Rows     [][]ASTNode
+	Position NodePosition
+}
+
+func (n *ArrayNode) Eval(ctx *EvalContext) (Primitive, error) {
+	array := NewArrayValue(len(n.Rows), len(n.Rows[0]))
+	for i, row := range n.Rows {
+		for j, elem := range row {
+			value, err := elem.Eval(ctx)
+			if err != nil {
+				return nil, err
+			}
+			array.Set(i, j, value)
+		}
+	}
+	return array, nil
+}
+
+func (n *ArrayNode) GetPosition() NodePosition {
+	return n.Position
+}
+
+func (n *ArrayNode) ToString() string {
+	rows := make([]string, len(n.Rows))
+	for i, row := range n.Rows {
+		values := make([]string, len(row))
+		for j, elem := range row {
+			values[j] = elem.ToString()
+		}
+		rows[i] = strings.Join(values, ",")
+	}
+	return "{" + strings.Join(rows, ";") + "}"
+}
+
+// ErrorNode represents an error literal, like the #REF! left in place of a
+// reference to cells overwritten by a move
+type ErrorNode struct {
+	Code     ErrorCode
+	Position NodePosition
+}
+
+func (n *ErrorNode) Eval(ctx *EvalContext) (Primitive, error) {
+	return nil, NewSpreadsheetError(n.Code, "")
+}
+
+func (n *ErrorNode) GetPosition() NodePosition {
+	return n.Position
+}
+
+func (n *ErrorNode) ToString() string {
+	return ErrorMapper[n.Code]
+}
+
 // CellRefNode represents a cell reference (relative)
 type CellRefNode struct {
 	WorksheetID uint32
@@ -108,9 +193,9 @@ type CellRefNode struct {
 	Position    NodePosition
 }
 
-func (n *CellRefNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *CellRefNode) Eval(ctx *EvalContext) (Primitive, error) {
 	// Calculate absolute address from relative offset
-	currentAddr := s.GetCurrentAddress()
+	currentAddr := ctx.GetCurrentAddress()
 	targetRow := int32(currentAddr.Row) + n.RowOffset
 	targetCol := int32(currentAddr.Column) + n.ColOffset
 
@@ -129,23 +214,13 @@ func (n *CellRefNode) Eval(s *Spreadsheet) (Primitive, error) {
 	// in Calculate()
 
 	// Get worksheet
-	worksheet, exists := s.storage.worksheets.GetWorksheet(worksheetID)
+	worksheet, exists := ctx.spreadsheet.storage.worksheets.GetWorksheet(worksheetID)
 	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeRef, "Worksheet not found")
 	}
 
-	// Get cell value
-	cell := worksheet.GetCell(uint32(targetRow), uint32(targetCol))
-	if cell == nil {
-		return nil, nil // Empty cell
-	}
-
-	// If it's a formula cell with a result, return the result
-	if cell.FormulaID != 0 && cell.FormulaResultType != CellValueTypeEmpty {
-		return cell.Value, nil
-	}
-
-	return cell.Value, nil
+	// Get cell value, nil for empty cells
+	return worksheet.GetValue(uint32(targetRow), uint32(targetCol)), nil
 }
 
 func (n *CellRefNode) GetPosition() NodePosition {
@@ -159,53 +234,89 @@ func (n *CellRefNode) ToString() string {
 	return fmt.Sprintf("REF(%d,%d)", n.RowOffset, n.ColOffset)
 }
 
-// RangeNode represents a range of cells
+// RangeNode represents a range of cells. whole-column ranges (A:C) ignore
+// their row offsets and whole-row ranges (2:4) their column offsets.
 type RangeNode struct {
 	WorksheetID    uint32
 	StartRowOffset int32
 	StartColOffset int32
 	EndRowOffset   int32
 	EndColOffset   int32
+	WholeColumns   bool // rows are unbounded, e.g. A:C
+	WholeRows      bool // columns are unbounded, e.g. 2:4
 	Position       NodePosition
 }
 
-func (n *RangeNode) Eval(s *Spreadsheet) (Primitive, error) {
-	// calculate absolute range from relative offsets
-	currentAddr := s.GetCurrentAddress()
-	startRow := int32(currentAddr.Row) + n.StartRowOffset
-	startCol := int32(currentAddr.Column) + n.StartColOffset
-	endRow := int32(currentAddr.Row) + n.EndRowOffset
-	endCol := int32(currentAddr.Column) + n.EndColOffset
+// bounds resolves the range relative to the cell of its formula, with start
+// before end. whole-column and whole-row ranges span the worksheet in their
+// unbounded direction. ok is false when the range falls off the worksheet.
+func (n *RangeNode) bounds(origin CellAddress) (rangeAddr RangeAddress, ok bool) {
+	startRow := int32(origin.Row) + n.StartRowOffset
+	startCol := int32(origin.Column) + n.StartColOffset
+	endRow := int32(origin.Row) + n.EndRowOffset
+	endCol := int32(origin.Column) + n.EndColOffset
+	if n.WholeColumns {
+		startRow, endRow = 0, int32(MaxRows-1)
+	}
+	if n.WholeRows {
+		startCol, endCol = 0, int32(MaxColumns-1)
+	}
 
 	if startRow < 0 || startCol < 0 || endRow < 0 || endCol < 0 {
-		return nil, NewSpreadsheetError(ErrorCodeRef, "Invalid range reference")
+		return RangeAddress{}, false
 	}
 
 	worksheetID := n.WorksheetID
 	if worksheetID == 0 {
-		worksheetID = currentAddr.WorksheetID
+		worksheetID = origin.WorksheetID
 	}
+	return RangeAddress{
+		WorksheetID: worksheetID,
+		StartRow:    uint32(min(startRow, endRow)),
+		StartColumn: uint32(min(startCol, endCol)),
+		EndRow:      uint32(max(startRow, endRow)),
+		EndColumn:   uint32(max(startCol, endCol)),
+	}, true
+}
 
-	worksheet, exists := s.storage.worksheets.GetWorksheet(worksheetID)
+func (n *RangeNode) Eval(ctx *EvalContext) (Primitive, error) {
+	// calculate absolute range from relative offsets
+	rangeAddr, ok := n.bounds(ctx.GetCurrentAddress())
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeRef, "Invalid range reference")
+	}
+
+	worksheet, exists := ctx.spreadsheet.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
 	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeRef, "Worksheet not found")
 	}
 
-	// normalize the range so start is always less than or equal to end
-	normalizedStartRow := min(startRow, endRow)
-	normalizedEndRow := max(startRow, endRow)
-	normalizedStartCol := min(startCol, endCol)
-	normalizedEndCol := max(startCol, endCol)
+	// whole-column and whole-row ranges stop at the used extent of the
+	// worksheet rather than covering a million rows
+	if n.WholeColumns || n.WholeRows {
+		lastRow, lastCol, _ := worksheet.UsedExtent()
+		if n.WholeColumns {
+			rangeAddr.EndRow = max(lastRow, rangeAddr.StartRow)
+		}
+		if n.WholeRows {
+			rangeAddr.EndColumn = max(lastCol, rangeAddr.StartColumn)
+		}
+	}
+
+	if err := ctx.spreadsheet.limits.checkRangeSize(rangeAddr.StartRow, rangeAddr.StartColumn,
+		rangeAddr.EndRow, rangeAddr.EndColumn); err != nil {
+		return nil, err
+	}
 
 	// create and return a CellRange
 	return &CellRange{
-		worksheetID: worksheetID,
-		startRow:    uint32(normalizedStartRow),
-		startCol:    uint32(normalizedStartCol),
-		endRow:      uint32(normalizedEndRow),
-		endCol:      uint32(normalizedEndCol),
+		worksheetID: rangeAddr.WorksheetID,
+		startRow:    rangeAddr.StartRow,
+		startCol:    rangeAddr.StartColumn,
+		endRow:      rangeAddr.EndRow,
+		endCol:      rangeAddr.EndColumn,
 		worksheet:   worksheet,
-		storage:     s.storage,
+		storage:     ctx.spreadsheet.storage,
 	}, nil
 }
 
@@ -214,7 +325,16 @@ func (n *RangeNode) GetPosition() NodePosition {
 }
 
 func (n *RangeNode) ToString() string {
-	if n.WorksheetID != 0 {
+	switch {
+	case n.WholeColumns && n.WorksheetID != 0:
+		return fmt.Sprintf("WS_COLS(%d,%d,%d)", n.WorksheetID, n.StartColOffset, n.EndColOffset)
+	case n.WholeColumns:
+		return fmt.Sprintf("N_WS_COLS(%d,%d)", n.StartColOffset, n.EndColOffset)
+	case n.WholeRows && n.WorksheetID != 0:
+		return fmt.Sprintf("WS_ROWS(%d,%d,%d)", n.WorksheetID, n.StartRowOffset, n.EndRowOffset)
+	case n.WholeRows:
+		return fmt.Sprintf("N_WS_ROWS(%d,%d)", n.StartRowOffset, n.EndRowOffset)
+	case n.WorksheetID != 0:
 		return fmt.Sprintf("WS_RANGE(%d,%d,%d,%d,%d)", n.WorksheetID,
 			n.StartRowOffset, n.StartColOffset, n.EndRowOffset, n.EndColOffset)
 	}
@@ -222,31 +342,102 @@ func (n *RangeNode) ToString() string {
 		n.StartRowOffset, n.StartColOffset, n.EndRowOffset, n.EndColOffset)
 }
 
+// Range3DNode represents the same area across a span of worksheets, e.g.
+// Jan:Dec!B7. the span covers every worksheet between the two endpoints in
+// tab order, so it follows worksheets added, moved or removed inside it.
+type Range3DNode struct {
+	FirstWorksheetID uint32
+	LastWorksheetID  uint32
+	Area             *RangeNode // area on every worksheet, its WorksheetID is unset
+	Position         NodePosition
+}
+
+// areaOn returns the area of the reference on one worksheet
+func (n *Range3DNode) areaOn(worksheetID uint32) *RangeNode {
+	area := *n.Area
+	area.WorksheetID = worksheetID
+	return &area
+}
+
+func (n *Range3DNode) Eval(ctx *EvalContext) (Primitive, error) {
+	span, ok := ctx.spreadsheet.storage.worksheets.GetWorksheetSpan(n.FirstWorksheetID, n.LastWorksheetID)
+	if !ok {
+		return nil, NewSpreadsheetError(ErrorCodeRef, "Worksheet span not found")
+	}
+
+	areas := make([]*CellRange, 0, len(span))
+	cells := uint64(0)
+	for _, worksheetID := range span {
+		value, err := n.areaOn(worksheetID).Eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		area := value.(*CellRange)
+		cells += uint64(area.Size())
+		areas = append(areas, area)
+	}
+
+	if err := ctx.spreadsheet.limits.checkRangeCells(cells); err != nil {
+		return nil, err
+	}
+
+	return &MultiRange{areas: areas}, nil
+}
+
+func (n *Range3DNode) GetPosition() NodePosition {
+	return n.Position
+}
+
+func (n *Range3DNode) ToString() string {
+	return fmt.Sprintf("WS_SPAN(%d,%d,%s)", n.FirstWorksheetID, n.LastWorksheetID, n.Area.ToString())
+}
+
 // NamedRangeNode represents a named range reference
 type NamedRangeNode struct {
-	Name     string
-	Position NodePosition
+	Name        string
+	WorksheetID uint32 // worksheet of a qualified name like Sheet1!Total, 0 if unqualified
+	Position    NodePosition
+}
+
+// nameID returns the ID of the name the node refers to from a formula on a
+// worksheet. unqualified names local to the worksheet come before workbook
+// names.
+func (n *NamedRangeNode) nameID(names *NamedRangeTable, worksheetID uint32) (uint32, bool) {
+	if n.WorksheetID != 0 {
+		return names.GetNamedRangeID(n.WorksheetID, n.Name)
+	}
+	return names.ResolveNamedRangeID(worksheetID, n.Name)
 }
 
-func (n *NamedRangeNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *NamedRangeNode) Eval(ctx *EvalContext) (Primitive, error) {
 	// Look up named range
-	nameID, exists := s.storage.namedRanges.GetNamedRangeID(n.Name)
+	nameID, exists := n.nameID(ctx.spreadsheet.storage.namedRanges, ctx.GetCurrentAddress().WorksheetID)
 	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Named range '%s' not found", n.Name))
 	}
 
+	// names defined as formulas evaluate them
+	if formula, isFormula := ctx.spreadsheet.storage.namedRanges.GetFormula(nameID); isFormula {
+		return ctx.evalNamedFormula(formula)
+	}
+
 	// Get range address
-	rangeAddr, exists := s.storage.namedRanges.GetRangeAddress(nameID)
+	rangeAddr, exists := ctx.spreadsheet.storage.namedRanges.GetRangeAddress(nameID)
 	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeName, fmt.Sprintf("Named range '%s' is not defined", n.Name))
 	}
 
 	// Get worksheet
-	worksheet, exists := s.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
+	worksheet, exists := ctx.spreadsheet.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
 	if !exists {
 		return nil, NewSpreadsheetError(ErrorCodeRef, "Worksheet not found for named range")
 	}
 
+	if err := ctx.spreadsheet.limits.checkRangeSize(rangeAddr.StartRow, rangeAddr.StartColumn,
+		rangeAddr.EndRow, rangeAddr.EndColumn); err != nil {
+		return nil, err
+	}
+
 	// Return a CellRange for the named range
 	return &CellRange{
 		worksheetID: rangeAddr.WorksheetID,
@@ -255,7 +446,7 @@ func (n *NamedRangeNode) Eval(s *Spreadsheet) (Primitive, error) {
 		endRow:      rangeAddr.EndRow,
 		endCol:      rangeAddr.EndColumn,
 		worksheet:   worksheet,
-		storage:     s.storage,
+		storage:     ctx.spreadsheet.storage,
 	}, nil
 }
 
@@ -264,6 +455,9 @@ func (n *NamedRangeNode) GetPosition() NodePosition {
 }
 
 func (n *NamedRangeNode) ToString() string {
+	if n.WorksheetID != 0 {
+		return fmt.Sprintf("WS_NAME(%d,%s)", n.WorksheetID, n.Name)
+	}
 	return n.Name
 }
 
@@ -275,27 +469,35 @@ type BinaryOpNode struct {
 	Position NodePosition
 }
 
-func (n *BinaryOpNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *BinaryOpNode) Eval(ctx *EvalContext) (Primitive, error) {
 	// evaluate left and right operands
 	// errors from evaluation are converted to error values
-	leftVal, err := n.Left.Eval(s)
+	leftVal, err := n.Left.Eval(ctx)
 	if err != nil {
-		// convert evaluation errors to error values
-		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-			leftVal = spreadsheetErr
-		} else {
-			leftVal = NewSpreadsheetError(ErrorCodeValue, err.Error())
-		}
+		leftVal = toErrorValue(err)
 	}
 
-	rightVal, err := n.Right.Eval(s)
+	rightVal, err := n.Right.Eval(ctx)
 	if err != nil {
-		// convert evaluation errors to error values
-		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-			rightVal = spreadsheetErr
-		} else {
-			rightVal = NewSpreadsheetError(ErrorCodeValue, err.Error())
-		}
+		rightVal = toErrorValue(err)
+	}
+
+	return evalBinaryOp(ctx, n.Op, leftVal, rightVal)
+}
+
+// toErrorValue converts an evaluation error to an error value
+func toErrorValue(err error) *SpreadsheetError {
+	if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
+		return spreadsheetErr
+	}
+	return NewSpreadsheetError(ErrorCodeValue, err.Error())
+}
+
+// evalBinaryOp applies a binary operator to evaluated operands
+func evalBinaryOp(ctx *EvalContext, op BinaryOp, leftVal, rightVal Primitive) (Primitive, error) {
+	// ranges and arrays are combined element by element
+	if isArrayOperand(leftVal) || isArrayOperand(rightVal) {
+		return broadcastBinaryOp(ctx, op, leftVal, rightVal)
 	}
 
 	// propagate errors
@@ -306,7 +508,7 @@ func (n *BinaryOpNode) Eval(s *Spreadsheet) (Primitive, error) {
 		return err, nil
 	}
 
-	switch n.Op {
+	switch op {
 	case BinOpAdd:
 		// try numeric addition first
 		if leftNum, leftOk := toNumber(leftVal); leftOk {
@@ -352,7 +554,7 @@ func (n *BinaryOpNode) Eval(s *Spreadsheet) (Primitive, error) {
 		return math.Pow(leftNum, rightNum), nil
 
 	case BinOpConcat:
-		return toString(leftVal) + toString(rightVal), nil
+		return ctx.spreadsheet.limits.checkStringResult(toString(leftVal) + toString(rightVal)), nil
 
 	case BinOpEqual:
 		return comparePrimitives(leftVal, rightVal) == 0, nil
@@ -437,17 +639,21 @@ type UnaryOpNode struct {
 	Position NodePosition
 }
 
-func (n *UnaryOpNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *UnaryOpNode) Eval(ctx *EvalContext) (Primitive, error) {
 	// Evaluate operand
 	// Errors from evaluation are converted to error values
-	val, err := n.Operand.Eval(s)
+	val, err := n.Operand.Eval(ctx)
 	if err != nil {
-		// Convert evaluation errors to error values
-		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-			val = spreadsheetErr
-		} else {
-			val = NewSpreadsheetError(ErrorCodeValue, err.Error())
-		}
+		val = toErrorValue(err)
+	}
+
+	return evalUnaryOp(n.Op, val)
+}
+
+// evalUnaryOp applies a unary operator to an evaluated operand
+func evalUnaryOp(op UnaryOp, val Primitive) (Primitive, error) {
+	if isArrayOperand(val) {
+		return broadcastUnaryOp(op, val)
 	}
 
 	// Check for error in value and propagate it
@@ -455,7 +661,7 @@ func (n *UnaryOpNode) Eval(s *Spreadsheet) (Primitive, error) {
 		return err, nil
 	}
 
-	switch n.Op {
+	switch op {
 	case UnaryOpPlus:
 		num, ok := toNumber(val)
 		if !ok {
@@ -503,36 +709,42 @@ func (n *UnaryOpNode) ToString() string {
 type FunctionCallNode struct {
 	Name     string
 	Args     []ASTNode
+	Local    bool // calls a LAMBDA bound by an enclosing LET or LAMBDA
 	Position NodePosition
 }
 
-func (n *FunctionCallNode) Eval(s *Spreadsheet) (Primitive, error) {
+func (n *FunctionCallNode) Eval(ctx *EvalContext) (Primitive, error) {
+	// special forms decide which of their arguments to evaluate
+	if n.isSpecialForm() {
+		args := make([]compiledFormula, len(n.Args))
+		for i, argNode := range n.Args {
+			args[i] = argNode.Eval
+		}
+		return specialForm(n, args)(ctx)
+	}
+
 	// Evaluate arguments
 	args := make([]any, len(n.Args))
 	for i, argNode := range n.Args {
-		argVal, err := argNode.Eval(s)
+		argVal, err := argNode.Eval(ctx)
 		if err != nil {
-			// If the error is a SpreadsheetError, pass it as a value to the function
-			// Functions will decide how to handle error values
-			if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-				args[i] = spreadsheetErr
-			} else {
-				// For non-SpreadsheetErrors (shouldn't happen), convert to SpreadsheetError
-				args[i] = NewSpreadsheetError(ErrorCodeValue, err.Error())
-			}
+			// pass errors as values to the function, functions will decide how
+			// to handle error values
+			args[i] = toErrorValue(err)
 		} else {
 			args[i] = argVal
 		}
 	}
 
+	// functions that aren't built in may be LAMBDAs defined as names
+	if _, builtin := lookupFunction(n.Name); !builtin {
+		return callNamedFunction(ctx, n.Name, args)
+	}
+
 	// Call built-in function
-	result, err := s.functions.Call(n.Name, args...)
+	result, err := ctx.spreadsheet.functions.Call(n.Name, args...)
 	if err != nil {
-		// Convert regular error to SpreadsheetError if needed
-		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-			return nil, spreadsheetErr
-		}
-		return nil, NewSpreadsheetError(ErrorCodeValue, err.Error())
+		return nil, toErrorValue(err)
 	}
 
 	return result, nil
@@ -606,8 +818,29 @@ func (p *Parser) Parse() (ASTNode, error) {
 	return node, nil
 }
 
+// enter increases the nesting depth, returning an error once it exceeds the
+// maximum depth of the context. callers must call leave when done.
+func (p *Parser) enter() error {
+	p.depth++
+	if p.context != nil && p.context.MaxDepth > 0 && p.depth > p.context.MaxDepth {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Formula nesting exceeds depth limit of %d", p.context.MaxDepth))
+	}
+	return nil
+}
+
+// leave decreases the nesting depth
+func (p *Parser) leave() {
+	p.depth--
+}
+
 // parseComparison handles comparison operators (lowest precedence)
 func (p *Parser) parseComparison() (ASTNode, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+
 	left, err := p.parseConcatenation()
 	if err != nil {
 		return nil, err
@@ -821,6 +1054,10 @@ func (p *Parser) parseUnary() (ASTNode, error) {
 
 		startPos := tok.Pos
 		p.pos++
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
 		operand, err := p.parseUnary() // recurse for chained unary operators
 		if err != nil {
 			return nil, err
@@ -902,8 +1139,21 @@ func (p *Parser) parsePrimary() (ASTNode, error) {
 		p.pos++
 		return p.parseRange(tok)
 
+	case TokenStructured:
+		p.pos++
+		return p.parseStructuredRef(tok)
+
 	case TokenIdentifier:
 		p.pos++
+		if strings.Contains(tok.Value, "!") {
+			return p.parseQualifiedName(tok)
+		}
+		if p.inScope(tok.Value) {
+			return &VariableNode{
+				Name:     tok.Value,
+				Position: NodePosition{Start: tok.Pos, End: tok.Pos + len(tok.Value)},
+			}, nil
+		}
 		// could be a named range
 		return &NamedRangeNode{
 			Name:     tok.Value,
@@ -913,6 +1163,9 @@ func (p *Parser) parsePrimary() (ASTNode, error) {
 	case TokenFunction:
 		return p.parseFunctionCall()
 
+	case TokenLeftBrace:
+		return p.parseArray()
+
 	case TokenLeftParen:
 		p.pos++
 		node, err := p.parseComparison()
@@ -949,6 +1202,11 @@ func (p *Parser) parseFunctionCall() (ASTNode, error) {
 	}
 	p.pos++
 
+	// LET and LAMBDA bind names for their later arguments
+	if !p.inScope(funcName) && (funcName == "LET" || funcName == "LAMBDA") {
+		return p.parseBindings(funcName, startPos)
+	}
+
 	// parse arguments
 	args := []ASTNode{}
 
@@ -958,6 +1216,7 @@ func (p *Parser) parseFunctionCall() (ASTNode, error) {
 		return &FunctionCallNode{
 			Name:     funcName,
 			Args:     args,
+			Local:    p.inScope(funcName),
 			Position: NodePosition{Start: startPos, End: p.tokens[p.pos-1].Pos + 1},
 		}, nil
 	}
@@ -994,6 +1253,67 @@ func (p *Parser) parseFunctionCall() (ASTNode, error) {
 		p.pos++
 	}
 
+	return &FunctionCallNode{
+		Name:     funcName,
+		Args:     args,
+		Local:    p.inScope(funcName),
+		Position: NodePosition{Start: startPos, End: p.tokens[p.pos-1].Pos + 1},
+	}, nil
+}
+
+// parseBindings parses the arguments of LET(name1, value1, ..., calculation)
+// or LAMBDA(parameter1, ..., calculation). names are in scope from the
+// argument after them on, parameters within the calculation.
+func (p *Parser) parseBindings(funcName string, startPos int) (ASTNode, error) {
+	isLet := funcName == "LET"
+	bound := 0
+	defer func() { p.scope = p.scope[:len(p.scope)-bound] }()
+
+	args := []ASTNode{}
+	for p.pos+1 < len(p.tokens) && p.tokens[p.pos].Type == TokenIdentifier && p.tokens[p.pos+1].Type == TokenComma {
+		nameTok := p.tokens[p.pos]
+		p.pos += 2 // name and comma
+		args = append(args, &VariableNode{
+			Name:     nameTok.Value,
+			Position: NodePosition{Start: nameTok.Pos, End: nameTok.Pos + len(nameTok.Value)},
+		})
+		if !isLet {
+			for _, param := range args[:len(args)-1] {
+				if strings.EqualFold(param.(*VariableNode).Name, nameTok.Value) {
+					return nil, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("LAMBDA parameter %s is repeated", nameTok.Value))
+				}
+			}
+			p.scope = append(p.scope, nameTok.Value)
+			bound++
+			continue
+		}
+
+		value, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].Type != TokenComma {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "LET requires a calculation after its last value")
+		}
+		p.pos++
+		p.scope = append(p.scope, nameTok.Value)
+		bound++
+	}
+	if isLet && bound == 0 {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "LET requires a name and a value before its calculation")
+	}
+
+	calculation, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, calculation)
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].Type != TokenRightParen {
+		return nil, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("expected ')' after the calculation of %s", funcName))
+	}
+	p.pos++
+
 	return &FunctionCallNode{
 		Name:     funcName,
 		Args:     args,
@@ -1001,6 +1321,90 @@ func (p *Parser) parseFunctionCall() (ASTNode, error) {
 	}, nil
 }
 
+// inScope reports whether a name is bound by an enclosing LET or LAMBDA.
+// names are matched ignoring case, like function names.
+func (p *Parser) inScope(name string) bool {
+	for _, bound := range p.scope {
+		if strings.EqualFold(bound, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArray parses an array constant. rows must all have the same number
+// of values.
+func (p *Parser) parseArray() (ASTNode, error) {
+	startPos := p.tokens[p.pos].Pos
+	p.pos++
+
+	rows := [][]ASTNode{{}}
+	for {
+		value, err := p.parseArrayValue()
+		if err != nil {
+			return nil, err
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], value)
+
+		if p.pos >= len(p.tokens) {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "unexpected end in array constant")
+		}
+		tok := p.tokens[p.pos]
+		p.pos++
+		switch tok.Type {
+		case TokenComma:
+			continue
+		case TokenSemicolon:
+			rows = append(rows, []ASTNode{})
+			continue
+		case TokenRightBrace:
+		default:
+			return nil, NewSpreadsheetError(ErrorCodeValue, "expected ',', ';' or '}' in array constant")
+		}
+
+		for _, row := range rows {
+			if len(row) != len(rows[0]) {
+				return nil, NewSpreadsheetError(ErrorCodeValue, "array constant rows must have the same number of values")
+			}
+		}
+		return &ArrayNode{
+			Rows:     rows,
+			Position: NodePosition{Start: startPos, End: tok.Pos + 1},
+		}, nil
+	}
+}
+
+// parseArrayValue parses a value of an array constant: a number with an
+// optional sign, a string or a boolean
+func (p *Parser) parseArrayValue() (ASTNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, NewSpreadsheetError(ErrorCodeValue, "unexpected end in array constant")
+	}
+
+	tok := p.tokens[p.pos]
+	switch tok.Type {
+	case TokenNumber, TokenString, TokenBoolean:
+		return p.parsePrimary()
+
+	case TokenUnaryPrefixOp:
+		p.pos++
+		value, err := p.parseArrayValue()
+		if err != nil {
+			return nil, err
+		}
+		number, isNumber := value.(*NumberNode)
+		if !isNumber {
+			return nil, NewSpreadsheetError(ErrorCodeValue, "only numbers can be signed in array constants")
+		}
+		if tok.Value == "-" {
+			number.Value = -number.Value
+		}
+		number.Position.Start = tok.Pos
+		return number, nil
+	}
+	return nil, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("array constants can only hold numbers, strings and booleans, got %s", tok.Value))
+}
+
 // isValueToken checks if the token at position is a value token
 func (p *Parser) isValueToken(pos int) bool {
 	if pos >= len(p.tokens) {
@@ -1009,7 +1413,7 @@ func (p *Parser) isValueToken(pos int) bool {
 
 	switch p.tokens[pos].Type {
 	case TokenNumber, TokenString, TokenBoolean, TokenCell, TokenRange,
-		TokenIdentifier, TokenFunction, TokenLeftParen:
+		TokenStructured, TokenIdentifier, TokenFunction, TokenLeftParen, TokenLeftBrace:
 		return true
 	case TokenUnaryPrefixOp:
 		// Unary operators can start a value
@@ -1059,11 +1463,75 @@ func (p *Parser) parseCellReference(tok Token) (ASTNode, error) {
 	}, nil
 }
 
+// parseQualifiedName parses a name local to a worksheet, like Sheet1!Total
+func (p *Parser) parseQualifiedName(tok Token) (ASTNode, error) {
+	idx := strings.LastIndex(tok.Value, "!")
+	worksheetName := tok.Value[:idx]
+	if strings.HasPrefix(worksheetName, "'") && strings.HasSuffix(worksheetName, "'") {
+		worksheetName = worksheetName[1 : len(worksheetName)-1]
+	}
+
+	var worksheetID uint32
+	if p.context.ResolveWorksheet != nil {
+		worksheetID = p.context.ResolveWorksheet(worksheetName)
+	}
+	if worksheetID == 0 {
+		return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("unknown worksheet: %s", worksheetName))
+	}
+
+	return &NamedRangeNode{
+		Name:        tok.Value[idx+1:],
+		WorksheetID: worksheetID,
+		Position:    NodePosition{Start: tok.Pos, End: tok.Pos + len(tok.Value)},
+	}, nil
+}
+
+// parseStructuredRef parses a structured reference into a table, like
+// Sales[Amount] or [@Qty]
+func (p *Parser) parseStructuredRef(tok Token) (ASTNode, error) {
+	idx := strings.Index(tok.Value, "[")
+	tableName := tok.Value[:idx]
+	area, first, last, err := parseTableSpecifier(tok.Value[idx+1 : len(tok.Value)-1])
+	if err != nil {
+		return nil, NewSpreadsheetError(ErrorCodeRef, err.Error())
+	}
+
+	var table *Table
+	if p.context.ResolveTable != nil {
+		table = p.context.ResolveTable(tableName)
+	}
+	if table == nil {
+		if tableName == "" {
+			return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("structured reference outside of a table: %s", tok.Value))
+		}
+		return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("unknown table: %s", tableName))
+	}
+
+	node := &StructuredRefNode{
+		TableID:     table.ID,
+		Area:        area,
+		FirstColumn: -1,
+		LastColumn:  -1,
+		Position:    NodePosition{Start: tok.Pos, End: tok.Pos + len(tok.Value)},
+	}
+	if first != "" {
+		node.FirstColumn, node.LastColumn = table.columnIndex(first), table.columnIndex(last)
+		if node.FirstColumn < 0 || node.LastColumn < 0 {
+			return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("unknown column in table %s: %s", table.Name, tok.Value))
+		}
+		if node.FirstColumn > node.LastColumn {
+			node.FirstColumn, node.LastColumn = node.LastColumn, node.FirstColumn
+		}
+	}
+	return node, nil
+}
+
 // parseRange parses a range token into a RangeNode
 func (p *Parser) parseRange(tok Token) (ASTNode, error) {
 	// extract worksheet info if present
 	worksheetID := p.context.CurrentWorksheetID
 	rangeStr := tok.Value
+	position := NodePosition{Start: tok.Pos, End: tok.Pos + len(tok.Value)}
 
 	// check for worksheet reference (contains !)
 	if idx := strings.Index(rangeStr, "!"); idx != -1 {
@@ -1075,18 +1543,81 @@ func (p *Parser) parseRange(tok Token) (ASTNode, error) {
 			worksheetName = worksheetName[1 : len(worksheetName)-1]
 		}
 
+		// a span of worksheets makes a 3D reference
+		if firstName, lastName, isSpan := strings.Cut(worksheetName, ":"); isSpan {
+			return p.parseRange3D(firstName, lastName, rangeStr, position)
+		}
+
 		// resolve worksheet name to ID
 		if p.context.ResolveWorksheet != nil {
 			worksheetID = p.context.ResolveWorksheet(worksheetName)
 		}
 	}
 
+	return p.parseArea(rangeStr, worksheetID, position)
+}
+
+// parseRange3D parses a 3D reference like Jan:Dec!B7 into a Range3DNode. a
+// single cell becomes a one-cell area.
+func (p *Parser) parseRange3D(firstName, lastName, rangeStr string, position NodePosition) (ASTNode, error) {
+	var firstID, lastID uint32
+	if p.context.ResolveWorksheet != nil {
+		firstID = p.context.ResolveWorksheet(firstName)
+		lastID = p.context.ResolveWorksheet(lastName)
+	}
+
+	if !strings.Contains(rangeStr, ":") {
+		rangeStr = rangeStr + ":" + rangeStr
+	}
+	area, err := p.parseArea(rangeStr, 0, position)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Range3DNode{
+		FirstWorksheetID: firstID,
+		LastWorksheetID:  lastID,
+		Area:             area,
+		Position:         position,
+	}, nil
+}
+
+// parseArea parses the cells of a range, without a worksheet prefix, into a
+// RangeNode on the given worksheet
+func (p *Parser) parseArea(rangeStr string, worksheetID uint32, position NodePosition) (*RangeNode, error) {
 	// split the range
 	parts := strings.Split(rangeStr, ":")
 	if len(parts) != 2 {
 		return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("invalid range format: %s", rangeStr))
 	}
 
+	node := &RangeNode{
+		WorksheetID: worksheetID,
+		Position:    position,
+	}
+
+	// whole-column (A:C) and whole-row (2:4) ranges
+	if startCol, ok := parseColumnLetters(parts[0]); ok {
+		endCol, ok := parseColumnLetters(parts[1])
+		if !ok {
+			return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("invalid end column in range: %s", parts[1]))
+		}
+		node.WholeColumns = true
+		node.StartColOffset = startCol - p.context.CurrentColumn
+		node.EndColOffset = endCol - p.context.CurrentColumn
+		return node, nil
+	}
+	if startRow, ok := parseRowNumber(parts[0]); ok {
+		endRow, ok := parseRowNumber(parts[1])
+		if !ok {
+			return nil, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("invalid end row in range: %s", parts[1]))
+		}
+		node.WholeRows = true
+		node.StartRowOffset = startRow - p.context.CurrentRow
+		node.EndRowOffset = endRow - p.context.CurrentRow
+		return node, nil
+	}
+
 	// parse start and end cells
 	startCol, startRow, err := p.parseCellAddress(parts[0])
 	if err != nil {
@@ -1099,19 +1630,40 @@ func (p *Parser) parseRange(tok Token) (ASTNode, error) {
 	}
 
 	// calculate relative offsets
-	startRowOffset := startRow - p.context.CurrentRow
-	startColOffset := startCol - p.context.CurrentColumn
-	endRowOffset := endRow - p.context.CurrentRow
-	endColOffset := endCol - p.context.CurrentColumn
-
-	return &RangeNode{
-		WorksheetID:    worksheetID,
-		StartRowOffset: startRowOffset,
-		StartColOffset: startColOffset,
-		EndRowOffset:   endRowOffset,
-		EndColOffset:   endColOffset,
-		Position:       NodePosition{Start: tok.Pos, End: tok.Pos + len(tok.Value)},
-	}, nil
+	node.StartRowOffset = startRow - p.context.CurrentRow
+	node.StartColOffset = startCol - p.context.CurrentColumn
+	node.EndRowOffset = endRow - p.context.CurrentRow
+	node.EndColOffset = endCol - p.context.CurrentColumn
+	return node, nil
+}
+
+// parseColumnLetters parses a column reference like "C" of a whole-column
+// range into its 0-based index
+func parseColumnLetters(s string) (int32, bool) {
+	if len(s) == 0 || len(s) > 3 {
+		return 0, false
+	}
+	col := int32(0)
+	for _, ch := range strings.ToUpper(s) {
+		if ch < 'A' || ch > 'Z' {
+			return 0, false
+		}
+		col = col*26 + int32(ch-'A') + 1
+	}
+	if col > int32(MaxColumns) {
+		return 0, false
+	}
+	return col - 1, true
+}
+
+// parseRowNumber parses a row reference like "4" of a whole-row range into
+// its 0-based index
+func parseRowNumber(s string) (int32, bool) {
+	row, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || row < 1 || row > int64(MaxRows) {
+		return 0, false
+	}
+	return int32(row - 1), true
 }
 
 // parseCellAddress parses a cell address like "A1" into column and
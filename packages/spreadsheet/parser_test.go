@@ -21,6 +21,17 @@ func createTestParser() *Parser {
 				return 0
 			}
 		},
+		ResolveTable: func(name string) *Table {
+			if name != "" && name != "Sales" {
+				return nil
+			}
+			return &Table{
+				ID:      1,
+				Name:    "Sales",
+				Range:   RangeAddress{WorksheetID: 1, StartRow: 0, EndRow: 5, EndColumn: 2},
+				Columns: []string{"Qty", "Unit Price", "Amount"},
+			}
+		},
 	}
 	return NewParser([]Token{}, context)
 }
@@ -55,6 +66,33 @@ func TestParserBasicFormulas(t *testing.T) {
 		"=SUM(B2:A1)",
 		"=SUM(A1:A1)",
 		"=SUM(A1:Z1000)",
+		"=SUM(A:A)",
+		"=SUM(b:D)",
+		"=SUM(3:3)",
+		"=SUM(2:10)*2",
+		"=Sheet2!B:D",
+		"=SUM('Sheet2'!1:5)",
+		"=SUM(Sheet2!A:XFD)",
+		"=SUM(Sheet1:Sheet3!A1)",
+		"=SUM('Sheet1:Sheet2'!A1:B2)",
+		"=AVERAGE(Jan:Dec!B:B)",
+		"=A1:A3*B1:B3",
+		"=-A1:A3+1",
+		"=SUM({1,2,3})",
+		`={"a",1;"b",-2.5}`,
+		"=SUM({1,2}*{3;4})",
+		"=SUM(A1:A3, {TRUE,FALSE})",
+		"=LET(x, 1, y, x+1, x*y)",
+		"=LAMBDA(a, b, a*b)",
+		"=LET(f, LAMBDA(x, x*2), f(3))",
+		"=MAP(A1:A3, LAMBDA(v, v+1))",
+		"=Sheet2!Total*2",
+		"=SUM(Sheet1!Sales_2024)",
+		"=SUM(Sales[Amount])",
+		"=[@Qty]*[@[Unit Price]]",
+		"=SUM(Sales[[#Totals],[Qty]:[Amount]])",
+		"=ROWS(Sales[#All])+ROWS(Sales[])",
+		"=IFERROR(ERROR.TYPE(A1), NA())",
 		`="Hello 世界"`,
 		`="Test 😀 emoji"`,
 		`=CONCATENATE("Hello ", "世界")`,
@@ -74,7 +112,32 @@ func TestParserInvalidFormulas(t *testing.T) {
 		"=",
 		"=SUM(",
 		"=A1:",
+		"=SUM(A:A1)",
+		"=SUM(1:A)",
+		"=SUM(0:3)",
+		"=SUM(A:ABCD)",
+		"=Sheet2!A:",
+		"=SUM(Sheet1:Sheet3!)",
 		`="hello`,
+		"={1,2;3}",
+		"={A1,2}",
+		"={1,{2}}",
+		"={1,2",
+		"=1}",
+		"={}",
+		"={-\"a\"}",
+		"=1;2",
+		"=LET(x, 1)",
+		"=LET(1, 2, 3)",
+		"=LAMBDA(x, x, x+1)",
+		"=LAMBDA()",
+		"=Sheet1:Sheet3!Total",
+		"=NoSuchSheet!Total",
+		"=Sheet1!Total(1)",
+		"=Sales[Discount]",
+		"=Orders[Qty]",
+		"=Sales[Qty",
+		"=Sales[[#Headers],[#Totals]]",
 	}
 
 	for _, formula := range invalidFormulas {
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// PasteMode selects what CopyRange pastes
+type PasteMode int
+
+const (
+	PasteAll      PasteMode = iota // values and formulas
+	PasteValues                    // values, with formulas pasted as their calculated results
+	PasteFormulas                  // formulas only, other destination cells are left untouched
+)
+
+// FillDirection selects the direction FillSeries extends a series in
+type FillDirection int
+
+const (
+	FillDirectionDown  FillDirection = iota // each column is a series, starting at the top
+	FillDirectionRight                      // each row is a series, starting at the left
+)
+
+// SeriesUnit selects how FillSeries steps from one value to the next
+type SeriesUnit int
+
+const (
+	SeriesLinear SeriesUnit = iota // adds the step, for numbers and for dates in days
+	SeriesMonths                   // adds the step in months to a date
+	SeriesYears                    // adds the step in years to a date
+)
+
+// clipboardCell is a source cell of a copy, relative to the source range
+type clipboardCell struct {
+	rowOffset uint32
+	colOffset uint32
+	value     Primitive
+	ast       ASTNode // formula of the cell, nil for values
+}
+
+// CopyRange copies a cell, like "Sheet1!A1", or a range, like
+// "Sheet1!A1:B2", to a destination. the destination is a cell for the
+// top-left corner, or a range that is filled with copies of the source when
+// its size is a multiple of the source's. formulas keep their relative
+// references, so they are shared with the source in the formula table, and
+// references pushed off the worksheet become #REF!.
+func (s *Spreadsheet) CopyRange(src string, dst string, mode PasteMode) error {
+	if mode < PasteAll || mode > PasteFormulas {
+		return NewApplicationError(InvalidArgument, "Invalid paste mode")
+	}
+
+	source, err := s.resolveRange(src)
+	if err != nil {
+		return err
+	}
+	destination, err := s.resolveRange(dst)
+	if err != nil {
+		return err
+	}
+
+	return s.copyArea(source, destination, mode)
+}
+
+// FillDown copies the top row of a range, like "Sheet1!A1:C10", into the
+// rows below it
+func (s *Spreadsheet) FillDown(rangeAddr string) error {
+	r, err := s.resolveRange(rangeAddr)
+	if err != nil {
+		return err
+	}
+	if r.StartRow == r.EndRow {
+		return nil
+	}
+
+	source := r
+	source.EndRow = r.StartRow
+	destination := r
+	destination.StartRow++
+	return s.copyArea(source, destination, PasteAll)
+}
+
+// FillRight copies the left column of a range, like "Sheet1!A1:C10", into
+// the columns right of it
+func (s *Spreadsheet) FillRight(rangeAddr string) error {
+	r, err := s.resolveRange(rangeAddr)
+	if err != nil {
+		return err
+	}
+	if r.StartColumn == r.EndColumn {
+		return nil
+	}
+
+	source := r
+	source.EndColumn = r.StartColumn
+	destination := r
+	destination.StartColumn++
+	return s.copyArea(source, destination, PasteAll)
+}
+
+// FillSeries fills a range with series starting at the numbers or dates in
+// its first row or column. each column (down) or row (right) is a separate
+// series, lines with an empty first cell are left alone. months and years
+// keep the day of the month where possible, e.g. Jan 31 + 1 month is Feb 28.
+func (s *Spreadsheet) FillSeries(rangeAddr string, direction FillDirection, step float64, unit SeriesUnit) error {
+	r, err := s.resolveRange(rangeAddr)
+	if err != nil {
+		return err
+	}
+	if direction != FillDirectionDown && direction != FillDirectionRight {
+		return NewApplicationError(InvalidArgument, "Invalid fill direction")
+	}
+	if unit < SeriesLinear || unit > SeriesYears {
+		return NewApplicationError(InvalidArgument, "Invalid series unit")
+	}
+	if math.IsNaN(step) || math.IsInf(step, 0) || (unit != SeriesLinear && step != math.Trunc(step)) {
+		return NewApplicationError(InvalidArgument, fmt.Sprintf("Invalid series step %v", step))
+	}
+
+	worksheet, _ := s.storage.worksheets.GetWorksheet(r.WorksheetID)
+
+	// a line is a column when filling down and a row when filling right
+	lines, length := r.EndColumn-r.StartColumn+1, r.EndRow-r.StartRow+1
+	if direction == FillDirectionRight {
+		lines, length = length, lines
+	}
+	at := func(line, i uint32) CellAddress {
+		if direction == FillDirectionRight {
+			return CellAddress{WorksheetID: r.WorksheetID, Row: r.StartRow + line, Column: r.StartColumn + i}
+		}
+		return CellAddress{WorksheetID: r.WorksheetID, Row: r.StartRow + i, Column: r.StartColumn + line}
+	}
+
+	// check every start before writing anything
+	starts := make([]Primitive, lines)
+	for line := range lines {
+		start := at(line, 0)
+		starts[line] = worksheet.GetValue(start.Row, start.Column)
+		if _, isNumber := starts[line].(float64); starts[line] != nil && !isNumber {
+			return NewApplicationError(InvalidArgument,
+				fmt.Sprintf("Series start %s is not a number", s.formatCellAddress(start)))
+		}
+	}
+
+	for line, start := range starts {
+		if start == nil {
+			continue
+		}
+		for i := uint32(1); i < length; i++ {
+			var value float64
+			switch unit {
+			case SeriesMonths:
+				value = addMonthsToSerial(start.(float64), int(step)*int(i))
+			case SeriesYears:
+				value = addMonthsToSerial(start.(float64), 12*int(step)*int(i))
+			default:
+				value = start.(float64) + step*float64(i)
+			}
+			if err := s.setCell(worksheet, at(uint32(line), i), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addMonthsToSerial adds months to a date serial number, clamping the day to
+// the end of the resulting month. the time of day is kept.
+func addMonthsToSerial(serial float64, months int) float64 {
+	days := math.Floor(serial)
+	date := time.UnixMilli(EXCEL_EPOCH_MS + int64(days)*MS_PER_DAY).UTC()
+
+	firstOfMonth := time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	moved := firstOfMonth.AddDate(0, 0, min(date.Day(), lastDay)-1)
+
+	return float64((moved.UnixMilli()-EXCEL_EPOCH_MS)/MS_PER_DAY) + (serial - days)
+}
+
+// copyArea pastes the cells of the source range into the destination,
+// tiling the source over the destination when it fits a whole number of
+// times and pasting it once at the top-left corner otherwise
+func (s *Spreadsheet) copyArea(source, destination RangeAddress, mode PasteMode) error {
+	sourceWorksheet, _ := s.storage.worksheets.GetWorksheet(source.WorksheetID)
+	worksheet, _ := s.storage.worksheets.GetWorksheet(destination.WorksheetID)
+
+	height := source.EndRow - source.StartRow + 1
+	width := source.EndColumn - source.StartColumn + 1
+	tilesDown, tilesRight := uint32(1), uint32(1)
+	if rows, cols := destination.EndRow-destination.StartRow+1, destination.EndColumn-destination.StartColumn+1; rows%height == 0 && cols%width == 0 {
+		tilesDown, tilesRight = rows/height, cols/width
+	}
+	if uint64(destination.StartRow)+uint64(tilesDown*height) > uint64(MaxRows) ||
+		uint64(destination.StartColumn)+uint64(tilesRight*width) > uint64(MaxColumns) {
+		return NewApplicationError(OutOfRange, "Paste area extends past the worksheet")
+	}
+
+	// take the source before writing, the areas may overlap
+	var cells []clipboardCell
+	occupied := make(map[[2]uint32]struct{})
+	sourceWorksheet.occupiedCells(source.StartRow, source.StartColumn, source.EndRow, source.EndColumn, func(row, col uint32) bool {
+		if mode != PasteValues && s.spilledWithin(CellAddress{WorksheetID: source.WorksheetID, Row: row, Column: col}, source) {
+			return true
+		}
+		cell := clipboardCell{
+			rowOffset: row - source.StartRow,
+			colOffset: col - source.StartColumn,
+			value:     sourceWorksheet.GetValue(row, col),
+		}
+		if formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: source.WorksheetID, Row: row, Column: col}); isFormula {
+			cell.ast, _ = s.storage.formulas.GetAST(formulaID)
+			if source.WorksheetID != destination.WorksheetID {
+				cell.ast = retargetWorksheet(cell.ast, source.WorksheetID, destination.WorksheetID, nil)
+			}
+		}
+		cells = append(cells, cell)
+		occupied[[2]uint32{cell.rowOffset, cell.colOffset}] = struct{}{}
+		return true
+	})
+
+	for tileRow := range tilesDown {
+		for tileCol := range tilesRight {
+			top := destination.StartRow + tileRow*height
+			left := destination.StartColumn + tileCol*width
+
+			// cells that are empty in the source are cleared, unless only
+			// formulas are pasted
+			if mode != PasteFormulas {
+				var cleared []CellAddress
+				worksheet.occupiedCells(top, left, top+height-1, left+width-1, func(row, col uint32) bool {
+					if _, exists := occupied[[2]uint32{row - top, col - left}]; !exists {
+						cleared = append(cleared, CellAddress{WorksheetID: destination.WorksheetID, Row: row, Column: col})
+					}
+					return true
+				})
+				for _, cellAddr := range cleared {
+					s.removeCell(worksheet, cellAddr)
+				}
+			}
+
+			for _, cell := range cells {
+				cellAddr := CellAddress{
+					WorksheetID: destination.WorksheetID,
+					Row:         top + cell.rowOffset,
+					Column:      left + cell.colOffset,
+				}
+				if err := s.pasteCell(worksheet, cellAddr, cell, mode); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// pasteCell pastes one source cell into a destination cell
+func (s *Spreadsheet) pasteCell(worksheet *Worksheet, cellAddr CellAddress, cell clipboardCell, mode PasteMode) error {
+	switch {
+	case cell.ast != nil && mode != PasteValues:
+		return s.setFormulaAST(worksheet, cellAddr, cell.ast)
+
+	case mode == PasteFormulas:
+		return nil
+
+	case cell.value == nil:
+		s.removeCell(worksheet, cellAddr)
+		return nil
+	}
+
+	return s.setCell(worksheet, cellAddr, cell.value)
+}
+
+// setFormulaAST stores an already parsed formula in a cell, as Set does for
+// formula text
+func (s *Spreadsheet) setFormulaAST(worksheet *Worksheet, cellAddr CellAddress, ast ASTNode) error {
+	if err := s.checkNewCell(worksheet, cellAddr); err != nil {
+		return err
+	}
+	if s.hasSubscribers() {
+		oldValue, oldFormula := s.cellState(cellAddr)
+		defer s.emitCellChanges(cellAddr, oldValue, oldFormula)
+	}
+	s.spillCellEdited(worksheet, cellAddr)
+	s.storeFormula(worksheet, cellAddr, ast, "="+s.formulaText(ast, cellAddr))
+	return nil
+}
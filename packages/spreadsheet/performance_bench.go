@@ -69,6 +69,24 @@ func BenchmarkLargeRangeSUM(b *testing.B) {
 	}
 }
 
+func BenchmarkSparseRangeSUM(b *testing.B) {
+	s := NewSpreadsheet()
+	s.AddWorksheet("Sheet1")
+
+	// 50 values spread over a million rows
+	for i := 1; i <= 50; i++ {
+		addr := fmt.Sprintf("Sheet1!A%d", i*20000)
+		s.Set(addr, float64(i))
+	}
+	s.Set("Sheet1!B1", "=SUM(A1:A1000000)")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set("Sheet1!A20000", float64(i))
+		s.Calculate()
+	}
+}
+
 func BenchmarkComplexNestedFormulas(b *testing.B) {
 	s := NewSpreadsheet()
 	s.AddWorksheet("Sheet1")
@@ -292,12 +310,56 @@ func BenchmarkDirtyPropagation(b *testing.B) {
 	}
 }
 
-func columnToLetters(col int) string {
-	result := ""
-	for col > 0 {
-		col--
-		result = string(rune('A'+col%26)) + result
-		col /= 26
+func BenchmarkManyRangeDependencies(b *testing.B) {
+	s := NewSpreadsheet()
+	s.AddWorksheet("Sheet1")
+
+	// 5000 SUM formulas over distinct windows of column A
+	for i := 1; i <= 5000; i++ {
+		s.Set(fmt.Sprintf("Sheet1!A%d", i), float64(i))
+		s.Set(fmt.Sprintf("Sheet1!C%d", i), fmt.Sprintf("=SUM(A%d:A%d)", i, i+9))
+	}
+	s.Calculate()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set("Sheet1!A2500", float64(i))
+		s.Calculate()
+	}
+}
+
+func BenchmarkFormulaEvaluation(b *testing.B) {
+	s := NewSpreadsheet()
+	s.AddWorksheet("Sheet1")
+
+	for i := 1; i <= 200; i++ {
+		s.Set(fmt.Sprintf("Sheet1!A%d", i), float64(i))
+		s.Set(fmt.Sprintf("Sheet1!B%d", i), fmt.Sprintf(`=IF(A%d>100, (A%d*2+1)/3, ROUND(A%d^2-A%d, 1))&"x"`, i, i, i, i))
 	}
-	return result
+
+	worksheetID, _, _, _ := s.resolveAddress("Sheet1!B1")
+	formulas := make([]CellAddress, 0, 200)
+	for row := uint32(0); row < 200; row++ {
+		formulas = append(formulas, CellAddress{WorksheetID: worksheetID, Row: row, Column: 1})
+	}
+
+	// compare the compiled form with walking the AST
+	b.Run("Compiled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, addr := range formulas {
+				formulaID, _ := s.storage.formulas.GetFormulaAtCell(addr)
+				formula, _ := s.storage.formulas.GetCompiled(formulaID)
+				s.evaluateFormula(formula, addr)
+			}
+		}
+	})
+	b.Run("AST", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, addr := range formulas {
+				formulaID, _ := s.storage.formulas.GetFormulaAtCell(addr)
+				ast, _ := s.storage.formulas.GetAST(formulaID)
+				s.evaluateFormula(ast.Eval, addr)
+			}
+		}
+	})
 }
@@ -1,6 +1,10 @@
 package main
 
-import "iter"
+import (
+	"iter"
+	"slices"
+	"strings"
+)
 
 // RangeAddress represents a range of cells within a single worksheet
 type RangeAddress struct {
@@ -12,16 +16,21 @@ type RangeAddress struct {
 }
 
 // NamedRangeTable manages named ranges with ID tracking for efficient renaming.
-// supports both defined and non-existent named ranges with reference counting
+// supports both defined and non-existent named ranges with reference counting.
+// a name is local to a worksheet or belongs to the whole workbook, and the
+// same name may exist in several scopes. names match ignoring case, and a
+// name keeps the spelling it was defined with.
 type NamedRangeTable struct {
 	// core name/ID mapping (for all ranges, defined or not)
 
-	nameToID map[string]uint32 // name -> ID for all ranges
-	idToName map[uint32]string // ID -> name for all ranges
+	nameToID map[nameKey]uint32  // scoped upper case name -> ID for all ranges
+	idToName map[uint32]nameKey  // ID -> scoped name as spelled for all ranges
+	folded   map[string][]uint32 // upper case name -> IDs in every scope
 
 	// range definitions
 
-	definedRanges map[uint32]RangeAddress // ID -> address for defined ranges
+	definedRanges   map[uint32]RangeAddress // ID -> address for defined ranges
+	definedFormulas map[uint32]namedFormula // ID -> formula for names defined as formulas
 
 	// track undefined ranges (referenced but not yet defined)
 
@@ -33,74 +42,137 @@ type NamedRangeTable struct {
 	nextID    uint32
 }
 
+// nameKey identifies a name within its scope
+type nameKey struct {
+	worksheetID uint32 // worksheet the name is local to, 0 for workbook names
+	name        string
+}
+
 // NewNamedRangeTable creates a new named range table
 func NewNamedRangeTable() *NamedRangeTable {
 	return &NamedRangeTable{
-		nameToID:      make(map[string]uint32),
-		idToName:      make(map[uint32]string),
-		definedRanges: make(map[uint32]RangeAddress),
-		undefinedIDs:  make(map[uint32]struct{}),
-		refCounts:     make(map[uint32]int),
-		nextID:        1, // start at 1, reserve 0 for no range
+		nameToID:        make(map[nameKey]uint32),
+		idToName:        make(map[uint32]nameKey),
+		folded:          make(map[string][]uint32),
+		definedRanges:   make(map[uint32]RangeAddress),
+		definedFormulas: make(map[uint32]namedFormula),
+		undefinedIDs:    make(map[uint32]struct{}),
+		refCounts:       make(map[uint32]int),
+		nextID:          1, // start at 1, reserve 0 for no range
+	}
+}
+
+// namedFormula is the definition of a name as a formula, a constant or a
+// LAMBDA. references are relative to origin, whose worksheet is the one of
+// the formula using the name when it is 0.
+type namedFormula struct {
+	ast      ASTNode
+	compiled compiledFormula
+	origin   CellAddress
+}
+
+// originFor returns the cell the references of the formula are relative to
+// when used by the formula of a cell
+func (f namedFormula) originFor(addr CellAddress) CellAddress {
+	origin := f.origin
+	if origin.WorksheetID == 0 {
+		origin.WorksheetID = addr.WorksheetID
 	}
+	return origin
+}
+
+// foldName returns the key a name is found under in a scope
+func foldName(worksheetID uint32, name string) nameKey {
+	return nameKey{worksheetID: worksheetID, name: strings.ToUpper(name)}
+}
+
+// newID adds a name to a scope and returns its ID
+func (nrt *NamedRangeTable) newID(key nameKey) uint32 {
+	id := nrt.nextID
+	folded := foldName(key.worksheetID, key.name)
+	nrt.nameToID[folded] = id
+	nrt.idToName[id] = key
+	nrt.folded[folded.name] = append(nrt.folded[folded.name], id)
+	nrt.nextID++
+	return id
 }
 
-// InternNamedRange adds a reference to a named range (defined or not). returns
-// the ID of the named range.
-func (nrt *NamedRangeTable) InternNamedRange(name string) uint32 {
+// InternNamedRange adds a reference to a named range (defined or not) in
+// the scope of a worksheet, 0 for the workbook. returns the ID of the named
+// range.
+func (nrt *NamedRangeTable) InternNamedRange(worksheetID uint32, name string) uint32 {
+	key := nameKey{worksheetID: worksheetID, name: name}
+
 	// check if name already exists
-	if id, exists := nrt.nameToID[name]; exists {
+	if id, exists := nrt.nameToID[foldName(worksheetID, name)]; exists {
 		nrt.refCounts[id]++
 		return id
 	}
 
 	// add new undefined range
-	id := nrt.nextID
-	nrt.nameToID[name] = id
-	nrt.idToName[id] = name
+	id := nrt.newID(key)
 	nrt.undefinedIDs[id] = struct{}{} // start as undefined
 	nrt.refCounts[id] = 1
-	nrt.nextID++
 
 	return id
 }
 
 // DefineNamedRange defines or redefines a named range with an address. if
-// the range was previously undefined, it transitions to defined state. returns
-// the ID of the named range.
-func (nrt *NamedRangeTable) DefineNamedRange(name string, address RangeAddress) uint32 {
+// the range was previously undefined, it transitions to defined state and
+// takes the spelling of the definition. returns the ID of the named range.
+func (nrt *NamedRangeTable) DefineNamedRange(worksheetID uint32, name string, address RangeAddress) uint32 {
+	key := nameKey{worksheetID: worksheetID, name: name}
+
 	// check if name already exists
-	if id, exists := nrt.nameToID[name]; exists {
+	if id, exists := nrt.nameToID[foldName(worksheetID, name)]; exists {
 		// update the definition
+		nrt.idToName[id] = key
 		nrt.definedRanges[id] = address
+		delete(nrt.definedFormulas, id)
 		delete(nrt.undefinedIDs, id) // remove from undefined if present
 		nrt.refCounts[id]++          // increment reference since we're defining it
 		return id
 	}
 
 	// create new defined range
-	id := nrt.nextID
-	nrt.nameToID[name] = id
-	nrt.idToName[id] = name
+	id := nrt.newID(key)
 	nrt.definedRanges[id] = address
 	nrt.refCounts[id] = 1
-	nrt.nextID++
 
 	return id
 }
 
+// DefineNamedFormula defines or redefines a name as a formula with
+// references relative to origin, replacing any range it pointed to. returns
+// the ID of the name.
+func (nrt *NamedRangeTable) DefineNamedFormula(worksheetID uint32, name string, ast ASTNode, origin CellAddress) uint32 {
+	key := nameKey{worksheetID: worksheetID, name: name}
+	id, exists := nrt.nameToID[foldName(worksheetID, name)]
+	if !exists {
+		id = nrt.newID(key)
+	}
+	nrt.idToName[id] = key
+
+	nrt.definedFormulas[id] = namedFormula{ast: ast, compiled: compile(ast), origin: origin}
+	delete(nrt.definedRanges, id)
+	delete(nrt.undefinedIDs, id)
+	nrt.refCounts[id]++
+	return id
+}
+
 // UndefineNamedRange removes the definition of a named range. if the range
 // still has references, it transitions to undefined state. if it has no
 // references, it's removed completely. returns true if the range was
 // removed completely.
-func (nrt *NamedRangeTable) UndefineNamedRange(name string) bool {
-	id, exists := nrt.nameToID[name]
+func (nrt *NamedRangeTable) UndefineNamedRange(worksheetID uint32, name string) bool {
+	id, exists := nrt.nameToID[foldName(worksheetID, name)]
 	if !exists {
 		return false
 	}
 
 	// remove the definition
 	delete(nrt.definedRanges, id)
+	delete(nrt.definedFormulas, id)
 
 	// check if there are still references
 	if nrt.refCounts[id] > 0 {
@@ -114,12 +186,35 @@ func (nrt *NamedRangeTable) UndefineNamedRange(name string) bool {
 	return true
 }
 
+// UndefineScope removes the definitions of all names local to a worksheet.
+// returns the IDs of the names that were defined.
+func (nrt *NamedRangeTable) UndefineScope(worksheetID uint32) []uint32 {
+	var result []uint32
+	for key, id := range nrt.nameToID {
+		if key.worksheetID == worksheetID && nrt.IsRangeDefined(id) {
+			result = append(result, id)
+		}
+	}
+	for _, id := range result {
+		key := nrt.idToName[id]
+		nrt.UndefineNamedRange(key.worksheetID, key.name)
+	}
+	return result
+}
+
 // removeRange removes a range completely from all tracking maps
 func (nrt *NamedRangeTable) removeRange(id uint32) {
-	name := nrt.idToName[id]
-	delete(nrt.nameToID, name)
+	key := nrt.idToName[id]
+	folded := foldName(key.worksheetID, key.name)
+	delete(nrt.nameToID, folded)
 	delete(nrt.idToName, id)
+	if ids := slices.DeleteFunc(nrt.folded[folded.name], func(other uint32) bool { return other == id }); len(ids) > 0 {
+		nrt.folded[folded.name] = ids
+	} else {
+		delete(nrt.folded, folded.name)
+	}
 	delete(nrt.definedRanges, id)
+	delete(nrt.definedFormulas, id)
 	delete(nrt.undefinedIDs, id)
 	delete(nrt.refCounts, id)
 }
@@ -161,27 +256,63 @@ func (nrt *NamedRangeTable) GetRangeAddress(id uint32) (RangeAddress, bool) {
 	return addr, exists
 }
 
-// IsRangeDefined checks if a named range has a definition
+// GetFormula returns the formula of a name defined as a formula
+func (nrt *NamedRangeTable) GetFormula(id uint32) (namedFormula, bool) {
+	formula, exists := nrt.definedFormulas[id]
+	return formula, exists
+}
+
+// IsRangeDefined checks if a named range has a definition, as a range or
+// as a formula
 func (nrt *NamedRangeTable) IsRangeDefined(id uint32) bool {
+	if _, exists := nrt.definedFormulas[id]; exists {
+		return true
+	}
 	_, exists := nrt.definedRanges[id]
 	return exists
 }
 
-// GetNamedRangeID returns the ID for a named range
-func (nrt *NamedRangeTable) GetNamedRangeID(name string) (uint32, bool) {
-	id, exists := nrt.nameToID[name]
+// GetNamedRangeID returns the ID for a named range in the scope of a
+// worksheet, 0 for the workbook, matching the name ignoring case
+func (nrt *NamedRangeTable) GetNamedRangeID(worksheetID uint32, name string) (uint32, bool) {
+	id, exists := nrt.nameToID[foldName(worksheetID, name)]
 	return id, exists
 }
 
-// GetNamedRangeName returns the name for a named range ID
+// ResolveNamedRangeID returns the ID of the name a formula on a worksheet
+// refers to without qualifying it: a defined name local to the worksheet
+// comes before the workbook name
+func (nrt *NamedRangeTable) ResolveNamedRangeID(worksheetID uint32, name string) (uint32, bool) {
+	if worksheetID != 0 {
+		if id, exists := nrt.GetNamedRangeID(worksheetID, name); exists && nrt.IsRangeDefined(id) {
+			return id, true
+		}
+	}
+	return nrt.GetNamedRangeID(0, name)
+}
+
+// GetNamedRangeIDsFold returns the IDs of a name in every scope
+func (nrt *NamedRangeTable) GetNamedRangeIDsFold(name string) []uint32 {
+	return slices.Clone(nrt.folded[strings.ToUpper(name)])
+}
+
+// GetNamedRangeName returns the name for a named range ID, without its
+// scope
 func (nrt *NamedRangeTable) GetNamedRangeName(id uint32) (string, bool) {
-	name, exists := nrt.idToName[id]
-	return name, exists
+	key, exists := nrt.idToName[id]
+	return key.name, exists
+}
+
+// GetNamedRangeScope returns the worksheet a named range ID is local to, 0
+// for workbook names
+func (nrt *NamedRangeTable) GetNamedRangeScope(id uint32) uint32 {
+	return nrt.idToName[id].worksheetID
 }
 
-// Contains checks if a named range exists (defined or undefined)
-func (nrt *NamedRangeTable) Contains(name string) bool {
-	_, exists := nrt.nameToID[name]
+// Contains checks if a named range exists (defined or undefined) in the
+// scope of a worksheet, 0 for the workbook
+func (nrt *NamedRangeTable) Contains(worksheetID uint32, name string) bool {
+	_, exists := nrt.nameToID[foldName(worksheetID, name)]
 	return exists
 }
 
@@ -190,26 +321,49 @@ func (nrt *NamedRangeTable) GetReferenceCount(id uint32) int {
 	return nrt.refCounts[id]
 }
 
-// GetAllDefinedRanges returns all defined named ranges
+// GetAllDefinedRanges returns all defined workbook named ranges
 func (nrt *NamedRangeTable) GetAllDefinedRanges() map[string]RangeAddress {
 	result := make(map[string]RangeAddress)
 	for id, addr := range nrt.definedRanges {
-		if name, exists := nrt.idToName[id]; exists {
-			result[name] = addr
+		if key, exists := nrt.idToName[id]; exists && key.worksheetID == 0 {
+			result[key.name] = addr
 		}
 	}
 	return result
 }
 
-// GetAllUndefinedRanges returns all undefined (referenced but not defined)
-// named ranges
-func (nrt *NamedRangeTable) GetAllUndefinedRanges() []string {
-	result := make([]string, 0, len(nrt.undefinedIDs))
-	for id := range nrt.undefinedIDs {
-		if name, exists := nrt.idToName[id]; exists {
-			result = append(result, name)
+// DefinedRanges iterates over the IDs and addresses of the defined named
+// ranges of every scope
+func (nrt *NamedRangeTable) DefinedRanges() iter.Seq2[uint32, RangeAddress] {
+	return func(yield func(uint32, RangeAddress) bool) {
+		for id, addr := range nrt.definedRanges {
+			if !yield(id, addr) {
+				return
+			}
 		}
 	}
+}
+
+// GetAllDefinedIDs returns the IDs of all defined names of every scope,
+// ranges and formulas alike
+func (nrt *NamedRangeTable) GetAllDefinedIDs() []uint32 {
+	result := make([]uint32, 0, nrt.CountDefined())
+	for id := range nrt.definedRanges {
+		result = append(result, id)
+	}
+	for id := range nrt.definedFormulas {
+		result = append(result, id)
+	}
+	return result
+}
+
+// GetAllUndefinedIDs returns the IDs of all undefined (referenced but not
+// defined) named ranges of every scope
+func (nrt *NamedRangeTable) GetAllUndefinedIDs() []uint32 {
+	result := make([]uint32, 0, len(nrt.undefinedIDs))
+	for id := range nrt.undefinedIDs {
+		result = append(result, id)
+	}
 	return result
 }
 
@@ -218,9 +372,10 @@ func (nrt *NamedRangeTable) Count() int {
 	return len(nrt.nameToID)
 }
 
-// CountDefined returns the number of defined named ranges
+// CountDefined returns the number of defined named ranges, ranges and
+// formulas alike
 func (nrt *NamedRangeTable) CountDefined() int {
-	return len(nrt.definedRanges)
+	return len(nrt.definedRanges) + len(nrt.definedFormulas)
 }
 
 // CountUndefined returns the number of undefined named ranges
@@ -240,9 +395,11 @@ func (nrt *NamedRangeTable) TotalReferences() int {
 
 // Clear removes all named ranges from the table
 func (nrt *NamedRangeTable) Clear() {
-	nrt.nameToID = make(map[string]uint32)
-	nrt.idToName = make(map[uint32]string)
+	nrt.nameToID = make(map[nameKey]uint32)
+	nrt.idToName = make(map[uint32]nameKey)
+	nrt.folded = make(map[string][]uint32)
 	nrt.definedRanges = make(map[uint32]RangeAddress)
+	nrt.definedFormulas = make(map[uint32]namedFormula)
 	nrt.undefinedIDs = make(map[uint32]struct{})
 	nrt.refCounts = make(map[uint32]int)
 	nrt.nextID = 1
@@ -251,8 +408,11 @@ func (nrt *NamedRangeTable) Clear() {
 // Range represents a lazy range type for memory-efficient formula evaluation
 type Range interface {
 	GetBounds() RangeAddress
+	Size() int
 	Iterate() iter.Seq[*Cell]
 	IterateValues() iter.Seq[Primitive]
+	IterateOccupied() iter.Seq2[CellAddress, Primitive]
+	IterateOccupiedValues() iter.Seq[Primitive]
 }
 
 // CellRange implements Range for lazy cell iteration
@@ -305,12 +465,142 @@ func (r *CellRange) Iterate() iter.Seq[*Cell] {
 	}
 }
 
-// IterateValues returns an iterator over cell values in the range
+// Size returns the number of cells in the range, empty or not
+func (r *CellRange) Size() int {
+	return int(r.endRow-r.startRow+1) * int(r.endCol-r.startCol+1)
+}
+
+// IterateValues returns an iterator over the value of every cell in the
+// range in row-major order, with nil for empty cells. use it where position
+// matters; aggregates that ignore empty cells should use
+// IterateOccupiedValues.
 func (r *CellRange) IterateValues() iter.Seq[Primitive] {
 	return func(yield func(Primitive) bool) {
-		for cell := range r.Iterate() {
-			if !yield(cell.Value) {
-				return
+		if r.worksheet == nil {
+			return
+		}
+
+		for row := r.startRow; row <= r.endRow; row++ {
+			for col := r.startCol; col <= r.endCol; col++ {
+				if !yield(r.worksheet.GetValue(row, col)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// IterateOccupied returns an iterator over the occupied cells of the range
+// and their values in row-major order. empty chunks and empty cells are
+// skipped without being visited, so the cost follows the number of values
+// rather than the size of the range.
+func (r *CellRange) IterateOccupied() iter.Seq2[CellAddress, Primitive] {
+	return func(yield func(CellAddress, Primitive) bool) {
+		if r.worksheet == nil {
+			return
+		}
+
+		r.worksheet.occupiedCells(r.startRow, r.startCol, r.endRow, r.endCol, func(row, col uint32) bool {
+			addr := CellAddress{WorksheetID: r.worksheetID, Row: row, Column: col}
+			return yield(addr, r.worksheet.GetValue(row, col))
+		})
+	}
+}
+
+// IterateOccupiedValues returns an iterator over the values of the occupied
+// cells of the range in row-major order. unlike Iterate it builds no Cell
+// and renders no formula text per cell, values are read straight from the
+// chunk arrays.
+func (r *CellRange) IterateOccupiedValues() iter.Seq[Primitive] {
+	return func(yield func(Primitive) bool) {
+		if r.worksheet == nil {
+			return
+		}
+
+		r.worksheet.occupiedCells(r.startRow, r.startCol, r.endRow, r.endCol, func(row, col uint32) bool {
+			return yield(r.worksheet.GetValue(row, col))
+		})
+	}
+}
+
+// MultiRange implements Range over several areas, one per worksheet of a 3D
+// reference. iteration visits the areas in tab order.
+type MultiRange struct {
+	areas []*CellRange
+}
+
+// Areas returns the areas of the range in tab order
+func (r *MultiRange) Areas() []*CellRange {
+	return r.areas
+}
+
+// GetBounds returns the boundaries of the first area
+func (r *MultiRange) GetBounds() RangeAddress {
+	if len(r.areas) == 0 {
+		return RangeAddress{}
+	}
+	return r.areas[0].GetBounds()
+}
+
+// Size returns the number of cells across all areas
+func (r *MultiRange) Size() int {
+	size := 0
+	for _, area := range r.areas {
+		size += area.Size()
+	}
+	return size
+}
+
+// Iterate returns an iterator over all cells of every area
+func (r *MultiRange) Iterate() iter.Seq[*Cell] {
+	return func(yield func(*Cell) bool) {
+		for _, area := range r.areas {
+			for cell := range area.Iterate() {
+				if !yield(cell) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// IterateValues returns an iterator over the value of every cell of every
+// area, with nil for empty cells
+func (r *MultiRange) IterateValues() iter.Seq[Primitive] {
+	return func(yield func(Primitive) bool) {
+		for _, area := range r.areas {
+			for value := range area.IterateValues() {
+				if !yield(value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// IterateOccupied returns an iterator over the occupied cells of every area
+// and their values
+func (r *MultiRange) IterateOccupied() iter.Seq2[CellAddress, Primitive] {
+	return func(yield func(CellAddress, Primitive) bool) {
+		for _, area := range r.areas {
+			for addr, value := range area.IterateOccupied() {
+				if !yield(addr, value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// IterateOccupiedValues returns an iterator over the values of the occupied
+// cells of every area
+func (r *MultiRange) IterateOccupiedValues() iter.Seq[Primitive] {
+	return func(yield func(Primitive) bool) {
+		for _, area := range r.areas {
+			for value := range area.IterateOccupiedValues() {
+				if !yield(value) {
+					return
+				}
 			}
 		}
 	}
@@ -0,0 +1,278 @@
+package main
+
+// RangeIndex is a spatial index over the ranges observed by formulas. each
+// worksheet has a segment tree over its rows, and every node of it a
+// segment tree over the columns. a range is stored at the few nodes whose
+// rows together make up its rows exactly, and at each of them at the column
+// nodes that make up its columns, so a cell lies in exactly one stored copy
+// of every range containing it.
+//
+// a stabbing query for a cell walks one path down the row tree and, at each
+// node on it, one path down the column tree: at most log2(MaxRows) *
+// log2(MaxColumns) nodes whatever the number of ranges, plus one call per
+// range found. a rectangle query visits the nodes overlapping it that hold
+// ranges, reporting each range once, at the node holding its cell closest
+// to the top left corner of the query.
+type RangeIndex struct {
+	trees  map[uint32]*rangeRowNode  // worksheet ID -> root of its row tree
+	ranges map[RangeAddress]struct{} // every indexed range
+}
+
+// rangeRowNode is a node of a worksheet's row tree. nodes are created as
+// ranges are stored below them and pruned once they hold none.
+type rangeRowNode struct {
+	children [2]*rangeRowNode
+	columns  *rangeColumnNode // ranges stored at this node, by column
+	count    int              // ranges stored at this node or below
+}
+
+// rangeColumnNode is a node of the column tree of a row node
+type rangeColumnNode struct {
+	children [2]*rangeColumnNode
+	ranges   []RangeAddress // ranges stored at this node
+	count    int            // ranges stored at this node or below
+}
+
+// NewRangeIndex creates an empty range index
+func NewRangeIndex() *RangeIndex {
+	return &RangeIndex{
+		trees:  make(map[uint32]*rangeRowNode),
+		ranges: make(map[RangeAddress]struct{}),
+	}
+}
+
+// Len returns the number of ranges in the index
+func (ri *RangeIndex) Len() int {
+	return len(ri.ranges)
+}
+
+// Insert adds a range to the index. inserting a range twice has no effect.
+func (ri *RangeIndex) Insert(r RangeAddress) {
+	if _, exists := ri.ranges[r]; exists {
+		return
+	}
+	ri.ranges[r] = struct{}{}
+
+	root := ri.trees[r.WorksheetID]
+	if root == nil {
+		root = &rangeRowNode{}
+		ri.trees[r.WorksheetID] = root
+	}
+	startRow, endRow := clampSpan(r.StartRow, r.EndRow, MaxRows)
+	root.insert(0, MaxRows-1, startRow, endRow, r)
+}
+
+// Delete removes a range from the index
+func (ri *RangeIndex) Delete(r RangeAddress) bool {
+	if _, exists := ri.ranges[r]; !exists {
+		return false
+	}
+	delete(ri.ranges, r)
+
+	root := ri.trees[r.WorksheetID]
+	startRow, endRow := clampSpan(r.StartRow, r.EndRow, MaxRows)
+	if root.delete(0, MaxRows-1, startRow, endRow, r) {
+		delete(ri.trees, r.WorksheetID)
+	}
+	return true
+}
+
+// Containing calls fn for every indexed range that contains the cell
+func (ri *RangeIndex) Containing(addr CellAddress, fn func(RangeAddress)) {
+	lo, hi := uint32(0), MaxRows-1
+	for node := ri.trees[addr.WorksheetID]; node != nil; {
+		node.columns.containing(addr.Column, fn)
+		if lo == hi {
+			return
+		}
+		mid := lo + (hi-lo)/2
+		if addr.Row <= mid {
+			node, hi = node.children[0], mid
+		} else {
+			node, lo = node.children[1], mid+1
+		}
+	}
+}
+
+// Intersecting calls fn for every indexed range that shares at least one
+// cell with the query rectangle
+func (ri *RangeIndex) Intersecting(query RangeAddress, fn func(RangeAddress)) {
+	ri.trees[query.WorksheetID].intersecting(0, MaxRows-1, query, fn)
+}
+
+// Clear removes every range from the index
+func (ri *RangeIndex) Clear() {
+	ri.trees = make(map[uint32]*rangeRowNode)
+	ri.ranges = make(map[RangeAddress]struct{})
+}
+
+// rangesIntersect checks if two ranges on the same worksheet overlap
+func rangesIntersect(a, b RangeAddress) bool {
+	return a.StartRow <= b.EndRow && b.StartRow <= a.EndRow &&
+		a.StartColumn <= b.EndColumn && b.StartColumn <= a.EndColumn
+}
+
+// clampSpan limits a span to the first size rows or columns, the extent of
+// the trees
+func clampSpan(start, end, size uint32) (uint32, uint32) {
+	return min(start, size-1), min(end, size-1)
+}
+
+// insert stores r at the nodes below n, which covers rows lo to hi, making
+// up its rows start to end
+func (n *rangeRowNode) insert(lo, hi, start, end uint32, r RangeAddress) {
+	n.count++
+	if start <= lo && hi <= end {
+		if n.columns == nil {
+			n.columns = &rangeColumnNode{}
+		}
+		startColumn, endColumn := clampSpan(r.StartColumn, r.EndColumn, MaxColumns)
+		n.columns.insert(0, MaxColumns-1, startColumn, endColumn, r)
+		return
+	}
+
+	mid := lo + (hi-lo)/2
+	if start <= mid {
+		if n.children[0] == nil {
+			n.children[0] = &rangeRowNode{}
+		}
+		n.children[0].insert(lo, mid, start, end, r)
+	}
+	if end > mid {
+		if n.children[1] == nil {
+			n.children[1] = &rangeRowNode{}
+		}
+		n.children[1].insert(mid+1, hi, start, end, r)
+	}
+}
+
+// delete removes r from the nodes insert stored it at. returns true when n
+// holds no ranges anymore and can be dropped.
+func (n *rangeRowNode) delete(lo, hi, start, end uint32, r RangeAddress) bool {
+	n.count--
+	if start <= lo && hi <= end {
+		startColumn, endColumn := clampSpan(r.StartColumn, r.EndColumn, MaxColumns)
+		if n.columns.delete(0, MaxColumns-1, startColumn, endColumn, r) {
+			n.columns = nil
+		}
+		return n.count == 0
+	}
+
+	mid := lo + (hi-lo)/2
+	if start <= mid && n.children[0].delete(lo, mid, start, end, r) {
+		n.children[0] = nil
+	}
+	if end > mid && n.children[1].delete(mid+1, hi, start, end, r) {
+		n.children[1] = nil
+	}
+	return n.count == 0
+}
+
+// intersecting reports the ranges overlapping the query stored below n,
+// which covers rows lo to hi. a range is stored at exactly one node holding
+// its first row within the query, and only reported there.
+func (n *rangeRowNode) intersecting(lo, hi uint32, query RangeAddress, fn func(RangeAddress)) {
+	if n == nil || hi < query.StartRow || lo > query.EndRow {
+		return
+	}
+	n.columns.intersecting(0, MaxColumns-1, query, func(r RangeAddress) {
+		if first := max(r.StartRow, query.StartRow); lo <= first && first <= hi {
+			fn(r)
+		}
+	})
+	if lo == hi {
+		return
+	}
+	mid := lo + (hi-lo)/2
+	n.children[0].intersecting(lo, mid, query, fn)
+	n.children[1].intersecting(mid+1, hi, query, fn)
+}
+
+// insert stores r at the nodes below n, which covers columns lo to hi,
+// making up its columns start to end
+func (n *rangeColumnNode) insert(lo, hi, start, end uint32, r RangeAddress) {
+	n.count++
+	if start <= lo && hi <= end {
+		n.ranges = append(n.ranges, r)
+		return
+	}
+
+	mid := lo + (hi-lo)/2
+	if start <= mid {
+		if n.children[0] == nil {
+			n.children[0] = &rangeColumnNode{}
+		}
+		n.children[0].insert(lo, mid, start, end, r)
+	}
+	if end > mid {
+		if n.children[1] == nil {
+			n.children[1] = &rangeColumnNode{}
+		}
+		n.children[1].insert(mid+1, hi, start, end, r)
+	}
+}
+
+// delete removes r from the nodes insert stored it at. returns true when n
+// holds no ranges anymore and can be dropped.
+func (n *rangeColumnNode) delete(lo, hi, start, end uint32, r RangeAddress) bool {
+	n.count--
+	if start <= lo && hi <= end {
+		for i, stored := range n.ranges {
+			if stored == r {
+				last := len(n.ranges) - 1
+				n.ranges[i] = n.ranges[last]
+				n.ranges = n.ranges[:last]
+				break
+			}
+		}
+		return n.count == 0
+	}
+
+	mid := lo + (hi-lo)/2
+	if start <= mid && n.children[0].delete(lo, mid, start, end, r) {
+		n.children[0] = nil
+	}
+	if end > mid && n.children[1].delete(mid+1, hi, start, end, r) {
+		n.children[1] = nil
+	}
+	return n.count == 0
+}
+
+// containing reports the ranges stored on the path to a column
+func (n *rangeColumnNode) containing(column uint32, fn func(RangeAddress)) {
+	lo, hi := uint32(0), MaxColumns-1
+	for n != nil {
+		for _, r := range n.ranges {
+			fn(r)
+		}
+		if lo == hi {
+			return
+		}
+		mid := lo + (hi-lo)/2
+		if column <= mid {
+			n, hi = n.children[0], mid
+		} else {
+			n, lo = n.children[1], mid+1
+		}
+	}
+}
+
+// intersecting reports the ranges overlapping the columns of the query
+// stored below n, which covers columns lo to hi, each at the node holding
+// its first column within the query
+func (n *rangeColumnNode) intersecting(lo, hi uint32, query RangeAddress, fn func(RangeAddress)) {
+	if n == nil || hi < query.StartColumn || lo > query.EndColumn {
+		return
+	}
+	for _, r := range n.ranges {
+		if first := max(r.StartColumn, query.StartColumn); lo <= first && first <= hi {
+			fn(r)
+		}
+	}
+	if lo == hi {
+		return
+	}
+	mid := lo + (hi-lo)/2
+	n.children[0].intersecting(lo, mid, query, fn)
+	n.children[1].intersecting(mid+1, hi, query, fn)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// minParallelLevelSize is the smallest level worth spreading over workers.
+// smaller levels are evaluated on the calling goroutine.
+const minParallelLevelSize = 64
+
+// SetParallelism sets the maximum number of workers Calculate uses to
+// evaluate independent formulas concurrently. values below 2 select the
+// serial engine.
+func (s *Spreadsheet) SetParallelism(workers int) {
+	s.parallelism = max(workers, 1)
+}
+
+// calculateParallel evaluates the formula cells affected by the dirty set
+// level by level. cells of a level only depend on cells of earlier levels, so
+// each level is evaluated by a bounded pool of workers and the results are
+// identical to the serial engine. cells that sit on or behind a cycle are
+// left dirty so the serial engine can report the circular reference. when
+// ctx is done the cells that were not evaluated stay dirty.
+func (s *Spreadsheet) calculateParallel(ctx context.Context) error {
+	for {
+		reopened, err := s.calculateLevels(ctx)
+		if err != nil || !reopened {
+			return err
+		}
+	}
+}
+
+// calculateLevels evaluates the levels of the cells affected by the dirty
+// set. spilled cells aren't in the dependency graph, so a spill can reopen
+// readers that were already calculated; the levels after them were built
+// against their old values, so it stops after that level and reports it.
+func (s *Spreadsheet) calculateLevels(ctx context.Context) (reopened bool, err error) {
+	for _, level := range s.calculationLevels() {
+		evaluated, deferred := s.evaluateLevel(ctx, level)
+		before := len(s.calculationStack.reopened)
+
+		// graph bookkeeping and spills happen on the calling goroutine, once
+		// the whole level is stored. the level is completed before any spill
+		// is stored, so readers of spilled cells within it are reopened too
+		for i, addr := range level {
+			if evaluated[i] {
+				s.storage.dependencyGraph.ClearDirty(addr)
+				s.calculationStack.markCompleted(addr)
+			}
+		}
+		for i, addr := range level {
+			if !evaluated[i] {
+				continue
+			}
+			if deferred[i] != nil {
+				s.storeDeferredResult(addr, deferred[i])
+			}
+			s.reportProgress()
+		}
+
+		if err := ctx.Err(); err != nil {
+			return false, newInterruptedError(err)
+		}
+		if len(s.calculationStack.reopened) > before {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// calculationLevels collects every formula cell affected by the dirty set and
+// groups them into levels using Kahn's algorithm. each level is sorted for
+// deterministic scheduling.
+func (s *Spreadsheet) calculationLevels() [][]CellAddress {
+	pending := s.pendingFormulaCells()
+
+	// build edges between pending cells (precedent -> dependent). a range
+	// containing the cell itself becomes a self-loop, which keeps the cell
+	// out of every level
+	dependents := make(map[CellAddress][]CellAddress, len(pending))
+	inDegree := make(map[CellAddress]int, len(pending))
+	for addr, precedents := range s.pendingPrecedents(pending) {
+		inDegree[addr] += len(precedents)
+		for _, precedent := range precedents {
+			dependents[precedent] = append(dependents[precedent], addr)
+		}
+	}
+
+	var ready []CellAddress
+	for addr, degree := range inDegree {
+		if degree == 0 {
+			ready = append(ready, addr)
+		}
+	}
+
+	var levels [][]CellAddress
+	for len(ready) > 0 {
+		sortCellAddresses(ready)
+		levels = append(levels, ready)
+
+		var next []CellAddress
+		for _, addr := range ready {
+			for _, dep := range dependents[addr] {
+				inDegree[dep]--
+				if inDegree[dep] == 0 {
+					next = append(next, dep)
+				}
+			}
+		}
+		ready = next
+	}
+
+	return levels
+}
+
+// pendingFormulaCells collects the dirty formula cells and every formula cell
+// downstream of them. all of them are marked dirty, so cells a scheduler
+// can't handle (cycles) are still picked up by the serial engine.
+func (s *Spreadsheet) pendingFormulaCells() map[CellAddress]struct{} {
+	dg := s.storage.dependencyGraph
+
+	pending := make(map[CellAddress]struct{})
+	queue := make([]CellAddress, 0, len(dg.dirtySet))
+	for addr := range dg.dirtySet {
+		queue = append(queue, addr)
+	}
+	for len(queue) > 0 {
+		addr := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, seen := pending[addr]; seen {
+			continue
+		}
+		if _, isFormula := s.storage.formulas.GetFormulaAtCell(addr); !isFormula {
+			// value cells have nothing to calculate
+			continue
+		}
+		pending[addr] = struct{}{}
+		queue = append(queue, dg.GetDirectDependents(addr)...)
+		queue = append(queue, dg.GetRangeDependents(addr)...)
+	}
+
+	for addr := range pending {
+		dg.MarkDirty(addr)
+	}
+	return pending
+}
+
+// pendingPrecedents returns, for every pending cell, the sorted pending cells
+// it depends on, either directly or through one of its ranges
+func (s *Spreadsheet) pendingPrecedents(pending map[CellAddress]struct{}) map[CellAddress][]CellAddress {
+	dg := s.storage.dependencyGraph
+
+	sorted := make([]CellAddress, 0, len(pending))
+	for addr := range pending {
+		sorted = append(sorted, addr)
+	}
+	sortCellAddresses(sorted)
+
+	result := make(map[CellAddress][]CellAddress, len(pending))
+	for _, addr := range sorted {
+		seen := make(map[CellAddress]struct{})
+		precedents := []CellAddress{}
+		for _, precedent := range dg.GetDirectPrecedents(addr) {
+			if _, ok := pending[precedent]; ok {
+				seen[precedent] = struct{}{}
+				precedents = append(precedents, precedent)
+			}
+		}
+		for _, rangeAddr := range dg.GetRangePrecedents(addr) {
+			for _, other := range cellsInRange(sorted, rangeAddr) {
+				if _, dup := seen[other]; !dup {
+					seen[other] = struct{}{}
+					precedents = append(precedents, other)
+				}
+			}
+		}
+		sortCellAddresses(precedents)
+		result[addr] = precedents
+	}
+	return result
+}
+
+// evaluateLevel evaluates and stores the cells of a level, spreading the
+// work over at most s.parallelism goroutines. workers stop picking up cells
+// once ctx is done, the returned slices report which cells were evaluated
+// and the results left for the caller to store.
+func (s *Spreadsheet) evaluateLevel(ctx context.Context, level []CellAddress) ([]bool, []Primitive) {
+	evaluated := make([]bool, len(level))
+	deferred := make([]Primitive, len(level))
+	workers := min(s.parallelism, len(level))
+	if len(level) < minParallelLevelSize {
+		workers = 1
+	}
+
+	if workers <= 1 {
+		for i, addr := range level {
+			if ctx.Err() != nil {
+				break
+			}
+			deferred[i], _ = s.evaluateLevelCell(addr)
+			evaluated[i] = true
+		}
+		return evaluated, deferred
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(level) || ctx.Err() != nil {
+					return
+				}
+				deferred[i], _ = s.evaluateLevelCell(level[i])
+				evaluated[i] = true
+			}
+		}()
+	}
+	wg.Wait()
+	return evaluated, deferred
+}
+
+// evaluateLevelCell evaluates a single formula cell and stores its result.
+// it must not touch the dependency graph or other cells since it runs on a
+// worker, so results that spill, or clear an earlier spill, are returned
+// with deferred set for the caller to store with storeDeferredResult.
+func (s *Spreadsheet) evaluateLevelCell(addr CellAddress) (result Primitive, deferred bool) {
+	worksheet, exists := s.storage.worksheets.GetWorksheet(addr.WorksheetID)
+	if !exists {
+		return nil, false
+	}
+
+	formulaID, _ := s.storage.formulas.GetFormulaAtCell(addr)
+	formula, exists := s.storage.formulas.GetCompiled(formulaID)
+	if !exists {
+		return nil, false
+	}
+
+	result = s.evaluateFormula(formula, addr)
+	if _, isArray := result.(*ArrayValue); isArray || s.spills.IsAnchor(addr) {
+		return result, true
+	}
+	s.setFormulaResult(worksheet, addr, result)
+	return nil, false
+}
+
+// storeDeferredResult stores a result evaluateLevelCell left to the calling
+// goroutine
+func (s *Spreadsheet) storeDeferredResult(addr CellAddress, result Primitive) {
+	if worksheet, exists := s.storage.worksheets.GetWorksheet(addr.WorksheetID); exists {
+		s.setFormulaResult(worksheet, addr, s.spillResult(worksheet, addr, result))
+	}
+}
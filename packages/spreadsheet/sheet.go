@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // AppErrorCode represents gRPC-style error codes for application-level errors.
@@ -15,6 +19,9 @@ const (
 	// OK indicates the operation completed successfully.
 	OK AppErrorCode = 0
 
+	// Canceled indicates the operation was canceled, typically by the caller.
+	Canceled AppErrorCode = 1
+
 	// Unknown error. Errors raised by APIs that do not return enough error
 	// information may be converted to this error.
 	Unknown AppErrorCode = 2
@@ -22,6 +29,9 @@ const (
 	// InvalidArgument indicates client specified an invalid argument.
 	InvalidArgument AppErrorCode = 3
 
+	// DeadlineExceeded means the operation expired before completion.
+	DeadlineExceeded AppErrorCode = 4
+
 	// NotFound means some requested entity (e.g., worksheet or named range)
 	// was not found.
 	NotFound AppErrorCode = 5
@@ -55,12 +65,19 @@ const (
 type AppError struct {
 	Code    AppErrorCode
 	Message string
+	cause   error
 }
 
 func (e *AppError) Error() string {
 	return e.Message
 }
 
+// Unwrap returns the underlying error, if any, so callers can use errors.Is
+// with context.Canceled or context.DeadlineExceeded
+func (e *AppError) Unwrap() error {
+	return e.cause
+}
+
 // NewApplicationError creates a new application error
 func NewApplicationError(code AppErrorCode, message string) *AppError {
 	return &AppError{
@@ -69,13 +86,51 @@ func NewApplicationError(code AppErrorCode, message string) *AppError {
 	}
 }
 
+// newInterruptedError converts the error of a done context into the AppError
+// returned by an interrupted calculation
+func newInterruptedError(err error) *AppError {
+	code := Canceled
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = DeadlineExceeded
+	}
+	return &AppError{
+		Code:    code,
+		Message: fmt.Sprintf("calculation interrupted: %v", err),
+		cause:   err,
+	}
+}
+
+// isAbortError reports whether err stops the whole calculation, because the
+// context is done or a limit is exhausted, instead of being stored in a cell
+func isAbortError(err error) bool {
+	_, ok := err.(*AppError)
+	return ok
+}
+
+// CalculationProgress is reported to the progress handler after each formula
+// cell is calculated
+type CalculationProgress struct {
+	Done  int // formula cells calculated so far by this call
+	Dirty int // cells still waiting to be calculated
+}
+
 // Spreadsheet is the main spreadsheet class that combines storage, parsing,
 // dependency tracking, and formula evaluation into a unified API
 type Spreadsheet struct {
 	storage          *Storage
 	calculationStack *CalculationStack
 	functions        *BuiltInFunctions
-	currentAddress   CellAddress
+	parallelism      int // maximum number of calculation workers
+	progress         func(CalculationProgress)
+	calculatedCells  int // formula cells calculated by the current call
+	limits           Limits
+	iteration        IterationSettings
+	cycleStatus      []CycleStatus // cycles evaluated by the last iterative calculation
+	subscribers      map[int]*subscriber
+	nextSubscriberID int
+	changes          map[CellAddress]Primitive // values before the running calculation changed them
+	changesMu        sync.Mutex                // guards changes during parallel calculation
+	spills           *SpillTable
 }
 
 // NewSpreadsheet creates a new spreadsheet instance
@@ -83,16 +138,75 @@ func NewSpreadsheet() *Spreadsheet {
 	storage := &Storage{
 		worksheets:      NewWorksheetTable(),
 		namedRanges:     NewNamedRangeTable(),
+		tables:          NewTableRegistry(),
 		strings:         NewStringTable(),
 		formulas:        NewFormulaTable(),
 		dependencyGraph: NewDependencyGraph(),
 	}
 
-	return &Spreadsheet{
+	s := &Spreadsheet{
 		storage:          storage,
 		calculationStack: NewCalculationStack(),
 		functions:        NewDefaultBuiltInFunctions(),
+		parallelism:      1,
+		limits:           DefaultLimits(),
+		iteration:        DefaultIterationSettings(),
+		spills:           NewSpillTable(),
+	}
+	s.functions.limits = &s.limits
+	return s
+}
+
+// formatCellAddress formats a cell address in A1 notation with its
+// worksheet prefix, e.g. "Sheet1!B2"
+func (s *Spreadsheet) formatCellAddress(addr CellAddress) string {
+	name, _ := s.storage.worksheets.GetWorksheetName(addr.WorksheetID)
+	return fmt.Sprintf("%s!%s%d", name, columnToLetters(int(addr.Column)+1), addr.Row+1)
+}
+
+// formatRangeAddress formats a range address in A1 notation with its
+// worksheet prefix, e.g. "Sheet1!A1:B2"
+func (s *Spreadsheet) formatRangeAddress(r RangeAddress) string {
+	name, _ := s.storage.worksheets.GetWorksheetName(r.WorksheetID)
+
+	// whole columns and whole rows, e.g. "Sheet1!A:C" and "Sheet1!2:4"
+	if r.StartRow == 0 && r.EndRow == MaxRows-1 {
+		return fmt.Sprintf("%s!%s:%s", name,
+			columnToLetters(int(r.StartColumn)+1), columnToLetters(int(r.EndColumn)+1))
+	}
+	if r.StartColumn == 0 && r.EndColumn == MaxColumns-1 {
+		return fmt.Sprintf("%s!%d:%d", name, r.StartRow+1, r.EndRow+1)
 	}
+
+	return fmt.Sprintf("%s!%s%d:%s%d", name,
+		columnToLetters(int(r.StartColumn)+1), r.StartRow+1,
+		columnToLetters(int(r.EndColumn)+1), r.EndRow+1)
+}
+
+// formatWorksheetSpan formats a 3D reference in A1 notation, e.g.
+// "Jan:Dec!B7" or "Jan:Dec!A1:B2". only the cells of the area are used.
+func (s *Spreadsheet) formatWorksheetSpan(first, last uint32, area RangeAddress) string {
+	firstName, _ := s.storage.worksheets.GetWorksheetName(first)
+	lastName, _ := s.storage.worksheets.GetWorksheetName(last)
+
+	cells := s.formatRangeAddress(area)
+	cells = cells[strings.Index(cells, "!")+1:]
+	if area.StartRow == area.EndRow && area.StartColumn == area.EndColumn {
+		cells = fmt.Sprintf("%s%d", columnToLetters(int(area.StartColumn)+1), area.StartRow+1)
+	}
+	return fmt.Sprintf("%s:%s!%s", firstName, lastName, cells)
+}
+
+// columnToLetters converts a 1-based column number to its letters, e.g. 28
+// becomes "AB"
+func columnToLetters(col int) string {
+	result := ""
+	for col > 0 {
+		col--
+		result = string(rune('A'+col%26)) + result
+		col /= 26
+	}
+	return result
 }
 
 // resolveAddress parses a cell address and resolves it to worksheet ID, row, and column
@@ -135,12 +249,25 @@ type SpreadsheetInterface interface {
 	Get(address string) (Primitive, error)
 	Set(address string, value Primitive) error
 	Remove(address string) error
+	GetSpillRange(address string) (string, error)
+
+	// copy, move and fill methods
+
+	CopyRange(src string, dst string, mode PasteMode) error
+	MoveRange(src string, dst string) error
+	FillDown(rangeAddr string) error
+	FillRight(rangeAddr string) error
+	FillSeries(rangeAddr string, direction FillDirection, step float64, unit SeriesUnit) error
 
 	// worksheet methods
 
 	AddWorksheet(name string) error
 	RemoveWorksheet(name string) error
 	RenameWorksheet(oldName string, newName string) error
+	MoveWorksheet(name string, index int) error
+	CopyWorksheet(src string, dst string) error
+	GetWorksheetProperties(name string) (WorksheetProperties, error)
+	SetWorksheetProperties(name string, properties WorksheetProperties) error
 	DoesWorksheetExist(name string) bool
 	ListWorksheets() []string
 	ListReferencedWorksheets() []string
@@ -148,15 +275,36 @@ type SpreadsheetInterface interface {
 	// named range methods
 
 	AddNamedRange(name string) error
+	DefineNamedRange(name string, rangeOrAddress string) error
+	DefineNamedFormula(name string, formula string) error
+	DefineNamedFormulaAt(name string, formula string, address string) error
+	DefineNamedConstant(name string, value Primitive) error
 	RemoveNamedRange(name string) error
 	RenameNamedRange(oldName string, newName string) error
 	DoesNamedRangeExist(name string) bool
 	ListNamedRanges() []string
+	ListWorksheetNamedRanges(worksheet string) ([]string, error)
 	ListReferencedNamedRanges() []string
 
+	// table methods
+
+	AddTable(name string, rangeOrAddress string, totalsRow bool) error
+	RemoveTable(name string) error
+	RenameTableColumn(tableName string, oldName string, newName string) error
+	AppendTableRow(tableName string, values ...Primitive) error
+	GetTable(name string) (Table, error)
+	ListTables() []string
+
+	// auditing methods
+
+	TracePrecedents(address string, depth int) (*TraceNode, error)
+	TraceDependents(address string, depth int) (*TraceNode, error)
+	ExplainFormula(address string) (*FormulaExplanation, error)
+
 	// common methods
 
 	Calculate() error
+	CalculateContext(ctx context.Context) error
 }
 
 // Implementation of SpreadsheetInterface
@@ -243,9 +391,31 @@ func (s *Spreadsheet) Set(address string, value Primitive) error {
 		Column:      col,
 	}
 
+	return s.setCell(worksheet, cellAddr, value)
+}
+
+// setCell sets the value or formula of a cell of a worksheet
+func (s *Spreadsheet) setCell(worksheet *Worksheet, cellAddr CellAddress, value Primitive) error {
+	row, col := cellAddr.Row, cellAddr.Column
+
+	if err := s.checkNewCell(worksheet, cellAddr); err != nil {
+		return err
+	}
+
+	// report the edit to subscribers once the cell is stored
+	if s.hasSubscribers() {
+		oldValue, oldFormula := s.cellState(cellAddr)
+		defer s.emitCellChanges(cellAddr, oldValue, oldFormula)
+	}
+	s.spillCellEdited(worksheet, cellAddr)
+
 	// check if value is a formula (starts with =)
 	var formula string
 	if str, ok := value.(string); ok && len(str) > 0 && str[0] == '=' {
+		if err := s.limits.checkFormulaLength(str); err != nil {
+			return err
+		}
+
 		formula = str // keep the = sign for the lexer
 		value = nil   // formula cells don't have a direct value
 
@@ -277,14 +447,26 @@ func (s *Spreadsheet) Set(address string, value Primitive) error {
 				}
 				return id
 			},
+			ResolveTable: s.tableResolver(cellAddr),
+			MaxDepth:     s.limits.MaxASTDepth,
 		}
 
 		parser := NewParser(tokens, parserContext)
 		ast, parseErr := parser.Parse()
+		if parseErr == nil {
+			parseErr = s.limits.checkASTDepth(ast)
+		}
+		if appErr, ok := parseErr.(*AppError); ok {
+			// limit breaches reject the formula instead of storing an error
+			return appErr
+		}
 		if parseErr != nil {
 			// check if this is a REF error for cross-worksheet ranges
 			if strings.HasPrefix(parseErr.Error(), "REF:") {
 				worksheet.SetCell(row, col, NewSpreadsheetError(ErrorCodeRef, strings.TrimPrefix(parseErr.Error(), "REF: ")), "")
+			} else if refErr, ok := parseErr.(*SpreadsheetError); ok && refErr.ErrorCode == ErrorCodeRef {
+				// references to unknown worksheets, tables or columns
+				worksheet.SetCell(row, col, refErr, "")
 			} else {
 				// store error in cell
 				worksheet.SetCell(row, col, NewSpreadsheetError(ErrorCodeValue, parseErr.Error()), "")
@@ -292,33 +474,14 @@ func (s *Spreadsheet) Set(address string, value Primitive) error {
 			return nil
 		}
 
-		// intern the formula
-		formulaID := s.storage.formulas.InternFormula(ast, cellAddr)
-
-		// extract dependencies from AST and update dependency graph
-		s.extractDependencies(ast, cellAddr)
-
-		// mark this cell as having a formula in the dependency graph
-		s.storage.dependencyGraph.SetFormula(cellAddr, formula)
-
-		// store formula ID in cell
-		worksheet.SetCell(row, col, nil, formula)
-
-		// store formula ID directly in chunk
-		chunkRow := row / ChunkRows
-		chunkCol := col / ChunkCols
-		localRow := row % ChunkRows
-		localCol := col % ChunkCols
-		chunk := worksheet.getChunk(chunkRow, chunkCol)
-		idx := localCol*ChunkRows + localRow
-		if chunk.FormulaIDs == nil {
-			chunk.FormulaIDs = make([]uint32, ChunkSize)
+		s.storeFormula(worksheet, cellAddr, ast, formula)
+	} else {
+		if str, ok := value.(string); ok {
+			if err := s.limits.checkStringValue(str); err != nil {
+				return err
+			}
 		}
-		chunk.FormulaIDs[idx] = formulaID
 
-		// mark cell as dirty for calculation
-		s.storage.dependencyGraph.MarkDirty(cellAddr)
-	} else {
 		// Clear any existing dependencies
 		s.storage.dependencyGraph.ClearDependencies(cellAddr)
 
@@ -335,6 +498,51 @@ func (s *Spreadsheet) Set(address string, value Primitive) error {
 	return nil
 }
 
+// checkNewCell rejects new cells once the workbook holds the maximum number
+// of cells
+func (s *Spreadsheet) checkNewCell(worksheet *Worksheet, cellAddr CellAddress) error {
+	if s.limits.MaxTotalCells > 0 && worksheet.GetCell(cellAddr.Row, cellAddr.Column) == nil &&
+		s.cellCount() >= s.limits.MaxTotalCells {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Workbook cell count exceeds limit of %d", s.limits.MaxTotalCells))
+	}
+	return nil
+}
+
+// storeFormula stores a parsed formula in a cell, interning it and tracking
+// its dependencies, and marks the cell dirty
+func (s *Spreadsheet) storeFormula(worksheet *Worksheet, cellAddr CellAddress, ast ASTNode, formula string) {
+	row, col := cellAddr.Row, cellAddr.Column
+
+	// store the formula cell first, releasing any formula it replaces, so
+	// interning doesn't share tracking with the old formula
+	worksheet.SetCell(row, col, nil, formula)
+
+	// intern the formula
+	formulaID := s.storage.formulas.InternFormula(ast, cellAddr)
+
+	// extract dependencies from AST and update dependency graph
+	s.extractDependencies(ast, cellAddr)
+
+	// mark this cell as having a formula in the dependency graph
+	s.storage.dependencyGraph.SetFormula(cellAddr, formula)
+
+	// store formula ID directly in chunk
+	chunkRow := row / ChunkRows
+	chunkCol := col / ChunkCols
+	localRow := row % ChunkRows
+	localCol := col % ChunkCols
+	chunk := worksheet.getChunk(chunkRow, chunkCol)
+	idx := localCol*ChunkRows + localRow
+	if chunk.FormulaIDs == nil {
+		chunk.FormulaIDs = make([]uint32, ChunkSize)
+	}
+	chunk.FormulaIDs[idx] = formulaID
+
+	// mark cell as dirty for calculation
+	s.storage.dependencyGraph.MarkDirty(cellAddr)
+}
+
 // Remove removes a cell
 func (s *Spreadsheet) Remove(address string) error {
 	worksheetID, row, col, err := s.resolveAddress(address)
@@ -359,6 +567,18 @@ func (s *Spreadsheet) Remove(address string) error {
 		Column:      col,
 	}
 
+	s.removeCell(worksheet, cellAddr)
+	return nil
+}
+
+// removeCell removes a cell of a worksheet
+func (s *Spreadsheet) removeCell(worksheet *Worksheet, cellAddr CellAddress) {
+	if s.hasSubscribers() {
+		oldValue, oldFormula := s.cellState(cellAddr)
+		defer s.emitCellChanges(cellAddr, oldValue, oldFormula)
+	}
+	s.spillCellEdited(worksheet, cellAddr)
+
 	// get dependents before clearing dependencies
 	dependents := s.storage.dependencyGraph.GetDirectDependents(cellAddr)
 
@@ -366,7 +586,7 @@ func (s *Spreadsheet) Remove(address string) error {
 	s.storage.dependencyGraph.ClearDependencies(cellAddr)
 
 	// remove the cell
-	worksheet.RemoveCell(row, col)
+	worksheet.RemoveCell(cellAddr.Row, cellAddr.Column)
 
 	// mark dependent cells as dirty - removed cells affect their dependents
 	s.storage.dependencyGraph.MarkCellIfInRangeDirty(cellAddr)
@@ -376,20 +596,23 @@ func (s *Spreadsheet) Remove(address string) error {
 
 	// remove from dependency graph
 	s.storage.dependencyGraph.RemoveNode(cellAddr)
-
-	return nil
 }
 
 // AddWorksheet adds a new worksheet
 func (s *Spreadsheet) AddWorksheet(name string) error {
-	if s.storage.worksheets.Contains(name) {
+	if s.DoesWorksheetExist(name) {
 		return NewApplicationError(AlreadyExists, "Worksheet already exists")
 	}
 
+	// a name already referenced by formulas keeps its ID, so those formulas
+	// now read the new worksheet
 	worksheet := NewWorksheet(s.storage, 0)
 	worksheetID := s.storage.worksheets.DefineWorksheet(name, worksheet)
 	worksheet.worksheetID = worksheetID
+	s.markWorksheetDependentsDirty(worksheetID)
+	s.refreshWorksheetSpans()
 
+	s.emit(Event{Type: EventWorksheetAdded, Name: name})
 	return nil
 }
 
@@ -403,26 +626,33 @@ func (s *Spreadsheet) RemoveWorksheet(name string) error {
 	worksheet, _ := s.storage.worksheets.GetWorksheetByName(name)
 	worksheetID := worksheet.worksheetID
 
-	// mark all cells that depend on this worksheet as dirty. we need to check
-	// all nodes in the dependency graph
-	for cellAddr, node := range s.storage.dependencyGraph.nodes {
-		// check cell precedents
-		for precedentAddr := range node.CellPrecedents {
-			if precedentAddr.WorksheetID == worksheetID {
-				s.storage.dependencyGraph.MarkDirty(cellAddr)
-				break
-			}
-		}
+	s.markWorksheetDependentsDirty(worksheetID)
 
-		// check range precedents
-		for rangeAddr := range node.RangePrecedents {
-			if rangeAddr.WorksheetID == worksheetID {
-				s.storage.dependencyGraph.MarkDirty(cellAddr)
-				break
-			}
-		}
+	// names local to the worksheet go with it
+	for _, nameID := range s.storage.namedRanges.UndefineScope(worksheetID) {
+		s.markNamedRangeUsersDirty(nameID)
 	}
 
+	// and so do its tables
+	for _, table := range slices.Clone(worksheet.tables) {
+		s.removeTable(table)
+	}
+
+	// 3D references ending on the worksheet end on its neighbour inside their
+	// span instead, as in Excel
+	order := s.storage.worksheets.GetWorksheetOrder()
+	position, _ := s.storage.worksheets.GetWorksheetPosition(worksheetID)
+	s.moveSpanEndpoints(worksheetID, func(other uint32) uint32 {
+		otherPosition, defined := s.storage.worksheets.GetWorksheetPosition(other)
+		switch {
+		case !defined || otherPosition == position:
+			return 0
+		case otherPosition > position:
+			return order[position+1]
+		}
+		return order[position-1]
+	})
+
 	// remove all cells from the removed worksheet from the dependency graph. this
 	// prevents them from being in the dirty set
 	cellsToRemove := []CellAddress{}
@@ -434,11 +664,36 @@ func (s *Spreadsheet) RemoveWorksheet(name string) error {
 	for _, cellAddr := range cellsToRemove {
 		s.storage.dependencyGraph.RemoveNode(cellAddr)
 	}
+	s.spills.removeWorksheet(worksheetID)
 
 	s.storage.worksheets.UndefineWorksheet(name)
+	s.refreshWorksheetSpans()
+	s.emit(Event{Type: EventWorksheetRemoved, Name: name})
 	return nil
 }
 
+// markWorksheetDependentsDirty marks all cells that depend on a worksheet as
+// dirty. we need to check all nodes in the dependency graph
+func (s *Spreadsheet) markWorksheetDependentsDirty(worksheetID uint32) {
+	for cellAddr, node := range s.storage.dependencyGraph.nodes {
+		// check cell precedents
+		for precedentAddr := range node.CellPrecedents {
+			if precedentAddr.WorksheetID == worksheetID {
+				s.storage.dependencyGraph.MarkDirty(cellAddr)
+				break
+			}
+		}
+
+		// check range precedents
+		for rangeAddr := range node.RangePrecedents {
+			if rangeAddr.WorksheetID == worksheetID {
+				s.storage.dependencyGraph.MarkDirty(cellAddr)
+				break
+			}
+		}
+	}
+}
+
 // RenameWorksheet renames a worksheet
 func (s *Spreadsheet) RenameWorksheet(oldName string, newName string) error {
 	if !s.storage.worksheets.Contains(oldName) {
@@ -450,25 +705,322 @@ func (s *Spreadsheet) RenameWorksheet(oldName string, newName string) error {
 	}
 
 	worksheet, _ := s.storage.worksheets.GetWorksheetByName(oldName)
+	oldID := worksheet.worksheetID
+	position, _ := s.storage.worksheets.GetWorksheetPosition(oldID)
 
 	s.storage.worksheets.UndefineWorksheet(oldName)
 
-	s.storage.worksheets.DefineWorksheet(newName, worksheet)
+	// the renamed worksheet keeps its place in the tab order, and the 3D
+	// references ending on it
+	newID := s.storage.worksheets.DefineWorksheet(newName, worksheet)
+	s.storage.worksheets.MoveWorksheet(newID, position)
+	s.moveSpanEndpoints(oldID, func(uint32) uint32 { return newID })
+	s.refreshWorksheetSpans()
 
+	s.emit(Event{Type: EventWorksheetRenamed, Name: newName, OldName: oldName})
 	return nil
 }
 
+// MoveWorksheet moves a worksheet to a 0-based index in the tab order. 3D
+// references spanning the worksheets in between are updated.
+func (s *Spreadsheet) MoveWorksheet(name string, index int) error {
+	worksheet, exists := s.storage.worksheets.GetWorksheetByName(name)
+	if !exists {
+		return NewApplicationError(NotFound, "Worksheet not found")
+	}
+
+	if index < 0 || index >= s.storage.worksheets.CountDefined() {
+		return NewApplicationError(OutOfRange, fmt.Sprintf("Worksheet index %d out of range", index))
+	}
+
+	s.storage.worksheets.MoveWorksheet(worksheet.worksheetID, index)
+	s.refreshWorksheetSpans()
+
+	s.emit(Event{Type: EventWorksheetMoved, Name: name})
+	return nil
+}
+
+// CopyWorksheet copies a worksheet, its cells and its tab metadata to a new
+// worksheet placed right after it. formulas of the copy are re-interned so
+// references to the source worksheet point to the copy instead.
+func (s *Spreadsheet) CopyWorksheet(src string, dst string) error {
+	source, exists := s.storage.worksheets.GetWorksheetByName(src)
+	if !exists {
+		return NewApplicationError(NotFound, "Worksheet not found")
+	}
+
+	if s.DoesWorksheetExist(dst) {
+		return NewApplicationError(AlreadyExists, "Worksheet already exists")
+	}
+
+	if s.limits.MaxTotalCells > 0 && s.cellCount()+source.GetTotalCells() > s.limits.MaxTotalCells {
+		return NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Workbook cell count exceeds limit of %d", s.limits.MaxTotalCells))
+	}
+
+	sourceID := source.worksheetID
+	worksheet := source.clone(0)
+
+	// spilled values belong to the source's formulas, the copies spill their
+	// own once calculated
+	for addr := range s.spills.cells {
+		if addr.WorksheetID == sourceID {
+			worksheet.RemoveCell(addr.Row, addr.Column)
+		}
+	}
+	worksheetID := s.storage.worksheets.DefineWorksheet(dst, worksheet)
+	position, _ := s.storage.worksheets.GetWorksheetPosition(sourceID)
+	s.storage.worksheets.MoveWorksheet(worksheetID, position+1)
+	tables := s.copyWorksheetTables(source, worksheet)
+	s.copyWorksheetNames(sourceID, worksheetID, tables)
+
+	// re-intern every formula of the copy for its new cell
+	for key, chunk := range worksheet.chunks {
+		for idx, formulaID := range chunk.FormulaIDs {
+			if formulaID == 0 {
+				continue
+			}
+			cellAddr := CellAddress{
+				WorksheetID: worksheetID,
+				Row:         key.ChunkRow*ChunkRows + uint32(idx)%ChunkRows,
+				Column:      key.ChunkCol*ChunkCols + uint32(idx)/ChunkRows,
+			}
+
+			ast, _ := s.storage.formulas.GetAST(formulaID)
+			ast = retargetWorksheet(ast, sourceID, worksheetID, tables)
+			chunk.FormulaIDs[idx] = s.storage.formulas.InternFormula(ast, cellAddr)
+			s.extractDependencies(ast, cellAddr)
+			s.storage.dependencyGraph.SetFormula(cellAddr, "="+s.formulaText(ast, cellAddr))
+			s.storage.dependencyGraph.MarkDirty(cellAddr)
+		}
+	}
+
+	s.markWorksheetDependentsDirty(worksheetID)
+	s.refreshWorksheetSpans()
+
+	s.emit(Event{Type: EventWorksheetAdded, Name: dst})
+	for _, table := range worksheet.tables {
+		s.emit(Event{Type: EventTableAdded, Name: table.Name})
+	}
+	return nil
+}
+
+// copyWorksheetNames defines the names local to a worksheet on its copy,
+// with references to the source and its tables pointing to the copies
+func (s *Spreadsheet) copyWorksheetNames(sourceID, worksheetID uint32, tables map[uint32]uint32) {
+	namedRanges := s.storage.namedRanges
+	for _, id := range namedRanges.GetAllDefinedIDs() {
+		if namedRanges.GetNamedRangeScope(id) != sourceID {
+			continue
+		}
+		name, _ := namedRanges.GetNamedRangeName(id)
+		if rangeAddr, isRange := namedRanges.GetRangeAddress(id); isRange {
+			if rangeAddr.WorksheetID == sourceID {
+				rangeAddr.WorksheetID = worksheetID
+			}
+			namedRanges.DefineNamedRange(worksheetID, name, rangeAddr)
+		} else if formula, isFormula := namedRanges.GetFormula(id); isFormula {
+			origin := formula.origin
+			if origin.WorksheetID == sourceID {
+				origin.WorksheetID = worksheetID
+			}
+			namedRanges.DefineNamedFormula(worksheetID, name, retargetWorksheet(formula.ast, sourceID, worksheetID, tables), origin)
+		}
+	}
+}
+
+// retargetWorksheet returns a copy of the AST with references to one
+// worksheet pointing to another, and structured references to the tables
+// in tables pointing to the tables they map to. nodes without such
+// references are shared.
+func retargetWorksheet(node ASTNode, from, to uint32, tables map[uint32]uint32) ASTNode {
+	switch n := node.(type) {
+	case *StructuredRefNode:
+		if copied, exists := tables[n.TableID]; exists {
+			retargeted := *n
+			retargeted.TableID = copied
+			return &retargeted
+		}
+	case *CellRefNode:
+		if n.WorksheetID == from {
+			retargeted := *n
+			retargeted.WorksheetID = to
+			return &retargeted
+		}
+	case *RangeNode:
+		if n.WorksheetID == from {
+			retargeted := *n
+			retargeted.WorksheetID = to
+			return &retargeted
+		}
+	case *NamedRangeNode:
+		if n.WorksheetID == from {
+			retargeted := *n
+			retargeted.WorksheetID = to
+			return &retargeted
+		}
+	case *BinaryOpNode:
+		return &BinaryOpNode{Op: n.Op, Left: retargetWorksheet(n.Left, from, to, tables),
+			Right: retargetWorksheet(n.Right, from, to, tables), Position: n.Position}
+	case *UnaryOpNode:
+		return &UnaryOpNode{Op: n.Op, Operand: retargetWorksheet(n.Operand, from, to, tables), Position: n.Position}
+	case *FunctionCallNode:
+		args := make([]ASTNode, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = retargetWorksheet(arg, from, to, tables)
+		}
+		return &FunctionCallNode{Name: n.Name, Args: args, Local: n.Local, Position: n.Position}
+	}
+	return node
+}
+
+// moveSpanEndpoints moves the endpoints on a worksheet of the 3D references
+// in the formulas of cells and names to the worksheet endpoint returns given
+// the other endpoint, or leaves them when it returns 0
+func (s *Spreadsheet) moveSpanEndpoints(worksheetID uint32, endpoint func(other uint32) uint32) {
+	for _, formulaID := range s.storage.formulas.GetFormulasWithWorksheetSpans() {
+		ast, _ := s.storage.formulas.GetAST(formulaID)
+		moved := moveSpanEndpoint(ast, worksheetID, endpoint)
+		if moved == ast {
+			continue
+		}
+		for _, cellAddr := range s.storage.formulas.GetCellsUsingFormula(formulaID) {
+			if worksheet, exists := s.storage.worksheets.GetWorksheet(cellAddr.WorksheetID); exists {
+				s.setFormulaAST(worksheet, cellAddr, moved)
+			}
+		}
+	}
+
+	namedRanges := s.storage.namedRanges
+	for _, id := range namedRanges.GetAllDefinedIDs() {
+		formula, isFormula := namedRanges.GetFormula(id)
+		if !isFormula {
+			continue
+		}
+		if moved := moveSpanEndpoint(formula.ast, worksheetID, endpoint); moved != formula.ast {
+			key := namedRanges.idToName[id]
+			namedRanges.DefineNamedFormula(key.worksheetID, key.name, moved, formula.origin)
+			s.markNamedRangeUsersDirty(id)
+		}
+	}
+}
+
+// moveSpanEndpoint returns the AST with the endpoints on a worksheet of its
+// 3D references moved as moveSpanEndpoints does, or the AST itself when none
+// of them moves
+func moveSpanEndpoint(node ASTNode, worksheetID uint32, endpoint func(other uint32) uint32) ASTNode {
+	switch n := node.(type) {
+	case *Range3DNode:
+		moved := *n
+		if n.FirstWorksheetID == worksheetID {
+			if first := endpoint(n.LastWorksheetID); first != 0 {
+				moved.FirstWorksheetID = first
+			}
+		}
+		if n.LastWorksheetID == worksheetID {
+			if last := endpoint(n.FirstWorksheetID); last != 0 {
+				moved.LastWorksheetID = last
+			}
+		}
+		if moved.FirstWorksheetID != n.FirstWorksheetID || moved.LastWorksheetID != n.LastWorksheetID {
+			return &moved
+		}
+	case *BinaryOpNode:
+		left := moveSpanEndpoint(n.Left, worksheetID, endpoint)
+		right := moveSpanEndpoint(n.Right, worksheetID, endpoint)
+		if left != n.Left || right != n.Right {
+			return &BinaryOpNode{Op: n.Op, Left: left, Right: right, Position: n.Position}
+		}
+	case *UnaryOpNode:
+		if operand := moveSpanEndpoint(n.Operand, worksheetID, endpoint); operand != n.Operand {
+			return &UnaryOpNode{Op: n.Op, Operand: operand, Position: n.Position}
+		}
+	case *FunctionCallNode:
+		args := make([]ASTNode, len(n.Args))
+		changed := false
+		for i, arg := range n.Args {
+			args[i] = moveSpanEndpoint(arg, worksheetID, endpoint)
+			changed = changed || args[i] != arg
+		}
+		if changed {
+			return &FunctionCallNode{Name: n.Name, Args: args, Local: n.Local, Position: n.Position}
+		}
+	}
+	return node
+}
+
+// GetWorksheetProperties returns the tab metadata of a worksheet
+func (s *Spreadsheet) GetWorksheetProperties(name string) (WorksheetProperties, error) {
+	worksheet, exists := s.storage.worksheets.GetWorksheetByName(name)
+	if !exists {
+		return WorksheetProperties{}, NewApplicationError(NotFound, "Worksheet not found")
+	}
+	return worksheet.properties, nil
+}
+
+// SetWorksheetProperties replaces the tab metadata of a worksheet. at least
+// one worksheet has to stay visible.
+func (s *Spreadsheet) SetWorksheetProperties(name string, properties WorksheetProperties) error {
+	worksheet, exists := s.storage.worksheets.GetWorksheetByName(name)
+	if !exists {
+		return NewApplicationError(NotFound, "Worksheet not found")
+	}
+
+	if properties.Visibility > WorksheetVeryHidden {
+		return NewApplicationError(InvalidArgument, "Invalid worksheet visibility")
+	}
+	if !isTabColor(properties.TabColor) {
+		return NewApplicationError(InvalidArgument, fmt.Sprintf("Invalid tab color %q", properties.TabColor))
+	}
+	if !(properties.DefaultColumnWidth >= 0) {
+		return NewApplicationError(InvalidArgument, "Default column width must not be negative")
+	}
+
+	if properties.Visibility != WorksheetVisible && worksheet.properties.Visibility == WorksheetVisible {
+		visible := 0
+		for _, other := range s.storage.worksheets.GetAllDefinedWorksheets() {
+			if other.properties.Visibility == WorksheetVisible {
+				visible++
+			}
+		}
+		if visible == 1 {
+			return NewApplicationError(FailedPrecondition, "Cannot hide the last visible worksheet")
+		}
+	}
+
+	worksheet.properties = properties
+	return nil
+}
+
+// isTabColor checks that a tab color is empty or in "#RRGGBB" form
+func isTabColor(color string) bool {
+	if color == "" {
+		return true
+	}
+	if len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	for _, ch := range color[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", ch) {
+			return false
+		}
+	}
+	return true
+}
+
 // DoesWorksheetExist checks if a worksheet exists
 func (s *Spreadsheet) DoesWorksheetExist(name string) bool {
 	id, exists := s.storage.worksheets.GetWorksheetID(name)
 	return exists && s.storage.worksheets.IsWorksheetDefined(id)
 }
 
-// ListWorksheets returns all defined worksheet names
+// ListWorksheets returns all defined worksheet names in tab order, hidden
+// worksheets included
 func (s *Spreadsheet) ListWorksheets() []string {
-	worksheets := s.storage.worksheets.GetAllDefinedWorksheets()
-	result := make([]string, 0, len(worksheets))
-	for name := range worksheets {
+	order := s.storage.worksheets.GetWorksheetOrder()
+	result := make([]string, 0, len(order))
+	for _, worksheetID := range order {
+		name, _ := s.storage.worksheets.GetWorksheetName(worksheetID)
 		result = append(result, name)
 	}
 	return result
@@ -479,82 +1031,420 @@ func (s *Spreadsheet) ListReferencedWorksheets() []string {
 	return s.storage.worksheets.GetAllUndefinedWorksheets()
 }
 
-// AddNamedRange adds a named range
+// AddNamedRange adds a named range. names like "Sheet1!Total" are local to
+// the worksheet, others belong to the whole workbook.
 func (s *Spreadsheet) AddNamedRange(name string) error {
-	if s.storage.namedRanges.Contains(name) {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+	if s.storage.namedRanges.Contains(key.worksheetID, key.name) {
 		return NewApplicationError(AlreadyExists, "Named range already exists")
 	}
 
 	// For now, just intern the name without defining it
-	s.storage.namedRanges.InternNamedRange(name)
+	s.storage.namedRanges.InternNamedRange(key.worksheetID, key.name)
+	s.emit(Event{Type: EventNamedRangeAdded, Name: name})
+	return nil
+}
+
+// DefineNamedRange points a named range at a cell, like "Sheet1!A1", or a
+// range, like "Sheet1!A1:B10", adding the name if it doesn't exist. formulas
+// using the name are marked dirty.
+func (s *Spreadsheet) DefineNamedRange(name string, rangeOrAddress string) error {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+	if err := s.checkNameSpelling(key); err != nil {
+		return err
+	}
+	rangeAddr, err := s.resolveRange(rangeOrAddress)
+	if err != nil {
+		return err
+	}
+
+	added := !s.storage.namedRanges.Contains(key.worksheetID, key.name)
+	s.storage.namedRanges.DefineNamedRange(key.worksheetID, key.name, rangeAddr)
+	s.markNameUsersDirty(key.name)
+
+	if added {
+		s.emit(Event{Type: EventNamedRangeAdded, Name: name})
+	}
+	return nil
+}
+
+// DefineNamedFormula defines a name as a formula, like "=Sheet1!B1*2" or
+// "=LAMBDA(price, price*0.21)", adding the name if it doesn't exist. a name
+// holding a LAMBDA is called like a function, e.g. =TAXCALC(A1). references
+// without a worksheet are to the worksheet of the formula using the name,
+// relative to A1. formulas using the name are marked dirty.
+func (s *Spreadsheet) DefineNamedFormula(name string, formula string) error {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+	ast, err := s.parseNamedFormula(formula, CellAddress{})
+	if err != nil {
+		return err
+	}
+	return s.defineNamedFormula(name, key, ast, CellAddress{})
+}
+
+// DefineNamedFormulaAt defines a name as a formula evaluated in the context
+// of a cell, like "Sheet1!C1": references are relative to that cell, and
+// references without a worksheet are to its worksheet
+func (s *Spreadsheet) DefineNamedFormulaAt(name string, formula string, address string) error {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+	worksheetID, row, col, err := s.resolveAddress(address)
+	if err != nil {
+		return err
+	}
+	if worksheetID == 0 || !s.storage.worksheets.IsWorksheetDefined(worksheetID) {
+		return NewApplicationError(NotFound, fmt.Sprintf("Worksheet not found for %s", address))
+	}
+	origin := CellAddress{WorksheetID: worksheetID, Row: row, Column: col}
+	ast, err := s.parseNamedFormula(formula, origin)
+	if err != nil {
+		return err
+	}
+	return s.defineNamedFormula(name, key, ast, origin)
+}
+
+// DefineNamedConstant defines a name as a number, string or boolean, like
+// TaxRate = 0.21
+func (s *Spreadsheet) DefineNamedConstant(name string, value Primitive) error {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+
+	var ast ASTNode
+	switch v := value.(type) {
+	case float64:
+		ast = &NumberNode{Value: v}
+	case int:
+		ast = &NumberNode{Value: float64(v)}
+	case string:
+		if err := s.limits.checkStringValue(v); err != nil {
+			return err
+		}
+		ast = &StringNode{Value: v}
+	case bool:
+		ast = &BooleanNode{Value: v}
+	default:
+		return NewApplicationError(InvalidArgument, fmt.Sprintf("Named constant can't hold %T", value))
+	}
+	return s.defineNamedFormula(name, key, ast, CellAddress{})
+}
+
+// defineNamedFormula defines a name as a parsed formula and marks the
+// formulas using it dirty
+func (s *Spreadsheet) defineNamedFormula(name string, key nameKey, ast ASTNode, origin CellAddress) error {
+	if err := s.checkNameSpelling(key); err != nil {
+		return err
+	}
+	added := !s.storage.namedRanges.Contains(key.worksheetID, key.name)
+	s.storage.namedRanges.DefineNamedFormula(key.worksheetID, key.name, ast, origin)
+	s.markNameUsersDirty(key.name)
+
+	if added {
+		s.emit(Event{Type: EventNamedRangeAdded, Name: name})
+	}
+	return nil
+}
+
+// checkNameSpelling rejects defining a name that differs only by case from
+// a name defined in the same scope. names match ignoring case, so the two
+// would be the same name.
+func (s *Spreadsheet) checkNameSpelling(key nameKey) error {
+	id, exists := s.storage.namedRanges.GetNamedRangeID(key.worksheetID, key.name)
+	if !exists || !s.storage.namedRanges.IsRangeDefined(id) {
+		return nil
+	}
+	if name, _ := s.storage.namedRanges.GetNamedRangeName(id); name != key.name {
+		return NewApplicationError(AlreadyExists, fmt.Sprintf("Named range already exists as %s", name))
+	}
 	return nil
 }
 
+// parseNamedFormula parses the formula of a name relative to origin. an
+// origin without a worksheet leaves references without one.
+func (s *Spreadsheet) parseNamedFormula(formula string, origin CellAddress) (ASTNode, error) {
+	if !strings.HasPrefix(formula, "=") {
+		return nil, NewApplicationError(InvalidArgument, "Named formula must start with '='")
+	}
+	if err := s.limits.checkFormulaLength(formula); err != nil {
+		return nil, err
+	}
+
+	tokens, lexErrors := NewLexer(formula).Tokenize()
+	if len(lexErrors) > 0 {
+		return nil, NewApplicationError(InvalidArgument, strings.Join(lexErrors, "; "))
+	}
+	parser := NewParser(tokens, &ParserContext{
+		CurrentWorksheetID: origin.WorksheetID,
+		CurrentRow:         int32(origin.Row),
+		CurrentColumn:      int32(origin.Column),
+		ResolveWorksheet: func(name string) uint32 {
+			id, _ := s.storage.worksheets.GetWorksheetID(name)
+			if id == 0 {
+				id = s.storage.worksheets.InternWorksheet(name)
+			}
+			return id
+		},
+		ResolveTable: s.tableResolver(origin),
+		MaxDepth:     s.limits.MaxASTDepth,
+	})
+	ast, err := parser.Parse()
+	if err == nil {
+		err = s.limits.checkASTDepth(ast)
+	}
+	if _, ok := err.(*AppError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, NewApplicationError(InvalidArgument, err.Error())
+	}
+	return ast, nil
+}
+
+// markNamedRangeUsersDirty marks the cells of formulas using a named range
+// as dirty. their dependencies include what the name reads, so they are
+// extracted again for its new definition.
+func (s *Spreadsheet) markNamedRangeUsersDirty(nameID uint32) {
+	s.markFormulaCellsDirty(s.storage.formulas.GetFormulasUsingNamedRange(nameID))
+}
+
+// markFormulaCellsDirty extracts the dependencies of the cells using
+// formulas again and marks them dirty
+func (s *Spreadsheet) markFormulaCellsDirty(formulaIDs []uint32) {
+	for _, formulaID := range formulaIDs {
+		ast, _ := s.storage.formulas.GetAST(formulaID)
+		for _, addr := range s.storage.formulas.GetCellsUsingFormula(formulaID) {
+			s.extractDependencies(ast, addr)
+			s.storage.dependencyGraph.MarkDirty(addr)
+		}
+	}
+}
+
+// markNameUsersDirty marks the users of a name dirty in every scope, and
+// the formulas calling it as a function. a name local to a worksheet hides
+// the workbook name, so all of them may refer to a new definition.
+func (s *Spreadsheet) markNameUsersDirty(name string) {
+	for _, nameID := range s.storage.namedRanges.GetNamedRangeIDsFold(name) {
+		s.markNamedRangeUsersDirty(nameID)
+	}
+	s.markFormulaCellsDirty(s.storage.formulas.GetFormulasCallingFunction(name))
+}
+
 // RemoveNamedRange removes a named range
 func (s *Spreadsheet) RemoveNamedRange(name string) error {
-	if !s.storage.namedRanges.Contains(name) {
+	key, err := s.resolveName(name)
+	if err != nil {
+		return err
+	}
+	if !s.storage.namedRanges.Contains(key.worksheetID, key.name) {
 		return NewApplicationError(NotFound, "Named range not found")
 	}
 
-	s.storage.namedRanges.UndefineNamedRange(name)
+	s.storage.namedRanges.UndefineNamedRange(key.worksheetID, key.name)
+	s.markNameUsersDirty(key.name)
+	s.emit(Event{Type: EventNamedRangeRemoved, Name: name})
 	return nil
 }
 
-// RenameNamedRange renames a named range
+// RenameNamedRange renames a named range. the name keeps its scope, so
+// the new name may leave out the worksheet of a name local to one.
 func (s *Spreadsheet) RenameNamedRange(oldName string, newName string) error {
-	if !s.storage.namedRanges.Contains(oldName) {
+	oldKey, err := s.resolveName(oldName)
+	if err != nil {
+		return err
+	}
+	if !s.storage.namedRanges.Contains(oldKey.worksheetID, oldKey.name) {
 		return NewApplicationError(NotFound, "Named range not found")
 	}
 
-	if s.storage.namedRanges.Contains(newName) {
+	newKey, err := s.resolveName(newName)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(newName, "!") {
+		newKey.worksheetID = oldKey.worksheetID
+	}
+	if newKey.worksheetID != oldKey.worksheetID {
+		return NewApplicationError(InvalidArgument, "Renaming can't change the scope of a named range")
+	}
+	// Get the range address or formula if defined
+	id, _ := s.storage.namedRanges.GetNamedRangeID(oldKey.worksheetID, oldKey.name)
+
+	// names match ignoring case, so only the spelling of the name itself may
+	// change to one matching it
+	if otherID, exists := s.storage.namedRanges.GetNamedRangeID(newKey.worksheetID, newKey.name); exists && (otherID != id || newKey.name == oldKey.name) {
 		return NewApplicationError(AlreadyExists, "Named range already exists")
 	}
 
-	// Get the range address if defined
-	id, _ := s.storage.namedRanges.GetNamedRangeID(oldName)
 	rangeAddr, isDefined := s.storage.namedRanges.GetRangeAddress(id)
+	formula, isFormula := s.storage.namedRanges.GetFormula(id)
 
-	// Remove old name
-	s.storage.namedRanges.UndefineNamedRange(oldName)
+	// Remove old name, formulas using it no longer find it
+	s.storage.namedRanges.UndefineNamedRange(oldKey.worksheetID, oldKey.name)
+	s.markNameUsersDirty(oldKey.name)
 
 	// Add with new name
-	if isDefined {
-		s.storage.namedRanges.DefineNamedRange(newName, rangeAddr)
+	if isFormula {
+		s.storage.namedRanges.DefineNamedFormula(newKey.worksheetID, newKey.name, formula.ast, formula.origin)
+	} else if isDefined {
+		s.storage.namedRanges.DefineNamedRange(newKey.worksheetID, newKey.name, rangeAddr)
 	} else {
-		s.storage.namedRanges.InternNamedRange(newName)
+		s.storage.namedRanges.InternNamedRange(newKey.worksheetID, newKey.name)
 	}
+	s.markNameUsersDirty(newKey.name)
 
+	s.emit(Event{Type: EventNamedRangeRenamed, Name: newName, OldName: oldName})
 	return nil
 }
 
 // DoesNamedRangeExist checks if a named range exists
 func (s *Spreadsheet) DoesNamedRangeExist(name string) bool {
-	id, exists := s.storage.namedRanges.GetNamedRangeID(name)
+	key, err := s.resolveName(name)
+	if err != nil {
+		return false
+	}
+	id, exists := s.storage.namedRanges.GetNamedRangeID(key.worksheetID, key.name)
 	return exists && s.storage.namedRanges.IsRangeDefined(id)
 }
 
-// ListNamedRanges returns all defined named range names
+// ListNamedRanges returns all defined named range names, including names
+// defined as formulas. names local to a worksheet are listed with it, like
+// "Sheet1!Total".
 func (s *Spreadsheet) ListNamedRanges() []string {
-	ranges := s.storage.namedRanges.GetAllDefinedRanges()
-	result := make([]string, 0, len(ranges))
-	for name := range ranges {
-		result = append(result, name)
+	ids := s.storage.namedRanges.GetAllDefinedIDs()
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.formatName(id))
 	}
 	return result
 }
 
+// ListWorksheetNamedRanges returns the defined names local to a worksheet,
+// without the worksheet
+func (s *Spreadsheet) ListWorksheetNamedRanges(worksheet string) ([]string, error) {
+	ws, exists := s.storage.worksheets.GetWorksheetByName(worksheet)
+	if !exists {
+		return nil, NewApplicationError(NotFound, "Worksheet not found")
+	}
+
+	var result []string
+	for _, id := range s.storage.namedRanges.GetAllDefinedIDs() {
+		if s.storage.namedRanges.GetNamedRangeScope(id) == ws.worksheetID {
+			name, _ := s.storage.namedRanges.GetNamedRangeName(id)
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
 // ListReferencedNamedRanges returns all referenced but undefined named range names
 func (s *Spreadsheet) ListReferencedNamedRanges() []string {
-	return s.storage.namedRanges.GetAllUndefinedRanges()
+	ids := s.storage.namedRanges.GetAllUndefinedIDs()
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.formatName(id))
+	}
+	return result
+}
+
+// resolveName splits a name like "Sheet1!Total" into the worksheet it is
+// local to and the name. names without a worksheet belong to the workbook.
+func (s *Spreadsheet) resolveName(name string) (nameKey, error) {
+	idx := strings.LastIndex(name, "!")
+	if idx == -1 {
+		return nameKey{name: name}, nil
+	}
+
+	worksheetName := name[:idx]
+	if strings.HasPrefix(worksheetName, "'") && strings.HasSuffix(worksheetName, "'") {
+		worksheetName = worksheetName[1 : len(worksheetName)-1]
+	}
+	worksheet, exists := s.storage.worksheets.GetWorksheetByName(worksheetName)
+	if !exists {
+		return nameKey{}, NewApplicationError(NotFound, fmt.Sprintf("Worksheet not found for %s", name))
+	}
+	return nameKey{worksheetID: worksheet.worksheetID, name: name[idx+1:]}, nil
+}
+
+// formatName formats a named range ID with the worksheet it is local to,
+// e.g. "Sheet1!Total", or alone for workbook names
+func (s *Spreadsheet) formatName(id uint32) string {
+	name, _ := s.storage.namedRanges.GetNamedRangeName(id)
+	if worksheetID := s.storage.namedRanges.GetNamedRangeScope(id); worksheetID != 0 {
+		worksheetName, _ := s.storage.worksheets.GetWorksheetName(worksheetID)
+		return worksheetName + "!" + name
+	}
+	return name
 }
 
 // Calculate recalculates all dirty cells in the spreadsheet
 func (s *Spreadsheet) Calculate() error {
+	return s.CalculateContext(context.Background())
+}
+
+// SetProgressHandler sets a callback invoked after each formula cell is
+// calculated. the handler runs on the goroutine calling Calculate, pass nil
+// to remove it.
+func (s *Spreadsheet) SetProgressHandler(handler func(CalculationProgress)) {
+	s.progress = handler
+}
+
+// CalculateContext recalculates all dirty cells in the spreadsheet, checking
+// ctx between cells. when ctx is done an AppError with code Canceled or
+// DeadlineExceeded is returned and the cells that were not calculated stay
+// dirty, so a later call resumes where this one stopped.
+func (s *Spreadsheet) CalculateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return newInterruptedError(err)
+	}
+
+	// track value changes so each changed cell is reported once, even if the
+	// calculation evaluates it several times
+	if s.hasSubscribers() {
+		s.changes = make(map[CellAddress]Primitive)
+		defer s.emitCalculationChanges()
+	}
+
 	// mark all volatile cells as dirty (they should always be recalculated)
 	s.storage.dependencyGraph.MarkAllVolatileDirty()
 
+	// nothing to calculate. iterative calculation still runs to report the
+	// status of its cycles
+	if len(s.storage.dependencyGraph.dirtySet) == 0 && !s.iteration.Enabled {
+		s.calculatedCells = 0
+		return nil
+	}
+
 	// reset calculation stack
 	s.calculationStack.reset()
+	s.calculatedCells = 0
+
+	// with iterative calculation enabled, cycles are resolved by iterating
+	// instead of being reported as circular references
+	if s.iteration.Enabled {
+		if err := s.calculateIterative(ctx); err != nil {
+			return err
+		}
+	}
+
+	// evaluate independent cells concurrently when enabled. anything left dirty
+	// (cells on or behind a cycle) is handled by the serial loop below
+	if s.parallelism > 1 {
+		if err := s.calculateParallel(ctx); err != nil {
+			return err
+		}
+	}
 
 	// keep processing while there are dirty cells
 	for len(s.storage.dependencyGraph.dirtySet) > 0 {
@@ -565,15 +1455,7 @@ func (s *Spreadsheet) Calculate() error {
 		}
 
 		// Sort cells for deterministic order (by worksheet, then row, then column)
-		sort.Slice(dirtyCells, func(i, j int) bool {
-			if dirtyCells[i].WorksheetID != dirtyCells[j].WorksheetID {
-				return dirtyCells[i].WorksheetID < dirtyCells[j].WorksheetID
-			}
-			if dirtyCells[i].Row != dirtyCells[j].Row {
-				return dirtyCells[i].Row < dirtyCells[j].Row
-			}
-			return dirtyCells[i].Column < dirtyCells[j].Column
-		})
+		sortCellAddresses(dirtyCells)
 
 		// process each dirty cell in sorted order
 		for _, cellAddr := range dirtyCells {
@@ -589,7 +1471,10 @@ func (s *Spreadsheet) Calculate() error {
 			}
 
 			// calculate this cell
-			if err := s.calculateCell(cellAddr); err != nil {
+			if err := s.calculateCell(ctx, cellAddr); err != nil {
+				if isAbortError(err) {
+					return err
+				}
 				// only REF errors should be returned from calculateCell and they've
 				// already been stored in the cell. error already stored in cell
 				continue
@@ -603,42 +1488,174 @@ func (s *Spreadsheet) Calculate() error {
 	return nil
 }
 
-// calculateCell calculates a single cell and its dependencies
-func (s *Spreadsheet) calculateCell(cellAddr CellAddress) error {
+// calcFrame is a formula cell on the calculation work stack. a frame first
+// calculates its direct precedents in order, then the dirty cells of each of
+// its range precedents, and is evaluated once nothing is left.
+type calcFrame struct {
+	addr       CellAddress
+	worksheet  *Worksheet
+	formula    compiledFormula
+	precedents []CellAddress  // direct precedents
+	next       int            // index of the next direct precedent
+	direct     bool           // whether the last precedent handed out was direct
+	ranges     []RangeAddress // range precedents
+	rangeIdx   int            // index of the range being calculated
+	rangeCells []CellAddress  // dirty cells of the current pass over the range
+	rangeNext  int            // index of the next cell of the current pass
+	passActive bool           // whether a pass over the current range is running
+	calculated bool           // whether the current pass calculated any cell
+}
+
+// nextPrecedent returns the next precedent the frame has to wait on. cells
+// of a range can dirty later cells of the same range, so each range is
+// passed over until a pass calculates nothing.
+func (s *Spreadsheet) nextPrecedent(frame *calcFrame) (CellAddress, bool) {
+	if frame.next < len(frame.precedents) {
+		frame.next++
+		frame.direct = true
+		return frame.precedents[frame.next-1], true
+	}
+
+	frame.direct = false
+	for frame.rangeIdx < len(frame.ranges) {
+		if !frame.passActive {
+			frame.rangeCells = s.storage.dependencyGraph.GetDirtyCellsInRange(frame.ranges[frame.rangeIdx])
+			frame.rangeNext = 0
+			frame.passActive = true
+			frame.calculated = false
+		}
+
+		for frame.rangeNext < len(frame.rangeCells) {
+			rangeCell := frame.rangeCells[frame.rangeNext]
+			frame.rangeNext++
+			// skip cells calculated meanwhile or already being processed
+			if s.calculationStack.isCompleted(rangeCell) || s.calculationStack.isProcessing(rangeCell) {
+				continue
+			}
+			frame.calculated = true
+			return rangeCell, true
+		}
+
+		frame.passActive = false
+		if !frame.calculated {
+			frame.rangeIdx++
+		}
+	}
+
+	return CellAddress{}, false
+}
+
+// calculateCell calculates a single cell and its dependencies. precedents
+// are calculated depth first using an explicit work stack, so very deep
+// dependency chains don't grow the goroutine stack.
+func (s *Spreadsheet) calculateCell(ctx context.Context, cellAddr CellAddress) error {
+	frame, err := s.enterCell(ctx, cellAddr)
+	if frame == nil {
+		return err
+	}
+
+	stack := []*calcFrame{frame}
+
+	// result of the frame finished last, handed to the frame below it the
+	// same way a return value would be
+	var result error
+
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+
+		if result != nil {
+			err := result
+			result = nil
+			// circular reference detected in a direct precedent - store it in
+			// this cell and propagate. circular reference errors from range
+			// cells aren't propagated, they'll be picked up during evaluation
+			if spreadsheetErr, ok := err.(*SpreadsheetError); ok && frame.direct && spreadsheetErr.ErrorCode == ErrorCodeCircular {
+				s.storeFormulaResult(frame.worksheet, frame.addr, spreadsheetErr)
+				s.leaveCell(frame.addr)
+				stack = stack[:len(stack)-1]
+				result = spreadsheetErr
+				continue
+			}
+		}
+
+		precedent, ok := s.nextPrecedent(frame)
+		if !ok {
+			// evaluate the formula, errors are stored in the cell and
+			// propagate through formula evaluation of dependents
+			s.storeFormulaResult(frame.worksheet, frame.addr, s.evaluateFormula(frame.formula, frame.addr))
+			s.leaveCell(frame.addr)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		child, err := s.enterCell(ctx, precedent)
+		if err != nil && isAbortError(err) {
+			// leave the cells on the stack dirty, they are calculated on the
+			// next call
+			return err
+		}
+		if child != nil {
+			stack = append(stack, child)
+			continue
+		}
+		result = err
+	}
+
+	return result
+}
+
+// enterCell pushes a cell onto the calculation stack and returns its frame.
+// cells that need no precedents calculated are finished right away, in
+// which case the frame is nil and the error is what the cell resolved to.
+func (s *Spreadsheet) enterCell(ctx context.Context, cellAddr CellAddress) (*calcFrame, error) {
 	if s.calculationStack.isCompleted(cellAddr) {
-		return nil
+		return nil, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, newInterruptedError(err)
 	}
 
 	if s.calculationStack.isProcessing(cellAddr) {
 		// cell is already being calculated, we have a circular reference
-		return NewSpreadsheetError(ErrorCodeRef, "Circular reference detected")
+		return nil, s.newCircularReferenceError(append(s.calculationStack.pathFrom(cellAddr, s.formatCellAddress), s.formatCellAddress(cellAddr)))
+	}
+
+	if s.limits.MaxRecursionDepth > 0 && len(s.calculationStack.items) >= s.limits.MaxRecursionDepth {
+		// leave this cell dirty, it is calculated once the limit is raised
+		return nil, NewApplicationError(ResourceExhausted,
+			fmt.Sprintf("Calculation exceeds recursion depth limit of %d", s.limits.MaxRecursionDepth))
 	}
 
 	// push to stack (processing this cell)
 	s.calculationStack.push(cellAddr)
-	defer func() {
-		s.calculationStack.pop()
-		s.calculationStack.markCompleted(cellAddr)
-	}()
 
 	// get worksheet
 	worksheet, exists := s.storage.worksheets.GetWorksheet(cellAddr.WorksheetID)
 	if !exists {
-		return nil // worksheet not found
+		s.leaveCell(cellAddr)
+		return nil, nil // worksheet not found
 	}
 
-	cell := worksheet.GetCell(cellAddr.Row, cellAddr.Column)
-	if cell == nil || cell.FormulaID == 0 {
+	formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(cellAddr)
+	if !isFormula {
 		// no formula to calculate - non-formula cells don't need propagation
 		// they only change when explicitly set, not during calculation
 		s.storage.dependencyGraph.ClearDirty(cellAddr)
-		return nil
+		s.leaveCell(cellAddr)
+
+		// a spilled value is only current once its anchor is calculated
+		if anchor, spilled := s.spills.GetAnchor(cellAddr); spilled {
+			return s.enterCell(ctx, anchor)
+		}
+		return nil, nil
 	}
 
-	// get formula AST
-	ast, exists := s.storage.formulas.GetAST(cell.FormulaID)
+	// get compiled formula
+	formula, exists := s.storage.formulas.GetCompiled(formulaID)
 	if !exists {
-		return nil // formula not found... should not happen
+		s.leaveCell(cellAddr)
+		return nil, nil // formula not found... should not happen
 	}
 
 	// check for circular reference through ranges. a cell cannot depend on a
@@ -647,94 +1664,116 @@ func (s *Spreadsheet) calculateCell(cellAddr CellAddress) error {
 	for _, rangeAddr := range rangePrecedents {
 		if s.storage.dependencyGraph.IsInRange(cellAddr, rangeAddr) {
 			// cell depends on a range that includes itself - circular reference
-			circularErr := NewSpreadsheetError(ErrorCodeRef, "Circular reference detected")
-			worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column, circularErr)
-			s.storage.dependencyGraph.ClearDirty(cellAddr)
-			return circularErr
+			circularErr := s.newCircularReferenceError([]string{s.formatCellAddress(cellAddr), s.formatRangeAddress(rangeAddr)})
+			s.storeFormulaResult(worksheet, cellAddr, circularErr)
+			s.leaveCell(cellAddr)
+			return nil, circularErr
 		}
 	}
 
-	// calculate cell dependencies first
-	precedents := s.storage.dependencyGraph.GetDirectPrecedents(cellAddr)
-	for _, precedent := range precedents {
-		if err := s.calculateCell(precedent); err != nil {
-			// circular reference detected - store it in this cell and propagate
-			if spreadsheetErr, ok := err.(*SpreadsheetError); ok && spreadsheetErr.ErrorCode == ErrorCodeRef {
-				// store REF error from precedent
-				worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column, spreadsheetErr)
-				s.storage.dependencyGraph.ClearDirty(cellAddr)
-				return spreadsheetErr
-			}
-			// non-REF errors shouldn't be returned from calculateCell
-			// should be stored in the cell and propagate through formula evaluation
-		}
-	}
+	return &calcFrame{
+		addr:       cellAddr,
+		worksheet:  worksheet,
+		formula:    formula,
+		precedents: s.storage.dependencyGraph.GetDirectPrecedents(cellAddr),
+		ranges:     rangePrecedents,
+	}, nil
+}
 
-	// calculate range dependencies - ensure all cells in ranges we depend on are calculated
-	rangePrecedents = s.storage.dependencyGraph.GetRangePrecedents(cellAddr)
-	for _, rangeAddr := range rangePrecedents {
-		// calculate all cells in the range in deterministic order
-		for row := rangeAddr.StartRow; row <= rangeAddr.EndRow; row++ {
-			for col := rangeAddr.StartColumn; col <= rangeAddr.EndColumn; col++ {
-				rangeCell := CellAddress{
-					WorksheetID: rangeAddr.WorksheetID,
-					Row:         row,
-					Column:      col,
-				}
-				// only calculate if it's dirty and not already being processed
-				if _, isDirty := s.storage.dependencyGraph.dirtySet[rangeCell]; isDirty {
-					if err := s.calculateCell(rangeCell); err != nil {
-						// handle circular reference errors
-						if spreadsheetErr, ok := err.(*SpreadsheetError); ok && spreadsheetErr.ErrorCode == ErrorCodeRef {
-							// don't propagate REF errors from range cells,
-							// they'll be picked up during evaluation
-						}
-					}
-				}
-			}
-		}
-	}
+// newCircularReferenceError creates the error stored in cells on a cycle.
+// the message lists the path of the cycle, e.g. "Sheet1!A1 -> Sheet1!B1 ->
+// Sheet1!A1"
+func (s *Spreadsheet) newCircularReferenceError(path []string) *SpreadsheetError {
+	return NewSpreadsheetError(ErrorCodeCircular, "Circular reference detected: "+strings.Join(path, " -> "))
+}
 
-	// set current addr for relative references (after calculating dependencies)
-	s.currentAddress = cellAddr
+// leaveCell pops a cell off the calculation stack and marks it completed
+func (s *Spreadsheet) leaveCell(cellAddr CellAddress) {
+	s.calculationStack.pop()
+	s.calculationStack.markCompleted(cellAddr)
+}
 
-	// evaluate the formula
-	result, err := ast.Eval(s)
+// evaluateFormula evaluates the formula at cellAddr and returns the value to
+// store in the cell. evaluation only reads from storage, so cells that don't
+// depend on each other can be evaluated concurrently.
+func (s *Spreadsheet) evaluateFormula(formula compiledFormula, cellAddr CellAddress) Primitive {
+	ctx := NewEvalContext(s, cellAddr)
+	ctx.args = argStacks.Get().(*argStack)
+	result, err := formula(ctx)
+	argStacks.Put(ctx.args)
 	if err != nil {
-		// store error in cell
 		if spreadsheetErr, ok := err.(*SpreadsheetError); ok {
-			// store formula evaluation error
-			worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column, spreadsheetErr)
-		} else {
-			worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column,
-				NewSpreadsheetError(ErrorCodeValue, err.Error()))
+			return spreadsheetErr
 		}
-		return nil // continue calculating other cells
+		return NewSpreadsheetError(ErrorCodeValue, err.Error())
 	}
 
-	// check if result is an error (e.g. from a cell reference that has an error)
-	if spreadsheetErr, ok := result.(*SpreadsheetError); ok {
-		// Formula result is an error
-		worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column, spreadsheetErr)
-		return nil
+	// handle nil results as 0
+	if result == nil {
+		return 0.0
 	}
 
-	// store result (handle nil results as 0)
-	if result == nil {
-		result = 0.0
+	if _, isLambda := result.(*LambdaValue); isLambda {
+		return NewSpreadsheetError(ErrorCodeCalc, "Formula returns a LAMBDA without calling it")
 	}
-	worksheet.SetFormulaResult(cellAddr.Row, cellAddr.Column, result)
 
-	// clear dirty flag
+	// ranges and arrays spill, unless they hold a single value
+	if r, isRange := result.(Range); isRange {
+		array, ok := toArray(r)
+		switch {
+		case !ok:
+			return NewSpreadsheetError(ErrorCodeValue, "3D references can't be a formula result")
+		case array.Size() == 0:
+			return NewSpreadsheetError(ErrorCodeValue, "Empty array")
+		case array.Size() > 1:
+			return array
+		}
+		return spilledValue(s.limits, array.At(0, 0))
+	}
+	return s.limits.checkStringResult(result)
+}
+
+// storeFormulaResult stores the result of a formula cell, spilling arrays,
+// clears its dirty flag and marks everything that reads the cell as dirty
+// (lazy propagation)
+func (s *Spreadsheet) storeFormulaResult(worksheet *Worksheet, cellAddr CellAddress, result Primitive) {
+	s.setFormulaResult(worksheet, cellAddr, s.spillResult(worksheet, cellAddr, result))
 	s.storage.dependencyGraph.ClearDirty(cellAddr)
 
-	// mark direct dependents as dirty (lazy propagation)
-	dependents := s.storage.dependencyGraph.GetDirectDependents(cellAddr)
-	for _, dep := range dependents {
+	// dependents are marked even when the result is an error, otherwise they
+	// would keep a stale value
+	s.storage.dependencyGraph.MarkCellIfInRangeDirty(cellAddr)
+	for _, dep := range s.storage.dependencyGraph.GetDirectDependents(cellAddr) {
 		s.storage.dependencyGraph.MarkDirty(dep)
 	}
 
-	return nil
+	s.reportProgress()
+}
+
+// reportProgress counts a calculated formula cell and notifies the progress
+// handler, if any
+func (s *Spreadsheet) reportProgress() {
+	s.calculatedCells++
+	if s.progress != nil {
+		s.progress(CalculationProgress{
+			Done:  s.calculatedCells,
+			Dirty: len(s.storage.dependencyGraph.dirtySet),
+		})
+	}
+}
+
+// sortCellAddresses sorts cells for deterministic order (by worksheet, then
+// row, then column)
+func sortCellAddresses(cells []CellAddress) {
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].WorksheetID != cells[j].WorksheetID {
+			return cells[i].WorksheetID < cells[j].WorksheetID
+		}
+		if cells[i].Row != cells[j].Row {
+			return cells[i].Row < cells[j].Row
+		}
+		return cells[i].Column < cells[j].Column
+	})
 }
 
 // extractDependencies extracts cell and range dependencies from an AST
@@ -747,86 +1786,153 @@ func (s *Spreadsheet) extractDependencies(node ASTNode, cellAddr CellAddress) {
 	s.storage.dependencyGraph.ClearDependencies(cellAddr)
 	s.storage.dependencyGraph.UnmarkVolatile(cellAddr)
 
-	// recursively extract dependencies
-	s.extractDependenciesRecursive(node, cellAddr)
+	var reads formulaReads
+	s.readFormula(node, cellAddr, cellAddr, nil, &reads)
+	for _, targetAddr := range reads.cells {
+		s.storage.dependencyGraph.AddCellDependency(cellAddr, targetAddr)
+	}
+	for _, rangeAddr := range append(reads.ranges, reads.nameRanges...) {
+		s.storage.dependencyGraph.AddRangeDependency(cellAddr, rangeAddr)
+	}
+	if reads.volatile {
+		s.storage.dependencyGraph.MarkVolatile(cellAddr)
+	}
+	for _, key := range reads.names {
+		s.trackNamedRangeUse(key, cellAddr)
+	}
+	if formulaID, exists := s.storage.formulas.formulaAtCell[cellAddr]; exists {
+		for _, name := range reads.calls {
+			s.storage.formulas.TrackFunctionCall(formulaID, name)
+		}
+	}
 }
 
-// extractDependenciesRecursive recursively extracts dependencies from AST nodes
-func (s *Spreadsheet) extractDependenciesRecursive(node ASTNode, cellAddr CellAddress) {
+// formulaReads is what the formula of a cell reads, including through the
+// definitions of the names it uses
+type formulaReads struct {
+	cells      []CellAddress
+	ranges     []RangeAddress
+	nameRanges []RangeAddress // ranges of named ranges, traces list them below the name
+	names      []nameKey      // names used, including by the formulas of names
+	calls      []string       // functions called that aren't built in, defined or not
+	volatile   bool
+}
+
+// readFormula recursively collects what AST nodes read. references are
+// relative to origin, the formula cell itself except within the formula of
+// a name it uses. expanding holds the names being expanded, so names defined
+// in terms of each other are expanded once.
+func (s *Spreadsheet) readFormula(node ASTNode, origin, cellAddr CellAddress, expanding []uint32, reads *formulaReads) {
 	switch n := node.(type) {
 	case *CellRefNode:
-		// calculate absolute address from relative offset
-		targetRow := int32(cellAddr.Row) + n.RowOffset
-		targetCol := int32(cellAddr.Column) + n.ColOffset
-
-		if targetRow >= 0 && targetCol >= 0 {
-			targetAddr := CellAddress{
-				WorksheetID: n.WorksheetID,
-				Row:         uint32(targetRow),
-				Column:      uint32(targetCol),
-			}
-			if n.WorksheetID == 0 {
-				targetAddr.WorksheetID = cellAddr.WorksheetID
-			}
-			s.storage.dependencyGraph.AddCellDependency(cellAddr, targetAddr)
+		if targetAddr, ok := cellRefAddress(n, origin); ok {
+			reads.cells = append(reads.cells, targetAddr)
 		}
 
 	case *RangeNode:
-		// calculate absolute range from relative offsets
-		startRow := int32(cellAddr.Row) + n.StartRowOffset
-		startCol := int32(cellAddr.Column) + n.StartColOffset
-		endRow := int32(cellAddr.Row) + n.EndRowOffset
-		endCol := int32(cellAddr.Column) + n.EndColOffset
-
-		if startRow >= 0 && startCol >= 0 && endRow >= 0 && endCol >= 0 {
-			rangeAddr := RangeAddress{
-				WorksheetID: n.WorksheetID,
-				StartRow:    uint32(startRow),
-				StartColumn: uint32(startCol),
-				EndRow:      uint32(endRow),
-				EndColumn:   uint32(endCol),
-			}
-			if n.WorksheetID == 0 {
-				rangeAddr.WorksheetID = cellAddr.WorksheetID
+		// whole-column and whole-row ranges are tracked at their full size, so
+		// cells appended past the used extent still dirty the formula
+		if rangeAddr, ok := n.bounds(origin); ok {
+			reads.ranges = append(reads.ranges, rangeAddr)
+		}
+
+	case *Range3DNode:
+		// the area is observed on every worksheet currently in the span.
+		// refreshWorksheetSpans re-extracts when worksheets join or leave it
+		span, _ := s.storage.worksheets.GetWorksheetSpan(n.FirstWorksheetID, n.LastWorksheetID)
+		for _, worksheetID := range span {
+			if rangeAddr, ok := n.areaOn(worksheetID).bounds(origin); ok {
+				reads.ranges = append(reads.ranges, rangeAddr)
 			}
-			s.storage.dependencyGraph.AddRangeDependency(cellAddr, rangeAddr)
 		}
 
 	case *BinaryOpNode:
-		s.extractDependenciesRecursive(n.Left, cellAddr)
-		s.extractDependenciesRecursive(n.Right, cellAddr)
+		s.readFormula(n.Left, origin, cellAddr, expanding, reads)
+		s.readFormula(n.Right, origin, cellAddr, expanding, reads)
 
 	case *UnaryOpNode:
-		s.extractDependenciesRecursive(n.Operand, cellAddr)
+		s.readFormula(n.Operand, origin, cellAddr, expanding, reads)
 
 	case *FunctionCallNode:
 		// check if this function is volatile
 		if isVolatileFunction(n.Name) {
-			s.storage.dependencyGraph.MarkVolatile(cellAddr)
+			reads.volatile = true
+		}
+		// functions that aren't built in are LAMBDAs defined as names. calls
+		// of names not defined yet are only tracked by function name, so they
+		// don't add names to the workbook
+		if _, builtin := lookupFunction(n.Name); !builtin && !n.isSpecialForm() {
+			reads.calls = append(reads.calls, n.Name)
+			if nameID, exists := s.storage.namedRanges.ResolveNamedRangeID(origin.WorksheetID, n.Name); exists && s.storage.namedRanges.IsRangeDefined(nameID) {
+				s.readName(s.storage.namedRanges.idToName[nameID], cellAddr, expanding, reads)
+			}
 		}
 		for _, arg := range n.Args {
-			s.extractDependenciesRecursive(arg, cellAddr)
+			s.readFormula(arg, origin, cellAddr, expanding, reads)
+		}
+
+	case *StructuredRefNode:
+		// AppendTableRow and RenameTableColumn re-extract through
+		// refreshTableReferences when the table changes
+		if rangeAddr, ok := s.structuredRefBounds(n, origin); ok {
+			reads.ranges = append(reads.ranges, rangeAddr)
 		}
 
 	case *NamedRangeNode:
-		// track named range usage
-		if s.storage.formulas != nil && s.storage.namedRanges != nil {
-			formulaID, exists := s.storage.formulas.formulaAtCell[cellAddr]
-			if exists {
-				// get or intern the named range ID
-				nameID := s.storage.namedRanges.InternNamedRange(n.Name)
-				s.storage.formulas.TrackNamedRangeReference(formulaID, nameID)
-			}
+		key := nameKey{worksheetID: n.WorksheetID, name: n.Name}
+		if nameID, exists := n.nameID(s.storage.namedRanges, origin.WorksheetID); exists {
+			key = s.storage.namedRanges.idToName[nameID]
 		}
+		s.readName(key, cellAddr, expanding, reads)
 
-	case *StringNode, *NumberNode, *BooleanNode:
+	case *StringNode, *NumberNode, *BooleanNode, *ArrayNode:
 		// literal nodes don't have dependencies
 	}
 }
 
-// GetCurrentAddress returns the current cell address being calculated
-func (s *Spreadsheet) GetCurrentAddress() CellAddress {
-	return s.currentAddress
+// readName records the use of a name and collects what its definition
+// reads: the range of a named range, or the references of a named formula
+func (s *Spreadsheet) readName(key nameKey, cellAddr CellAddress, expanding []uint32, reads *formulaReads) {
+	reads.names = append(reads.names, key)
+	nameID, exists := s.storage.namedRanges.GetNamedRangeID(key.worksheetID, key.name)
+	if !exists || slices.Contains(expanding, nameID) {
+		return
+	}
+
+	if rangeAddr, defined := s.storage.namedRanges.GetRangeAddress(nameID); defined {
+		reads.nameRanges = append(reads.nameRanges, rangeAddr)
+	} else if formula, defined := s.storage.namedRanges.GetFormula(nameID); defined {
+		s.readFormula(formula.ast, formula.originFor(cellAddr), cellAddr, append(expanding, nameID), reads)
+	}
+}
+
+// trackNamedRangeUse records that the formula of a cell uses a name, so
+// defining the name marks the cell dirty
+func (s *Spreadsheet) trackNamedRangeUse(key nameKey, cellAddr CellAddress) {
+	if s.storage.formulas != nil && s.storage.namedRanges != nil {
+		formulaID, exists := s.storage.formulas.formulaAtCell[cellAddr]
+		if exists {
+			// get or intern the named range ID
+			nameID := s.storage.namedRanges.InternNamedRange(key.worksheetID, key.name)
+			s.storage.formulas.TrackNamedRangeReference(formulaID, nameID)
+		}
+	}
+}
+
+// refreshWorksheetSpans re-extracts the dependencies of every formula with a
+// 3D reference and marks it dirty, after worksheets were added, moved or
+// removed and the worksheets inside its span may have changed
+func (s *Spreadsheet) refreshWorksheetSpans() {
+	for _, formulaID := range s.storage.formulas.GetFormulasWithWorksheetSpans() {
+		ast, exists := s.storage.formulas.GetAST(formulaID)
+		if !exists {
+			continue
+		}
+		for _, cellAddr := range s.storage.formulas.GetCellsUsingFormula(formulaID) {
+			s.extractDependencies(ast, cellAddr)
+			s.storage.dependencyGraph.MarkDirty(cellAddr)
+		}
+	}
 }
 
 // GetWorksheet returns a worksheet by name for diagnostic purposes
@@ -844,6 +1950,7 @@ type CalculationStack struct {
 	items      []CellAddress            // stack of cells to process
 	processing map[CellAddress]struct{} // currently being processed (cycle detection)
 	completed  map[CellAddress]struct{} // already calculated in this pass
+	reopened   map[CellAddress]struct{} // calculated again after a spill changed
 }
 
 // NewCalculationStack creates a new calculation stack
@@ -852,6 +1959,7 @@ func NewCalculationStack() *CalculationStack {
 		items:      make([]CellAddress, 0),
 		processing: make(map[CellAddress]struct{}),
 		completed:  make(map[CellAddress]struct{}),
+		reopened:   make(map[CellAddress]struct{}),
 	}
 }
 
@@ -861,6 +1969,21 @@ func (cs *CalculationStack) push(addr CellAddress) {
 	cs.processing[addr] = struct{}{}
 }
 
+// pathFrom returns the formatted cells of the stack from addr to the top,
+// which is the path of a cycle when addr is entered again
+func (cs *CalculationStack) pathFrom(addr CellAddress, format func(CellAddress) string) []string {
+	var path []string
+	for i := len(cs.items) - 1; i >= 0; i-- {
+		if cs.items[i] == addr {
+			for _, item := range cs.items[i:] {
+				path = append(path, format(item))
+			}
+			break
+		}
+	}
+	return path
+}
+
 // pop removes and returns the top cell from the stack
 func (cs *CalculationStack) pop() (CellAddress, bool) {
 	if len(cs.items) == 0 {
@@ -889,11 +2012,26 @@ func (cs *CalculationStack) isCompleted(addr CellAddress) bool {
 	return exists
 }
 
+// reopen lets a calculated cell be calculated again in this pass, after a
+// spill changed a cell it reads. each cell is reopened at most once, so
+// spills reading each other can't keep the calculation going forever.
+func (cs *CalculationStack) reopen(addr CellAddress) {
+	if _, done := cs.reopened[addr]; done {
+		return
+	}
+	if _, completed := cs.completed[addr]; !completed {
+		return
+	}
+	cs.reopened[addr] = struct{}{}
+	delete(cs.completed, addr)
+}
+
 // reset clears the stack
 func (cs *CalculationStack) reset() {
 	cs.items = cs.items[:0]
 	cs.processing = make(map[CellAddress]struct{})
 	cs.completed = make(map[CellAddress]struct{})
+	cs.reopened = make(map[CellAddress]struct{})
 }
 
 // RunnableSpreadsheet provides a chainable interface for
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 type SpreadsheetTestCase struct {
@@ -1463,14 +1469,14 @@ func TestCellReferences(t *testing.T) {
 		NewSpreadsheetTestCase(t, "Direct circular").
 			Set("Sheet1!A1", "=A1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
 			End()
 
 		NewSpreadsheetTestCase(t, "Indirect circular").
 			Set("Sheet1!A1", "=B1").
 			Set("Sheet1!B1", "=A1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
 			End()
 	})
 }
@@ -1871,6 +1877,31 @@ func TestUpdateAndRecalculation(t *testing.T) {
 			AssertCellEq("Sheet1!B1", 0.0).
 			End()
 	})
+
+	t.Run("ErrorResultPropagates", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Dependent of erroring formula").
+			Set("Sheet1!B1", "=A1").
+			Set("Sheet1!A1", "=3").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 3.0).
+			Set("Sheet1!A1", "=1/0").
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!B1", ErrorCodeDiv0).
+			End()
+	})
+
+	t.Run("RangeOverFormulaCells", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Range observer of recalculated formula").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", "=A1*2").
+			Set("Sheet1!B1", "=SUM(A2:A3)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 2.0).
+			Set("Sheet1!A1", 5.0).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 10.0).
+			End()
+	})
 }
 
 func TestNamedRangesInFormulas(t *testing.T) {
@@ -2054,9 +2085,9 @@ func TestAdvancedCircularReferences(t *testing.T) {
 			Set("Sheet1!B1", "=A1").
 			Set("Sheet1!C1", "=B1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
-			AssertCellErr("Sheet1!B1", ErrorCodeRef).
-			AssertCellErr("Sheet1!C1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
+			AssertCellErr("Sheet1!B1", ErrorCodeCircular).
+			AssertCellErr("Sheet1!C1", ErrorCodeCircular).
 			End()
 	})
 
@@ -2064,7 +2095,7 @@ func TestAdvancedCircularReferences(t *testing.T) {
 		NewSpreadsheetTestCase(t, "Circular via range").
 			Set("Sheet1!A1", "=SUM(A1:A3)").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
 			End()
 	})
 
@@ -2073,8 +2104,8 @@ func TestAdvancedCircularReferences(t *testing.T) {
 			Set("Sheet1!A1", "=IF(B1>0, B1, 0)").
 			Set("Sheet1!B1", "=A1+1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
-			AssertCellErr("Sheet1!B1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
+			AssertCellErr("Sheet1!B1", ErrorCodeCircular).
 			End()
 	})
 
@@ -2086,7 +2117,7 @@ func TestAdvancedCircularReferences(t *testing.T) {
 			Set("Sheet1!A4", "=A5").
 			Set("Sheet1!A5", "=A1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
 			End()
 	})
 }
@@ -2424,8 +2455,8 @@ func TestWorksheetLifecycleAdvanced(t *testing.T) {
 			Set("Sheet1!A1", "=Sheet2!A1").
 			Set("Sheet2!A1", "=Sheet1!A1").
 			Run().
-			AssertCellErr("Sheet1!A1", ErrorCodeRef).
-			AssertCellErr("Sheet2!A1", ErrorCodeRef).
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
+			AssertCellErr("Sheet2!A1", ErrorCodeCircular).
 			End()
 	})
 
@@ -2495,3 +2526,2913 @@ func TestComplexRealWorldScenarios(t *testing.T) {
 			End()
 	})
 }
+
+func TestParallelCalculation(t *testing.T) {
+	// buildModel populates a wide model with many independent chains, range
+	// aggregates, errors and a cycle
+	buildModel := func(tc *SpreadsheetTestCase) {
+		tc.AddWorksheet("Sheet2")
+		for row := 1; row <= 100; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), float64(row))
+			for col := 2; col <= 8; col++ {
+				prev := fmt.Sprintf("%s%d", columnToLetters(col-1), row)
+				tc.Set(fmt.Sprintf("Sheet1!%s%d", columnToLetters(col), row), fmt.Sprintf("=%s*2+1", prev))
+			}
+			tc.Set(fmt.Sprintf("Sheet2!A%d", row), fmt.Sprintf("=SUM(Sheet1!A%d:H%d)", row, row)).
+				Set(fmt.Sprintf("Sheet2!B%d", row), fmt.Sprintf("=Sheet2!A%d/(A%d-50)", row, row))
+		}
+		tc.Set("Sheet2!C1", "=SUM(A1:A100)").
+			Set("Sheet2!D1", "=D2+1").
+			Set("Sheet2!D2", "=D1+1").
+			Set("Sheet2!D3", "=D1*2")
+	}
+
+	assertSameValues := func(t *testing.T, serial, parallel *Spreadsheet) {
+		for _, sheet := range []string{"Sheet1", "Sheet2"} {
+			for row := 1; row <= 100; row++ {
+				for col := 1; col <= 8; col++ {
+					addr := fmt.Sprintf("%s!%s%d", sheet, columnToLetters(col), row)
+					want, _ := serial.Get(addr)
+					got, _ := parallel.Get(addr)
+					wantErr, wantIsErr := want.(*SpreadsheetError)
+					gotErr, gotIsErr := got.(*SpreadsheetError)
+					if wantIsErr || gotIsErr {
+						if !wantIsErr || !gotIsErr || wantErr.ErrorCode != gotErr.ErrorCode {
+							t.Errorf("%s: serial = %v, parallel = %v", addr, want, got)
+						}
+						continue
+					}
+					if want != got {
+						t.Errorf("%s: serial = %v, parallel = %v", addr, want, got)
+					}
+				}
+			}
+		}
+	}
+
+	t.Run("MatchesSerialEngine", func(t *testing.T) {
+		serial := NewSpreadsheetTestCase(t, "Serial engine")
+		parallel := NewSpreadsheetTestCase(t, "Parallel engine")
+		parallel.spreadsheet.SetParallelism(8)
+		buildModel(serial)
+		buildModel(parallel)
+
+		serial.RunAndAssertNoError()
+		parallel.RunAndAssertNoError().
+			AssertCellEq("Sheet1!H1", 255.0).
+			AssertCellErr("Sheet2!D1", ErrorCodeCircular)
+		assertSameValues(t, serial.spreadsheet, parallel.spreadsheet)
+	})
+
+	t.Run("IncrementalUpdates", func(t *testing.T) {
+		serial := NewSpreadsheetTestCase(t, "Serial engine")
+		parallel := NewSpreadsheetTestCase(t, "Parallel engine")
+		parallel.spreadsheet.SetParallelism(4)
+		for _, tc := range []*SpreadsheetTestCase{serial, parallel} {
+			buildModel(tc)
+			tc.RunAndAssertNoError().
+				Set("Sheet1!A50", 1000.0).
+				Set("Sheet1!A7", "=A6+A8").
+				RunAndAssertNoError()
+		}
+		assertSameValues(t, serial.spreadsheet, parallel.spreadsheet)
+
+		if dirty := len(parallel.spreadsheet.GetDependencyGraph().dirtySet); dirty != 0 {
+			t.Errorf("parallel engine left %d dirty cells", dirty)
+		}
+	})
+
+	t.Run("ReadersOfSpilledCells", func(t *testing.T) {
+		// the readers share a level with the anchor and come after it
+		tc := NewSpreadsheetTestCase(t, "Readers of spilled cells")
+		tc.spreadsheet.SetParallelism(2)
+		tc.Set("Sheet1!A1", "=SEQUENCE(3)").
+			Set("Sheet1!B1", "=A2*10").
+			Set("Sheet1!C5", "=A3*10").
+			Set("Sheet1!D5", "=C5+1").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 20.0).
+			AssertCellEq("Sheet1!C5", 30.0).
+			AssertCellEq("Sheet1!D5", 31.0).
+			Set("Sheet1!A1", "=SEQUENCE(3, 1, 2)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 30.0).
+			AssertCellEq("Sheet1!C5", 40.0).
+			AssertCellEq("Sheet1!D5", 41.0).
+			End()
+
+		if dirty := len(tc.spreadsheet.GetDependencyGraph().dirtySet); dirty != 0 {
+			t.Errorf("parallel engine left %d dirty cells", dirty)
+		}
+	})
+}
+
+func TestCalculateContext(t *testing.T) {
+	// buildChain creates a chain of 100 formulas on top of a single value
+	buildChain := func(t *testing.T, parallelism int) *SpreadsheetTestCase {
+		tc := NewSpreadsheetTestCase(t, "Chain")
+		tc.spreadsheet.SetParallelism(parallelism)
+		tc.Set("Sheet1!A1", 1.0)
+		for row := 2; row <= 101; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=A%d+1", row-1))
+		}
+		return tc
+	}
+
+	t.Run("CanceledBeforeStart", func(t *testing.T) {
+		s := buildChain(t, 1).spreadsheet
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := s.CalculateContext(ctx)
+		var appErr *AppError
+		if !errors.As(err, &appErr) || appErr.Code != Canceled {
+			t.Fatalf("CalculateContext() error = %v, want Canceled", err)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("errors.Is(err, context.Canceled) = false")
+		}
+		worksheetID, row, col, _ := s.resolveAddress("Sheet1!A101")
+		if !s.storage.dependencyGraph.IsDirty(CellAddress{WorksheetID: worksheetID, Row: row, Column: col}) {
+			t.Errorf("A101 should still be dirty")
+		}
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		s := buildChain(t, 1).spreadsheet
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		err := s.CalculateContext(ctx)
+		var appErr *AppError
+		if !errors.As(err, &appErr) || appErr.Code != DeadlineExceeded {
+			t.Fatalf("CalculateContext() error = %v, want DeadlineExceeded", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("errors.Is(err, context.DeadlineExceeded) = false")
+		}
+	})
+
+	for _, parallelism := range []int{1, 4} {
+		t.Run(fmt.Sprintf("CancelMidwayAndResume/parallelism=%d", parallelism), func(t *testing.T) {
+			tc := buildChain(t, parallelism)
+			s := tc.spreadsheet
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s.SetProgressHandler(func(p CalculationProgress) {
+				if p.Done == 10 {
+					cancel()
+				}
+			})
+			err := s.CalculateContext(ctx)
+			var appErr *AppError
+			if !errors.As(err, &appErr) || appErr.Code != Canceled {
+				t.Fatalf("CalculateContext() error = %v, want Canceled", err)
+			}
+			if s.calculatedCells != 10 {
+				t.Errorf("calculated %d cells before stopping, want 10", s.calculatedCells)
+			}
+			if len(s.storage.dependencyGraph.dirtySet) == 0 {
+				t.Fatalf("remaining cells should stay dirty")
+			}
+
+			// a later call resumes and finishes the remaining cells
+			s.SetProgressHandler(nil)
+			tc.RunAndAssertNoError()
+			for _, row := range []int{2, 11, 12, 101} {
+				tc.AssertCellEq(fmt.Sprintf("Sheet1!A%d", row), row)
+			}
+		})
+	}
+
+	t.Run("ProgressReporting", func(t *testing.T) {
+		s := buildChain(t, 1).spreadsheet
+		var reports []CalculationProgress
+		s.SetProgressHandler(func(p CalculationProgress) {
+			reports = append(reports, p)
+		})
+		if err := s.CalculateContext(context.Background()); err != nil {
+			t.Fatalf("CalculateContext() failed: %v", err)
+		}
+
+		if len(reports) != 100 {
+			t.Fatalf("got %d progress reports, want 100", len(reports))
+		}
+		for i, p := range reports {
+			if p.Done != i+1 {
+				t.Errorf("report %d: Done = %d, want %d", i, p.Done, i+1)
+			}
+		}
+		if last := reports[len(reports)-1]; last.Dirty != 0 {
+			t.Errorf("last report: Dirty = %d, want 0", last.Dirty)
+		}
+	})
+}
+
+func TestResourceLimits(t *testing.T) {
+	newTestCase := func(t *testing.T, limits Limits) *SpreadsheetTestCase {
+		tc := NewSpreadsheetTestCase(t, t.Name())
+		tc.spreadsheet.SetLimits(limits)
+		return tc
+	}
+
+	assertResourceExhausted := func(t *testing.T, err error) {
+		t.Helper()
+		var appErr *AppError
+		if !errors.As(err, &appErr) || appErr.Code != ResourceExhausted {
+			t.Errorf("error = %v, want ResourceExhausted", err)
+		}
+	}
+
+	t.Run("FormulaLength", func(t *testing.T) {
+		tc := newTestCase(t, Limits{MaxFormulaLength: 10})
+		assertResourceExhausted(t, tc.spreadsheet.Set("Sheet1!A1", "=1+2+3+4+5+6"))
+		tc.AssertCellEmpty("Sheet1!A1").
+			Set("Sheet1!A1", "=1+2").
+			End()
+	})
+
+	t.Run("ASTDepth", func(t *testing.T) {
+		tc := newTestCase(t, Limits{MaxASTDepth: 20})
+		s := tc.spreadsheet
+		assertResourceExhausted(t, s.Set("Sheet1!A1", "="+strings.Repeat("(", 30)+"1"+strings.Repeat(")", 30)))
+		assertResourceExhausted(t, s.Set("Sheet1!A2", "=1"+strings.Repeat("+1", 30)))
+		assertResourceExhausted(t, s.Set("Sheet1!A3", "="+strings.Repeat("-", 30)+"1"))
+		assertResourceExhausted(t, s.Set("Sheet1!A4", "="+strings.Repeat("ABS(", 30)+"1"+strings.Repeat(")", 30)))
+		tc.Set("Sheet1!A5", "=ABS(ABS((1+2)*3))")
+
+		// without a length limit, pathological nesting is still rejected
+		// instead of overflowing the stack
+		s = newTestCase(t, Limits{MaxASTDepth: 256}).spreadsheet
+		assertResourceExhausted(t, s.Set("Sheet1!A1", "="+strings.Repeat("(", 200000)+"1"+strings.Repeat(")", 200000)))
+	})
+
+	t.Run("RangeCells", func(t *testing.T) {
+		newTestCase(t, DefaultLimits()).
+			Set("Sheet1!A2", 1.0).
+			Set("Sheet1!B1", "=SUM(A2:XFD1048576)").
+			Set("Sheet1!C1", "=SUM(A2:A10)").
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!B1", ErrorCodeNum).
+			AssertCellEq("Sheet1!C1", 1.0).
+			End()
+	})
+
+	t.Run("TotalCells", func(t *testing.T) {
+		tc := newTestCase(t, Limits{MaxTotalCells: 3}).
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", "=A1+1").
+			Set("Sheet1!A3", "text")
+		assertResourceExhausted(t, tc.spreadsheet.Set("Sheet1!A4", 4.0))
+
+		// existing cells can still be overwritten, and removing a cell frees
+		// room for a new one
+		tc.Set("Sheet1!A2", "=A1+2").
+			Set("Sheet1!A3", 3.0).
+			Remove("Sheet1!A2").
+			Set("Sheet1!A4", 4.0).
+			End()
+	})
+
+	t.Run("RecursionDepth", func(t *testing.T) {
+		// each cell depends on the one below it, so the serial engine
+		// recurses through the whole chain
+		tc := newTestCase(t, Limits{MaxRecursionDepth: 1000})
+		for row := 1; row < 10000; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=A%d+1", row+1))
+		}
+		tc.Set("Sheet1!A10000", 1.0)
+
+		s := tc.spreadsheet
+		assertResourceExhausted(t, s.Calculate())
+		if len(s.storage.dependencyGraph.dirtySet) == 0 {
+			t.Errorf("cells should stay dirty after hitting the recursion limit")
+		}
+
+		// raising the limit lets a later call finish
+		s.SetLimits(DefaultLimits())
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 10000.0).
+			End()
+	})
+
+	t.Run("StringLength", func(t *testing.T) {
+		tc := newTestCase(t, Limits{MaxStringLength: 10})
+		assertResourceExhausted(t, tc.spreadsheet.Set("Sheet1!A1", "this string is too long"))
+		tc.Set("Sheet1!A1", "abcdefgh").
+			Set("Sheet1!A2", "=A1&A1").
+			Set("Sheet1!A3", "=CONCATENATE(A1,A1)").
+			Set("Sheet1!A4", "=A1&\"!\"").
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!A2", ErrorCodeNum).
+			AssertCellErr("Sheet1!A3", ErrorCodeNum).
+			AssertCellEq("Sheet1!A4", "abcdefgh!").
+			End()
+	})
+}
+
+func TestDeepDependencyChains(t *testing.T) {
+	t.Run("RunningBalance", func(t *testing.T) {
+		// each balance depends on the one above it and is set bottom up, so
+		// the first dirty cell visited is the end of the chain
+		tc := NewSpreadsheetTestCase(t, "Running balance")
+		const rows = 100000
+		for row := rows; row >= 2; row-- {
+			tc.Set(fmt.Sprintf("Sheet1!B%d", row), fmt.Sprintf("=B%d+A%d", row-1, row)).
+				Set(fmt.Sprintf("Sheet1!A%d", row), 1.0)
+		}
+		tc.Set("Sheet1!B1", 0.0).
+			Set("Sheet1!C1", fmt.Sprintf("=B%d", rows)).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!C1", rows-1).
+			// an update at the top of the chain ripples all the way down
+			Set("Sheet1!B1", 10.0).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!C1", rows-1+10).
+			End()
+	})
+
+	t.Run("DeepChainThroughRanges", func(t *testing.T) {
+		// each cell sums the range above it in the same column
+		tc := NewSpreadsheetTestCase(t, "Deep chain through ranges")
+		const rows = 5000
+		tc.Set("Sheet1!A1", 1.0)
+		for row := rows; row >= 2; row-- {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=SUM(A%d:A%d)", row-1, row-1))
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq(fmt.Sprintf("Sheet1!A%d", rows), 1.0).
+			End()
+	})
+
+	t.Run("CircularReferenceAtEndOfDeepChain", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Circular reference at end of deep chain")
+		const rows = 50000
+		tc.Set("Sheet1!A1", fmt.Sprintf("=A%d+1", rows))
+		for row := 2; row <= rows; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=A%d+1", row-1))
+		}
+		tc.Set("Sheet1!B1", fmt.Sprintf("=A%d*2", rows/2)).
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!A1", ErrorCodeCircular).
+			AssertCellErr("Sheet1!A2", ErrorCodeCircular).
+			AssertCellErr(fmt.Sprintf("Sheet1!A%d", rows), ErrorCodeCircular).
+			AssertCellErr("Sheet1!B1", ErrorCodeCircular).
+			End()
+	})
+
+	t.Run("CalculationOrderIncludesRanges", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Calculation order includes ranges").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", "=A1*2").
+			Set("Sheet1!A3", "=A2*2").
+			Set("Sheet1!B1", "=SUM(A1:A3)").
+			Set("Sheet1!C1", "=B1+1")
+		s := tc.spreadsheet
+
+		dg := s.storage.dependencyGraph
+		order, hasCycle := dg.GetCalculationOrder()
+		if hasCycle {
+			t.Fatalf("GetCalculationOrder() reported a cycle")
+		}
+		position := make(map[CellAddress]int, len(order))
+		for i, addr := range order {
+			position[addr] = i
+		}
+		resolve := func(address string) CellAddress {
+			worksheetID, row, col, _ := s.resolveAddress(address)
+			return CellAddress{WorksheetID: worksheetID, Row: row, Column: col}
+		}
+		for _, before := range []string{"Sheet1!A1", "Sheet1!A2", "Sheet1!A3"} {
+			if position[resolve(before)] > position[resolve("Sheet1!B1")] {
+				t.Errorf("%s should come before Sheet1!B1 in %v", before, order)
+			}
+		}
+		if position[resolve("Sheet1!B1")] > position[resolve("Sheet1!C1")] {
+			t.Errorf("Sheet1!B1 should come before Sheet1!C1 in %v", order)
+		}
+
+		// a range containing a dependent of its observer is a cycle
+		tc.Set("Sheet1!A3", "=C1")
+		if !dg.HasCycle() {
+			t.Errorf("HasCycle() = false, want true for a cycle through a range")
+		}
+	})
+}
+
+func TestIterativeCalculation(t *testing.T) {
+	iterative := func(maxIterations int, maxChange float64) IterationSettings {
+		return IterationSettings{Enabled: true, MaxIterations: maxIterations, MaxChange: maxChange}
+	}
+
+	// near checks a converged value, which is only as precise as MaxChange
+	near := func(want float64) func(Primitive, *testing.T) {
+		return func(value Primitive, t *testing.T) {
+			t.Helper()
+			if got, ok := value.(float64); !ok || math.Abs(got-want) > 0.01 {
+				t.Errorf("value = %v, want %v", value, want)
+			}
+		}
+	}
+
+	// buildInterestModel sets up interest that is charged on a total which
+	// includes the interest itself
+	buildInterestModel := func(t *testing.T) *SpreadsheetTestCase {
+		return NewSpreadsheetTestCase(t, t.Name()).
+			Set("Sheet1!B1", 1000.0).
+			Set("Sheet1!B2", 0.1).
+			Set("Sheet1!B3", "=B2*B4").
+			Set("Sheet1!B4", "=B1+B3").
+			Set("Sheet1!C1", "=B4*2")
+	}
+
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		tc := buildInterestModel(t).
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!B3", ErrorCodeCircular).
+			AssertCellErr("Sheet1!B4", ErrorCodeCircular)
+		if status := tc.spreadsheet.GetCycleStatus(); len(status) != 0 {
+			t.Errorf("GetCycleStatus() = %v, want none", status)
+		}
+	})
+
+	t.Run("Converges", func(t *testing.T) {
+		tc := buildInterestModel(t)
+		tc.spreadsheet.SetIterativeCalculation(iterative(100, 0.0001))
+		tc.RunAndAssertNoError().
+			AssertCellFn("Sheet1!B4", near(1000/0.9)).
+			AssertCellFn("Sheet1!B3", near(100/0.9)).
+			AssertCellFn("Sheet1!C1", near(2000/0.9))
+
+		status := tc.spreadsheet.GetCycleStatus()
+		if len(status) != 1 {
+			t.Fatalf("GetCycleStatus() returned %d cycles, want 1", len(status))
+		}
+		if !status[0].Converged || status[0].Iterations < 2 || status[0].MaxChange > 0.0001 {
+			t.Errorf("status = %+v, want converged", status[0])
+		}
+		if fmt.Sprint(status[0].Cells) != "[Sheet1!B3 Sheet1!B4]" {
+			t.Errorf("status cells = %v, want [Sheet1!B3 Sheet1!B4]", status[0].Cells)
+		}
+
+		// updates restart the iteration from the current values
+		tc.Set("Sheet1!B1", 2000.0).
+			RunAndAssertNoError().
+			AssertCellFn("Sheet1!B4", near(2000/0.9)).
+			End()
+	})
+
+	t.Run("StopsAtMaxIterations", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Stops at max iterations").
+			Set("Sheet1!A1", "=A1+1")
+		tc.spreadsheet.SetIterativeCalculation(iterative(10, 0.001))
+		tc.RunAndAssertNoError().
+			AssertCellFn("Sheet1!A1", near(10))
+
+		status := tc.spreadsheet.GetCycleStatus()
+		if len(status) != 1 || status[0].Converged || status[0].Iterations != 10 || status[0].MaxChange != 1 {
+			t.Errorf("GetCycleStatus() = %+v, want one unconverged cycle after 10 iterations", status)
+		}
+	})
+
+	t.Run("RangeIncludingItself", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Range including itself").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 1.0).
+			Set("Sheet1!A3", "=SUM(A1:A3)*0.5+1")
+		tc.spreadsheet.SetIterativeCalculation(iterative(200, 0.00001))
+		tc.RunAndAssertNoError().
+			AssertCellFn("Sheet1!A3", near(4)).
+			End()
+	})
+
+	t.Run("EnablingRecalculatesCircularErrors", func(t *testing.T) {
+		tc := buildInterestModel(t).
+			RunAndAssertNoError()
+		tc.spreadsheet.SetIterativeCalculation(iterative(100, 0.0001))
+		tc.RunAndAssertNoError().
+			AssertCellFn("Sheet1!B4", near(1000/0.9))
+
+		// disabling it reports the cycle again
+		tc.spreadsheet.SetIterativeCalculation(DefaultIterationSettings())
+		tc.RunAndAssertNoError().
+			AssertCellErr("Sheet1!B4", ErrorCodeCircular).
+			End()
+	})
+
+	t.Run("ErrorsInsideCycle", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Errors inside cycle").
+			Set("Sheet1!A1", "=B1/0").
+			Set("Sheet1!B1", "=A1+1")
+		tc.spreadsheet.SetIterativeCalculation(iterative(100, 0.001))
+		tc.RunAndAssertNoError().
+			AssertCellErr("Sheet1!A1", ErrorCodeDiv0)
+		if status := tc.spreadsheet.GetCycleStatus(); len(status) != 1 || !status[0].Converged {
+			t.Errorf("GetCycleStatus() = %+v, want a converged cycle", status)
+		}
+	})
+}
+
+func TestFindCircularReferences(t *testing.T) {
+	tests := []struct {
+		name  string
+		cells map[string]Primitive
+		want  string
+	}{
+		{"None", map[string]Primitive{"Sheet1!A1": 1.0, "Sheet1!A2": "=A1+1"}, "[]"},
+		{"SelfReference", map[string]Primitive{"Sheet1!A1": "=A1+1"}, "[[Sheet1!A1]]"},
+		{"TwoCells", map[string]Primitive{"Sheet1!B1": "=A1", "Sheet1!A1": "=B1"}, "[[Sheet1!A1 Sheet1!B1]]"},
+		{"ThroughRange", map[string]Primitive{"Sheet1!A1": "=SUM(A2:A3)", "Sheet1!A2": 1.0, "Sheet1!A3": "=A1"}, "[[Sheet1!A1 Sheet1!A3]]"},
+		{"RangeIncludingItself", map[string]Primitive{"Sheet1!A1": "=SUM(A1:A3)"}, "[[Sheet1!A1]]"},
+		{"SharedCell", map[string]Primitive{"Sheet1!A1": "=B1+C1", "Sheet1!B1": "=A1", "Sheet1!C1": "=A1"}, "[[Sheet1!A1 Sheet1!B1] [Sheet1!A1 Sheet1!C1]]"},
+		{"CrossSheet", map[string]Primitive{"Sheet1!A1": "=Sheet2!A1", "Sheet2!A1": "=Sheet1!A1*2"}, "[[Sheet1!A1 Sheet2!A1]]"},
+		{"SeparateCycles", map[string]Primitive{"Sheet1!A1": "=A2", "Sheet1!A2": "=A1", "Sheet1!C5": "=C5", "Sheet1!D1": "=A1"}, "[[Sheet1!A1 Sheet1!A2] [Sheet1!C5]]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := NewSpreadsheetTestCase(t, tt.name).AddWorksheet("Sheet2")
+			for addr, value := range tt.cells {
+				tc.Set(addr, value)
+			}
+			if got := fmt.Sprint(tc.spreadsheet.FindCircularReferences()); got != tt.want {
+				t.Errorf("FindCircularReferences() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("ErrorDescribesCycle", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Circular error message").
+			Set("Sheet1!A1", "=B1+1").
+			Set("Sheet1!B1", "=A1+1").
+			Set("Sheet1!C1", "=SUM(C1:C2)").
+			Set("Sheet1!D1", "=NoSheet!A1").
+			Run().
+			AssertCellFn("Sheet1!A1", func(value Primitive, t *testing.T) {
+				err, ok := value.(*SpreadsheetError)
+				if !ok || err.ErrorCode != ErrorCodeCircular {
+					t.Fatalf("Sheet1!A1 = %v, want #CIRCULAR!", value)
+				}
+				if want := "Circular reference detected: Sheet1!A1 -> Sheet1!B1 -> Sheet1!A1"; err.Message != want {
+					t.Errorf("message = %q, want %q", err.Message, want)
+				}
+			}).
+			AssertCellFn("Sheet1!C1", func(value Primitive, t *testing.T) {
+				err, ok := value.(*SpreadsheetError)
+				if !ok || err.Message != "Circular reference detected: Sheet1!C1 -> Sheet1!C1:C2" {
+					t.Errorf("Sheet1!C1 = %v, want circular reference through its range", value)
+				}
+			}).
+			AssertCellErr("Sheet1!B1", ErrorCodeCircular).
+			AssertCellErr("Sheet1!D1", ErrorCodeRef).
+			End()
+
+		if got := NewSpreadsheetError(ErrorCodeCircular, "").Error(); got != "#CIRCULAR!" {
+			t.Errorf("Error() = %q, want #CIRCULAR!", got)
+		}
+	})
+}
+
+func TestEventSubscriptions(t *testing.T) {
+	// describe renders events compactly so sequences can be compared
+	describe := func(e Event) string {
+		switch e.Type {
+		case EventCellValueChanged:
+			return fmt.Sprintf("value %s %v->%v", e.Address, e.OldValue, e.NewValue)
+		case EventCellFormulaChanged:
+			return fmt.Sprintf("formula %s %q->%q", e.Address, e.OldFormula, e.NewFormula)
+		case EventWorksheetAdded:
+			return "sheet+ " + e.Name
+		case EventWorksheetRemoved:
+			return "sheet- " + e.Name
+		case EventWorksheetRenamed:
+			return "sheet " + e.OldName + "->" + e.Name
+		case EventNamedRangeAdded:
+			return "name+ " + e.Name
+		case EventNamedRangeRemoved:
+			return "name- " + e.Name
+		case EventNamedRangeRenamed:
+			return "name " + e.OldName + "->" + e.Name
+		}
+		return fmt.Sprintf("unknown %d", e.Type)
+	}
+	record := func(events *[]string) func(Event) {
+		return func(e Event) {
+			*events = append(*events, describe(e))
+		}
+	}
+	expect := func(t *testing.T, got []string, want ...string) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("events = %q, want %q", got, want)
+		}
+	}
+
+	t.Run("SetAndRemove", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Set and remove")
+		var events []string
+		tc.spreadsheet.Subscribe(record(&events))
+
+		tc.Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A1", "text").
+			Remove("Sheet1!A1").
+			Remove("Sheet1!A1")
+		expect(t, events,
+			"value Sheet1!A1 <nil>->1",
+			"value Sheet1!A1 1->text",
+			"value Sheet1!A1 text-><nil>")
+	})
+
+	t.Run("FormulaChanges", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Formula changes").
+			Set("Sheet1!A1", 2.0)
+		var events []string
+		tc.spreadsheet.Subscribe(record(&events))
+
+		tc.Set("Sheet1!B1", "=A1*2").
+			Run().
+			Set("Sheet1!B1", "=A1*3").
+			Run().
+			Set("Sheet1!B1", 5.0)
+		expect(t, events,
+			`formula Sheet1!B1 ""->"=A1*2"`,
+			"value Sheet1!B1 <nil>->4",
+			`formula Sheet1!B1 "=A1*2"->"=A1*3"`,
+			"value Sheet1!B1 4->6",
+			`formula Sheet1!B1 "=A1*3"->""`,
+			"value Sheet1!B1 6->5")
+	})
+
+	t.Run("CalculateReportsEachCellOnce", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Calculate reports each cell once").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 2.0).
+			Set("Sheet1!B1", "=A1+A2").
+			Set("Sheet1!B2", "=SUM(A1:A2)*0").
+			Set("Sheet1!C1", "=B1*10").
+			Run()
+		var events []string
+		tc.spreadsheet.Subscribe(record(&events))
+
+		tc.Set("Sheet1!A1", 5.0).
+			Set("Sheet1!A2", 6.0).
+			Run()
+		expect(t, events,
+			"value Sheet1!A1 1->5",
+			"value Sheet1!A2 2->6",
+			"value Sheet1!B1 3->11",
+			"value Sheet1!C1 30->110")
+
+		events = nil
+		tc.Run()
+		expect(t, events)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Watch").AddWorksheet("Sheet2")
+		s := tc.spreadsheet
+		var cellEvents, rangeEvents []string
+		if _, err := s.Watch("Sheet1!B2", record(&cellEvents)); err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+		unwatch, err := s.Watch("Sheet1!A1:B2", record(&rangeEvents))
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+
+		tc.Set("Sheet1!A1", 1.0).
+			Set("Sheet1!B2", "=A1+1").
+			Set("Sheet1!C3", 3.0).
+			Set("Sheet2!A1", 4.0).
+			AddWorksheet("Sheet3").
+			Run()
+		unwatch()
+		tc.Set("Sheet1!A1", 10.0).
+			Run()
+
+		expect(t, cellEvents,
+			`formula Sheet1!B2 ""->"=A1+1"`,
+			"value Sheet1!B2 <nil>->2",
+			"value Sheet1!B2 2->11")
+		expect(t, rangeEvents,
+			"value Sheet1!A1 <nil>->1",
+			`formula Sheet1!B2 ""->"=A1+1"`,
+			"value Sheet1!B2 <nil>->2")
+	})
+
+	t.Run("WatchInvalidReference", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Watch invalid reference").AddWorksheet("Sheet2").spreadsheet
+		var appErr *AppError
+		if _, err := s.Watch("NoSheet!A1", func(Event) {}); !errors.As(err, &appErr) || appErr.Code != NotFound {
+			t.Errorf("Watch(NoSheet!A1) error = %v, want NotFound", err)
+		}
+		if _, err := s.Watch("Sheet1!A1:Sheet2!B2", func(Event) {}); !errors.As(err, &appErr) || appErr.Code != InvalidArgument {
+			t.Errorf("Watch(Sheet1!A1:Sheet2!B2) error = %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		tc := &SpreadsheetTestCase{t: t, name: "Lifecycle", spreadsheet: NewSpreadsheet()}
+		var events []string
+		unsubscribe := tc.spreadsheet.Subscribe(record(&events))
+
+		tc.AddWorksheet("Sheet1").
+			AddWorksheet("Sheet1").
+			ExpectAppError(AlreadyExists).
+			RenameWorksheet("Sheet1", "Data").
+			AddNamedRange("Total").
+			RenameNamedRange("Total", "Sum").
+			RemoveNamedRange("Sum").
+			RemoveWorksheet("Data")
+		unsubscribe()
+		tc.AddWorksheet("Sheet2")
+		expect(t, events,
+			"sheet+ Sheet1",
+			"sheet Sheet1->Data",
+			"name+ Total",
+			"name Total->Sum",
+			"name- Sum",
+			"sheet- Data")
+	})
+
+	t.Run("Parallel", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Parallel")
+		tc.spreadsheet.SetParallelism(4)
+		tc.Set("Sheet1!A1", 1.0)
+		for row := 2; row <= 50; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=A%d+1", row-1)).
+				Set(fmt.Sprintf("Sheet1!B%d", row), fmt.Sprintf("=A%d*2", row))
+		}
+		tc.Run()
+		var events []string
+		tc.spreadsheet.Subscribe(record(&events))
+
+		tc.Set("Sheet1!A1", 2.0).
+			Run()
+		if len(events) != 99 {
+			t.Fatalf("got %d events, want 99", len(events))
+		}
+		expect(t, events[:3], "value Sheet1!A1 1->2", "value Sheet1!A2 2->3", "value Sheet1!B2 4->6")
+	})
+}
+
+func TestTracePrecedentsAndDependents(t *testing.T) {
+	// render flattens a trace into indented lines, marking special nodes
+	var render func(node *TraceNode, indent string, lines *[]string)
+	render = func(node *TraceNode, indent string, lines *[]string) {
+		line := indent + node.Address
+		if node.Range != "" {
+			line += "=" + node.Range
+		}
+		switch {
+		case node.Circular:
+			line += " (circular)"
+		case node.Repeated:
+			line += " (repeated)"
+		case node.Truncated:
+			line += " (truncated)"
+		}
+		*lines = append(*lines, line)
+		for _, child := range node.Children {
+			render(child, indent+"  ", lines)
+		}
+	}
+	lines := func(node *TraceNode) string {
+		var result []string
+		render(node, "", &result)
+		return strings.Join(result, "\n")
+	}
+
+	build := func(t *testing.T) *Spreadsheet {
+		s := NewSpreadsheetTestCase(t, "Trace model").
+			AddWorksheet("Sheet2").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", "=A1*2").
+			Set("Sheet1!A3", 3.0).
+			Set("Sheet1!B1", "=SUM(A1:A3)").
+			Set("Sheet1!B2", "=B1+A2").
+			Set("Sheet2!A1", "=Sheet1!B2+SUM(Prices)").
+			spreadsheet
+		if err := s.DefineNamedRange("Prices", "Sheet1!A2:A3"); err != nil {
+			t.Fatalf("DefineNamedRange failed: %v", err)
+		}
+		return s
+	}
+
+	t.Run("Precedents", func(t *testing.T) {
+		s := build(t)
+		trace, err := s.TracePrecedents("Sheet2!A1", 0)
+		if err != nil {
+			t.Fatalf("TracePrecedents failed: %v", err)
+		}
+		want := strings.Join([]string{
+			"Sheet2!A1",
+			"  Sheet1!B2",
+			"    Sheet1!B1",
+			"      Sheet1!A1:A3",
+			"        Sheet1!A2",
+			"          Sheet1!A1",
+			"    Sheet1!A2 (repeated)",
+			"  Prices=Sheet1!A2:A3",
+			"    Sheet1!A2:A3",
+			"      Sheet1!A2 (repeated)",
+		}, "\n")
+		if got := lines(trace); got != want {
+			t.Errorf("TracePrecedents() =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("Dependents", func(t *testing.T) {
+		s := build(t)
+		trace, err := s.TraceDependents("Sheet1!A1", 0)
+		if err != nil {
+			t.Fatalf("TraceDependents failed: %v", err)
+		}
+		want := strings.Join([]string{
+			"Sheet1!A1",
+			"  Sheet1!A2",
+			"    Sheet1!B2",
+			"      Sheet2!A1",
+			"    Sheet1!A1:A3",
+			"      Sheet1!B1",
+			"        Sheet1!B2 (repeated)",
+			"    Prices=Sheet1!A2:A3",
+			"      Sheet2!A1 (repeated)",
+			"  Sheet1!A1:A3 (repeated)",
+		}, "\n")
+		if got := lines(trace); got != want {
+			t.Errorf("TraceDependents() =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("Depth", func(t *testing.T) {
+		s := build(t)
+		trace, err := s.TraceDependents("Sheet1!A1", 1)
+		if err != nil {
+			t.Fatalf("TraceDependents failed: %v", err)
+		}
+		want := "Sheet1!A1\n  Sheet1!A2 (truncated)\n  Sheet1!A1:A3 (truncated)"
+		if got := lines(trace); got != want {
+			t.Errorf("TraceDependents(depth 1) =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("Circular", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Circular trace").
+			Set("Sheet1!A1", "=B1").
+			Set("Sheet1!B1", "=A1+1").
+			spreadsheet
+		trace, err := s.TracePrecedents("Sheet1!A1", 0)
+		if err != nil {
+			t.Fatalf("TracePrecedents failed: %v", err)
+		}
+		if got, want := lines(trace), "Sheet1!A1\n  Sheet1!B1\n    Sheet1!A1 (circular)"; got != want {
+			t.Errorf("TracePrecedents() =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("LongChain", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Long chain").
+			Set("Sheet1!A1", 1.0)
+		for row := 2; row <= 10000; row++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", row), fmt.Sprintf("=A%d+1", row-1))
+		}
+		trace, err := tc.spreadsheet.TraceDependents("Sheet1!A1", 0)
+		if err != nil {
+			t.Fatalf("TraceDependents failed: %v", err)
+		}
+		levels := 0
+		for node := trace; len(node.Children) > 0; node = node.Children[0] {
+			levels++
+		}
+		if levels != 9999 {
+			t.Errorf("trace has %d levels, want 9999", levels)
+		}
+	})
+
+	t.Run("UnknownWorksheet", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Unknown worksheet").spreadsheet
+		var appErr *AppError
+		if _, err := s.TracePrecedents("NoSheet!A1", 0); !errors.As(err, &appErr) || appErr.Code != NotFound {
+			t.Errorf("TracePrecedents(NoSheet!A1) error = %v, want NotFound", err)
+		}
+	})
+
+	t.Run("AllDependentsIncludeRangeObservers", func(t *testing.T) {
+		s := build(t)
+		worksheetID, row, col, _ := s.resolveAddress("Sheet1!A3")
+		dependents := s.storage.dependencyGraph.GetAllDependents(CellAddress{WorksheetID: worksheetID, Row: row, Column: col})
+		sortCellAddresses(dependents)
+		got := make([]string, len(dependents))
+		for i, addr := range dependents {
+			got[i] = s.formatCellAddress(addr)
+		}
+		if want := "[Sheet1!B1 Sheet1!B2 Sheet2!A1]"; fmt.Sprint(got) != want {
+			t.Errorf("GetAllDependents(Sheet1!A3) = %v, want %s", got, want)
+		}
+	})
+}
+
+func TestExplainFormula(t *testing.T) {
+	// describe renders the steps of an explanation, one per line
+	describe := func(explanation *FormulaExplanation) string {
+		lines := make([]string, len(explanation.Steps))
+		for i, step := range explanation.Steps {
+			value := fmt.Sprint(step.Value)
+			if r, ok := step.Value.(*CellRange); ok {
+				value = fmt.Sprintf("range %d:%d", r.startRow+1, r.endRow+1)
+			}
+			lines[i] = fmt.Sprintf("%s%s = %s", strings.Repeat("  ", step.Depth), step.Expression, value)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	t.Run("Steps", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Explain steps").
+			AddWorksheet("Sheet2").
+			Set("Sheet1!A1", 2.0).
+			Set("Sheet1!A2", 3.0).
+			Set("Sheet2!B1", 4.0).
+			Set("Sheet1!C1", "=(A1+A2)*SUM(A1:A2)-Sheet2!B1^2").
+			RunAndAssertNoError().
+			spreadsheet
+
+		explanation, err := s.ExplainFormula("Sheet1!C1")
+		if err != nil {
+			t.Fatalf("ExplainFormula failed: %v", err)
+		}
+		if want := "=(A1+A2)*SUM(A1:A2)-Sheet2!B1^2"; explanation.Formula != want {
+			t.Errorf("Formula = %q, want %q", explanation.Formula, want)
+		}
+		want := strings.Join([]string{
+			"      A1 = 2",
+			"      A2 = 3",
+			"    A1+A2 = 5",
+			"      A1:A2 = range 1:2",
+			"    SUM(A1:A2) = 5",
+			"  (A1+A2)*SUM(A1:A2) = 25",
+			"    Sheet2!B1 = 4",
+			"    2 = 2",
+			"  Sheet2!B1^2 = 16",
+			"(A1+A2)*SUM(A1:A2)-Sheet2!B1^2 = 9",
+		}, "\n")
+		if got := describe(explanation); got != want {
+			t.Errorf("steps =\n%s\nwant\n%s", got, want)
+		}
+		if explanation.Value != 9.0 || explanation.ErrorStep != -1 || explanation.ErrorCell != "" {
+			t.Errorf("Value = %v, ErrorStep = %d, ErrorCell = %q, want 9, -1, \"\"",
+				explanation.Value, explanation.ErrorStep, explanation.ErrorCell)
+		}
+		if ref := explanation.Steps[6].Reference; ref != "Sheet2!B1" {
+			t.Errorf("Reference = %q, want Sheet2!B1", ref)
+		}
+	})
+
+	t.Run("Rendering", func(t *testing.T) {
+		tests := []struct {
+			formula string
+			want    string
+		}{
+			{"=A1-(B1-C1)", "=A1-(B1-C1)"},
+			{"=(A1-B1)-C1", "=A1-B1-C1"},
+			{"=2^3^2", "=2^3^2"},
+			{"=(2^3)^2", "=(2^3)^2"},
+			{"=-A1%", "=-A1%"},
+			{"=(A1&\"x\")=\"ax\"", "=A1&\"x\"=\"ax\""},
+			{"=IF(A1>1,\"a\"\"b\",TRUE)", "=IF(A1>1,\"a\"\"b\",TRUE)"},
+			{"=AVERAGE(B3:A1)*1.5", "=AVERAGE(A1:B3)*1.5"},
+		}
+		for _, tt := range tests {
+			s := NewSpreadsheetTestCase(t, tt.formula).
+				Set("Sheet1!D5", tt.formula).
+				spreadsheet
+			explanation, err := s.ExplainFormula("Sheet1!D5")
+			if err != nil {
+				t.Fatalf("ExplainFormula(%s) failed: %v", tt.formula, err)
+			}
+			if explanation.Formula != tt.want {
+				t.Errorf("Formula of %s = %q, want %q", tt.formula, explanation.Formula, tt.want)
+			}
+		}
+	})
+
+	t.Run("ErrorOrigin", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Explain error origin").
+			Set("Sheet1!A1", 0.0).
+			Set("Sheet1!A2", "=1/A1").
+			Set("Sheet1!A3", 5.0).
+			Set("Sheet1!B1", "=SUM(A2:A3)").
+			Set("Sheet1!C1", "=10+B1*2").
+			RunAndAssertNoError().
+			spreadsheet
+
+		explanation, err := s.ExplainFormula("Sheet1!C1")
+		if err != nil {
+			t.Fatalf("ExplainFormula failed: %v", err)
+		}
+		if explanation.ErrorStep < 0 {
+			t.Fatalf("ErrorStep = -1, want the B1 step")
+		}
+		if step := explanation.Steps[explanation.ErrorStep]; step.Expression != "B1" {
+			t.Errorf("error step = %q, want B1", step.Expression)
+		}
+		if explanation.ErrorCell != "Sheet1!A2" {
+			t.Errorf("ErrorCell = %q, want Sheet1!A2", explanation.ErrorCell)
+		}
+
+		explanation, _ = s.ExplainFormula("Sheet1!A2")
+		if step := explanation.Steps[explanation.ErrorStep]; step.Expression != "1/A1" || explanation.ErrorCell != "" {
+			t.Errorf("error step = %q in %q, want 1/A1 in this formula", step.Expression, explanation.ErrorCell)
+		}
+	})
+
+	t.Run("NotAFormula", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Explain a value").
+			Set("Sheet1!A1", 1.0).
+			spreadsheet
+		var appErr *AppError
+		if _, err := s.ExplainFormula("Sheet1!A1"); !errors.As(err, &appErr) || appErr.Code != InvalidArgument {
+			t.Errorf("ExplainFormula(Sheet1!A1) error = %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestCompiledFormulas(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Compiled formulas").
+		AddWorksheet("Sheet2").
+		Set("Sheet1!A1", 4.0).
+		Set("Sheet1!A2", "text").
+		Set("Sheet1!A3", true).
+		Set("Sheet1!A4", 0.0).
+		Set("Sheet2!A1", 10.0)
+	s := tc.spreadsheet
+	if err := s.DefineNamedRange("Values", "Sheet1!A1:A4"); err != nil {
+		t.Fatalf("DefineNamedRange failed: %v", err)
+	}
+
+	formulas := []string{
+		"=A1+2", "=A1-2.5", "=A1*A3", "=A1/A4", "=A1/2", "=A1^0.5", "=-A1%",
+		"=A2&A1", "=A2+1", "=A1>3", "=A2=\"TEXT\"", "=A1<>A1", "=+A5",
+		"=SUM(A1:A4)*2", "=SUM(Values)", "=AVERAGE(A1,Sheet2!A1)", "=IF(A1>3,\"big\",\"small\")",
+		"=NOSUCH(A1)", "=Missing+1", "=LEN(A2)&UPPER(A2)", "=ROUND(PI(),3)", "=MAX(A1:A4,Sheet2!A1)",
+		"=1/0+A2", "=NOT(A4)", "=CONCATENATE(A1,\"-\",A3)",
+		// nested calls share the argument stack, including through LAMBDA calls
+		"=SUM(1,MAX(2,SUM(3,A1)),MIN(5,6))", "=LET(f,LAMBDA(x,SUM(x,MAX(x,1))),SUM(f(A1),f(2)))",
+	}
+
+	for i, formula := range formulas {
+		tc.Set(fmt.Sprintf("Sheet1!C%d", i+1), formula)
+	}
+	tc.RunAndAssertNoError()
+
+	for i, formula := range formulas {
+		worksheetID, row, col, _ := s.resolveAddress(fmt.Sprintf("Sheet1!C%d", i+1))
+		addr := CellAddress{WorksheetID: worksheetID, Row: row, Column: col}
+		formulaID, _ := s.storage.formulas.GetFormulaAtCell(addr)
+		ast, _ := s.storage.formulas.GetAST(formulaID)
+		compiled, ok := s.storage.formulas.GetCompiled(formulaID)
+		if !ok {
+			t.Fatalf("%s was not compiled", formula)
+		}
+
+		want := s.evaluateFormula(ast.Eval, addr)
+		got := s.evaluateFormula(compiled, addr)
+		if !valuesEqual(got, want) || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: compiled = %v, AST = %v", formula, got, want)
+		}
+		if stored := s.formulaResult(addr); fmt.Sprint(stored) != fmt.Sprint(want) {
+			t.Errorf("%s: stored = %v, want %v", formula, stored, want)
+		}
+	}
+}
+
+func TestRangeIndex(t *testing.T) {
+	// deterministic pseudo-random ranges, compared against a linear scan
+	seed := uint32(12345)
+	next := func(n uint32) uint32 {
+		seed = seed*1664525 + 1013904223
+		return (seed >> 8) % n
+	}
+	randomRange := func() RangeAddress {
+		r := RangeAddress{WorksheetID: next(2), StartRow: next(200), StartColumn: next(30)}
+		r.EndRow = r.StartRow + next(40)
+		r.EndColumn = r.StartColumn + next(8)
+		return r
+	}
+
+	index := NewRangeIndex()
+	live := make(map[RangeAddress]struct{})
+	for i := 0; i < 2000; i++ {
+		r := randomRange()
+		if i%3 == 2 {
+			// delete an existing range about a third of the time
+			for existing := range live {
+				r = existing
+				break
+			}
+			if !index.Delete(r) {
+				t.Fatalf("Delete(%v) = false for an indexed range", r)
+			}
+			delete(live, r)
+			continue
+		}
+		index.Insert(r)
+		live[r] = struct{}{}
+	}
+	if index.Len() != len(live) {
+		t.Fatalf("Len() = %d, want %d", index.Len(), len(live))
+	}
+	if index.Delete(RangeAddress{WorksheetID: 7}) {
+		t.Error("Delete of an unknown range should return false")
+	}
+
+	check := func(query RangeAddress) {
+		got := make(map[RangeAddress]int)
+		index.Intersecting(query, func(r RangeAddress) { got[r]++ })
+		want := 0
+		for r := range live {
+			if r.WorksheetID == query.WorksheetID && rangesIntersect(r, query) {
+				want++
+				if got[r] != 1 {
+					t.Fatalf("query %v: range %v reported %d times", query, r, got[r])
+				}
+			}
+		}
+		if len(got) != want {
+			t.Fatalf("query %v: got %d ranges, want %d", query, len(got), want)
+		}
+	}
+	// whole columns and rows span the trees
+	for _, r := range []RangeAddress{
+		{WorksheetID: 1, StartRow: 0, StartColumn: 3, EndRow: MaxRows - 1, EndColumn: 3},
+		{WorksheetID: 1, StartRow: 50, StartColumn: 0, EndRow: 50, EndColumn: MaxColumns - 1},
+	} {
+		index.Insert(r)
+		live[r] = struct{}{}
+	}
+	containing := func(addr CellAddress) {
+		got := make(map[RangeAddress]int)
+		index.Containing(addr, func(r RangeAddress) { got[r]++ })
+		want := 0
+		for r := range live {
+			if r.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+				want++
+				if got[r] != 1 {
+					t.Fatalf("cell %v: range %v reported %d times", addr, r, got[r])
+				}
+			}
+		}
+		if len(got) != want {
+			t.Fatalf("cell %v: got %d ranges, want %d", addr, len(got), want)
+		}
+	}
+	for i := 0; i < 300; i++ {
+		row, col := next(260), next(45)
+		check(RangeAddress{WorksheetID: next(2), StartRow: row, StartColumn: col, EndRow: row, EndColumn: col})
+		check(randomRange())
+		containing(CellAddress{WorksheetID: next(2), Row: row, Column: col})
+	}
+	containing(CellAddress{WorksheetID: 1, Row: MaxRows - 1, Column: 3})
+	check(RangeAddress{WorksheetID: 1, StartRow: 0, StartColumn: 0, EndRow: MaxRows - 1, EndColumn: MaxColumns - 1})
+
+	// deleting every range prunes the trees
+	for r := range live {
+		index.Delete(r)
+		delete(live, r)
+	}
+	if index.Len() != 0 || len(index.trees) != 0 {
+		t.Errorf("after deleting every range Len() = %d, trees = %d", index.Len(), len(index.trees))
+	}
+	index.Insert(randomRange())
+
+	index.Clear()
+	if index.Len() != 0 {
+		t.Errorf("Len() after Clear = %d", index.Len())
+	}
+
+	t.Run("DependencyGraph", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Range dependencies")
+		for i := 1; i <= 200; i++ {
+			// each formula sums a distinct window of column A
+			tc.Set(fmt.Sprintf("Sheet1!A%d", i), float64(i)).
+				Set(fmt.Sprintf("Sheet1!C%d", i), fmt.Sprintf("=SUM(A%d:A%d)", i, i+4))
+		}
+		tc.RunAndAssertNoError()
+		s := tc.spreadsheet
+
+		dg := s.GetDependencyGraph()
+		sheetID, _, _, _ := s.resolveAddress("Sheet1!A1")
+		if dg.RangeObserverCount() != 200 || dg.rangeIndex.Len() != 200 {
+			t.Fatalf("observed ranges = %d, indexed = %d, want 200", dg.RangeObserverCount(), dg.rangeIndex.Len())
+		}
+
+		// A10 is read by the windows starting at rows 6 through 10
+		dependents := dg.GetRangeDependents(CellAddress{WorksheetID: sheetID, Row: 9, Column: 0})
+		sortCellAddresses(dependents)
+		if len(dependents) != 5 || dependents[0].Row != 5 || dependents[4].Row != 9 {
+			t.Errorf("dependents of A10 = %v", dependents)
+		}
+
+		// a rectangle query over A10:A12 finds the union without duplicates
+		block := RangeAddress{WorksheetID: sheetID, StartRow: 9, StartColumn: 0, EndRow: 11, EndColumn: 0}
+		if got := dg.GetRangeDependentsInRange(block); len(got) != 7 {
+			t.Errorf("dependents of A10:A12 = %d cells, want 7", len(got))
+		}
+
+		tc.Set("Sheet1!A10", 1000.0)
+		if dirty := len(dg.dirtySet); dirty != 5 {
+			t.Errorf("dirty cells after editing A10 = %d, want 5", dirty)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet1!C8", 8.0+9+1000+11+12)
+
+		// replacing formulas keeps the index in step with the observers
+		for i := 1; i <= 200; i++ {
+			tc.Set(fmt.Sprintf("Sheet1!C%d", i), 1.0)
+		}
+		if dg.RangeObserverCount() != 0 || dg.rangeIndex.Len() != 0 {
+			t.Errorf("observed ranges = %d, indexed = %d, want 0", dg.RangeObserverCount(), dg.rangeIndex.Len())
+		}
+	})
+}
+
+func TestSparseRangeIteration(t *testing.T) {
+	// values scattered across four chunks, including formula cells and a
+	// cell that was set and then removed
+	s := NewSpreadsheetTestCase(t, "Sparse cells").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet1!C3", "text").
+		Set("Sheet1!IV256", 2.0).
+		Set("Sheet1!IW256", true).
+		Set("Sheet1!IU257", 3.0).
+		Set("Sheet1!IW300", 4.0).
+		Set("Sheet1!B70", "=A1*10").
+		Set("Sheet1!IV64", "=IU257+1").
+		Set("Sheet1!D5", 9.0).
+		Remove("Sheet1!D5").
+		RunAndAssertNoError().
+		spreadsheet
+
+	worksheet, _ := s.GetWorksheet("Sheet1")
+	sheetID, _, _, _ := s.resolveAddress("Sheet1!A1")
+	newRange := func(startRow, startCol, endRow, endCol uint32) *CellRange {
+		return &CellRange{worksheetID: sheetID, startRow: startRow, startCol: startCol,
+			endRow: endRow, endCol: endCol, worksheet: worksheet, storage: s.storage}
+	}
+
+	// every sub-rectangle must match a full positional scan
+	bounds := [][4]uint32{
+		{0, 0, 299, 299}, {0, 0, 0, 0}, {1, 1, 69, 2}, {63, 255, 64, 256},
+		{255, 254, 256, 256}, {256, 0, 511, 300}, {2, 2, 2, 2}, {100, 100, 200, 200},
+	}
+	for _, b := range bounds {
+		r := newRange(b[0], b[1], b[2], b[3])
+
+		var want []string
+		position := 0
+		for value := range r.IterateValues() {
+			if value != nil {
+				row := b[0] + uint32(position)/(b[3]-b[1]+1)
+				col := b[1] + uint32(position)%(b[3]-b[1]+1)
+				want = append(want, fmt.Sprintf("%d,%d=%v", row, col, value))
+			}
+			position++
+		}
+		if position != r.Size() {
+			t.Errorf("%v: IterateValues visited %d cells, Size() = %d", b, position, r.Size())
+		}
+
+		var got []string
+		for addr, value := range r.IterateOccupied() {
+			got = append(got, fmt.Sprintf("%d,%d=%v", addr.Row, addr.Column, value))
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%v: IterateOccupied = %v, want %v", b, got, want)
+		}
+
+		count := 0
+		for range r.IterateOccupiedValues() {
+			count++
+		}
+		if count != len(want) {
+			t.Errorf("%v: IterateOccupiedValues yielded %d values, want %d", b, count, len(want))
+		}
+	}
+
+	// iteration stops as soon as the consumer does
+	count := 0
+	for range newRange(0, 0, 299, 299).IterateOccupiedValues() {
+		count++
+		if count == 3 {
+			break
+		}
+	}
+	if count != 3 {
+		t.Errorf("early break yielded %d values", count)
+	}
+
+	t.Run("Aggregates over sparse ranges", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Sum over a million rows").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A500000", 2.0).
+			Set("Sheet1!A1000000", 3.0).
+			Set("Sheet1!B1", "=SUM(A1:A1000000)").
+			Set("Sheet1!B2", "=COUNT(A1:A1000000)").
+			Set("Sheet1!B3", "=AVERAGE(A1:A1000000)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 6.0).
+			AssertCellEq("Sheet1!B2", 3.0).
+			AssertCellEq("Sheet1!B3", 2.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Empty cells still count as zero").
+			Set("Sheet1!A1", -5.0).
+			Set("Sheet1!A2", -1.0).
+			Set("Sheet1!A4", 7.0).
+			Set("Sheet1!B1", "=MAX(A1:A2)").
+			Set("Sheet1!B2", "=MAX(A1:A3)").
+			Set("Sheet1!B3", "=MIN(A4:A6)").
+			Set("Sheet1!B4", "=MEDIAN(A1:A6)").
+			Set("Sheet1!B5", "=MODE(A1:A6)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", -1.0).
+			AssertCellEq("Sheet1!B2", 0.0).
+			AssertCellEq("Sheet1!B3", 0.0).
+			AssertCellEq("Sheet1!B4", 0.0).
+			AssertCellEq("Sheet1!B5", 0.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Errors keep row-major precedence").
+			Set("Sheet1!B1", "=1/0").
+			Set("Sheet1!A2", "=NOSUCH()").
+			Set("Sheet1!C1", "=SUM(A1:B2)").
+			Run().
+			AssertCellErr("Sheet1!C1", ErrorCodeDiv0).
+			End()
+	})
+
+	t.Run("COUNTBLANK", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Countblank counts empty cells").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A3", "text").
+			Set("Sheet1!B1", "=COUNTBLANK(A1:A10)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 8.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Countblank counts empty text but not errors").
+			Set("Sheet1!A1", "=\"\"").
+			Set("Sheet1!A2", "=1/0").
+			Set("Sheet1!A3", 0.0).
+			Set("Sheet1!B1", "=COUNTBLANK(A1:A4)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!B1", 2.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Countblank over a large sparse range").
+			Set("Sheet1!C1", 1.0).
+			Set("Sheet1!D300", 1.0).
+			Set("Sheet1!A1", "=COUNTBLANK(C1:D1000)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 1998.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Countblank of a single cell").
+			Set("Sheet1!A1", "=COUNTBLANK(B1)").
+			Set("Sheet1!A2", "=COUNTBLANK(A1)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 1.0).
+			AssertCellEq("Sheet1!A2", 0.0).
+			End()
+
+		NewSpreadsheetTestCase(t, "Countblank argument count").
+			Set("Sheet1!A1", "=COUNTBLANK()").
+			Run().
+			AssertCellErr("Sheet1!A1", ErrorCodeNA).
+			End()
+	})
+}
+
+func TestWholeColumnAndRowReferences(t *testing.T) {
+	NewSpreadsheetTestCase(t, "Whole column sum").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet1!A2", 2.0).
+		Set("Sheet1!A3", 3.0).
+		Set("Sheet1!C1", "=SUM(A:A)").
+		Set("Sheet1!C2", "=COUNT(a:b)").
+		Set("Sheet1!C3", "=SUM(A1:A1)").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!C1", 6.0).
+		AssertCellEq("Sheet1!C2", 3.0).
+		AssertCellEq("Sheet1!C3", 1.0).
+		End()
+
+	NewSpreadsheetTestCase(t, "Whole row sum").
+		Set("Sheet1!A2", 1.0).
+		Set("Sheet1!B2", 2.0).
+		Set("Sheet1!Z3", 3.0).
+		Set("Sheet1!A5", "=SUM(2:3)").
+		Set("Sheet1!B5", "=SUM(2:2)").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!A5", 6.0).
+		AssertCellEq("Sheet1!B5", 3.0).
+		End()
+
+	NewSpreadsheetTestCase(t, "Whole columns on another worksheet").
+		AddWorksheet("Sheet2").
+		Set("Sheet2!B1", 10.0).
+		Set("Sheet2!D7", 5.0).
+		Set("Sheet2!E1", 100.0).
+		Set("Sheet1!A1", "=SUM(Sheet2!B:D)").
+		Set("Sheet1!A2", "=SUM('Sheet2'!7:7)").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!A1", 15.0).
+		AssertCellEq("Sheet1!A2", 5.0).
+		End()
+
+	NewSpreadsheetTestCase(t, "Whole column containing its formula is circular").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet1!A5", "=SUM(A:A)").
+		Run().
+		AssertCellErr("Sheet1!A5", ErrorCodeCircular).
+		End()
+
+	t.Run("Appending rows dirties dependents", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Appending rows dirties dependents").
+			AddWorksheet("Data").
+			Set("Data!A1", 1.0).
+			Set("Sheet1!A1", "=SUM(Data!A:A)").
+			Set("Sheet1!A2", "=COUNTBLANK(Data!A:A)").
+			Set("Sheet1!A3", "=SUM(Data!5000:5000)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 1.0)
+		s := tc.spreadsheet
+
+		// the dependency is tracked at full size, not at the used extent
+		dg := s.GetDependencyGraph()
+		worksheetID, _, _, _ := s.resolveAddress("Data!A1")
+		sheetID, _, _, _ := s.resolveAddress("Sheet1!A1")
+		precedents := dg.GetRangePrecedents(CellAddress{WorksheetID: sheetID, Row: 0, Column: 0})
+		if len(precedents) != 1 || precedents[0].WorksheetID != worksheetID || precedents[0].EndRow != MaxRows-1 {
+			t.Errorf("range precedents = %v", precedents)
+		}
+
+		// appending far below the used extent, which is then A1:C5000 so
+		// column A has 4998 blank cells
+		tc.Set("Data!A5000", 41.0).
+			Set("Data!C5000", 1.0).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 42.0).
+			AssertCellEq("Sheet1!A2", 4998.0).
+			AssertCellEq("Sheet1!A3", 42.0).
+			Remove("Data!A5000").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!A1", 1.0).
+			End()
+	})
+
+	t.Run("Used extent", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Used extent")
+		worksheet, _ := tc.spreadsheet.GetWorksheet("Sheet1")
+		if _, _, ok := worksheet.UsedExtent(); ok {
+			t.Error("empty worksheet should have no used extent")
+		}
+
+		tc.Set("Sheet1!C700", 1.0).
+			Set("Sheet1!KA2", "=1+1")
+		if lastRow, lastCol, ok := worksheet.UsedExtent(); !ok || lastRow != 699 || lastCol != 286 {
+			t.Errorf("UsedExtent() = %d, %d, %v, want 699, 286, true", lastRow, lastCol, ok)
+		}
+
+		tc.Remove("Sheet1!C700")
+		if lastRow, lastCol, ok := worksheet.UsedExtent(); !ok || lastRow != 1 || lastCol != 286 {
+			t.Errorf("UsedExtent() after remove = %d, %d, %v, want 1, 286, true", lastRow, lastCol, ok)
+		}
+	})
+
+	t.Run("Limits apply to the used extent", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Limits apply to the used extent")
+		tc.spreadsheet.SetLimits(Limits{MaxRangeCells: 100})
+		tc.Set("Sheet1!A1", 1.0).
+			Set("Sheet1!B1", "=SUM(A:A)").
+			Set("Sheet1!A500", 1.0).
+			Set("Sheet1!B2", "=SUM(A:A)+0").
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!B2", ErrorCodeNum).
+			End()
+	})
+
+	t.Run("Rendering", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Whole column rendering").
+			AddWorksheet("Sheet2").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!C1", "=SUM(A:B)+SUM(Sheet2!3:4)").
+			RunAndAssertNoError().
+			spreadsheet
+
+		explanation, err := s.ExplainFormula("Sheet1!C1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Formula != "=SUM(A:B)+SUM(Sheet2!3:4)" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+
+		trace, err := s.TracePrecedents("Sheet1!C1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addresses []string
+		for _, child := range trace.Children {
+			addresses = append(addresses, child.Address)
+		}
+		if strings.Join(addresses, " ") != "Sheet1!A:B Sheet2!3:4" {
+			t.Errorf("precedents = %v", addresses)
+		}
+	})
+}
+
+func TestWorksheetSpanReferences(t *testing.T) {
+	NewSpreadsheetTestCase(t, "Sum across a span of worksheets").
+		AddWorksheet("Sheet2").
+		AddWorksheet("Sheet3").
+		AddWorksheet("Summary").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet2!A1", 2.0).
+		Set("Sheet3!A1", 3.0).
+		Set("Sheet2!B1", 10.0).
+		Set("Summary!A1", "=SUM(Sheet1:Sheet3!A1)").
+		Set("Summary!A2", "=SUM('Sheet1:Sheet3'!A1:B1)").
+		Set("Summary!A3", "=COUNT(Sheet3:Sheet2!A1)").
+		Set("Summary!A4", "=SUM(Sheet2:Sheet2!A1)").
+		RunAndAssertNoError().
+		AssertCellEq("Summary!A1", 6.0).
+		AssertCellEq("Summary!A2", 16.0).
+		AssertCellEq("Summary!A3", 2.0).
+		AssertCellEq("Summary!A4", 2.0).
+		End()
+
+	NewSpreadsheetTestCase(t, "Span over the worksheet of the formula is circular").
+		AddWorksheet("Sheet2").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet2!A1", "=SUM(Sheet1:Sheet2!A1)").
+		Run().
+		AssertCellErr("Sheet2!A1", ErrorCodeCircular).
+		End()
+
+	t.Run("Worksheets joining and leaving the span", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Worksheets joining and leaving the span").
+			RenameWorksheet("Sheet1", "Jan").
+			AddWorksheet("Feb").
+			AddWorksheet("Mar").
+			AddWorksheet("Summary").
+			Set("Jan!B2", 1.0).
+			Set("Feb!B2", 2.0).
+			Set("Mar!B2", 4.0).
+			Set("Summary!A1", "=SUM(Jan:Mar!B2)").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 7.0).
+			// added after the last endpoint, outside the span
+			AddWorksheet("Apr").
+			Set("Apr!B2", 8.0).
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 7.0)
+
+		// moved inside the span
+		if err := tc.spreadsheet.MoveWorksheet("Apr", 1); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 15.0).
+			// editing a worksheet in the middle of the span
+			Set("Apr!B2", 16.0).
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 23.0).
+			RemoveWorksheet("Feb").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 21.0).
+			// renaming keeps the worksheet inside the span
+			RenameWorksheet("Apr", "April").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 21.0).
+			// removing an endpoint moves it to its neighbour inside the span
+			RemoveWorksheet("Mar").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 17.0).
+			// renaming an endpoint keeps it
+			RenameWorksheet("Jan", "January").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 17.0)
+
+		explanation, err := tc.spreadsheet.ExplainFormula("Summary!A1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "=SUM(January:April!B2)"; explanation.Formula != want {
+			t.Errorf("formula after renaming Jan = %q, want %q", explanation.Formula, want)
+		}
+
+		// a span of a single worksheet goes with it
+		tc.Set("Summary!A2", "=SUM(April:April!B2)").
+			RemoveWorksheet("April").
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 1.0).
+			AssertCellErr("Summary!A2", ErrorCodeRef).
+			End()
+	})
+
+	t.Run("Undefined endpoint", func(t *testing.T) {
+		NewSpreadsheetTestCase(t, "Undefined endpoint").
+			RenameWorksheet("Sheet1", "Summary").
+			AddWorksheet("First").
+			Set("First!A1", 1.0).
+			Set("Summary!A1", "=SUM(First:Last!A1)").
+			Set("Summary!A2", "=Last!A1*2").
+			RunAndAssertNoError().
+			AssertCellErr("Summary!A1", ErrorCodeRef).
+			AddWorksheet("Last").
+			Set("Last!A1", 2.0).
+			RunAndAssertNoError().
+			AssertCellEq("Summary!A1", 3.0).
+			AssertCellEq("Summary!A2", 4.0).
+			End()
+	})
+
+	t.Run("Rendering", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Worksheet span rendering").
+			RenameWorksheet("Sheet1", "Jan").
+			AddWorksheet("Dec").
+			AddWorksheet("Summary").
+			Set("Summary!A1", "=SUM(Jan:Dec!B7)+SUM(Jan:Dec!A1:B2)+SUM(Jan:Dec!C:C)").
+			RunAndAssertNoError().
+			spreadsheet
+
+		explanation, err := s.ExplainFormula("Summary!A1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Formula != "=SUM(Jan:Dec!B7)+SUM(Jan:Dec!A1:B2)+SUM(Jan:Dec!C:C)" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+
+		trace, err := s.TracePrecedents("Summary!A1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trace.Children) != 6 {
+			t.Errorf("precedents = %d, want 6", len(trace.Children))
+		}
+	})
+}
+
+func TestWorksheetOrderAndCopy(t *testing.T) {
+	t.Run("ListWorksheets keeps tab order", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Tab order").
+			RenameWorksheet("Sheet1", "C").
+			AddWorksheet("A").
+			AddWorksheet("D").
+			AddWorksheet("B").
+			spreadsheet
+		if names := strings.Join(s.ListWorksheets(), " "); names != "C A D B" {
+			t.Errorf("ListWorksheets() = %s", names)
+		}
+
+		if err := s.MoveWorksheet("B", 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.MoveWorksheet("C", 3); err != nil {
+			t.Fatal(err)
+		}
+		if names := strings.Join(s.ListWorksheets(), " "); names != "B A D C" {
+			t.Errorf("ListWorksheets() after moving = %s", names)
+		}
+
+		if err := s.RenameWorksheet("A", "Z"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveWorksheet("D"); err != nil {
+			t.Fatal(err)
+		}
+		if names := strings.Join(s.ListWorksheets(), " "); names != "B Z C" {
+			t.Errorf("ListWorksheets() after rename and remove = %s", names)
+		}
+
+		if err := s.MoveWorksheet("B", 3); err == nil || err.(*AppError).Code != OutOfRange {
+			t.Errorf("MoveWorksheet past the end = %v, want OutOfRange", err)
+		}
+		if err := s.MoveWorksheet("Nope", 0); err == nil || err.(*AppError).Code != NotFound {
+			t.Errorf("MoveWorksheet of unknown worksheet = %v, want NotFound", err)
+		}
+	})
+
+	t.Run("CopyWorksheet", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Copy worksheet").
+			RenameWorksheet("Sheet1", "Data").
+			AddWorksheet("Other").
+			Set("Data!A1", 2.0).
+			Set("Data!A2", "text").
+			Set("Data!B1", "=A1*10").
+			Set("Data!B2", "=SUM(Data!A1:A2)+Other!A1").
+			Set("Other!A1", 1.0)
+		s := tc.spreadsheet
+		if err := s.SetWorksheetProperties("Data", WorksheetProperties{TabColor: "#FF0000", DefaultColumnWidth: 12}); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError()
+
+		if err := s.CopyWorksheet("Data", "Copy"); err != nil {
+			t.Fatal(err)
+		}
+		if names := strings.Join(s.ListWorksheets(), " "); names != "Data Copy Other" {
+			t.Errorf("ListWorksheets() = %s", names)
+		}
+
+		// the copy reads its own cells
+		tc.RunAndAssertNoError().
+			Set("Copy!A1", 5.0).
+			RunAndAssertNoError().
+			AssertCellEq("Copy!A2", "text").
+			AssertCellEq("Copy!B1", 50.0).
+			AssertCellEq("Copy!B2", 6.0).
+			AssertCellEq("Data!B1", 20.0).
+			AssertCellEq("Data!B2", 3.0)
+
+		explanation, err := s.ExplainFormula("Copy!B2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Formula != "=SUM(A1:A2)+Other!A1" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+
+		// edits to the source no longer reach the copy
+		tc.Set("Data!A2", "changed").
+			Remove("Data!B1").
+			AssertCellEq("Copy!A2", "text")
+
+		properties, _ := s.GetWorksheetProperties("Copy")
+		if properties.TabColor != "#FF0000" || properties.DefaultColumnWidth != 12 {
+			t.Errorf("copied properties = %+v", properties)
+		}
+
+		if err := s.CopyWorksheet("Data", "Other"); err == nil || err.(*AppError).Code != AlreadyExists {
+			t.Errorf("CopyWorksheet onto an existing worksheet = %v, want AlreadyExists", err)
+		}
+	})
+
+	t.Run("Worksheet properties", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Worksheet properties").AddWorksheet("Sheet2")
+		s := tc.spreadsheet
+
+		properties, err := s.GetWorksheetProperties("Sheet1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if properties.Visibility != WorksheetVisible || properties.DefaultColumnWidth != DefaultColumnWidth {
+			t.Errorf("default properties = %+v", properties)
+		}
+
+		if err := s.SetWorksheetProperties("Sheet1", WorksheetProperties{Visibility: WorksheetVeryHidden}); err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetWorksheetProperties("Sheet2", WorksheetProperties{Visibility: WorksheetHidden})
+		if err == nil || err.(*AppError).Code != FailedPrecondition {
+			t.Errorf("hiding the last visible worksheet = %v, want FailedPrecondition", err)
+		}
+
+		for _, invalid := range []WorksheetProperties{
+			{TabColor: "red"},
+			{TabColor: "#12345G"},
+			{DefaultColumnWidth: -1},
+			{Visibility: WorksheetVeryHidden + 1},
+		} {
+			err := s.SetWorksheetProperties("Sheet2", invalid)
+			if err == nil || err.(*AppError).Code != InvalidArgument {
+				t.Errorf("SetWorksheetProperties(%+v) = %v, want InvalidArgument", invalid, err)
+			}
+		}
+
+		// hidden worksheets are still listed and calculated
+		tc.Set("Sheet1!A1", 4.0).
+			Set("Sheet2!A1", "=Sheet1!A1*2").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet2!A1", 8.0)
+		if names := strings.Join(s.ListWorksheets(), " "); names != "Sheet1 Sheet2" {
+			t.Errorf("ListWorksheets() = %s", names)
+		}
+	})
+}
+
+func TestCopyRangeAndFill(t *testing.T) {
+	t.Run("Relative references translate", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Relative references translate").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 2.0).
+			Set("Sheet1!A3", 3.0).
+			Set("Sheet1!A4", 4.0).
+			Set("Sheet1!B1", "=A1*10").
+			Set("Sheet1!C1", "=SUM(A1:B1)")
+		s := tc.spreadsheet
+
+		if err := s.CopyRange("Sheet1!B1:C1", "Sheet1!B2:C4", PasteAll); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet1!B2", 20.0).
+			AssertCellEq("Sheet1!B4", 40.0).
+			AssertCellEq("Sheet1!C3", 33.0).
+			AssertCellEq("Sheet1!C4", 44.0)
+
+		// pasted cells share the formula of the source
+		sheetID, _, _, _ := s.resolveAddress("Sheet1!A1")
+		source, _ := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: sheetID, Row: 0, Column: 1})
+		pasted, _ := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: sheetID, Row: 3, Column: 1})
+		if source != pasted || s.storage.formulas.GetReferenceCount(source) != 4 {
+			t.Errorf("formula IDs %d and %d, %d references", source, pasted, s.storage.formulas.GetReferenceCount(source))
+		}
+
+		explanation, _ := s.ExplainFormula("Sheet1!C4")
+		if explanation.Formula != "=SUM(A4:B4)" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+	})
+
+	t.Run("References pushed off the worksheet", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "References pushed off the worksheet").
+			Set("Sheet1!B2", "=A1+1")
+		s := tc.spreadsheet
+		if err := s.CopyRange("Sheet1!B2", "Sheet1!A1", PasteAll); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellErr("Sheet1!A1", ErrorCodeRef)
+
+		explanation, _ := s.ExplainFormula("Sheet1!A1")
+		if explanation.Formula != "=#REF!+1" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+	})
+
+	t.Run("Paste modes", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Paste modes").
+			AddWorksheet("Sheet2").
+			Set("Sheet1!A1", 2.0).
+			Set("Sheet1!B1", "=A1*2").
+			Set("Sheet2!A1", "old").
+			Set("Sheet2!C1", "kept").
+			RunAndAssertNoError()
+		s := tc.spreadsheet
+
+		for _, paste := range []struct {
+			destination string
+			mode        PasteMode
+		}{
+			{"Sheet2!A2", PasteValues},
+			{"Sheet2!A1", PasteFormulas},
+			{"Sheet2!A3", PasteAll},
+		} {
+			if err := s.CopyRange("Sheet1!A1:C1", paste.destination, paste.mode); err != nil {
+				t.Fatalf("CopyRange to %s: %v", paste.destination, err)
+			}
+		}
+
+		// formulas only leaves values alone, the pasted formula reads Sheet2!A1
+		tc.RunAndAssertNoError().
+			AssertCellErr("Sheet2!B1", ErrorCodeValue).
+			AssertCellEq("Sheet2!A1", "old").
+			AssertCellEq("Sheet2!C1", "kept").
+			AssertCellEq("Sheet2!A2", 2.0).
+			AssertCellEq("Sheet2!B2", 4.0).
+			AssertCellEq("Sheet2!A3", 2.0).
+			AssertCellEq("Sheet2!B3", 4.0)
+		sheetID, _, _, _ := s.resolveAddress("Sheet2!B2")
+		if _, isFormula := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: sheetID, Row: 1, Column: 1}); isFormula {
+			t.Error("values only pasted a formula")
+		}
+
+		// empty source cells clear the destination
+		tc.Set("Sheet2!C3", "gone")
+		if err := s.CopyRange("Sheet1!A1:C1", "Sheet2!A3", PasteAll); err != nil {
+			t.Fatal(err)
+		}
+		tc.AssertCellEmpty("Sheet2!C3")
+
+		if err := s.CopyRange("Sheet1!A1", "Sheet1!XFD1:XFD1", PasteAll); err != nil {
+			t.Errorf("CopyRange to the last column = %v", err)
+		}
+		if err := s.CopyRange("Sheet1!A1:B1", "Sheet1!XFD1", PasteAll); err == nil || err.(*AppError).Code != OutOfRange {
+			t.Errorf("CopyRange past the last column = %v, want OutOfRange", err)
+		}
+	})
+
+	t.Run("Overlapping copy", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Overlapping copy").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 2.0).
+			Set("Sheet1!A3", 3.0)
+		if err := tc.spreadsheet.CopyRange("Sheet1!A1:A3", "Sheet1!A2", PasteAll); err != nil {
+			t.Fatal(err)
+		}
+		tc.AssertCellEq("Sheet1!A1", 1.0).
+			AssertCellEq("Sheet1!A2", 1.0).
+			AssertCellEq("Sheet1!A3", 2.0).
+			AssertCellEq("Sheet1!A4", 3.0).
+			End()
+	})
+
+	t.Run("FillDown and FillRight", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "FillDown and FillRight").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 2.0).
+			Set("Sheet1!A3", 3.0).
+			Set("Sheet1!B1", "=A1+1").
+			Set("Sheet1!C1", "label")
+		s := tc.spreadsheet
+		if err := s.FillDown("Sheet1!B1:C3"); err != nil {
+			t.Fatal(err)
+		}
+		tc.Set("Sheet1!D1", "=B1*2")
+		if err := s.FillRight("Sheet1!D1:F1"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet1!B3", 4.0).
+			AssertCellEq("Sheet1!C3", "label").
+			AssertCellEq("Sheet1!D1", 4.0).
+			AssertCellEq("Sheet1!F1", 8.0)
+
+		explanation, _ := s.ExplainFormula("Sheet1!F1")
+		if explanation.Formula != "=D1*2" {
+			t.Errorf("Formula = %s", explanation.Formula)
+		}
+	})
+
+	t.Run("FillSeries", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "FillSeries").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!B1", 10.0).
+			Set("Sheet1!D1", 45322.25). // 2024-01-31 06:00
+			Set("Sheet1!A10", 45292.0)  // 2024-01-01
+		s := tc.spreadsheet
+
+		for _, fill := range []struct {
+			target    string
+			direction FillDirection
+			step      float64
+			unit      SeriesUnit
+		}{
+			{"Sheet1!A1:B4", FillDirectionDown, 2, SeriesLinear},
+			{"Sheet1!C1:C4", FillDirectionDown, 1, SeriesLinear},
+			{"Sheet1!D1:D4", FillDirectionDown, 1, SeriesMonths},
+			{"Sheet1!A10:C10", FillDirectionRight, 1, SeriesYears},
+		} {
+			if err := s.FillSeries(fill.target, fill.direction, fill.step, fill.unit); err != nil {
+				t.Fatalf("FillSeries(%s): %v", fill.target, err)
+			}
+		}
+		tc.AssertCellEq("Sheet1!A4", 7.0).
+			AssertCellEq("Sheet1!B2", 12.0).
+			AssertCellEmpty("Sheet1!C4").        // no start, left alone
+			AssertCellEq("Sheet1!D2", 45351.25). // 2024-02-29
+			AssertCellEq("Sheet1!D3", 45382.25). // 2024-03-31
+			AssertCellEq("Sheet1!D4", 45412.25). // 2024-04-30
+			AssertCellEq("Sheet1!C10", 46023.0). // 2026-01-01
+			Set("Sheet1!E1", "text")
+
+		if err := s.FillSeries("Sheet1!E1:E3", FillDirectionDown, 1, SeriesLinear); err == nil || err.(*AppError).Code != InvalidArgument {
+			t.Errorf("FillSeries from text = %v, want InvalidArgument", err)
+		}
+		if err := s.FillSeries("Sheet1!D1:D3", FillDirectionDown, 0.5, SeriesMonths); err == nil || err.(*AppError).Code != InvalidArgument {
+			t.Errorf("FillSeries by half a month = %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestMoveRange(t *testing.T) {
+	formulaOf := func(t *testing.T, s *Spreadsheet, address string) string {
+		t.Helper()
+		explanation, err := s.ExplainFormula(address)
+		if err != nil {
+			t.Fatalf("ExplainFormula(%s): %v", address, err)
+		}
+		return explanation.Formula
+	}
+
+	t.Run("References follow the moved cells", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "References follow the moved cells").
+			AddWorksheet("Sheet2")
+		for i := 1; i <= 10; i++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", i), float64(i))
+		}
+		tc.Set("Sheet1!E1", "=SUM(A1:A10)").
+			Set("Sheet1!E2", "=A3*2").
+			Set("Sheet1!E3", "=SUM(A1:A20)").
+			Set("Sheet2!A1", "=Sheet1!A10+SUM(Sheet1!A2:A4)").
+			RunAndAssertNoError()
+		s := tc.spreadsheet
+
+		if err := s.MoveRange("Sheet1!A1:A10", "Sheet1!C1"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEmpty("Sheet1!A1").
+			AssertCellEq("Sheet1!C10", 10.0).
+			AssertCellEq("Sheet1!E1", 55.0).
+			AssertCellEq("Sheet1!E2", 6.0).
+			AssertCellEq("Sheet1!E3", 0.0).
+			AssertCellEq("Sheet2!A1", 19.0)
+
+		for address, want := range map[string]string{
+			"Sheet1!E1": "=SUM(C1:C10)",
+			"Sheet1!E2": "=C3*2",
+			"Sheet1!E3": "=SUM(A1:A20)", // only partly moved, stays
+			"Sheet2!A1": "=Sheet1!C10+SUM(Sheet1!C2:C4)",
+		} {
+			if formula := formulaOf(t, s, address); formula != want {
+				t.Errorf("%s = %s, want %s", address, formula, want)
+			}
+		}
+	})
+
+	t.Run("Moved formulas keep their targets", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Moved formulas keep their targets").
+			AddWorksheet("Sheet2").
+			Set("Sheet1!A1", 5.0).
+			Set("Sheet1!B1", 7.0).
+			Set("Sheet1!B2", "=A1+B1")
+		s := tc.spreadsheet
+
+		if err := s.MoveRange("Sheet1!B1:B2", "Sheet2!D4"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet2!D5", 12.0).
+			AssertCellEmpty("Sheet1!B2")
+
+		// A1 stayed behind, B1 moved along with the formula
+		if formula := formulaOf(t, s, "Sheet2!D5"); formula != "=Sheet1!A1+D4" {
+			t.Errorf("Formula = %s", formula)
+		}
+	})
+
+	t.Run("Overwritten cells become #REF!", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Overwritten cells become #REF!").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!B1", 2.0).
+			Set("Sheet1!C1", "=B1+1").
+			Set("Sheet1!C2", "=A1+1")
+		s := tc.spreadsheet
+
+		if err := s.MoveRange("Sheet1!A1", "Sheet1!B1"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellErr("Sheet1!C1", ErrorCodeRef).
+			AssertCellEq("Sheet1!C2", 2.0)
+
+		if formula := formulaOf(t, s, "Sheet1!C1"); formula != "=#REF!+1" {
+			t.Errorf("Formula = %s", formula)
+		}
+	})
+
+	t.Run("Overlapping move", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Overlapping move").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", "=A1*2").
+			Set("Sheet1!A3", "=A2*2")
+		s := tc.spreadsheet
+
+		if err := s.MoveRange("Sheet1!A1:A3", "Sheet1!A2"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEmpty("Sheet1!A1").
+			AssertCellEq("Sheet1!A2", 1.0).
+			AssertCellEq("Sheet1!A3", 2.0).
+			AssertCellEq("Sheet1!A4", 4.0)
+
+		if formula := formulaOf(t, s, "Sheet1!A4"); formula != "=A3*2" {
+			t.Errorf("Formula = %s", formula)
+		}
+	})
+
+	t.Run("Named ranges move", func(t *testing.T) {
+		tc := NewSpreadsheetTestCase(t, "Named ranges move").
+			Set("Sheet1!A1", 1.0).
+			Set("Sheet1!A2", 2.0)
+		s := tc.spreadsheet
+		if err := s.DefineNamedRange("Data", "Sheet1!A1:A2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DefineNamedRange("Wide", "Sheet1!A1:B9"); err != nil {
+			t.Fatal(err)
+		}
+		tc.Set("Sheet1!D1", "=SUM(Data)").
+			RunAndAssertNoError()
+
+		if err := s.MoveRange("Sheet1!A1:A2", "Sheet1!B5"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet1!D1", 3.0)
+
+		ranges := s.storage.namedRanges.GetAllDefinedRanges()
+		if got := s.formatRangeAddress(ranges["Data"]); got != "Sheet1!B5:B6" {
+			t.Errorf("Data = %s, want Sheet1!B5:B6", got)
+		}
+		if got := s.formatRangeAddress(ranges["Wide"]); got != "Sheet1!A1:B9" {
+			t.Errorf("Wide = %s, want Sheet1!A1:B9", got)
+		}
+	})
+
+	t.Run("Destination past the worksheet", func(t *testing.T) {
+		s := NewSpreadsheetTestCase(t, "Destination past the worksheet").spreadsheet
+		if err := s.MoveRange("Sheet1!A1:B1", "Sheet1!XFD1"); err == nil || err.(*AppError).Code != OutOfRange {
+			t.Errorf("MoveRange = %v, want OutOfRange", err)
+		}
+	})
+}
+
+func TestArrayFormulasAndSpill(t *testing.T) {
+	newTestCase := func(t *testing.T, name string) *SpreadsheetTestCase {
+		tc := NewSpreadsheetTestCase(t, name)
+		for i := 1; i <= 3; i++ {
+			tc.Set(fmt.Sprintf("Sheet1!A%d", i), float64(i)).
+				Set(fmt.Sprintf("Sheet1!B%d", i), float64(i*10))
+		}
+		return tc
+	}
+
+	t.Run("Operators apply element-wise with broadcasting", func(t *testing.T) {
+		tc := newTestCase(t, "Element-wise operators").
+			Set("Sheet1!D1", "=A1:A3*B1:B3").
+			Set("Sheet1!E1", "=A1:A3+100").
+			Set("Sheet1!F1", "=A1:A3*B1:C1").
+			Set("Sheet1!H1", "=A1:A2+B1:B3").
+			Set("Sheet1!I1", "=-A1:A3").
+			Set("Sheet1!J1", "=SUM(A1:A3*B1:B3)").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!D1", 10.0).
+			AssertCellEq("Sheet1!D2", 40.0).
+			AssertCellEq("Sheet1!D3", 90.0).
+			AssertCellEq("Sheet1!E3", 103.0).
+			AssertCellEq("Sheet1!F3", 30.0).
+			AssertCellEq("Sheet1!G3", 0.0). // C1 is empty
+			AssertCellEq("Sheet1!H2", 22.0).
+			AssertCellErr("Sheet1!H3", ErrorCodeNA).
+			AssertCellEq("Sheet1!I2", -2.0).
+			AssertCellEq("Sheet1!J1", 140.0).
+			AssertCellEmpty("Sheet1!J2")
+
+		for address, want := range map[string]string{
+			"Sheet1!D1": "Sheet1!D1:D3", "Sheet1!F1": "Sheet1!F1:G3", "Sheet1!J1": "", "Sheet1!D2": "",
+		} {
+			if got, _ := tc.spreadsheet.GetSpillRange(address); got != want {
+				t.Errorf("GetSpillRange(%s) = %q, want %q", address, got, want)
+			}
+		}
+	})
+
+	t.Run("Range results spill", func(t *testing.T) {
+		tc := newTestCase(t, "Range results spill").
+			Set("Sheet1!D1", "=A2:B3").
+			Set("Sheet1!G1", "=A2:A2").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!D1", 2.0).
+			AssertCellEq("Sheet1!E1", 20.0).
+			AssertCellEq("Sheet1!D2", 3.0).
+			AssertCellEq("Sheet1!E2", 30.0).
+			AssertCellEq("Sheet1!G1", 2.0)
+
+		if got, _ := tc.spreadsheet.GetSpillRange("Sheet1!G1"); got != "" {
+			t.Errorf("single values don't spill, got %q", got)
+		}
+	})
+
+	t.Run("Readers of spilled cells follow the spill", func(t *testing.T) {
+		for _, workers := range []int{1, 4} {
+			tc := newTestCase(t, fmt.Sprintf("Spill readers with %d workers", workers))
+			tc.spreadsheet.SetParallelism(workers)
+			// calculated before the anchor, which is further down
+			tc.Set("Sheet1!C1", "=E6*2").
+				Set("Sheet1!D1", "=SUM(E5:E7)").
+				Set("Sheet1!E5", "=A1:A3*2").
+				RunAndAssertNoError().
+				AssertCellEq("Sheet1!C1", 8.0).
+				AssertCellEq("Sheet1!D1", 12.0).
+				Set("Sheet1!A2", 5.0).
+				RunAndAssertNoError().
+				AssertCellEq("Sheet1!E6", 10.0).
+				AssertCellEq("Sheet1!C1", 20.0).
+				AssertCellEq("Sheet1!D1", 18.0).
+				End()
+		}
+	})
+
+	t.Run("Occupied cells block the spill", func(t *testing.T) {
+		tc := newTestCase(t, "Occupied cells block the spill").
+			Set("Sheet1!D1", "=A1:A3").
+			Set("Sheet1!E1", "=SUM(D1:D3)").
+			RunAndAssertNoError().
+			Set("Sheet1!D3", "x").
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!D1", ErrorCodeSpill).
+			AssertCellEmpty("Sheet1!D2").
+			AssertCellEq("Sheet1!D3", "x").
+			AssertCellErr("Sheet1!E1", ErrorCodeSpill)
+
+		if got, _ := tc.spreadsheet.GetSpillRange("Sheet1!D1"); got != "" {
+			t.Errorf("GetSpillRange = %q for a blocked spill", got)
+		}
+
+		tc.Remove("Sheet1!D3").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!D1", 1.0).
+			AssertCellEq("Sheet1!D3", 3.0).
+			AssertCellEq("Sheet1!E1", 6.0).
+			// a scalar result clears the spill
+			Set("Sheet1!D1", "=7").
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!D1", 7.0).
+			AssertCellEmpty("Sheet1!D2").
+			AssertCellEmpty("Sheet1!D3").
+			AssertCellEq("Sheet1!E1", 7.0).
+			End()
+	})
+
+	t.Run("Spills past the worksheet", func(t *testing.T) {
+		last := fmt.Sprintf("Sheet1!A%d", MaxRows)
+		newTestCase(t, "Spills past the worksheet").
+			Set(last, "=A1:A3").
+			RunAndAssertNoError().
+			AssertCellErr(last, ErrorCodeSpill).
+			End()
+	})
+
+	t.Run("Moving an anchor moves its spill", func(t *testing.T) {
+		tc := newTestCase(t, "Moving an anchor moves its spill").
+			Set("Sheet1!D1", "=Sheet1!A1:A3*2").
+			RunAndAssertNoError()
+
+		if err := tc.spreadsheet.MoveRange("Sheet1!D1:D3", "Sheet1!F1"); err != nil {
+			t.Fatal(err)
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEmpty("Sheet1!D2").
+			AssertCellEq("Sheet1!F1", 2.0).
+			AssertCellEq("Sheet1!F3", 6.0).
+			End()
+	})
+}
+
+func TestArrayConstants(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Array constants").
+		Set("Sheet1!A1", "=SUM({1,2,3})").
+		Set("Sheet1!A2", "=SUM({1,2}*{3;4})").
+		Set("Sheet1!A3", `=AVERAGE({"a",1;"b",3})`).
+		Set("Sheet1!A4", `=COUNTA({1,"x",TRUE})`).
+		Set("Sheet1!A5", "={1,2;3,4}").
+		Set("Sheet1!D1", "={1, 2}").
+		Set("Sheet1!D2", "={1,2}").
+		Set("Sheet1!D3", "={1,2;3}").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!A1", 6.0).
+		AssertCellEq("Sheet1!A2", 21.0).
+		AssertCellEq("Sheet1!A3", 2.0).
+		AssertCellEq("Sheet1!A4", 3.0).
+		AssertCellEq("Sheet1!A5", 1.0).
+		AssertCellEq("Sheet1!B5", 2.0).
+		AssertCellEq("Sheet1!A6", 3.0).
+		AssertCellEq("Sheet1!B6", 4.0).
+		AssertCellErr("Sheet1!D3", ErrorCodeValue) // ragged
+	s := tc.spreadsheet
+
+	// constants render the same however they were typed, so equal formulas
+	// share an entry in the formula table
+	worksheetID, _, _, _ := s.resolveAddress("Sheet1!D1")
+	d1, _ := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: worksheetID, Row: 0, Column: 3})
+	d2, _ := s.storage.formulas.GetFormulaAtCell(CellAddress{WorksheetID: worksheetID, Row: 1, Column: 3})
+	if d1 != d2 {
+		t.Errorf("={1, 2} and ={1,2} are interned separately")
+	}
+
+	tc.Set("Sheet1!F1", `={"a""b",-1.5;TRUE,2}`)
+	explanation, err := s.ExplainFormula("Sheet1!F1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Formula != `={"a""b",-1.5;TRUE,2}` {
+		t.Errorf("Formula = %s", explanation.Formula)
+	}
+}
+
+func TestDynamicArrayFunctions(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Dynamic array functions").
+		Set("Sheet1!A1", "pear").Set("Sheet1!B1", 3.0).
+		Set("Sheet1!A2", "Apple").Set("Sheet1!B2", 1.0).
+		Set("Sheet1!A3", "fig").Set("Sheet1!B3", 3.0).
+		Set("Sheet1!A4", "apple").Set("Sheet1!B4", 2.0).
+		Set("Sheet1!D1", "=SORT(A1:B4, 2, -1)").
+		Set("Sheet1!G1", "=SORTBY(A1:A4, B1:B4, 1, A1:A4, -1)").
+		Set("Sheet1!H1", "=FILTER(A1:A4, B1:B4>1)").
+		Set("Sheet1!I1", "=UNIQUE(A1:A4)").
+		Set("Sheet1!J1", "=SEQUENCE(2, 3, 10, 5)").
+		Set("Sheet1!J3", "=TRANSPOSE(B1:B4)").
+		Set("Sheet1!J5", "=SORT({3,1,2}, 1, 1, TRUE)").
+		Set("Sheet1!J6", "=UNIQUE({1;2;1;3}, FALSE, TRUE)").
+		Set("Sheet1!K6", "=SUM(FILTER(B1:B4, A1:A4=\"fig\"))").
+		RunAndAssertNoError().
+		// sorting is stable: pear stays ahead of fig on equal keys
+		AssertCellEq("Sheet1!D1", "pear").AssertCellEq("Sheet1!E1", 3.0).
+		AssertCellEq("Sheet1!D2", "fig").AssertCellEq("Sheet1!E2", 3.0).
+		AssertCellEq("Sheet1!D3", "apple").AssertCellEq("Sheet1!E3", 2.0).
+		AssertCellEq("Sheet1!D4", "Apple").AssertCellEq("Sheet1!E4", 1.0).
+		AssertCellEq("Sheet1!G1", "Apple").
+		AssertCellEq("Sheet1!G2", "apple").
+		AssertCellEq("Sheet1!G3", "pear").
+		AssertCellEq("Sheet1!G4", "fig").
+		AssertCellEq("Sheet1!H1", "pear").
+		AssertCellEq("Sheet1!H2", "fig").
+		AssertCellEq("Sheet1!H3", "apple").
+		AssertCellEq("Sheet1!I1", "pear").
+		AssertCellEq("Sheet1!I2", "Apple").
+		AssertCellEq("Sheet1!I3", "fig").
+		AssertCellEmpty("Sheet1!I4").
+		AssertCellEq("Sheet1!J1", 10.0).
+		AssertCellEq("Sheet1!K1", 15.0).
+		AssertCellEq("Sheet1!L1", 20.0).
+		AssertCellEq("Sheet1!J2", 25.0).
+		AssertCellEq("Sheet1!L2", 35.0).
+		AssertCellEq("Sheet1!J3", 3.0).
+		AssertCellEq("Sheet1!K3", 1.0).
+		AssertCellEq("Sheet1!L3", 3.0).
+		AssertCellEq("Sheet1!M3", 2.0).
+		AssertCellEq("Sheet1!J5", 1.0).
+		AssertCellEq("Sheet1!K5", 2.0).
+		AssertCellEq("Sheet1!L5", 3.0).
+		AssertCellEq("Sheet1!J6", 2.0).
+		AssertCellEq("Sheet1!J7", 3.0).
+		AssertCellEq("Sheet1!K6", 3.0)
+
+	for formula, code := range map[string]ErrorCode{
+		"=FILTER(A1:A4, B1:B4>5)":     ErrorCodeCalc,
+		"=FILTER(A1:A4, B1:B3>1)":     ErrorCodeValue,
+		"=SEQUENCE(0)":                ErrorCodeCalc,
+		"=SEQUENCE(-1)":               ErrorCodeValue,
+		"=SORT(A1:B4, 3)":             ErrorCodeValue,
+		"=SORT(A1:B4, 1, 2)":          ErrorCodeValue,
+		"=SORTBY(A1:A4, B1:B2)":       ErrorCodeValue,
+		"=UNIQUE({1;1}, FALSE, TRUE)": ErrorCodeCalc,
+	} {
+		tc.Set("Sheet1!P1", formula).
+			RunAndAssertNoError().
+			AssertCellErr("Sheet1!P1", code)
+	}
+
+	tc.Set("Sheet1!P1", `=FILTER(A1:A4, B1:B4>5, "none")`).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!P1", "none").
+		// sources are followed: editing a key re-sorts the spilled result
+		Set("Sheet1!B4", 5.0).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!D1", "apple").
+		End()
+}
+
+func TestLetAndLambda(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "LET and LAMBDA").
+		Set("Sheet1!A1", 1.0).Set("Sheet1!B1", 10.0).
+		Set("Sheet1!A2", 2.0).Set("Sheet1!B2", 20.0).
+		Set("Sheet1!A3", 3.0).Set("Sheet1!B3", 30.0)
+	s := tc.spreadsheet
+	if err := s.DefineNamedFormula("TaxCalc", "=LAMBDA(price, price*0.5)"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!D1", "=LET(x, A1, y, x+B1, x*y)").
+		Set("Sheet1!D2", "=LET(x, 1, LET(x, x+10, x)+x)").
+		Set("Sheet1!D3", "=LET(f, LAMBDA(a, b, a*b+A1), f(2, 3))").
+		Set("Sheet1!D4", "=TAXCALC(B2)+taxcalc(2)").
+		Set("Sheet1!D5", "=REDUCE(0, A1:B3, LAMBDA(acc, v, acc+v))").
+		Set("Sheet1!D6", "=LAMBDA(x, x)").
+		Set("Sheet1!D7", "=LET(f, LAMBDA(x, x), f(1, 2))").
+		Set("Sheet1!D8", "=NOSUCHFUNCTION(1)").
+		Set("Sheet1!F1", "=MAP(A1:A3, B1:B3, LAMBDA(a, b, a+b))").
+		Set("Sheet1!G1", "=SCAN(0, A1:A3, LAMBDA(acc, v, acc+v))").
+		Set("Sheet1!H1", "=BYROW(A1:B3, LAMBDA(row, SUM(row)))").
+		Set("Sheet1!I1", "=BYCOL(A1:B3, LAMBDA(col, MAX(col)))").
+		Set("Sheet1!I2", "=MAKEARRAY(2, 2, LAMBDA(r, c, r*10+c))").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!D1", 11.0).
+		AssertCellEq("Sheet1!D2", 12.0).
+		AssertCellEq("Sheet1!D3", 7.0).
+		AssertCellEq("Sheet1!D4", 11.0).
+		AssertCellEq("Sheet1!D5", 66.0).
+		AssertCellErr("Sheet1!D6", ErrorCodeCalc).
+		AssertCellErr("Sheet1!D7", ErrorCodeValue).
+		AssertCellErr("Sheet1!D8", ErrorCodeName).
+		AssertCellEq("Sheet1!F1", 11.0).
+		AssertCellEq("Sheet1!F2", 22.0).
+		AssertCellEq("Sheet1!F3", 33.0).
+		AssertCellEq("Sheet1!G1", 1.0).
+		AssertCellEq("Sheet1!G2", 3.0).
+		AssertCellEq("Sheet1!G3", 6.0).
+		AssertCellEq("Sheet1!H1", 11.0).
+		AssertCellEq("Sheet1!H2", 22.0).
+		AssertCellEq("Sheet1!H3", 33.0).
+		AssertCellEq("Sheet1!I1", 3.0).
+		AssertCellEq("Sheet1!J1", 30.0).
+		AssertCellEq("Sheet1!I2", 11.0).
+		AssertCellEq("Sheet1!J2", 12.0).
+		AssertCellEq("Sheet1!I3", 21.0).
+		AssertCellEq("Sheet1!J3", 22.0)
+
+	// neither LET names nor unknown functions are tracked as names
+	if referenced := s.ListReferencedNamedRanges(); len(referenced) != 0 {
+		t.Errorf("ListReferencedNamedRanges = %v, want []", referenced)
+	}
+	tc.Set("Sheet1!D11", "=INDEXX(1)").
+		RunAndAssertNoError().
+		AssertCellFn("Sheet1!D11", func(value Primitive, t *testing.T) {
+			if err, ok := value.(*SpreadsheetError); !ok || err.Message != "Unknown function: INDEXX" {
+				t.Errorf("D11 = %v, want Unknown function: INDEXX", value)
+			}
+		})
+	if referenced := s.ListReferencedNamedRanges(); len(referenced) != 0 {
+		t.Errorf("ListReferencedNamedRanges = %v, want []", referenced)
+	}
+
+	// defining an unknown function later recalculates its callers
+	if err := s.DefineNamedFormula("NoSuchFunction", "=LAMBDA(x, x*3)"); err != nil {
+		t.Fatal(err)
+	}
+	tc.RunAndAssertNoError().
+		AssertCellEq("Sheet1!D8", 3.0)
+
+	// redefining a named LAMBDA recalculates its callers
+	if err := s.DefineNamedFormula("TaxCalc", "=LAMBDA(price, price*2)"); err != nil {
+		t.Fatal(err)
+	}
+	tc.RunAndAssertNoError().
+		AssertCellEq("Sheet1!D4", 44.0)
+
+	// recursion is bounded by the call depth limit
+	if err := s.DefineNamedFormula("Forever", "=LAMBDA(n, FOREVER(n+1))"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!D9", "=FOREVER(1)").
+		RunAndAssertNoError().
+		AssertCellErr("Sheet1!D9", ErrorCodeNum)
+
+	if err := s.DefineNamedFormula("Bad", "LAMBDA(x, x)"); err == nil {
+		t.Errorf("DefineNamedFormula accepted a formula without '='")
+	}
+	tc.RenameNamedRange("TaxCalc", "Tax").
+		Set("Sheet1!D10", "=TAX(4)").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!D10", 8.0).
+		End()
+}
+
+func TestNamedConstantsAndFormulas(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Named constants and formulas").
+		AddWorksheet("Sheet2").
+		Set("Sheet1!A1", 100.0).
+		Set("Sheet1!A2", 200.0).
+		Set("Sheet1!A3", 300.0).
+		Set("Sheet2!C2", 5.0)
+	s := tc.spreadsheet
+	if err := s.DefineNamedConstant("TaxRate", 0.25); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineNamedConstant("Label", "net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineNamedFormula("Total", "=SUM(Sheet1!A1:A2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineNamedRange("Prices", "Sheet1!A1:A3"); err != nil {
+		t.Fatal(err)
+	}
+	// the reference is relative to Sheet2!C3, wherever the name is used
+	if err := s.DefineNamedFormulaAt("Above", "=C2", "Sheet2!C3"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!B1", "=A1*TaxRate").
+		Set("Sheet1!B2", "=Label&\" \"&Total").
+		Set("Sheet1!B3", "=SUM(Prices)").
+		Set("Sheet1!B4", "=Above*2").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!B1", 25.0).
+		AssertCellEq("Sheet1!B2", "net 300").
+		AssertCellEq("Sheet1!B3", 600.0).
+		AssertCellEq("Sheet1!B4", 10.0).
+		// cells read through names recalculate their users
+		Set("Sheet1!A2", 50.0).
+		Set("Sheet1!A3", 0.0).
+		Set("Sheet2!C2", 7.0).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!B2", "net 150").
+		AssertCellEq("Sheet1!B3", 150.0).
+		AssertCellEq("Sheet1!B4", 14.0)
+
+	// redefining a constant recalculates its users
+	if err := s.DefineNamedConstant("TaxRate", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	tc.RunAndAssertNoError().
+		AssertCellEq("Sheet1!B1", 50.0)
+
+	// names defined in terms of each other fail instead of recursing forever
+	if err := s.DefineNamedFormula("Ping", "=Pong+1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineNamedFormula("Pong", "=Ping+1"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!C1", "=Ping").
+		RunAndAssertNoError().
+		AssertCellErr("Sheet1!C1", ErrorCodeNum)
+
+	if err := s.DefineNamedConstant("Bad", []int{1}); err == nil {
+		t.Errorf("DefineNamedConstant accepted a slice")
+	}
+	if err := s.DefineNamedFormulaAt("Bad", "=A1", "NoSuchSheet!A1"); err == nil {
+		t.Errorf("DefineNamedFormulaAt accepted an unknown worksheet")
+	}
+}
+
+func TestWorksheetScopedNames(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Worksheet scoped names").
+		AddWorksheet("Sheet2").
+		Set("Sheet1!A1", 1.0).
+		Set("Sheet1!A2", 2.0).
+		Set("Sheet2!A1", 10.0).
+		Set("Sheet2!A2", 20.0)
+	s := tc.spreadsheet
+	if err := s.DefineNamedConstant("Total", 100.0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineNamedRange("Sheet2!Total", "Sheet2!A1:A2"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!B1", "=SUM(Total)").
+		Set("Sheet2!B1", "=SUM(Total)").
+		Set("Sheet1!B2", "=SUM(Sheet2!Total)").
+		Set("Sheet1!B3", "=SUM(Sheet1!Total)").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!B1", 100.0).
+		AssertCellEq("Sheet2!B1", 30.0).
+		AssertCellEq("Sheet1!B2", 30.0).
+		AssertCellErr("Sheet1!B3", ErrorCodeName) // undefined local name
+
+	// a local name defined later hides the workbook name on its worksheet
+	if err := s.DefineNamedRange("Sheet1!Total", "Sheet1!A1:A2"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!A2", 5.0).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!B1", 6.0).
+		AssertCellEq("Sheet1!B3", 6.0).
+		AssertCellEq("Sheet2!B1", 30.0)
+
+	names := s.ListNamedRanges()
+	sort.Strings(names)
+	if want := []string{"Sheet1!Total", "Sheet2!Total", "Total"}; !slices.Equal(names, want) {
+		t.Errorf("ListNamedRanges = %v, want %v", names, want)
+	}
+	local, err := s.ListWorksheetNamedRanges("Sheet2")
+	if err != nil || !slices.Equal(local, []string{"Total"}) {
+		t.Errorf("ListWorksheetNamedRanges = %v, %v, want [Total]", local, err)
+	}
+
+	// renaming keeps the scope, uses of the old name no longer find it
+	tc.RenameNamedRange("Sheet2!Total", "Sum").
+		AssertNamedRangeExists("Sheet2!Sum", true).
+		AssertNamedRangeExists("Sum", false).
+		RenameNamedRange("Sheet1!Total", "Sheet2!Total").
+		ExpectAppError(InvalidArgument).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet2!B1", 100.0)
+
+	// copies of a worksheet get their own copy of its local names
+	if err := s.CopyWorksheet("Sheet1", "Sheet3"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet3!A1", 7.0).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet3!B1", 12.0).
+		AssertCellEq("Sheet1!B1", 6.0).
+		RemoveWorksheet("Sheet3").
+		// local names go with their worksheet
+		RemoveWorksheet("Sheet2").
+		AssertWorksheetExists("Sheet2", false)
+
+	names = s.ListNamedRanges()
+	sort.Strings(names)
+	if want := []string{"Sheet1!Total", "Total"}; !slices.Equal(names, want) {
+		t.Errorf("after RemoveWorksheet ListNamedRanges = %v, want %v", names, want)
+	}
+	if err := s.DefineNamedRange("NoSuchSheet!Total", "Sheet1!A1"); err == nil {
+		t.Errorf("DefineNamedRange accepted a name local to an unknown worksheet")
+	}
+
+	// names match ignoring case, in calls and references alike, and a name
+	// can't be defined again with another spelling in the same scope
+	for _, definition := range []struct{ name, formula string }{
+		{"Double", "=LAMBDA(x, x*2)"},
+		{"Sheet1!dOUBLE", "=LAMBDA(x, x*4)"},
+		{"Rate", "=0.5"},
+	} {
+		if err := s.DefineNamedFormula(definition.name, definition.formula); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DefineNamedFormula("double", "=LAMBDA(x, x*3)"); err == nil {
+		t.Errorf("DefineNamedFormula defined double next to Double")
+	} else if appErr, ok := err.(*AppError); !ok || appErr.Code != AlreadyExists {
+		t.Errorf("DefineNamedFormula(double) = %v, want AlreadyExists", err)
+	}
+	tc.AddWorksheet("Sheet2").
+		Set("Sheet1!C1", "=DOUBLE(1)").
+		Set("Sheet2!C1", "=DOUBLE(1)").
+		Set("Sheet2!C2", "=10*rate").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!C1", 4.0).
+		AssertCellEq("Sheet2!C1", 2.0).
+		AssertCellEq("Sheet2!C2", 5.0).
+		AddNamedRange("RATE").
+		ExpectAppError(AlreadyExists).
+		// only the spelling of the name itself may change by case
+		RenameNamedRange("Rate", "RATE").
+		RenameNamedRange("Double", "rate").
+		ExpectAppError(AlreadyExists).
+		RemoveNamedRange("double").
+		RunAndAssertNoError().
+		AssertCellErr("Sheet2!C1", ErrorCodeName).
+		AssertCellEq("Sheet2!C2", 5.0).
+		AssertNamedRangeExists("rate", true).
+		End()
+	if names := s.ListNamedRanges(); !slices.Contains(names, "RATE") || slices.Contains(names, "Rate") {
+		t.Errorf("after the rename ListNamedRanges = %v, want RATE", names)
+	}
+}
+
+func TestTables(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Tables").
+		Set("Sheet1!A1", "Qty").Set("Sheet1!B1", "Price").Set("Sheet1!C1", "Amount").
+		Set("Sheet1!A2", 2.0).Set("Sheet1!B2", 5.0).
+		Set("Sheet1!A3", 3.0).Set("Sheet1!B3", 4.0).
+		Set("Sheet1!A4", "Total")
+	s := tc.spreadsheet
+	if err := s.AddTable("Sales", "Sheet1!A1:C4", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTable("Orders", "Sheet1!C3:D6", false); err == nil {
+		t.Error("overlapping table was added")
+	}
+	tc.Set("Sheet1!C2", "=[@Qty]*[@Price]").
+		Set("Sheet1!C3", "=[@Qty]*[@Price]").
+		Set("Sheet1!C4", "=SUM([Amount])").
+		Set("Sheet1!E1", "=SUM(Sales[Amount])").
+		Set("Sheet1!E2", "=COUNTA(Sales[#All])").
+		Set("Sheet1!E3", "=SUM(Sales[[#Totals],[Amount]])").
+		Set("Sheet1!E4", "=COUNTA(Sales[[#Headers],[Qty]:[Price]])").
+		Set("Sheet1!E5", "=[@Qty]").
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!C2", 10.0).
+		AssertCellEq("Sheet1!C3", 12.0).
+		AssertCellEq("Sheet1!C4", 22.0).
+		AssertCellEq("Sheet1!E1", 22.0).
+		AssertCellEq("Sheet1!E2", 11.0).
+		AssertCellEq("Sheet1!E3", 22.0).
+		AssertCellEq("Sheet1!E4", 2.0).
+		AssertCellErr("Sheet1!E5", ErrorCodeRef) // this row outside a table
+
+	// appending moves the totals row down and fills the calculated column
+	if err := s.AppendTableRow("Sales", 4.0, 10.0); err != nil {
+		t.Fatal(err)
+	}
+	tc.RunAndAssertNoError().
+		AssertCellEq("Sheet1!C4", 40.0).
+		AssertCellEq("Sheet1!A5", "Total").
+		AssertCellEq("Sheet1!C5", 62.0).
+		AssertCellEq("Sheet1!E1", 62.0).
+		AssertCellEq("Sheet1!E2", 14.0).
+		AssertCellEq("Sheet1!E3", 62.0)
+
+	// renamed columns keep their references
+	if err := s.RenameTableColumn("Sales", "price", "Unit Price"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("Sheet1!A2", 3.0).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!E1", 67.0)
+
+	explanation, err := s.ExplainFormula("Sheet1!C2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "=[@Qty]*[@[Unit Price]]"; explanation.Formula != want {
+		t.Errorf("formula after rename = %q, want %q", explanation.Formula, want)
+	}
+	if table, _ := s.GetTable("sales"); !slices.Equal(table.Columns, []string{"Qty", "Unit Price", "Amount"}) {
+		t.Errorf("columns = %v", table.Columns)
+	}
+
+	// references to a removed table are #REF!
+	if err := s.RemoveTable("Sales"); err != nil {
+		t.Fatal(err)
+	}
+	tc.RunAndAssertNoError().
+		AssertCellErr("Sheet1!E1", ErrorCodeRef)
+	if tables := s.ListTables(); len(tables) != 0 {
+		t.Errorf("ListTables = %v, want none", tables)
+	}
+
+	// buildSales sets up a table with a calculated column and a formula
+	// summing it from outside the table
+	buildSales := func(t *testing.T) *SpreadsheetTestCase {
+		tc := NewSpreadsheetTestCase(t, t.Name()).
+			Set("Sheet1!A1", "Qty").Set("Sheet1!B1", "Price").Set("Sheet1!C1", "Amount").
+			Set("Sheet1!A2", 2.0).Set("Sheet1!B2", 5.0)
+		if err := tc.spreadsheet.AddTable("Sales", "Sheet1!A1:C2", false); err != nil {
+			t.Fatal(err)
+		}
+		return tc.Set("Sheet1!C2", "=[@Qty]*[@Price]").
+			Set("Sheet1!E1", "=SUM(Sales[Amount])").
+			RunAndAssertNoError()
+	}
+
+	t.Run("CopiedWorksheet", func(t *testing.T) {
+		// the copy gets its own table, and its formulas refer to it
+		tc := buildSales(t)
+		s := tc.spreadsheet
+		if err := s.CopyWorksheet("Sheet1", "Copy"); err != nil {
+			t.Fatal(err)
+		}
+		tc.Set("Copy!A2", 4.0).
+			RunAndAssertNoError().
+			AssertCellEq("Copy!C2", 20.0).
+			AssertCellEq("Copy!E1", 20.0).
+			AssertCellEq("Sheet1!E1", 10.0)
+
+		if tables := s.ListTables(); !slices.Equal(tables, []string{"Sales", "Sales2"}) {
+			t.Errorf("ListTables = %v, want [Sales Sales2]", tables)
+		}
+		explanation, err := s.ExplainFormula("Copy!E1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "=SUM(Sales2[Amount])"; explanation.Formula != want {
+			t.Errorf("formula of the copy = %q, want %q", explanation.Formula, want)
+		}
+
+		if err := s.CopyWorksheet("Copy", "Copy2"); err != nil {
+			t.Fatal(err)
+		}
+		if tables := s.ListTables(); !slices.Equal(tables, []string{"Sales", "Sales2", "Sales3"}) {
+			t.Errorf("ListTables = %v, want [Sales Sales2 Sales3]", tables)
+		}
+	})
+
+	t.Run("MovedTable", func(t *testing.T) {
+		// a table within the moved block moves with its cells
+		tc := buildSales(t)
+		s := tc.spreadsheet
+		if err := s.MoveRange("Sheet1!A1:C2", "Sheet1!A11"); err != nil {
+			t.Fatal(err)
+		}
+		tc.Set("Sheet1!A12", 3.0).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet1!C12", 15.0).
+			AssertCellEq("Sheet1!E1", 15.0)
+		if table, _ := s.GetTable("Sales"); table.Range.StartRow != 10 || table.Range.EndRow != 11 {
+			t.Errorf("range = %+v, want rows 11 to 12", table.Range)
+		}
+
+		tc.AddWorksheet("Sheet2")
+		if err := s.MoveRange("Sheet1!A11:C12", "Sheet2!B2"); err != nil {
+			t.Fatal(err)
+		}
+		tc.Set("Sheet2!B3", 4.0).
+			RunAndAssertNoError().
+			AssertCellEq("Sheet2!D3", 20.0).
+			AssertCellEq("Sheet1!E1", 20.0)
+
+		// but can't land on another table
+		tc.Set("Sheet1!G1", "Name")
+		if err := s.AddTable("Orders", "Sheet1!G1:G3", false); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.MoveRange("Sheet2!B2:D3", "Sheet1!F2"); err == nil {
+			t.Error("table was moved onto another table")
+		}
+		tc.RunAndAssertNoError().
+			AssertCellEq("Sheet2!D3", 20.0)
+	})
+}
+
+func TestInformationFunctions(t *testing.T) {
+	tc := NewSpreadsheetTestCase(t, "Information functions").
+		Set("Sheet1!A1", 10.0).
+		Set("Sheet1!A2", 0.0).
+		Set("Sheet1!A3", "text").
+		Set("Sheet1!A4", true).
+		Set("Sheet1!A5", "=A1/A2").
+		Set("Sheet1!A6", "=NA()").
+		Set("Sheet1!A8", "=A8+1")
+	formulas := []struct {
+		formula string
+		want    Primitive
+	}{
+		{"=IFERROR(A1/A2, -1)", -1.0},
+		{"=IFERROR(A1*2, -1)", 20.0},
+		{"=IFNA(A6, \"missing\")", "missing"},
+		{"=IFNA(A5, 0)", ErrorCodeDiv0},
+		{"=ISERR(A5)", true},
+		{"=ISERR(A6)", false},
+		{"=ISERROR(A6)", true},
+		{"=ISNA(A6)", true},
+		{"=ISBLANK(A7)", true},
+		{"=ISBLANK(A2)", false},
+		{"=ISNUMBER(A1)", true},
+		{"=ISNUMBER(\"10\")", false},
+		{"=ISTEXT(A3)", true},
+		{"=ISLOGICAL(A4)", true},
+		{"=ISFORMULA(A5)", true},
+		{"=ISFORMULA(A1)", false},
+		{"=ISREF(A1)", true},
+		{"=ISREF(10)", false},
+		{"=ERROR.TYPE(A5)", 2.0},
+		{"=ERROR.TYPE(A6)", 7.0},
+		{"=ERROR.TYPE(A1)", ErrorCodeNA},
+		{"=ERROR.TYPE(A8)", 16.0},
+		{"=TYPE(A3)", 2.0},
+		{"=TYPE(A5)", 16.0},
+		{"=TYPE(A1:A2)", 64.0},
+		{"=N(A4)+N(A3)+N(A1)", 11.0},
+		{"=SUM(IFERROR(A1/A1:A2, 0))", 1.0},
+		{"=SUM(N(ISNUMBER(A1:A4)))", 1.0},
+		{"=IF(ISERROR(A5), \"bad\", A5)", "bad"},
+	}
+	for i, f := range formulas {
+		tc.Set(fmt.Sprintf("Sheet1!C%d", i+1), f.formula)
+	}
+	tc.RunAndAssertNoError()
+	for i, f := range formulas {
+		tc.AssertCellEq(fmt.Sprintf("Sheet1!C%d", i+1), f.want)
+	}
+
+	// IF and IFERROR only evaluate the branch they return
+	calls := 0
+	counted := func(value Primitive) compiledFormula {
+		return func(*EvalContext) (Primitive, error) {
+			calls++
+			return value, nil
+		}
+	}
+	ifNode := &FunctionCallNode{Name: "IF", Args: make([]ASTNode, 3)}
+	result, _ := specialForm(ifNode, []compiledFormula{counted(true), counted(1.0), counted(2.0)})(nil)
+	if result != 1.0 || calls != 2 {
+		t.Errorf("IF = %v after %d evaluations, want 1 after 2", result, calls)
+	}
+	calls = 0
+	ifErrorNode := &FunctionCallNode{Name: "IFERROR", Args: make([]ASTNode, 2)}
+	result, _ = specialForm(ifErrorNode, []compiledFormula{counted(3.0), counted(0.0)})(nil)
+	if result != 3.0 || calls != 1 {
+		t.Errorf("IFERROR = %v after %d evaluations, want 3 after 1", result, calls)
+	}
+
+	// an array condition selects element by element, evaluating each branch
+	// once, and the result spills
+	tc.Set("Sheet1!E30", "=IF({TRUE,FALSE},1,2)").
+		Set("Sheet1!G30", 1.0).Set("Sheet1!G31", 2.0).Set("Sheet1!G32", 1.0).
+		Set("Sheet1!H30", `=IF(G30:G32=1,"y","n")`).
+		Set("Sheet1!I30", "=SUM(IF(G30:G32<>5,1,0))").
+		Set("Sheet1!J30", "=IF(G30:G32=1,G30:G32*10)").
+		Set("Sheet1!K30", `=IF({TRUE;FALSE},{"a","b"},"c")`).
+		RunAndAssertNoError().
+		AssertCellEq("Sheet1!E30", 1.0).
+		AssertCellEq("Sheet1!F30", 2.0).
+		AssertCellEq("Sheet1!H30", "y").
+		AssertCellEq("Sheet1!H31", "n").
+		AssertCellEq("Sheet1!H32", "y").
+		AssertCellEq("Sheet1!I30", 3.0).
+		AssertCellEq("Sheet1!J30", 10.0).
+		AssertCellEq("Sheet1!J31", false).
+		AssertCellEq("Sheet1!J32", 10.0).
+		AssertCellEq("Sheet1!K30", "a").
+		AssertCellEq("Sheet1!L30", "b").
+		AssertCellEq("Sheet1!K31", "c").
+		AssertCellEq("Sheet1!L31", "c")
+
+	calls = 0
+	condition := &ArrayValue{rows: 1, cols: 3, values: []Primitive{true, false, true}}
+	ctx := NewEvalContext(tc.spreadsheet, CellAddress{})
+	result, _ = specialForm(ifNode, []compiledFormula{counted(condition), counted(1.0), counted(2.0)})(ctx)
+	if array, ok := result.(*ArrayValue); !ok || !slices.Equal(array.values, []Primitive{1.0, 2.0, 1.0}) || calls != 3 {
+		t.Errorf("IF = %v after %d evaluations, want {1,2,1} after 3", result, calls)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+)
+
+// spill is the area covered by the array result of a formula cell, its
+// anchor
+type spill struct {
+	area    RangeAddress // the anchor and the cells below and right of it
+	blocked bool         // whether occupied cells kept the array from spilling
+}
+
+// SpillTable tracks the arrays spilled by formula cells. spilled values are
+// stored in the worksheet like plain values, the table records which cells
+// hold them so they can be cleared or overwritten later.
+type SpillTable struct {
+	anchors map[CellAddress]spill       // formula cell -> area of its array
+	cells   map[CellAddress]CellAddress // cell holding a spilled value -> anchor
+}
+
+// NewSpillTable creates an empty spill table
+func NewSpillTable() *SpillTable {
+	return &SpillTable{
+		anchors: make(map[CellAddress]spill),
+		cells:   make(map[CellAddress]CellAddress),
+	}
+}
+
+// GetAnchor returns the formula cell whose array spilled into a cell
+func (st *SpillTable) GetAnchor(addr CellAddress) (CellAddress, bool) {
+	anchor, exists := st.cells[addr]
+	return anchor, exists
+}
+
+// IsAnchor reports whether a formula cell spills, or tried to and was
+// blocked
+func (st *SpillTable) IsAnchor(addr CellAddress) bool {
+	_, exists := st.anchors[addr]
+	return exists
+}
+
+// GetSpillRange returns the area covered by the array of a formula cell, the
+// anchor included. ok is false when the cell doesn't spill or is blocked.
+func (st *SpillTable) GetSpillRange(addr CellAddress) (RangeAddress, bool) {
+	s, exists := st.anchors[addr]
+	if !exists || s.blocked {
+		return RangeAddress{}, false
+	}
+	return s.area, true
+}
+
+// removeWorksheet forgets the spills of a removed worksheet
+func (st *SpillTable) removeWorksheet(worksheetID uint32) {
+	for anchor := range st.anchors {
+		if anchor.WorksheetID == worksheetID {
+			delete(st.anchors, anchor)
+		}
+	}
+	for addr := range st.cells {
+		if addr.WorksheetID == worksheetID {
+			delete(st.cells, addr)
+		}
+	}
+}
+
+// Clear removes all spills from the table
+func (st *SpillTable) Clear() {
+	st.anchors = make(map[CellAddress]spill)
+	st.cells = make(map[CellAddress]CellAddress)
+}
+
+// GetSpillRange returns the range an array formula at a cell, like
+// "Sheet1!A1", spills into, e.g. "Sheet1!A1:A3". it is empty when the cell
+// doesn't spill, because its result isn't an array or is #SPILL!.
+func (s *Spreadsheet) GetSpillRange(address string) (string, error) {
+	worksheetID, row, col, err := s.resolveAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	area, ok := s.spills.GetSpillRange(CellAddress{WorksheetID: worksheetID, Row: row, Column: col})
+	if !ok {
+		return "", nil
+	}
+	return s.formatRangeAddress(area), nil
+}
+
+// spillResult returns the value to store in a formula cell for its result.
+// an array spills into the cells below and right of the cell, which keeps
+// the top-left value, and becomes #SPILL! when any of those cells is
+// occupied or off the worksheet. a previous spill of the cell that the new
+// result no longer covers is cleared.
+func (s *Spreadsheet) spillResult(worksheet *Worksheet, anchor CellAddress, result Primitive) Primitive {
+	array, isArray := result.(*ArrayValue)
+	if !isArray {
+		if s.spills.IsAnchor(anchor) {
+			s.clearSpill(worksheet, anchor)
+		}
+		return result
+	}
+
+	if uint64(anchor.Row)+uint64(array.rows) > uint64(MaxRows) ||
+		uint64(anchor.Column)+uint64(array.cols) > uint64(MaxColumns) {
+		s.clearSpill(worksheet, anchor)
+		return NewSpreadsheetError(ErrorCodeSpill, "Spill range extends past the worksheet")
+	}
+	area := RangeAddress{
+		WorksheetID: anchor.WorksheetID,
+		StartRow:    anchor.Row,
+		StartColumn: anchor.Column,
+		EndRow:      anchor.Row + uint32(array.rows) - 1,
+		EndColumn:   anchor.Column + uint32(array.cols) - 1,
+	}
+
+	// every cell of the area must be blank or hold a value of this spill
+	var blocker CellAddress
+	blocked := false
+	owned := 0
+	worksheet.occupiedCells(area.StartRow, area.StartColumn, area.EndRow, area.EndColumn, func(row, col uint32) bool {
+		addr := CellAddress{WorksheetID: anchor.WorksheetID, Row: row, Column: col}
+		if addr == anchor {
+			return true
+		}
+		if owner, spilled := s.spills.GetAnchor(addr); spilled && owner == anchor {
+			owned++
+			return true
+		}
+		blocker, blocked = addr, true
+		return false
+	})
+	if blocked {
+		s.clearSpill(worksheet, anchor)
+		s.spills.anchors[anchor] = spill{area: area, blocked: true}
+		return NewSpreadsheetError(ErrorCodeSpill,
+			fmt.Sprintf("Spill range isn't blank, %s is occupied", s.formatCellAddress(blocker)))
+	}
+
+	if added := array.Size() - 1 - owned; s.limits.MaxTotalCells > 0 && s.cellCount()+added > s.limits.MaxTotalCells {
+		s.clearSpill(worksheet, anchor)
+		return NewSpreadsheetError(ErrorCodeSpill,
+			fmt.Sprintf("Spill range exceeds the workbook cell limit of %d", s.limits.MaxTotalCells))
+	}
+
+	// clear the cells of the previous spill that the new one doesn't cover
+	if previous, exists := s.spills.anchors[anchor]; exists && !previous.blocked {
+		s.forEachSpilledCell(anchor, previous.area, func(addr CellAddress) {
+			if !area.Contains(addr.WorksheetID, addr.Row, addr.Column) {
+				s.removeSpilledCell(worksheet, anchor, addr)
+			}
+		})
+	}
+
+	for row := range array.rows {
+		for col := range array.cols {
+			if row == 0 && col == 0 {
+				continue
+			}
+			addr := CellAddress{
+				WorksheetID: anchor.WorksheetID,
+				Row:         anchor.Row + uint32(row),
+				Column:      anchor.Column + uint32(col),
+			}
+			s.writeSpilledCell(worksheet, anchor, addr, spilledValue(s.limits, array.At(row, col)))
+		}
+	}
+	s.spills.anchors[anchor] = spill{area: area}
+
+	return spilledValue(s.limits, array.At(0, 0))
+}
+
+// spilledValue returns the value stored for an element of a spilled array.
+// empty elements show as 0, like empty formula results.
+func spilledValue(limits Limits, value Primitive) Primitive {
+	if value == nil {
+		return 0.0
+	}
+	return limits.checkStringResult(value)
+}
+
+// clearSpill removes the spilled values of a formula cell and forgets its
+// spill
+func (s *Spreadsheet) clearSpill(worksheet *Worksheet, anchor CellAddress) {
+	previous, exists := s.spills.anchors[anchor]
+	if !exists {
+		return
+	}
+	delete(s.spills.anchors, anchor)
+	if previous.blocked {
+		return
+	}
+
+	s.forEachSpilledCell(anchor, previous.area, func(addr CellAddress) {
+		s.removeSpilledCell(worksheet, anchor, addr)
+	})
+}
+
+// forEachSpilledCell calls fn for every cell of an area that holds a value
+// spilled by the anchor. the cells are collected first, so fn may remove
+// them.
+func (s *Spreadsheet) forEachSpilledCell(anchor CellAddress, area RangeAddress, fn func(addr CellAddress)) {
+	var cells []CellAddress
+	for row := area.StartRow; row <= area.EndRow; row++ {
+		for col := area.StartColumn; col <= area.EndColumn; col++ {
+			addr := CellAddress{WorksheetID: area.WorksheetID, Row: row, Column: col}
+			if owner, spilled := s.spills.GetAnchor(addr); spilled && owner == anchor {
+				cells = append(cells, addr)
+			}
+		}
+	}
+	for _, addr := range cells {
+		fn(addr)
+	}
+}
+
+// writeSpilledCell stores a spilled value in a cell and marks the cells
+// reading it dirty when it changed
+func (s *Spreadsheet) writeSpilledCell(worksheet *Worksheet, anchor, addr CellAddress, value Primitive) {
+	s.spills.cells[addr] = anchor
+
+	previous := worksheet.GetValue(addr.Row, addr.Column)
+	if previous != nil && valuesEqual(previous, value) {
+		return
+	}
+	worksheet.SetCell(addr.Row, addr.Column, value, "")
+	s.recordChange(addr, previous)
+	s.markSpilledCellReadersDirty(anchor, addr)
+}
+
+// removeSpilledCell clears a cell holding a spilled value and marks the
+// cells reading it dirty
+func (s *Spreadsheet) removeSpilledCell(worksheet *Worksheet, anchor, addr CellAddress) {
+	delete(s.spills.cells, addr)
+
+	previous := worksheet.GetValue(addr.Row, addr.Column)
+	worksheet.RemoveCell(addr.Row, addr.Column)
+	s.recordChange(addr, previous)
+	s.markSpilledCellReadersDirty(anchor, addr)
+}
+
+// markSpilledCellReadersDirty marks the formulas reading a spilled cell
+// dirty. spilled cells aren't in the dependency graph as dependents of their
+// anchor, so readers may have been calculated before the anchor in this
+// pass; they are reopened to be calculated again.
+func (s *Spreadsheet) markSpilledCellReadersDirty(anchor, addr CellAddress) {
+	dg := s.storage.dependencyGraph
+	for _, readers := range [][]CellAddress{dg.GetDirectDependents(addr), dg.GetRangeDependents(addr)} {
+		for _, reader := range readers {
+			if reader == anchor {
+				continue
+			}
+			dg.MarkDirty(reader)
+			s.calculationStack.reopen(reader)
+		}
+	}
+}
+
+// spilledWithin reports whether a cell holds a value spilled by a formula
+// within the range. such values are left behind by copies and moves of the
+// range, the formula spills them again at its new place.
+func (s *Spreadsheet) spilledWithin(addr CellAddress, r RangeAddress) bool {
+	anchor, spilled := s.spills.GetAnchor(addr)
+	return spilled && r.Contains(anchor.WorksheetID, anchor.Row, anchor.Column)
+}
+
+// spillCellEdited updates the spills around a cell about to be edited. an
+// edited anchor drops its spill, and an edit within the area of a spill,
+// over a spilled value or over a blocking cell, makes the anchor spill again.
+func (s *Spreadsheet) spillCellEdited(worksheet *Worksheet, cellAddr CellAddress) {
+	if s.spills.IsAnchor(cellAddr) {
+		s.clearSpill(worksheet, cellAddr)
+	}
+
+	// the edit replaces a spilled value
+	delete(s.spills.cells, cellAddr)
+
+	for anchor, sp := range s.spills.anchors {
+		if anchor != cellAddr && sp.area.Contains(cellAddr.WorksheetID, cellAddr.Row, cellAddr.Column) {
+			s.storage.dependencyGraph.MarkDirty(anchor)
+		}
+	}
+}
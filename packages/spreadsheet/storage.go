@@ -4,6 +4,7 @@ package main
 type Storage struct {
 	worksheets      *WorksheetTable
 	namedRanges     *NamedRangeTable
+	tables          *TableRegistry
 	strings         *StringTable
 	formulas        *FormulaTable
 	dependencyGraph *DependencyGraph
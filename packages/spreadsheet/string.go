@@ -1,12 +1,16 @@
 package main
 
+import "sync"
+
 // StringTable provides string interning for efficient string storage with
-// reference counting
+// reference counting. it is safe for concurrent use, since formula results
+// are interned from calculation workers.
 type StringTable struct {
 	strings    map[string]uint32
 	reverseMap map[uint32]string
 	refCounts  map[uint32]int // reference count for each string ID
 	nextID     uint32
+	mu         sync.RWMutex
 }
 
 // NewStringTable creates a new string table
@@ -22,6 +26,9 @@ func NewStringTable() *StringTable {
 // Intern adds a string to the table or increments its reference count if
 // it already exists. returns the ID of the string.
 func (st *StringTable) Intern(s string) uint32 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
 	// check if string already exists
 	if id, exists := st.strings[s]; exists {
 		st.refCounts[id]++
@@ -40,18 +47,27 @@ func (st *StringTable) Intern(s string) uint32 {
 
 // GetString retrieves a string by its ID
 func (st *StringTable) GetString(id uint32) (string, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
 	s, exists := st.reverseMap[id]
 	return s, exists
 }
 
 // Contains checks if a string exists in the table and returns its ID
 func (st *StringTable) Contains(s string) (uint32, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
 	id, exists := st.strings[s]
 	return id, exists
 }
 
 // AddReference increments the reference count for a string ID
 func (st *StringTable) AddReference(id uint32) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
 	if _, exists := st.reverseMap[id]; !exists {
 		return false
 	}
@@ -63,6 +79,9 @@ func (st *StringTable) AddReference(id uint32) bool {
 // count reaches 0, the string is removed from the table. returns true if
 // the string was removed, false otherwise.
 func (st *StringTable) RemoveReference(id uint32) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
 	s, exists := st.reverseMap[id]
 	if !exists {
 		return false
@@ -82,16 +101,25 @@ func (st *StringTable) RemoveReference(id uint32) bool {
 
 // GetReferenceCount returns the reference count for a string ID
 func (st *StringTable) GetReferenceCount(id uint32) int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
 	return st.refCounts[id]
 }
 
 // Count returns the number of unique strings in the table
 func (st *StringTable) Count() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
 	return len(st.strings)
 }
 
 // TotalReferences returns the total number of references across all strings
 func (st *StringTable) TotalReferences() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
 	total := 0
 	for _, count := range st.refCounts {
 		total += count
@@ -101,6 +129,9 @@ func (st *StringTable) TotalReferences() int {
 
 // Clear removes all strings from the table
 func (st *StringTable) Clear() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
 	st.strings = make(map[string]uint32)
 	st.reverseMap = make(map[uint32]string)
 	st.refCounts = make(map[uint32]int)
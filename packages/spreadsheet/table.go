@@ -0,0 +1,757 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Table is a block of cells organized as a table: a header row holding the
+// names of its columns, one or more data rows and an optional totals row.
+// formulas refer to its parts with structured references like Sales[Amount].
+type Table struct {
+	ID        uint32
+	Name      string
+	Range     RangeAddress // header row, data rows and totals row
+	Columns   []string     // column names, the values of the header row
+	TotalsRow bool         // the last row of Range is a totals row
+}
+
+// dataRows returns the first and last data row of the table
+func (t *Table) dataRows() (uint32, uint32) {
+	last := t.Range.EndRow
+	if t.TotalsRow {
+		last--
+	}
+	return t.Range.StartRow + 1, last
+}
+
+// columnIndex returns the position of a column, matching its name ignoring
+// case, or -1
+func (t *Table) columnIndex(name string) int {
+	for i, column := range t.Columns {
+		if strings.EqualFold(column, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// contains reports whether a cell is inside the table
+func (t *Table) contains(addr CellAddress) bool {
+	return addr.WorksheetID == t.Range.WorksheetID &&
+		addr.Row >= t.Range.StartRow && addr.Row <= t.Range.EndRow &&
+		addr.Column >= t.Range.StartColumn && addr.Column <= t.Range.EndColumn
+}
+
+// TableRegistry manages the tables of a workbook by ID. table names are
+// unique ignoring case, like in Excel.
+type TableRegistry struct {
+	nameToID map[string]uint32 // upper case name -> ID
+	tables   map[uint32]*Table // ID -> table
+	nextID   uint32
+}
+
+// NewTableRegistry creates a new table registry
+func NewTableRegistry() *TableRegistry {
+	return &TableRegistry{
+		nameToID: make(map[string]uint32),
+		tables:   make(map[uint32]*Table),
+		nextID:   1, // start at 1, reserve 0 for the table of the formula cell
+	}
+}
+
+// Add registers a table and returns its ID
+func (tr *TableRegistry) Add(table *Table) uint32 {
+	table.ID = tr.nextID
+	tr.nameToID[strings.ToUpper(table.Name)] = table.ID
+	tr.tables[table.ID] = table
+	tr.nextID++
+	return table.ID
+}
+
+// Remove removes a table
+func (tr *TableRegistry) Remove(id uint32) {
+	if table, exists := tr.tables[id]; exists {
+		delete(tr.nameToID, strings.ToUpper(table.Name))
+		delete(tr.tables, id)
+	}
+}
+
+// Get returns a table by ID
+func (tr *TableRegistry) Get(id uint32) (*Table, bool) {
+	table, exists := tr.tables[id]
+	return table, exists
+}
+
+// GetByName returns a table by name, ignoring case
+func (tr *TableRegistry) GetByName(name string) (*Table, bool) {
+	id, exists := tr.nameToID[strings.ToUpper(name)]
+	if !exists {
+		return nil, false
+	}
+	return tr.tables[id], true
+}
+
+// Count returns the number of tables
+func (tr *TableRegistry) Count() int {
+	return len(tr.tables)
+}
+
+// TableArea selects the rows of a table a structured reference covers
+type TableArea uint8
+
+const (
+	TableData        TableArea = iota // the data rows, the default
+	TableAll                          // every row, [#All]
+	TableHeaders                      // the header row, [#Headers]
+	TableTotals                       // the totals row, [#Totals]
+	TableHeadersData                  // [#Headers],[#Data]
+	TableDataTotals                   // [#Data],[#Totals]
+	TableThisRow                      // the data row of the formula cell, [@Qty]
+)
+
+// tableAreaNames are the item specifiers of structured references
+var tableAreaNames = map[string]TableArea{
+	"#ALL":      TableAll,
+	"#DATA":     TableData,
+	"#HEADERS":  TableHeaders,
+	"#TOTALS":   TableTotals,
+	"#THIS ROW": TableThisRow,
+}
+
+// StructuredRefNode represents a reference into a table, like Sales[Amount],
+// Sales[[#Headers],[Qty]:[Price]] or [@Qty]. columns are kept by position so
+// the reference follows renames.
+type StructuredRefNode struct {
+	TableID     uint32
+	Area        TableArea
+	FirstColumn int // first column of the reference, -1 for all columns
+	LastColumn  int
+	Position    NodePosition
+}
+
+// bounds returns the cells the reference covers when used by the formula of
+// the cell at
+func (n *StructuredRefNode) bounds(table *Table, at CellAddress) (RangeAddress, error) {
+	r := table.Range
+	first, last := table.dataRows()
+
+	switch n.Area {
+	case TableData:
+		r.StartRow, r.EndRow = first, last
+	case TableHeaders:
+		r.EndRow = r.StartRow
+	case TableHeadersData:
+		r.EndRow = last
+	case TableTotals, TableDataTotals:
+		if !table.TotalsRow {
+			return RangeAddress{}, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("Table %s has no totals row", table.Name))
+		}
+		if n.Area == TableTotals {
+			r.StartRow = r.EndRow
+		} else {
+			r.StartRow = first
+		}
+	case TableThisRow:
+		if at.WorksheetID != r.WorksheetID || at.Row < first || at.Row > last {
+			return RangeAddress{}, NewSpreadsheetError(ErrorCodeValue, fmt.Sprintf("Formula isn't in a data row of table %s", table.Name))
+		}
+		r.StartRow, r.EndRow = at.Row, at.Row
+	}
+
+	if n.FirstColumn >= 0 {
+		if n.LastColumn >= len(table.Columns) {
+			return RangeAddress{}, NewSpreadsheetError(ErrorCodeRef, fmt.Sprintf("Column not found in table %s", table.Name))
+		}
+		r.StartColumn = table.Range.StartColumn + uint32(n.FirstColumn)
+		r.EndColumn = table.Range.StartColumn + uint32(n.LastColumn)
+	}
+	return r, nil
+}
+
+func (n *StructuredRefNode) Eval(ctx *EvalContext) (Primitive, error) {
+	table, exists := ctx.spreadsheet.storage.tables.Get(n.TableID)
+	if !exists {
+		return nil, NewSpreadsheetError(ErrorCodeRef, "Table not found")
+	}
+	rangeAddr, err := n.bounds(table, ctx.GetCurrentAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	worksheet, exists := ctx.spreadsheet.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
+	if !exists {
+		return nil, NewSpreadsheetError(ErrorCodeRef, "Worksheet not found for table")
+	}
+
+	// a single cell of the row of the formula is its value, like Excel
+	if n.Area == TableThisRow && rangeAddr.StartColumn == rangeAddr.EndColumn {
+		return worksheet.GetValue(rangeAddr.StartRow, rangeAddr.StartColumn), nil
+	}
+
+	if err := ctx.spreadsheet.limits.checkRangeSize(rangeAddr.StartRow, rangeAddr.StartColumn,
+		rangeAddr.EndRow, rangeAddr.EndColumn); err != nil {
+		return nil, err
+	}
+	return &CellRange{
+		worksheetID: rangeAddr.WorksheetID,
+		startRow:    rangeAddr.StartRow,
+		startCol:    rangeAddr.StartColumn,
+		endRow:      rangeAddr.EndRow,
+		endCol:      rangeAddr.EndColumn,
+		worksheet:   worksheet,
+		storage:     ctx.spreadsheet.storage,
+	}, nil
+}
+
+func (n *StructuredRefNode) GetPosition() NodePosition {
+	return n.Position
+}
+
+func (n *StructuredRefNode) ToString() string {
+	return fmt.Sprintf("TABLE(%d,%d,%d,%d)", n.TableID, n.Area, n.FirstColumn, n.LastColumn)
+}
+
+// parseTableSpecifier parses what is inside the brackets of a structured
+// reference: nothing, an item specifier like #Totals, a column, "@" and a
+// column, or a list of bracketed items like [#Headers],[Qty]:[Price].
+// returns the area and the names of the first and last column, empty for
+// all columns.
+func parseTableSpecifier(content string) (TableArea, string, string, error) {
+	content = strings.TrimSpace(content)
+	area := TableData
+
+	if rest, thisRow := strings.CutPrefix(content, "@"); thisRow {
+		area, content = TableThisRow, strings.TrimSpace(rest)
+		if content == "" {
+			return area, "", "", nil
+		}
+		if !strings.HasPrefix(content, "[") {
+			return area, unescapeColumnName(content), unescapeColumnName(content), nil
+		}
+	}
+
+	if !strings.HasPrefix(content, "[") {
+		if content == "" {
+			return area, "", "", nil
+		}
+		if specified, isArea := tableAreaNames[strings.ToUpper(content)]; isArea {
+			return specified, "", "", nil
+		}
+		return area, unescapeColumnName(content), unescapeColumnName(content), nil
+	}
+
+	items, separators, err := splitBracketedItems(content)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	var specified []TableArea
+	var first, last string
+	for i, item := range items {
+		if i > 0 && separators[i-1] == ':' {
+			if last != first || first == "" {
+				return 0, "", "", fmt.Errorf("invalid column range in [%s]", content)
+			}
+			last = item
+			continue
+		}
+		if specifier, isArea := tableAreaNames[strings.ToUpper(item)]; isArea {
+			specified = append(specified, specifier)
+			continue
+		}
+		if first != "" {
+			return 0, "", "", fmt.Errorf("more than one column in [%s]", content)
+		}
+		first, last = item, item
+	}
+
+	switch {
+	case area == TableThisRow && len(specified) > 0:
+		return 0, "", "", fmt.Errorf("invalid item specifiers in [%s]", content)
+	case len(specified) == 1:
+		area = specified[0]
+	case len(specified) == 2 && specified[0] == TableHeaders && specified[1] == TableData:
+		area = TableHeadersData
+	case len(specified) == 2 && specified[0] == TableData && specified[1] == TableTotals:
+		area = TableDataTotals
+	case len(specified) > 1:
+		return 0, "", "", fmt.Errorf("invalid item specifiers in [%s]", content)
+	}
+	return area, first, last, nil
+}
+
+// splitBracketedItems splits a list like [#Headers],[Qty]:[Price] into its
+// unescaped items and the separators between them
+func splitBracketedItems(content string) ([]string, []rune, error) {
+	var items []string
+	var separators []rune
+	runes := []rune(content)
+
+	for i := 0; i < len(runes); {
+		if runes[i] != charLBracket {
+			return nil, nil, fmt.Errorf("expected [ in [%s]", content)
+		}
+		var item strings.Builder
+		i++
+		for i < len(runes) && runes[i] != charRBracket {
+			if runes[i] == charApostrophe && i+1 < len(runes) {
+				i++
+			}
+			item.WriteRune(runes[i])
+			i++
+		}
+		if i >= len(runes) {
+			return nil, nil, fmt.Errorf("unclosed [ in [%s]", content)
+		}
+		i++ // consume ]
+		items = append(items, strings.TrimSpace(item.String()))
+
+		for i < len(runes) && runes[i] == charSpace {
+			i++
+		}
+		if i < len(runes) {
+			if runes[i] != charComma && runes[i] != charColon {
+				return nil, nil, fmt.Errorf("expected , or : in [%s]", content)
+			}
+			separators = append(separators, runes[i])
+			i++
+			for i < len(runes) && runes[i] == charSpace {
+				i++
+			}
+		}
+	}
+	return items, separators, nil
+}
+
+// unescapeColumnName removes the apostrophes escaping special characters
+// of a column name
+func unescapeColumnName(name string) string {
+	var result strings.Builder
+	runes := []rune(name)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == charApostrophe && i+1 < len(runes) {
+			i++
+		}
+		result.WriteRune(runes[i])
+	}
+	return result.String()
+}
+
+// escapeColumnName escapes the characters of a column name with a meaning
+// in structured references
+func escapeColumnName(name string) string {
+	var result strings.Builder
+	for _, ch := range name {
+		switch ch {
+		case charLBracket, charRBracket, '#', charApostrophe, '@':
+			result.WriteRune(charApostrophe)
+		}
+		result.WriteRune(ch)
+	}
+	return result.String()
+}
+
+// structuredRefText renders a structured reference as written in the cell
+// at origin. references to the table containing origin leave out its name.
+func (s *Spreadsheet) structuredRefText(n *StructuredRefNode, origin CellAddress) string {
+	table, exists := s.storage.tables.Get(n.TableID)
+	if !exists || n.LastColumn >= len(table.Columns) {
+		return "#REF!"
+	}
+
+	name := table.Name
+	if table.contains(origin) {
+		name = ""
+	}
+
+	var columns string
+	if n.FirstColumn >= 0 {
+		columns = "[" + escapeColumnName(table.Columns[n.FirstColumn]) + "]"
+		if n.LastColumn != n.FirstColumn {
+			columns += ":[" + escapeColumnName(table.Columns[n.LastColumn]) + "]"
+		}
+	}
+
+	var specifiers []string
+	switch n.Area {
+	case TableThisRow:
+		// a single column needs no brackets unless its name has special characters
+		if n.FirstColumn >= 0 && n.LastColumn == n.FirstColumn &&
+			!strings.ContainsAny(table.Columns[n.FirstColumn], " []#'@,:") {
+			return name + "[@" + table.Columns[n.FirstColumn] + "]"
+		}
+		return name + "[@" + columns + "]"
+	case TableData:
+		if n.FirstColumn >= 0 && n.LastColumn == n.FirstColumn {
+			return name + columns
+		}
+		if n.FirstColumn >= 0 {
+			return name + "[" + columns + "]"
+		}
+		specifiers = []string{"#Data"}
+	case TableAll:
+		specifiers = []string{"#All"}
+	case TableHeaders:
+		specifiers = []string{"#Headers"}
+	case TableTotals:
+		specifiers = []string{"#Totals"}
+	case TableHeadersData:
+		specifiers = []string{"#Headers", "#Data"}
+	case TableDataTotals:
+		specifiers = []string{"#Data", "#Totals"}
+	}
+
+	if len(specifiers) == 1 && columns == "" {
+		return name + "[" + specifiers[0] + "]"
+	}
+	items := make([]string, 0, len(specifiers)+1)
+	for _, specifier := range specifiers {
+		items = append(items, "["+specifier+"]")
+	}
+	if columns != "" {
+		items = append(items, columns)
+	}
+	return name + "[" + strings.Join(items, ",") + "]"
+}
+
+// structuredRefBounds returns the cells a structured reference covers when
+// used by the formula of the cell at
+func (s *Spreadsheet) structuredRefBounds(n *StructuredRefNode, at CellAddress) (RangeAddress, bool) {
+	table, exists := s.storage.tables.Get(n.TableID)
+	if !exists {
+		return RangeAddress{}, false
+	}
+	rangeAddr, err := n.bounds(table, at)
+	return rangeAddr, err == nil
+}
+
+// tableResolver returns the ParserContext.ResolveTable of formulas written
+// in the cell at
+func (s *Spreadsheet) tableResolver(at CellAddress) func(name string) *Table {
+	return func(name string) *Table {
+		if name != "" {
+			table, _ := s.storage.tables.GetByName(name)
+			return table
+		}
+		worksheet, exists := s.storage.worksheets.GetWorksheet(at.WorksheetID)
+		if !exists {
+			return nil
+		}
+		table, _ := worksheet.tableAt(at.Row, at.Column)
+		return table
+	}
+}
+
+// GetTable returns a copy of a table by name
+func (s *Spreadsheet) GetTable(name string) (Table, error) {
+	table, exists := s.storage.tables.GetByName(name)
+	if !exists {
+		return Table{}, NewApplicationError(NotFound, "Table not found")
+	}
+	copied := *table
+	copied.Columns = append([]string(nil), table.Columns...)
+	return copied, nil
+}
+
+// ListTables returns the names of all tables, sorted
+func (s *Spreadsheet) ListTables() []string {
+	result := make([]string, 0, s.storage.tables.Count())
+	for _, table := range s.storage.tables.tables {
+		result = append(result, table.Name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// AddTable turns a range, like "Sheet1!A1:C10", into a table. its first row
+// is the header row, holding the column names, and its last row is a totals
+// row when totalsRow is set. empty header cells are named Column1, Column2
+// and so on. a table needs at least one data row, and can't overlap
+// another table.
+func (s *Spreadsheet) AddTable(name string, rangeOrAddress string, totalsRow bool) error {
+	if !isValidTableName(name) {
+		return NewApplicationError(InvalidArgument, fmt.Sprintf("Invalid table name: %s", name))
+	}
+	if _, exists := s.storage.tables.GetByName(name); exists {
+		return NewApplicationError(AlreadyExists, "Table already exists")
+	}
+	if _, exists := s.storage.namedRanges.GetNamedRangeID(0, name); exists {
+		return NewApplicationError(AlreadyExists, "A named range has the same name as the table")
+	}
+
+	rangeAddr, err := s.resolveRange(rangeOrAddress)
+	if err != nil {
+		return err
+	}
+	worksheet, exists := s.storage.worksheets.GetWorksheet(rangeAddr.WorksheetID)
+	if !exists {
+		return NewApplicationError(NotFound, "Worksheet not found")
+	}
+	minimumRows := uint32(2)
+	if totalsRow {
+		minimumRows++
+	}
+	if rangeAddr.EndRow-rangeAddr.StartRow+1 < minimumRows {
+		return NewApplicationError(InvalidArgument, "Table needs a header row and at least one data row")
+	}
+	for _, other := range worksheet.tables {
+		if rangesOverlap(other.Range, rangeAddr) {
+			return NewApplicationError(InvalidArgument, fmt.Sprintf("Table overlaps table %s", other.Name))
+		}
+	}
+
+	// the header row holds the column names as text
+	columns := make([]string, 0, rangeAddr.EndColumn-rangeAddr.StartColumn+1)
+	for col := rangeAddr.StartColumn; col <= rangeAddr.EndColumn; col++ {
+		column := ""
+		switch value := worksheet.GetValue(rangeAddr.StartRow, col).(type) {
+		case string:
+			column = strings.TrimSpace(value)
+		case float64:
+			column = strconv.FormatFloat(value, 'g', -1, 64)
+		case bool:
+			column = strings.ToUpper(fmt.Sprint(value))
+		}
+		if column == "" {
+			column = fmt.Sprintf("Column%d", len(columns)+1)
+		}
+		for _, existing := range columns {
+			if strings.EqualFold(existing, column) {
+				return NewApplicationError(InvalidArgument, fmt.Sprintf("Duplicate column name: %s", column))
+			}
+		}
+		columns = append(columns, column)
+	}
+	for i, column := range columns {
+		cellAddr := CellAddress{WorksheetID: rangeAddr.WorksheetID, Row: rangeAddr.StartRow, Column: rangeAddr.StartColumn + uint32(i)}
+		if worksheet.GetValue(cellAddr.Row, cellAddr.Column) != column {
+			if err := s.setCell(worksheet, cellAddr, column); err != nil {
+				return err
+			}
+		}
+	}
+
+	table := &Table{Name: name, Range: rangeAddr, Columns: columns, TotalsRow: totalsRow}
+	s.storage.tables.Add(table)
+	worksheet.tables = append(worksheet.tables, table)
+	s.refreshTableReferences()
+	s.emit(Event{Type: EventTableAdded, Name: name})
+	return nil
+}
+
+// RemoveTable removes a table, leaving its cells as they are. structured
+// references to it become #REF! errors.
+func (s *Spreadsheet) RemoveTable(name string) error {
+	table, exists := s.storage.tables.GetByName(name)
+	if !exists {
+		return NewApplicationError(NotFound, "Table not found")
+	}
+	s.removeTable(table)
+	s.emit(Event{Type: EventTableRemoved, Name: table.Name})
+	return nil
+}
+
+// removeTable removes a table from the registry and its worksheet
+func (s *Spreadsheet) removeTable(table *Table) {
+	s.storage.tables.Remove(table.ID)
+	if worksheet, exists := s.storage.worksheets.GetWorksheet(table.Range.WorksheetID); exists {
+		for i, other := range worksheet.tables {
+			if other == table {
+				worksheet.tables = append(worksheet.tables[:i], worksheet.tables[i+1:]...)
+				break
+			}
+		}
+	}
+	s.refreshTableReferences()
+}
+
+// copyWorksheetTables defines the tables of a worksheet on its copy, under
+// new names like Excel does, Sales becoming Sales2. returns the IDs of the
+// copies by the IDs of the tables copied.
+func (s *Spreadsheet) copyWorksheetTables(source, worksheet *Worksheet) map[uint32]uint32 {
+	copies := make(map[uint32]uint32, len(source.tables))
+	for _, table := range source.tables {
+		copied := &Table{
+			Name:      s.unusedTableName(table.Name),
+			Range:     table.Range,
+			Columns:   slices.Clone(table.Columns),
+			TotalsRow: table.TotalsRow,
+		}
+		copied.Range.WorksheetID = worksheet.worksheetID
+		copies[table.ID] = s.storage.tables.Add(copied)
+		worksheet.tables = append(worksheet.tables, copied)
+	}
+	return copies
+}
+
+// unusedTableName returns the name with the first number from 2 up that
+// makes it a valid name no table or workbook name has
+func (s *Spreadsheet) unusedTableName(name string) string {
+	base := strings.TrimRightFunc(name, unicode.IsDigit)
+	for n := 2; ; n++ {
+		candidate := base + strconv.Itoa(n)
+		if !isValidTableName(candidate) {
+			continue
+		}
+		if _, exists := s.storage.tables.GetByName(candidate); exists {
+			continue
+		}
+		if _, exists := s.storage.namedRanges.GetNamedRangeID(0, candidate); exists {
+			continue
+		}
+		return candidate
+	}
+}
+
+// RenameTableColumn renames a column of a table and its header cell.
+// formulas referring to the column show the new name.
+func (s *Spreadsheet) RenameTableColumn(tableName string, oldName string, newName string) error {
+	table, exists := s.storage.tables.GetByName(tableName)
+	if !exists {
+		return NewApplicationError(NotFound, "Table not found")
+	}
+	index := table.columnIndex(oldName)
+	if index < 0 {
+		return NewApplicationError(NotFound, "Column not found")
+	}
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return NewApplicationError(InvalidArgument, "Column name can't be empty")
+	}
+	if other := table.columnIndex(newName); other >= 0 && other != index {
+		return NewApplicationError(AlreadyExists, "Column already exists")
+	}
+
+	worksheet, _ := s.storage.worksheets.GetWorksheet(table.Range.WorksheetID)
+	cellAddr := CellAddress{WorksheetID: table.Range.WorksheetID, Row: table.Range.StartRow, Column: table.Range.StartColumn + uint32(index)}
+	if err := s.setCell(worksheet, cellAddr, newName); err != nil {
+		return err
+	}
+	table.Columns[index] = newName
+	s.refreshTableReferences()
+	return nil
+}
+
+// AppendTableRow adds a data row at the end of a table, holding values in
+// column order. the totals row moves down to make room. columns without a
+// value whose last data row holds a formula, a calculated column, get the
+// same formula. the row below the table has to be empty.
+func (s *Spreadsheet) AppendTableRow(tableName string, values ...Primitive) error {
+	table, exists := s.storage.tables.GetByName(tableName)
+	if !exists {
+		return NewApplicationError(NotFound, "Table not found")
+	}
+	if len(values) > len(table.Columns) {
+		return NewApplicationError(InvalidArgument, fmt.Sprintf("Table %s has %d columns", table.Name, len(table.Columns)))
+	}
+	worksheet, _ := s.storage.worksheets.GetWorksheet(table.Range.WorksheetID)
+	if table.Range.EndRow+1 >= MaxRows {
+		return NewApplicationError(ResourceExhausted, "Table can't grow past the last row")
+	}
+
+	below := table.Range
+	below.StartRow, below.EndRow = table.Range.EndRow+1, table.Range.EndRow+1
+	for col := below.StartColumn; col <= below.EndColumn; col++ {
+		if worksheet.GetCell(below.StartRow, col) != nil {
+			return NewApplicationError(InvalidArgument, "Cells below the table aren't empty")
+		}
+	}
+
+	_, lastDataRow := table.dataRows()
+	if table.TotalsRow {
+		totals := table.Range
+		totals.StartRow = totals.EndRow
+		if err := s.MoveRange(s.formatRangeAddress(totals), s.formatCellAddress(CellAddress{
+			WorksheetID: totals.WorksheetID, Row: totals.StartRow + 1, Column: totals.StartColumn,
+		})); err != nil {
+			return err
+		}
+	}
+	table.Range.EndRow++
+
+	for i := range table.Columns {
+		cellAddr := CellAddress{WorksheetID: table.Range.WorksheetID, Row: lastDataRow + 1, Column: table.Range.StartColumn + uint32(i)}
+		if i < len(values) && values[i] != nil {
+			if err := s.setCell(worksheet, cellAddr, values[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		above := CellAddress{WorksheetID: cellAddr.WorksheetID, Row: lastDataRow, Column: cellAddr.Column}
+		if formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(above); isFormula {
+			ast, _ := s.storage.formulas.GetAST(formulaID)
+			if err := s.setFormulaAST(worksheet, cellAddr, ast); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.refreshTableReferences()
+	return nil
+}
+
+// refreshTableReferences re-extracts the dependencies of every formula with
+// a structured reference, refreshes its text and marks it dirty, after a
+// table was added, removed, resized or had a column renamed
+func (s *Spreadsheet) refreshTableReferences() {
+	for _, formulaID := range s.storage.formulas.GetFormulasWithStructuredRefs() {
+		ast, exists := s.storage.formulas.GetAST(formulaID)
+		if !exists {
+			continue
+		}
+		for _, cellAddr := range s.storage.formulas.GetCellsUsingFormula(formulaID) {
+			s.extractDependencies(ast, cellAddr)
+			s.storage.dependencyGraph.SetFormula(cellAddr, "="+s.formulaText(ast, cellAddr))
+			s.storage.dependencyGraph.MarkDirty(cellAddr)
+		}
+	}
+}
+
+// tableAt returns the table containing a cell of the worksheet
+func (w *Worksheet) tableAt(row, col uint32) (*Table, bool) {
+	for _, table := range w.tables {
+		if table.contains(CellAddress{WorksheetID: w.worksheetID, Row: row, Column: col}) {
+			return table, true
+		}
+	}
+	return nil, false
+}
+
+// isValidTableName checks a table name starts with a letter or underscore
+// and holds only letters, digits, underscores and periods, and isn't a cell
+// reference. names like Sales2 are fine, their column is past the last one.
+func isValidTableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	lexer := NewLexer("")
+	for i, ch := range name {
+		if i == 0 && !lexer.isAlpha(ch) && ch != charUnderscore {
+			return false
+		}
+		if !lexer.isAlphaNumeric(ch) && ch != charUnderscore && ch != charPeriod {
+			return false
+		}
+	}
+	if lexer.isCell(name) {
+		letters := strings.TrimRightFunc(name, unicode.IsDigit)
+		_, isColumn := parseColumnLetters(letters)
+		_, isRow := parseRowNumber(name[len(letters):])
+		if isColumn && isRow {
+			return false
+		}
+	}
+	return !strings.EqualFold(name, "TRUE") && !strings.EqualFold(name, "FALSE")
+}
+
+// rangesOverlap reports whether two ranges share a cell
+func rangesOverlap(a, b RangeAddress) bool {
+	return a.WorksheetID == b.WorksheetID &&
+		a.StartRow <= b.EndRow && b.StartRow <= a.EndRow &&
+		a.StartColumn <= b.EndColumn && b.StartColumn <= a.EndColumn
+}
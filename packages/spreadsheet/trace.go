@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// TraceKind identifies what a TraceNode refers to
+type TraceKind int
+
+const (
+	TraceCell       TraceKind = iota + 1 // a single cell
+	TraceRange                           // a range referenced by a formula
+	TraceNamedRange                      // a named range referenced by a formula
+)
+
+// TraceNode is a cell, range or named range in a precedent or dependent
+// trace. its children are the nodes it leads to: what it depends on for
+// precedents, what depends on it for dependents.
+type TraceNode struct {
+	Kind      TraceKind
+	Address   string // "Sheet1!B2" for cells, "Sheet1!A1:B2" for ranges, the name for named ranges
+	Range     string // range a named range refers to, empty if it's undefined
+	Circular  bool   // the node is already on the path from the root, so it isn't expanded again
+	Repeated  bool   // the node was expanded earlier in the trace, its children are listed there
+	Truncated bool   // the depth limit stopped the expansion of the node
+	Children  []*TraceNode
+}
+
+// traceKey identifies a node of a trace
+type traceKey struct {
+	kind TraceKind
+	cell CellAddress
+	rng  RangeAddress
+	name uint32
+}
+
+// TracePrecedents returns the tree of cells, ranges and named ranges the
+// cell at address depends on, across worksheets. the children of a range
+// are the formula cells inside it. depth limits the levels below the root,
+// zero or less means no limit.
+func (s *Spreadsheet) TracePrecedents(address string, depth int) (*TraceNode, error) {
+	return s.trace(address, depth, s.tracePrecedentEdges)
+}
+
+// TraceDependents returns the tree of cells that depend on the cell at
+// address, across worksheets. cells depending on a range or named range
+// containing the cell are listed below that range or name. depth limits the
+// levels below the root, zero or less means no limit.
+func (s *Spreadsheet) TraceDependents(address string, depth int) (*TraceNode, error) {
+	return s.trace(address, depth, s.traceDependentEdges)
+}
+
+// trace builds a trace tree from a cell, following edges with an explicit
+// stack so long chains don't exhaust the goroutine stack
+func (s *Spreadsheet) trace(address string, depth int, edges func(traceKey) []traceKey) (*TraceNode, error) {
+	worksheetID, row, col, err := s.resolveAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if worksheetID == 0 || !s.storage.worksheets.IsWorksheetDefined(worksheetID) {
+		return nil, NewApplicationError(NotFound, fmt.Sprintf("Worksheet not found for %s", address))
+	}
+
+	type frame struct {
+		key      traceKey
+		node     *TraceNode
+		children []traceKey
+		next     int
+	}
+
+	rootKey := traceKey{kind: TraceCell, cell: CellAddress{WorksheetID: worksheetID, Row: row, Column: col}}
+	root := s.traceNode(rootKey)
+	expanded := map[traceKey]bool{rootKey: true}
+	onPath := map[traceKey]bool{rootKey: true}
+	stack := []frame{{key: rootKey, node: root, children: edges(rootKey)}}
+
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next >= len(top.children) {
+			delete(onPath, top.key)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		key := top.children[top.next]
+		top.next++
+		child := s.traceNode(key)
+		top.node.Children = append(top.node.Children, child)
+
+		switch {
+		case onPath[key]:
+			child.Circular = true
+		case expanded[key]:
+			child.Repeated = true
+		default:
+			children := edges(key)
+			if depth > 0 && len(stack) >= depth {
+				child.Truncated = len(children) > 0
+				continue
+			}
+			expanded[key] = true
+			onPath[key] = true
+			stack = append(stack, frame{key: key, node: child, children: children})
+		}
+	}
+
+	return root, nil
+}
+
+// traceNode creates the node for a trace key
+func (s *Spreadsheet) traceNode(key traceKey) *TraceNode {
+	switch key.kind {
+	case TraceRange:
+		return &TraceNode{Kind: TraceRange, Address: s.formatRangeAddress(key.rng)}
+	case TraceNamedRange:
+		node := &TraceNode{Kind: TraceNamedRange, Address: s.formatName(key.name)}
+		if rangeAddr, defined := s.storage.namedRanges.GetRangeAddress(key.name); defined {
+			node.Range = s.formatRangeAddress(rangeAddr)
+		}
+		return node
+	}
+	return &TraceNode{Kind: TraceCell, Address: s.formatCellAddress(key.cell)}
+}
+
+// tracePrecedentEdges returns what a trace node depends on: the cells,
+// ranges and named ranges of a formula, the formula cells inside a range,
+// and the range a named range refers to
+func (s *Spreadsheet) tracePrecedentEdges(key traceKey) []traceKey {
+	dg := s.storage.dependencyGraph
+	var result []traceKey
+
+	switch key.kind {
+	case TraceCell:
+		precedents := dg.GetDirectPrecedents(key.cell)
+		sortCellAddresses(precedents)
+		for _, addr := range precedents {
+			result = append(result, traceKey{kind: TraceCell, cell: addr})
+		}
+
+		ranges := dg.GetRangePrecedents(key.cell)
+		sortRangeAddresses(ranges)
+		for _, rangeAddr := range ranges {
+			if s.readsRangeDirectly(key.cell, rangeAddr) {
+				result = append(result, traceKey{kind: TraceRange, rng: rangeAddr})
+			}
+		}
+
+		if formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(key.cell); isFormula {
+			names := make([]uint32, 0, len(s.storage.formulas.namedRangesUsed[formulaID]))
+			for nameID := range s.storage.formulas.namedRangesUsed[formulaID] {
+				names = append(names, nameID)
+			}
+			for _, nameID := range s.sortNamedRangeIDs(names) {
+				result = append(result, traceKey{kind: TraceNamedRange, name: nameID})
+			}
+		}
+
+	case TraceRange:
+		cells := make([]CellAddress, 0, len(s.storage.formulas.formulaAtCell))
+		for addr := range s.storage.formulas.formulaAtCell {
+			if dg.IsInRange(addr, key.rng) {
+				cells = append(cells, addr)
+			}
+		}
+		sortCellAddresses(cells)
+		for _, addr := range cells {
+			result = append(result, traceKey{kind: TraceCell, cell: addr})
+		}
+
+	case TraceNamedRange:
+		if rangeAddr, defined := s.storage.namedRanges.GetRangeAddress(key.name); defined {
+			result = append(result, traceKey{kind: TraceRange, rng: rangeAddr})
+		}
+	}
+
+	return result
+}
+
+// traceDependentEdges returns what depends on a trace node: the direct
+// dependents of a cell and the ranges and named ranges containing it, the
+// cells observing a range, and the cells whose formulas use a named range
+func (s *Spreadsheet) traceDependentEdges(key traceKey) []traceKey {
+	dg := s.storage.dependencyGraph
+	var result []traceKey
+
+	switch key.kind {
+	case TraceCell:
+		dependents := dg.GetDirectDependents(key.cell)
+		sortCellAddresses(dependents)
+		for _, addr := range dependents {
+			result = append(result, traceKey{kind: TraceCell, cell: addr})
+		}
+
+		ranges := dg.GetObservedRangesContaining(key.cell)
+		sortRangeAddresses(ranges)
+		for _, rangeAddr := range ranges {
+			if len(s.rangeObservers(rangeAddr)) > 0 {
+				result = append(result, traceKey{kind: TraceRange, rng: rangeAddr})
+			}
+		}
+
+		var names []uint32
+		for nameID, rangeAddr := range s.storage.namedRanges.DefinedRanges() {
+			if dg.IsInRange(key.cell, rangeAddr) {
+				names = append(names, nameID)
+			}
+		}
+		for _, nameID := range s.sortNamedRangeIDs(names) {
+			result = append(result, traceKey{kind: TraceNamedRange, name: nameID})
+		}
+
+	case TraceRange:
+		observers := s.rangeObservers(key.rng)
+		sortCellAddresses(observers)
+		for _, addr := range observers {
+			result = append(result, traceKey{kind: TraceCell, cell: addr})
+		}
+
+	case TraceNamedRange:
+		var cells []CellAddress
+		for _, formulaID := range s.storage.formulas.GetFormulasUsingNamedRange(key.name) {
+			cells = append(cells, s.storage.formulas.GetCellsUsingFormula(formulaID)...)
+		}
+		sortCellAddresses(cells)
+		for _, addr := range cells {
+			result = append(result, traceKey{kind: TraceCell, cell: addr})
+		}
+	}
+
+	return result
+}
+
+// rangeObservers returns the cells reading a range directly, not only as
+// the range of a named range
+func (s *Spreadsheet) rangeObservers(rangeAddr RangeAddress) []CellAddress {
+	observers := make([]CellAddress, 0, len(s.storage.dependencyGraph.rangeObservers[rangeAddr]))
+	for addr := range s.storage.dependencyGraph.rangeObservers[rangeAddr] {
+		if s.readsRangeDirectly(addr, rangeAddr) {
+			observers = append(observers, addr)
+		}
+	}
+	return observers
+}
+
+// readsRangeDirectly reports whether the formula of a cell reads a range
+// other than as the range of a named range it uses. traces list the range
+// of a named range below the name instead.
+func (s *Spreadsheet) readsRangeDirectly(addr CellAddress, rangeAddr RangeAddress) bool {
+	formulaID, isFormula := s.storage.formulas.GetFormulaAtCell(addr)
+	if !isFormula {
+		return true
+	}
+	ast, exists := s.storage.formulas.GetAST(formulaID)
+	if !exists {
+		return true
+	}
+	var reads formulaReads
+	s.readFormula(ast, addr, addr, nil, &reads)
+	return slices.Contains(reads.ranges, rangeAddr) || !slices.Contains(reads.nameRanges, rangeAddr)
+}
+
+// sortNamedRangeIDs sorts named range IDs by name, with their worksheet
+func (s *Spreadsheet) sortNamedRangeIDs(ids []uint32) []uint32 {
+	sort.Slice(ids, func(i, j int) bool {
+		return s.formatName(ids[i]) < s.formatName(ids[j])
+	})
+	return ids
+}
+
+// sortRangeAddresses sorts ranges by worksheet, then by their top-left
+// corner, then by their bottom-right corner
+func sortRangeAddresses(ranges []RangeAddress) {
+	sort.Slice(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.WorksheetID != b.WorksheetID {
+			return a.WorksheetID < b.WorksheetID
+		}
+		if a.StartRow != b.StartRow {
+			return a.StartRow < b.StartRow
+		}
+		if a.StartColumn != b.StartColumn {
+			return a.StartColumn < b.StartColumn
+		}
+		if a.EndRow != b.EndRow {
+			return a.EndRow < b.EndRow
+		}
+		return a.EndColumn < b.EndColumn
+	})
+}
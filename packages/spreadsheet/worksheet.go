@@ -1,5 +1,11 @@
 package main
 
+import (
+	"math/bits"
+	"slices"
+	"sync"
+)
+
 // WorksheetTable manages worksheet storage and ID mappings
 type WorksheetTable struct {
 	// core name/ID mapping (for all worksheets, defined or not)
@@ -19,6 +25,10 @@ type WorksheetTable struct {
 
 	refCounts map[uint32]int // ID -> reference count
 	nextID    uint32
+
+	// tab order of the defined worksheets, which 3D references span
+
+	order []uint32 // defined worksheet IDs in tab order
 }
 
 // NewWorksheetTable creates a new worksheet table
@@ -60,6 +70,9 @@ func (wt *WorksheetTable) DefineWorksheet(name string, worksheet *Worksheet) uin
 	// check if name already exists
 	if id, exists := wt.nameToID[name]; exists {
 		// update the definition
+		if _, defined := wt.definedWorksheets[id]; !defined {
+			wt.order = append(wt.order, id)
+		}
 		wt.definedWorksheets[id] = worksheet
 		delete(wt.undefinedIDs, id) // remove from undefined if present
 		wt.refCounts[id]++          // increment reference since we're defining it
@@ -76,6 +89,7 @@ func (wt *WorksheetTable) DefineWorksheet(name string, worksheet *Worksheet) uin
 	wt.idToName[id] = name
 	wt.definedWorksheets[id] = worksheet
 	wt.refCounts[id] = 1
+	wt.order = append(wt.order, id)
 	wt.nextID++
 
 	// update the worksheet's ID
@@ -98,6 +112,7 @@ func (wt *WorksheetTable) UndefineWorksheet(name string) bool {
 
 	// remove the definition
 	delete(wt.definedWorksheets, id)
+	wt.removeFromOrder(id)
 
 	// check if there are still references
 	if wt.refCounts[id] > 0 {
@@ -119,6 +134,58 @@ func (wt *WorksheetTable) removeWorksheet(id uint32) {
 	delete(wt.definedWorksheets, id)
 	delete(wt.undefinedIDs, id)
 	delete(wt.refCounts, id)
+	wt.removeFromOrder(id)
+}
+
+// removeFromOrder drops a worksheet from the tab order
+func (wt *WorksheetTable) removeFromOrder(id uint32) {
+	if position, exists := wt.GetWorksheetPosition(id); exists {
+		wt.order = append(wt.order[:position], wt.order[position+1:]...)
+	}
+}
+
+// GetWorksheetOrder returns the IDs of the defined worksheets in tab order
+func (wt *WorksheetTable) GetWorksheetOrder() []uint32 {
+	return append([]uint32(nil), wt.order...)
+}
+
+// GetWorksheetPosition returns the 0-based tab position of a defined worksheet
+func (wt *WorksheetTable) GetWorksheetPosition(id uint32) (int, bool) {
+	for position, orderedID := range wt.order {
+		if orderedID == id {
+			return position, true
+		}
+	}
+	return 0, false
+}
+
+// MoveWorksheet moves a defined worksheet to a tab position, shifting the
+// worksheets in between. positions past the end move it to the end.
+func (wt *WorksheetTable) MoveWorksheet(id uint32, position int) bool {
+	current, exists := wt.GetWorksheetPosition(id)
+	if !exists {
+		return false
+	}
+	position = max(0, min(position, len(wt.order)-1))
+
+	wt.order = append(wt.order[:current], wt.order[current+1:]...)
+	wt.order = append(wt.order[:position], append([]uint32{id}, wt.order[position:]...)...)
+	return true
+}
+
+// GetWorksheetSpan returns the worksheets from first to last in tab order,
+// inclusive, as spanned by a 3D reference. the endpoints may be given in
+// either order. ok is false unless both endpoints are defined.
+func (wt *WorksheetTable) GetWorksheetSpan(first, last uint32) ([]uint32, bool) {
+	from, firstDefined := wt.GetWorksheetPosition(first)
+	to, lastDefined := wt.GetWorksheetPosition(last)
+	if !firstDefined || !lastDefined {
+		return nil, false
+	}
+	if from > to {
+		from, to = to, from
+	}
+	return append([]uint32(nil), wt.order[from:to+1]...), true
 }
 
 // AddReference increments the reference count for a worksheet ID
@@ -250,6 +317,7 @@ func (wt *WorksheetTable) Clear() {
 	wt.definedWorksheets = make(map[uint32]*Worksheet)
 	wt.undefinedIDs = make(map[uint32]struct{})
 	wt.refCounts = make(map[uint32]int)
+	wt.order = nil
 	wt.nextID = 1
 }
 
@@ -279,14 +347,55 @@ type Worksheet struct {
 	cellsByType [8]uint32           // cells by type for diagnostic use
 	storage     *Storage            // storage accessible to help
 	worksheetID uint32              // worksheet that owns this chunk
+	mu          sync.RWMutex        // guards chunk contents during parallel calculation
+
+	// bottom-right corner of the occupied cells, computed on demand and
+	// invalidated whenever a cell is set or removed
+	lastRow, lastCol uint32
+	extentState      uint8 // extentUnknown, extentEmpty or extentKnown
+
+	// tab metadata
+
+	properties WorksheetProperties
+	tables     []*Table // tables on the worksheet, also in the table registry
 }
 
+// WorksheetVisibility controls whether a worksheet's tab is shown
+type WorksheetVisibility uint8
+
+const (
+	WorksheetVisible    WorksheetVisibility = iota
+	WorksheetHidden                         // hidden, can be unhidden by the user
+	WorksheetVeryHidden                     // hidden, can only be unhidden through the API
+)
+
+// DefaultColumnWidth is the column width of new worksheets, in characters
+const DefaultColumnWidth = 8.43
+
+// WorksheetProperties holds the tab metadata of a worksheet
+type WorksheetProperties struct {
+	Visibility         WorksheetVisibility
+	TabColor           string  // "#RRGGBB", or empty for no color
+	DefaultColumnWidth float64 // in characters
+}
+
+const (
+	extentUnknown uint8 = iota
+	extentEmpty
+	extentKnown
+)
+
 const (
 	ChunkRows uint32 = 256                   // rows per chunk - power of 2 for efficient modulo
 	ChunkCols uint32 = 256                   // columns per chunk - matches typical viewport size
 	ChunkSize        = ChunkRows * ChunkCols // 65536 cells per chunk
 )
 
+const (
+	MaxRows    uint32 = 1 << 20 // rows in a worksheet, the bounds of a whole-column reference
+	MaxColumns uint32 = 1 << 14 // columns in a worksheet (A to XFD), the bounds of a whole-row reference
+)
+
 // Chunk represents a 256x256 region of cells using structure-of-arrays layout
 // for cache efficiency and minimal memory overhead. arrays are allocated
 // lazily - only Types and OccupiedBitmap exist initially.
@@ -314,6 +423,51 @@ func NewWorksheet(storage *Storage, worksheetID uint32) *Worksheet {
 		chunks:      make(map[ChunkKey]*Chunk),
 		storage:     storage,
 		worksheetID: worksheetID,
+		properties:  WorksheetProperties{DefaultColumnWidth: DefaultColumnWidth},
+	}
+}
+
+// clone returns a deep copy of the worksheet's chunks and metadata for
+// another worksheet ID. strings of the copy are referenced again, formula IDs
+// are copied as they are and left for the caller to re-intern.
+func (w *Worksheet) clone(worksheetID uint32) *Worksheet {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	copied := NewWorksheet(w.storage, worksheetID)
+	copied.totalCells = w.totalCells
+	copied.cellsByType = w.cellsByType
+	copied.properties = w.properties
+
+	for key, chunk := range w.chunks {
+		copied.chunks[key] = chunk.clone()
+		if w.storage == nil || w.storage.strings == nil {
+			continue
+		}
+		for idx, cellType := range chunk.Types {
+			if (cellType == uint8(CellValueTypeString) || cellType == uint8(CellValueTypeError)) &&
+				chunk.StringIDs != nil && chunk.StringIDs[idx] != 0 {
+				w.storage.strings.AddReference(chunk.StringIDs[idx])
+			}
+		}
+	}
+
+	return copied
+}
+
+// clone returns a deep copy of the chunk
+func (c *Chunk) clone() *Chunk {
+	return &Chunk{
+		Types:                  slices.Clone(c.Types),
+		NonEmptyCount:          c.NonEmptyCount,
+		OccupiedBitmap:         slices.Clone(c.OccupiedBitmap),
+		Numbers:                slices.Clone(c.Numbers),
+		StringIDs:              slices.Clone(c.StringIDs),
+		FormulaIDs:             slices.Clone(c.FormulaIDs),
+		FormulaResultTypes:     slices.Clone(c.FormulaResultTypes),
+		FormulaResultNumbers:   slices.Clone(c.FormulaResultNumbers),
+		FormulaResultStringIDs: slices.Clone(c.FormulaResultStringIDs),
+		FormulaResultBooleans:  slices.Clone(c.FormulaResultBooleans),
 	}
 }
 
@@ -333,6 +487,9 @@ func (w *Worksheet) getChunk(chunkRow, chunkCol uint32) *Chunk {
 
 // GetCell retrieves a cell at the given row and column
 func (w *Worksheet) GetCell(row, col uint32) *Cell {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
 	chunkRow := row / ChunkRows
 	chunkCol := col / ChunkCols
 	localRow := row % ChunkRows
@@ -415,58 +572,189 @@ func (w *Worksheet) GetCell(row, col uint32) *Cell {
 
 		// get formula result
 		if chunk.FormulaResultTypes != nil && idx < uint32(len(chunk.FormulaResultTypes)) {
-			cell.FormulaResultType = CellType(chunk.FormulaResultTypes[idx])
+			slot := chunk.formulaResultSlot(idx)
+			cell.FormulaResultType = CellType(slot.resultType)
+			if value := w.decodeFormulaResult(slot); value != nil {
+				cell.Value = value
+			}
+		}
+	}
 
-			switch cell.FormulaResultType {
-			case CellValueTypeNumber, CellValueTypeDate:
-				if chunk.FormulaResultNumbers != nil && idx < uint32(len(chunk.FormulaResultNumbers)) {
-					cell.Value = chunk.FormulaResultNumbers[idx]
+	return cell
+}
+
+// GetValue returns the value of a cell, or the result of a formula cell, as
+// GetCell would. nil for empty cells. unlike GetCell, it doesn't build a Cell
+// or render the formula, so it's cheap enough for every reference a formula
+// reads.
+func (w *Worksheet) GetValue(row, col uint32) Primitive {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	key := ChunkKey{ChunkRow: row / ChunkRows, ChunkCol: col / ChunkCols}
+	chunk, exists := w.chunks[key]
+	if !exists {
+		return nil
+	}
+	idx := (col%ChunkCols)*ChunkRows + row%ChunkRows
+
+	if chunk.FormulaIDs != nil && chunk.FormulaIDs[idx] != 0 {
+		if chunk.FormulaResultTypes == nil {
+			return nil
+		}
+		return w.decodeFormulaResult(chunk.formulaResultSlot(idx))
+	}
+
+	switch CellType(chunk.Types[idx]) {
+	case CellValueTypeNumber, CellValueTypeDate:
+		return chunk.Numbers[idx]
+	case CellValueTypeString:
+		str, _ := w.storage.strings.GetString(chunk.StringIDs[idx])
+		return str
+	case CellValueTypeBoolean:
+		return chunk.Numbers[idx] != 0
+	case CellValueTypeError:
+		message, _ := w.storage.strings.GetString(chunk.StringIDs[idx])
+		return &SpreadsheetError{
+			ErrorCode: ErrorCode(chunk.Numbers[idx]),
+			Message:   message,
+		}
+	}
+	return nil
+}
+
+// occupiedCells calls yield with the position of every occupied cell in the
+// rectangle, in row-major order. missing chunks are never visited and
+// OccupiedBitmap is read 64 rows at a time, so empty stretches of a range cost
+// one word test per column instead of one lookup per cell. iteration stops
+// when yield returns false.
+func (w *Worksheet) occupiedCells(startRow, startCol, endRow, endCol uint32, yield func(row, col uint32) bool) {
+	// present chunks of the current band of chunk rows, left to right. most
+	// ranges span a handful of chunk columns, so this stays on the stack
+	var buffer [8]*Chunk
+	var firstCols [8]uint32
+
+	for band := startRow / ChunkRows; band <= endRow/ChunkRows; band++ {
+		chunks := buffer[:0]
+		chunkCols := firstCols[:0]
+		w.mu.RLock()
+		for chunkCol := startCol / ChunkCols; chunkCol <= endCol/ChunkCols; chunkCol++ {
+			if chunk, exists := w.chunks[ChunkKey{ChunkRow: band, ChunkCol: chunkCol}]; exists {
+				chunks = append(chunks, chunk)
+				chunkCols = append(chunkCols, chunkCol)
+			}
+		}
+		w.mu.RUnlock()
+		if len(chunks) == 0 {
+			continue
+		}
+
+		// the bitmap only changes through SetCell and RemoveCell, never while
+		// workers evaluate formulas, so it is read without the lock
+		bandStart := band * ChunkRows
+		rowLo := max(startRow, bandStart) - bandStart
+		rowHi := min(endRow, bandStart+ChunkRows-1) - bandStart
+		for block := rowLo / 64; block <= rowHi/64; block++ {
+			// rows of this block that fall inside the range
+			mask := ^uint64(0)
+			if lo := block * 64; rowLo > lo {
+				mask &= ^uint64(0) << (rowLo - lo)
+			}
+			if hi := block*64 + 63; rowHi < hi {
+				mask &= ^uint64(0) >> (hi - rowHi)
+			}
+
+			// rows holding at least one occupied cell of the range
+			var rows uint64
+			for i, chunk := range chunks {
+				colLo, colHi := chunkColumnSpan(chunkCols[i], startCol, endCol)
+				for col := colLo; col <= colHi; col++ {
+					rows |= uint64(chunk.OccupiedBitmap[col*(ChunkRows/64)+block])
 				}
-			case CellValueTypeString:
-				if chunk.FormulaResultStringIDs != nil && idx < uint32(len(chunk.FormulaResultStringIDs)) {
-					stringID := chunk.FormulaResultStringIDs[idx]
-					if w.storage != nil && w.storage.strings != nil {
-						if str, ok := w.storage.strings.GetString(stringID); ok {
-							cell.Value = str
+			}
+			rows &= mask
+
+			for rows != 0 {
+				localRow := block*64 + uint32(bits.TrailingZeros64(rows))
+				rows &= rows - 1
+				bit := uint64(1) << (localRow % 64)
+
+				for i, chunk := range chunks {
+					colLo, colHi := chunkColumnSpan(chunkCols[i], startCol, endCol)
+					for col := colLo; col <= colHi; col++ {
+						if uint64(chunk.OccupiedBitmap[col*(ChunkRows/64)+block])&bit == 0 {
+							continue
+						}
+						if !yield(bandStart+localRow, chunkCols[i]*ChunkCols+col) {
+							return
 						}
 					}
 				}
-			case CellValueTypeBoolean:
-				if chunk.FormulaResultBooleans != nil && idx < uint32(len(chunk.FormulaResultBooleans)) {
-					cell.Value = chunk.FormulaResultBooleans[idx] != 0
-				}
-			case CellValueTypeError:
-				var errorCode ErrorCode
-				var message string
+			}
+		}
+	}
+}
 
-				// Get error code from FormulaResultNumbers
-				if chunk.FormulaResultNumbers != nil && idx < uint32(len(chunk.FormulaResultNumbers)) {
-					errorCode = ErrorCode(chunk.FormulaResultNumbers[idx])
-				}
+// UsedExtent returns the last row and column holding an occupied cell, the
+// bottom-right corner of the used area. ok is false for an empty worksheet.
+// whole-column and whole-row references are evaluated against it.
+func (w *Worksheet) UsedExtent() (lastRow, lastCol uint32, ok bool) {
+	w.mu.RLock()
+	if w.extentState != extentUnknown {
+		defer w.mu.RUnlock()
+		return w.lastRow, w.lastCol, w.extentState == extentKnown
+	}
+	w.mu.RUnlock()
 
-				// Get error message from string table
-				if chunk.FormulaResultStringIDs != nil && idx < uint32(len(chunk.FormulaResultStringIDs)) {
-					stringID := chunk.FormulaResultStringIDs[idx]
-					if w.storage != nil && w.storage.strings != nil {
-						if str, ok := w.storage.strings.GetString(stringID); ok {
-							message = str
-						}
-					}
-				}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.extentState == extentUnknown {
+		w.computeUsedExtent()
+	}
+	return w.lastRow, w.lastCol, w.extentState == extentKnown
+}
 
-				cell.Value = &SpreadsheetError{
-					ErrorCode: errorCode,
-					Message:   message,
-				}
+// computeUsedExtent scans the occupied bitmaps for the used extent. chunks
+// that cannot extend the extent found so far are skipped.
+func (w *Worksheet) computeUsedExtent() {
+	w.lastRow, w.lastCol = 0, 0
+	w.extentState = extentEmpty
+	for key, chunk := range w.chunks {
+		if chunk.NonEmptyCount == 0 {
+			continue
+		}
+		if w.extentState == extentKnown &&
+			(key.ChunkRow+1)*ChunkRows-1 <= w.lastRow && (key.ChunkCol+1)*ChunkCols-1 <= w.lastCol {
+			continue
+		}
+
+		// each column of the chunk takes ChunkRows/64 words of the bitmap
+		for word, occupied := range chunk.OccupiedBitmap {
+			if occupied == 0 {
+				continue
 			}
+			col := key.ChunkCol*ChunkCols + uint32(word)/(ChunkRows/64)
+			row := key.ChunkRow*ChunkRows + uint32(word)%(ChunkRows/64)*64 +
+				63 - uint32(bits.LeadingZeros64(uint64(occupied)))
+			w.lastRow = max(w.lastRow, row)
+			w.lastCol = max(w.lastCol, col)
+			w.extentState = extentKnown
 		}
 	}
+}
 
-	return cell
+// chunkColumnSpan returns the local columns of a chunk that fall inside the
+// column span of a range
+func chunkColumnSpan(chunkCol, startCol, endCol uint32) (uint32, uint32) {
+	chunkStart := chunkCol * ChunkCols
+	return max(startCol, chunkStart) - chunkStart, min(endCol, chunkStart+ChunkCols-1) - chunkStart
 }
 
 // SetCell sets a cell value at the given row and column
 func (w *Worksheet) SetCell(row, col uint32, value Primitive, formula string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	chunkRow := row / ChunkRows
 	chunkCol := col / ChunkCols
 	localRow := row % ChunkRows
@@ -474,9 +762,12 @@ func (w *Worksheet) SetCell(row, col uint32, value Primitive, formula string) er
 
 	chunk := w.getChunk(chunkRow, chunkCol)
 	idx := localCol*ChunkRows + localRow
+	w.extentState = extentUnknown
 
-	// track if this was previously empty and get old type for statistics
-	wasEmpty := chunk.Types[idx] == uint8(CellValueTypeEmpty)
+	// track if this was previously empty and get old type for statistics.
+	// formula cells keep an empty type, so check for a formula ID as well
+	hasFormula := chunk.FormulaIDs != nil && chunk.FormulaIDs[idx] != 0
+	wasEmpty := chunk.Types[idx] == uint8(CellValueTypeEmpty) && !hasFormula
 	oldType := CellType(chunk.Types[idx])
 
 	// clear any existing formula
@@ -595,10 +886,11 @@ func (w *Worksheet) SetCell(row, col uint32, value Primitive, formula string) er
 		}
 	}
 
-	// update occupied bitmap
+	// update occupied bitmap. formula cells keep an empty type, so they are
+	// marked occupied by the formula itself
 	bitIdx := idx / 64
 	bitPos := idx % 64
-	if chunk.Types[idx] != uint8(CellValueTypeEmpty) {
+	if chunk.Types[idx] != uint8(CellValueTypeEmpty) || formula != "" {
 		chunk.OccupiedBitmap[bitIdx] |= (1 << bitPos)
 	} else {
 		chunk.OccupiedBitmap[bitIdx] &^= (1 << bitPos)
@@ -617,6 +909,9 @@ func (w *Worksheet) SetCell(row, col uint32, value Primitive, formula string) er
 
 // RemoveCell removes a cell at the given row and column
 func (w *Worksheet) RemoveCell(row, col uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	chunkRow := row / ChunkRows
 	chunkCol := col / ChunkCols
 	localRow := row % ChunkRows
@@ -630,9 +925,11 @@ func (w *Worksheet) RemoveCell(row, col uint32) {
 
 	idx := localCol*ChunkRows + localRow
 
-	if chunk.Types[idx] == uint8(CellValueTypeEmpty) {
+	hasFormula := chunk.FormulaIDs != nil && chunk.FormulaIDs[idx] != 0
+	if chunk.Types[idx] == uint8(CellValueTypeEmpty) && !hasFormula {
 		return
 	}
+	w.extentState = extentUnknown
 
 	// get the cell type for statistics before removing
 	cellType := CellType(chunk.Types[idx])
@@ -681,8 +978,86 @@ func (w *Worksheet) RemoveCell(row, col uint32) {
 	}
 }
 
-// SetFormulaResult stores the calculated result of a formula cell
-func (w *Worksheet) SetFormulaResult(row, col uint32, result Primitive) {
+// formulaResultSlot is the raw encoding of a formula result within a chunk
+type formulaResultSlot struct {
+	resultType uint8
+	number     float64
+	stringID   uint32
+	boolean    uint8
+}
+
+// equal reports whether two slots encode the same result. only the fields
+// used by the result type are compared.
+func (a formulaResultSlot) equal(b formulaResultSlot) bool {
+	if a.resultType != b.resultType {
+		return false
+	}
+	switch CellType(a.resultType) {
+	case CellValueTypeNumber, CellValueTypeDate:
+		return a.number == b.number
+	case CellValueTypeString:
+		return a.stringID == b.stringID
+	case CellValueTypeBoolean:
+		return a.boolean == b.boolean
+	case CellValueTypeError:
+		return a.number == b.number && a.stringID == b.stringID
+	}
+	return true
+}
+
+// formulaResultSlot returns the raw encoding of the formula result at idx
+func (c *Chunk) formulaResultSlot(idx uint32) formulaResultSlot {
+	var slot formulaResultSlot
+	if c.FormulaResultTypes != nil {
+		slot.resultType = c.FormulaResultTypes[idx]
+	}
+	if c.FormulaResultNumbers != nil {
+		slot.number = c.FormulaResultNumbers[idx]
+	}
+	if c.FormulaResultStringIDs != nil {
+		slot.stringID = c.FormulaResultStringIDs[idx]
+	}
+	if c.FormulaResultBooleans != nil {
+		slot.boolean = c.FormulaResultBooleans[idx]
+	}
+	return slot
+}
+
+// decodeFormulaResult converts the raw encoding of a formula result back to
+// a value
+func (w *Worksheet) decodeFormulaResult(slot formulaResultSlot) Primitive {
+	lookup := func(stringID uint32) string {
+		if w.storage != nil && w.storage.strings != nil {
+			if str, ok := w.storage.strings.GetString(stringID); ok {
+				return str
+			}
+		}
+		return ""
+	}
+
+	switch CellType(slot.resultType) {
+	case CellValueTypeNumber, CellValueTypeDate:
+		return slot.number
+	case CellValueTypeString:
+		return lookup(slot.stringID)
+	case CellValueTypeBoolean:
+		return slot.boolean != 0
+	case CellValueTypeError:
+		return &SpreadsheetError{
+			ErrorCode: ErrorCode(slot.number),
+			Message:   lookup(slot.stringID),
+		}
+	}
+	return nil
+}
+
+// SetFormulaResult stores the calculated result of a formula cell. it
+// returns the previously stored result and whether the stored value changed.
+// it is safe to call concurrently for different cells of the same worksheet.
+func (w *Worksheet) SetFormulaResult(row, col uint32, result Primitive) (Primitive, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	chunkRow := row / ChunkRows
 	chunkCol := col / ChunkCols
 	localRow := row % ChunkRows
@@ -691,10 +1066,11 @@ func (w *Worksheet) SetFormulaResult(row, col uint32, result Primitive) {
 	key := ChunkKey{ChunkRow: chunkRow, ChunkCol: chunkCol}
 	chunk, exists := w.chunks[key]
 	if !exists {
-		return
+		return nil, false
 	}
 
 	idx := localCol*ChunkRows + localRow
+	previous := chunk.formulaResultSlot(idx)
 
 	// initialize formula result arrays if needed
 	if chunk.FormulaResultTypes == nil {
@@ -756,6 +1132,11 @@ func (w *Worksheet) SetFormulaResult(row, col uint32, result Primitive) {
 	case nil:
 		chunk.FormulaResultTypes[idx] = uint8(CellValueTypeEmpty)
 	}
+
+	if chunk.formulaResultSlot(idx).equal(previous) {
+		return nil, false
+	}
+	return w.decodeFormulaResult(previous), true
 }
 
 // GetCellsByType returns the count of cells by type for diagnostic purposes